@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math"
+	mathrand "math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+// maxErrorKinds bounds the distinct error messages reported.
+const maxErrorKinds = 20
+
+// sizes collects a comma separated list of sizes.
+type sizes []size
+
+func (s *sizes) String() string {
+	parts := make([]string, 0, len(*s))
+	for _, n := range *s {
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *sizes) Set(v string) error {
+	var parsed sizes
+	for _, part := range strings.Split(v, ",") {
+		var n size
+		if err := n.Set(strings.TrimSpace(part)); err != nil {
+			return err
+		}
+		parsed = append(parsed, n)
+	}
+	*s = parsed
+	return nil
+}
+
+// benchOptions are the flags of bench.
+type benchOptions struct {
+	sizes       sizes
+	eicarRatio  float64
+	concurrency int
+	workers     int
+	chunkSize   int
+	duration    time.Duration
+	requests    int
+	fake        bool
+	fakeDelay   time.Duration
+}
+
+// latencyStats summarize durations, in milliseconds.
+type latencyStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func newLatencyStats(durations []time.Duration) latencyStats {
+	if len(durations) == 0 {
+		return latencyStats{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(durations)))) - 1
+		return millis(durations[max(0, i)])
+	}
+	return latencyStats{
+		Mean: millis(total / time.Duration(len(durations))),
+		P50:  percentile(0.50),
+		P90:  percentile(0.90),
+		P95:  percentile(0.95),
+		P99:  percentile(0.99),
+		Max:  millis(durations[len(durations)-1]),
+	}
+}
+
+// benchReport is the result of bench, with its parameters to compare runs.
+type benchReport struct {
+	Target      string  `json:"target"`
+	Concurrency int     `json:"concurrency"`
+	Workers     int     `json:"workers,omitempty"`
+	ChunkSize   int     `json:"chunkSize,omitempty"`
+	Sizes       []int64 `json:"sizes"`
+	EICARRatio  float64 `json:"eicarRatio"`
+
+	DurationMs        float64        `json:"durationMs"`
+	Requests          int            `json:"requests"`
+	Errors            int            `json:"errors"`
+	ErrorRate         float64        `json:"errorRate"`
+	RequestsPerSecond float64        `json:"requestsPerSecond"`
+	BytesPerSecond    float64        `json:"bytesPerSecond"`
+	Infected          int            `json:"infected"`
+	Missed            int            `json:"missed"`
+	FalsePositives    int            `json:"falsePositives"`
+	LatencyMs         latencyStats   `json:"latencyMs"`
+	QueueWaitMs       latencyStats   `json:"queueWaitMs"`
+	ErrorKinds        map[string]int `json:"errorKinds,omitempty"`
+}
+
+// benchSample is the outcome of a scan of bench.
+type benchSample struct {
+	size     int64
+	eicar    bool
+	verdict  verdict
+	err      error
+	duration time.Duration
+}
+
+func (c *command) bench(ctx context.Context, args []string) int {
+	opts := benchOptions{sizes: sizes{1 << 10, 64 << 10, 1 << 20}}
+	fs := flag.NewFlagSet("clamctl bench", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(c.stderr, "Usage: clamctl [flags] bench [bench flags]")
+		fs.PrintDefaults()
+	}
+	fs.Var(&opts.sizes, "sizes", "sizes of the random files, picked uniformly, e.g. 1K,64K,1M")
+	fs.Float64Var(&opts.eicarRatio, "eicar-ratio", 0.1, "share of EICAR test files, between 0 and 1")
+	fs.IntVar(&opts.concurrency, "concurrency", 8, "scans sent at the same time")
+	fs.IntVar(&opts.workers, "workers", 0, "clamd sessions of the coordinator, defaults to -concurrency (clamd only)")
+	fs.IntVar(&opts.chunkSize, "chunk-size", 0, "INSTREAM chunk size in bytes, defaults to the clamd client default (clamd only)")
+	fs.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to run")
+	fs.IntVar(&opts.requests, "requests", 0, "stop after this many scans, 0 to run for -duration")
+	fs.BoolVar(&opts.fake, "fake", false, "run against an in-process fake clamd")
+	fs.DurationVar(&opts.fakeDelay, "fake-delay", 0, "scan duration of the fake clamd")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	switch {
+	case fs.NArg() != 0:
+		fs.Usage()
+		return exitError
+	case len(opts.sizes) == 0:
+		return c.fail(fmt.Errorf("%w: no sizes", errUsage))
+	case opts.eicarRatio < 0 || opts.eicarRatio > 1:
+		return c.fail(fmt.Errorf("%w: eicar-ratio must be between 0 and 1", errUsage))
+	case opts.concurrency < 1:
+		return c.fail(fmt.Errorf("%w: concurrency must be positive", errUsage))
+	case opts.duration <= 0 && opts.requests <= 0:
+		return c.fail(fmt.Errorf("%w: duration or requests must be positive", errUsage))
+	}
+	if opts.workers <= 0 {
+		opts.workers = opts.concurrency
+	}
+
+	report := benchReport{
+		Concurrency: opts.concurrency,
+		EICARRatio:  opts.eicarRatio,
+	}
+	for _, s := range opts.sizes {
+		report.Sizes = append(report.Sizes, int64(s))
+	}
+
+	if opts.fake {
+		fake, err := clamdtest.NewServer()
+		if err != nil {
+			return c.fail(err)
+		}
+		defer fake.Close()
+		fake.SetScanDelay(opts.fakeDelay)
+		c.target = &clamdTarget{clamd: &clamd.Clamd{
+			Network:        fake.Network(),
+			Address:        fake.Address(),
+			ConnectTimeout: c.opts.timeout,
+			ReadTimeout:    c.opts.timeout,
+			WriteTimeout:   c.opts.timeout,
+		}}
+	}
+	switch t := c.target.(type) {
+	case *clamdTarget:
+		t.clamd.StreamChunkSize = opts.chunkSize
+		report.Target = "clamd " + t.clamd.Network + ":" + t.clamd.Address
+		report.Workers = opts.workers
+		report.ChunkSize = opts.chunkSize
+		if opts.fake {
+			report.Target = "fake clamd"
+		}
+	case *httpTarget:
+		report.Target = "restclam " + t.base
+	}
+
+	t, release, err := c.scanTarget(opts.workers)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer release()
+
+	samples, elapsed := runBench(ctx, t, opts)
+	report.summarize(samples, elapsed)
+
+	if c.opts.json {
+		c.print(output{data: report})
+	} else {
+		c.printBench(report)
+	}
+	if report.Errors > 0 {
+		return exitError
+	}
+	return exitClean
+}
+
+// runBench scans random files until the duration or the requests are
+// done, returning the samples and how long it took.
+func runBench(ctx context.Context, t target, opts benchOptions) ([]benchSample, time.Duration) {
+	contents := make(map[size][]byte, len(opts.sizes))
+	for _, s := range opts.sizes {
+		content := make([]byte, s)
+		_, _ = rand.Read(content)
+		contents[s] = content
+	}
+
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var sent atomic.Int64
+	var mu sync.Mutex
+	var samples []benchSample
+	var wg sync.WaitGroup
+	for range opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if opts.requests > 0 && sent.Add(1) > int64(opts.requests) {
+					return
+				}
+
+				// EICAR is detected by its hash, so it is sent as is
+				sample := benchSample{eicar: mathrand.Float64() < opts.eicarRatio}
+				content := []byte(clamdtest.EICAR)
+				if !sample.eicar {
+					content = contents[opts.sizes[mathrand.IntN(len(opts.sizes))]]
+				}
+				sample.size = int64(len(content))
+
+				start := time.Now()
+				sample.verdict, sample.err = t.Scan(ctx, "bench", bytes.NewReader(content))
+				sample.duration = time.Since(start)
+				if sample.err != nil && ctx.Err() != nil {
+					// stopped while scanning, not an error of the target
+					return
+				}
+
+				mu.Lock()
+				samples = append(samples, sample)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return samples, time.Since(start)
+}
+
+// summarize fills the report with the samples of a run.
+func (r *benchReport) summarize(samples []benchSample, elapsed time.Duration) {
+	var latencies, queueWaits []time.Duration
+	var bytes int64
+	for _, s := range samples {
+		r.Requests++
+		status := clamd.ScanStatus(s.verdict.Status)
+		if s.err != nil || status == clamd.StatusError {
+			r.Errors++
+			msg := s.verdict.Error
+			if s.err != nil {
+				msg = s.err.Error()
+			}
+			if r.ErrorKinds == nil {
+				r.ErrorKinds = map[string]int{}
+			}
+			if _, ok := r.ErrorKinds[msg]; ok || len(r.ErrorKinds) < maxErrorKinds {
+				r.ErrorKinds[msg]++
+			}
+			continue
+		}
+
+		latencies = append(latencies, s.duration)
+		queueWaits = append(queueWaits, s.verdict.queueWait)
+		bytes += s.size
+		switch {
+		case status == clamd.StatusFound:
+			r.Infected++
+			if !s.eicar {
+				r.FalsePositives++
+			}
+		case s.eicar:
+			r.Missed++
+		}
+	}
+
+	r.DurationMs = millis(elapsed)
+	if r.Requests > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+	}
+	if elapsed > 0 {
+		r.RequestsPerSecond = float64(r.Requests) / elapsed.Seconds()
+		r.BytesPerSecond = float64(bytes) / elapsed.Seconds()
+	}
+	r.LatencyMs = newLatencyStats(latencies)
+	r.QueueWaitMs = newLatencyStats(queueWaits)
+}
+
+func (c *command) printBench(r benchReport) {
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "target:\t%s\n", r.Target)
+	fmt.Fprintf(w, "concurrency:\t%d\n", r.Concurrency)
+	if r.Workers > 0 {
+		fmt.Fprintf(w, "workers:\t%d\n", r.Workers)
+	}
+	fmt.Fprintf(w, "duration:\t%.1fs\n", r.DurationMs/1000)
+	fmt.Fprintf(w, "requests:\t%d\n", r.Requests)
+	fmt.Fprintf(w, "throughput:\t%.1f req/s, %s/s\n", r.RequestsPerSecond, formatBytes(int64(r.BytesPerSecond)))
+	fmt.Fprintf(w, "errors:\t%d (%.2f%%)\n", r.Errors, 100*r.ErrorRate)
+	fmt.Fprintf(w, "infected:\t%d (missed %d, false positives %d)\n", r.Infected, r.Missed, r.FalsePositives)
+	fmt.Fprintf(w, "latency:\t%s\n", r.LatencyMs)
+	fmt.Fprintf(w, "queue wait:\t%s\n", r.QueueWaitMs)
+	for msg, n := range r.ErrorKinds {
+		fmt.Fprintf(w, "error:\t%d× %s\n", n, msg)
+	}
+	_ = w.Flush()
+}
+
+func (l latencyStats) String() string {
+	return fmt.Sprintf("mean %.1fms, p50 %.1fms, p90 %.1fms, p95 %.1fms, p99 %.1fms, max %.1fms",
+		l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
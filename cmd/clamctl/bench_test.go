@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchFake(t *testing.T) {
+	// execute
+	code, stdout, _ := runClamctl(t, "-json", "bench", "-fake", "-requests", "50", "-concurrency", "4", "-sizes", "1K,4K", "-eicar-ratio", "0.5")
+
+	// assert
+	require.Equal(t, exitClean, code)
+	var report benchReport
+	require.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, "fake clamd", report.Target)
+	assert.Equal(t, []int64{1 << 10, 4 << 10}, report.Sizes)
+	assert.Equal(t, 50, report.Requests)
+	assert.Zero(t, report.Errors)
+	assert.Zero(t, report.Missed)
+	assert.Zero(t, report.FalsePositives)
+	assert.Positive(t, report.RequestsPerSecond)
+	assert.Positive(t, report.LatencyMs.Max)
+	assert.LessOrEqual(t, report.LatencyMs.P50, report.LatencyMs.P99)
+}
+
+func TestBenchThroughRestclam(t *testing.T) {
+	// prepare
+	server := newTestRestclam(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, "-server", server, "-api-key", testAPIKey, "-json", "bench", "-requests", "20", "-sizes", "1K", "-eicar-ratio", "1")
+
+	// assert
+	require.Equal(t, exitClean, code)
+	var report benchReport
+	require.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, "restclam "+server, report.Target)
+	assert.Equal(t, 20, report.Requests)
+	assert.Equal(t, 20, report.Infected)
+	assert.Zero(t, report.Workers)
+}
+
+func TestBenchUsage(t *testing.T) {
+	// execute
+	code, _, stderr := runClamctl(t, "bench", "-eicar-ratio", "2")
+
+	// assert
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "eicar-ratio must be between 0 and 1")
+}
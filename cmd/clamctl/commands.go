@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// command runs a clamctl command on the target.
+type command struct {
+	opts   options
+	target target
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (c *command) ping(ctx context.Context) int {
+	pong, err := c.target.Ping(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.print(output{text: pong, data: map[string]string{"reply": pong}})
+	return exitClean
+}
+
+func (c *command) version(ctx context.Context) int {
+	version, err := c.target.Version(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.print(output{text: version, data: map[string]string{"version": version}})
+	return exitClean
+}
+
+func (c *command) stats(ctx context.Context) int {
+	stats, err := c.target.Stats(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.print(stats)
+	return exitClean
+}
+
+func (c *command) reload(ctx context.Context) int {
+	reply, err := c.target.Reload(ctx)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.print(output{text: reply, data: map[string]string{"reply": reply}})
+	return exitClean
+}
+
+func (c *command) shutdown(ctx context.Context) int {
+	if err := c.target.Shutdown(ctx); err != nil {
+		return c.fail(err)
+	}
+	c.print(output{text: "clamd is shutting down", data: map[string]bool{"shutdown": true}})
+	return exitClean
+}
+
+// print writes the output as text, or as JSON with -json.
+func (c *command) print(out output) {
+	if !c.opts.json {
+		fmt.Fprintln(c.stdout, out.text)
+		return
+	}
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out.data); err != nil {
+		fmt.Fprintf(c.stderr, "clamctl: %v\n", err)
+	}
+}
+
+// fail prints the error and returns the error exit code.
+func (c *command) fail(err error) int {
+	fmt.Fprintf(c.stderr, "clamctl: %v\n", err)
+	return exitError
+}
@@ -1,5 +1,142 @@
+// Command clamctl is a command-line client of clamd, talking to it
+// directly or through a restclam server.
 package main
 
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/version"
+)
+
+// Exit codes, like clamdscan.
+const (
+	exitClean    = 0
+	exitInfected = 1
+	exitError    = 2
+)
+
+const usage = `Usage:
+  clamctl [flags] ping                     check that clamd answers
+  clamctl [flags] version                  print the clamd version
+  clamctl [flags] stats                    print clamd statistics, or restclam metrics
+  clamctl [flags] scan [scan flags] FILE   scan files, - for stdin, or directories with -r
+  clamctl [flags] watch [watch flags] DIR  scan files written in a directory
+  clamctl [flags] bench [bench flags]      load test clamd or restclam with random files
+  clamctl [flags] top [top flags]          monitor clamd threads and restclam workers
+  clamctl [flags] reload                   reload the clamd signature databases
+  clamctl [flags] shutdown                 stop clamd
+
+Talks to clamd at -network and -address, or to the restclam server at
+-server.  The exit code is 0 if all is fine, 1 if a virus was found and
+2 on errors.
+
+Flags:
+`
+
+// options are the global flags.
+type options struct {
+	network      string
+	address      string
+	server       string
+	apiKey       string
+	apiKeyHeader string
+	token        string
+	timeout      time.Duration
+	json         bool
+}
+
 func main() {
-	panic("to be implemented")
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run parses the flags and runs the command of the arguments, returning
+// the exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	var opts options
+	var showVersion bool
+	fs := flag.NewFlagSet("clamctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.network, "network", "unix", "clamd network: unix, tcp, tcp4 or tcp6")
+	fs.StringVar(&opts.address, "address", "/tmp/clamd.sock", "clamd socket path or host:port")
+	fs.StringVar(&opts.server, "server", "", "restclam server URL, e.g. https://restclam:8080, instead of clamd")
+	fs.StringVar(&opts.apiKey, "api-key", os.Getenv("CLAMCTL_API_KEY"), "restclam API key, defaults to $CLAMCTL_API_KEY")
+	fs.StringVar(&opts.apiKeyHeader, "api-key-header", "X-API-Key", "restclam API key header")
+	fs.StringVar(&opts.token, "token", os.Getenv("CLAMCTL_TOKEN"), "restclam bearer token, defaults to $CLAMCTL_TOKEN")
+	fs.DurationVar(&opts.timeout, "timeout", time.Minute, "timeout of each command or file scan")
+	fs.BoolVar(&opts.json, "json", false, "print results as JSON")
+	fs.BoolVar(&showVersion, "version", false, "print version and build information")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+
+	if showVersion {
+		fmt.Fprintf(stdout, "clamctl %s\n", version.Get())
+		return exitClean
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cmd := &command{
+		opts:   opts,
+		target: newTarget(opts),
+		stdin:  os.Stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	switch name, cmdArgs := fs.Arg(0), fs.Args()[1:]; name {
+	case "ping":
+		return cmd.ping(ctx)
+	case "version":
+		return cmd.version(ctx)
+	case "stats":
+		return cmd.stats(ctx)
+	case "scan":
+		return cmd.scan(ctx, cmdArgs)
+	case "watch":
+		return cmd.watch(ctx, cmdArgs)
+	case "bench":
+		return cmd.bench(ctx, cmdArgs)
+	case "top":
+		return cmd.top(ctx, cmdArgs)
+	case "reload":
+		return cmd.reload(ctx)
+	case "shutdown":
+		return cmd.shutdown(ctx)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", name)
+		fs.Usage()
+		return exitError
+	}
+}
+
+// newTarget returns the restclam server of the options, if any, otherwise
+// clamd.
+func newTarget(opts options) target {
+	if opts.server != "" {
+		return newHTTPTarget(opts)
+	}
+	return &clamdTarget{clamd: &clamd.Clamd{
+		Network:        opts.network,
+		Address:        opts.address,
+		ConnectTimeout: opts.timeout,
+		ReadTimeout:    opts.timeout,
+		WriteTimeout:   opts.timeout,
+	}}
 }
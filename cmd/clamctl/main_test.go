@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+	"github.com/tomrss/restclam/pkg/server/api"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+const testAPIKey = "test-key"
+
+func TestPing(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, append(clamdFlags(fake), "ping")...)
+
+	// assert
+	assert.Equal(t, exitClean, code)
+	assert.Equal(t, "PONG\n", stdout)
+}
+
+func TestStatsJSON(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, append(clamdFlags(fake), "-json", "stats")...)
+
+	// assert
+	require.Equal(t, exitClean, code)
+	var stats api.StatsResponse
+	require.NoError(t, json.Unmarshal([]byte(stdout), &stats))
+	assert.Equal(t, "VALID PRIMARY", stats.State)
+	assert.Equal(t, 12, stats.Threads.Max)
+	assert.Equal(t, "1369.152M", stats.Memory.PoolsTotal)
+}
+
+func TestReload(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, append(clamdFlags(fake), "reload")...)
+
+	// assert
+	assert.Equal(t, exitClean, code)
+	assert.Equal(t, "RELOADING\n", stdout)
+}
+
+func TestScanExitCodes(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	clean, infected := writeTestFiles(t)
+
+	tests := []struct {
+		name  string
+		files []string
+		code  int
+	}{
+		{"clean", []string{clean}, exitClean},
+		{"infected", []string{clean, infected}, exitInfected},
+		{"error", []string{infected, filepath.Join(t.TempDir(), "missing")}, exitError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// execute
+			args := append(clamdFlags(fake), "scan")
+			code, _, _ := runClamctl(t, append(args, tt.files...)...)
+
+			// assert
+			assert.Equal(t, tt.code, code)
+		})
+	}
+}
+
+func TestScanModes(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	_, infected := writeTestFiles(t)
+
+	for _, mode := range []string{modeInstream, modeScan} {
+		t.Run(mode, func(t *testing.T) {
+			// execute
+			code, stdout, _ := runClamctl(t, append(clamdFlags(fake), "scan", "-mode", mode, "-no-summary", infected)...)
+
+			// assert
+			assert.Equal(t, exitInfected, code)
+			assert.Equal(t, infected+": "+clamdtest.EICARSignature+" FOUND\n", stdout)
+		})
+	}
+}
+
+func TestScanThroughRestclam(t *testing.T) {
+	// prepare
+	server := newTestRestclam(t)
+	clean, infected := writeTestFiles(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, "-server", server, "-api-key", testAPIKey, "-json", "scan", clean, infected)
+
+	// assert
+	require.Equal(t, exitInfected, code)
+	var report scanReport
+	require.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, 1, report.Infected)
+	assert.Equal(t, verdict{File: infected, Size: int64(len(clamdtest.EICAR)), Status: "FOUND", Virus: clamdtest.EICARSignature}, report.Files[1])
+}
+
+func TestRestclamErrors(t *testing.T) {
+	// prepare
+	server := newTestRestclam(t)
+
+	// execute
+	unauthorized, _, unauthorizedErr := runClamctl(t, "-server", server, "-api-key", "wrong", "ping")
+	unsupported, _, unsupportedErr := runClamctl(t, "-server", server, "-api-key", testAPIKey, "shutdown")
+
+	// assert
+	assert.Equal(t, exitError, unauthorized)
+	assert.Contains(t, unauthorizedErr, "unauthorized: missing or invalid credentials (HTTP 401)")
+	assert.Equal(t, exitError, unsupported)
+	assert.Contains(t, unsupportedErr, "not supported through restclam: shutdown")
+}
+
+// helpers
+
+func runClamctl(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func clamdFlags(fake *clamdtest.Server) []string {
+	return []string{"-network", fake.Network(), "-address", fake.Address(), "-timeout", "5s"}
+}
+
+func newTestClamd(t *testing.T) *clamdtest.Server {
+	t.Helper()
+
+	fake, err := clamdtest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = fake.Close() })
+
+	return fake
+}
+
+// newTestRestclam serves the v1 and admin APIs, authenticated by testAPIKey, returning
+// its URL.
+func newTestRestclam(t *testing.T) string {
+	t.Helper()
+
+	fake := newTestClamd(t)
+	c := &clamd.Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]clamd.Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		clamd.SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	require.NoError(t, err)
+	t.Cleanup(c.Shutdown)
+
+	hash := sha256.Sum256([]byte(testAPIKey))
+	conf := config.AuthConfig{
+		Enabled:      true,
+		APIKeyHeader: "X-API-Key",
+		APIKeys: []config.APIKeyConfig{
+			{ID: "ci", Hash: "sha256:" + hex.EncodeToString(hash[:]), Scopes: []string{"scan", "read-stats", "admin"}},
+		},
+	}
+	authenticator, err := auth.NewAuthenticator(conf)
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Use(middleware.Authenticate(conf, authenticator, zerolog.Nop()))
+	r.Mount("/api/v1/clamav", api.ClamavV1(c, api.NewJobs()))
+	r.Mount("/api/v1/admin", api.Admin(c))
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func writeTestFiles(t *testing.T) (clean string, infected string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	clean = filepath.Join(dir, "clean.txt")
+	infected = filepath.Join(dir, "eicar.com")
+	require.NoError(t, os.WriteFile(clean, []byte("hello"), 0o600))
+	require.NoError(t, os.WriteFile(infected, []byte(clamdtest.EICAR), 0o600))
+
+	return clean, infected
+}
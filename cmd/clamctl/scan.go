@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+)
+
+// Scan modes.
+const (
+	modeInstream = "instream"
+	modeScan     = "scan"
+)
+
+// Symlink policies.
+const (
+	symlinksSkip   = "skip"
+	symlinksFollow = "follow"
+)
+
+const progressInterval = time.Second
+
+var (
+	errUsage       = errors.New("invalid usage")
+	errIsDirectory = errors.New("is a directory, scan it with -r")
+	errInvalidSize = errors.New("invalid size")
+)
+
+// globs collects the repeated glob flags.
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globs) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*g = append(*g, s)
+	return nil
+}
+
+// size is a flag of bytes, with an optional K, M or G suffix.
+type size int64
+
+func (s *size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *size) Set(v string) error {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		multiplier = 1 << 30
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(v, "KMG"), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%w %q, expected bytes like 1024, 512K, 25M or 2G", errInvalidSize, v)
+	}
+	*s = size(n * multiplier)
+	return nil
+}
+
+// scanOptions are the flags of scan.
+type scanOptions struct {
+	mode        string
+	noSummary   bool
+	recursive   bool
+	include     globs
+	exclude     globs
+	maxSize     size
+	symlinks    string
+	concurrency int
+	progress    bool
+	quarantine  string
+	remove      bool
+	checkpoint  string
+}
+
+// scanReport is the JSON output of scan.
+type scanReport struct {
+	Files      []verdict `json:"files"`
+	Scanned    int       `json:"scanned"`
+	Infected   int       `json:"infected"`
+	Errors     int       `json:"errors"`
+	Skipped    int       `json:"skipped"`
+	Resumed    int       `json:"resumed"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+func (r *scanReport) add(v verdict) {
+	r.Files = append(r.Files, v)
+	r.Scanned++
+	r.Bytes += v.Size
+	switch clamd.ScanStatus(v.Status) {
+	case clamd.StatusFound:
+		r.Infected++
+	case clamd.StatusError:
+		r.Errors++
+	}
+}
+
+// exitCode is infected if a virus was found, error if some file could not
+// be scanned.
+func (r *scanReport) exitCode() int {
+	switch {
+	case r.Errors > 0:
+		return exitError
+	case r.Infected > 0:
+		return exitInfected
+	default:
+		return exitClean
+	}
+}
+
+func (c *command) scan(ctx context.Context, args []string) int {
+	var opts scanOptions
+	fs := flag.NewFlagSet("clamctl scan", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(c.stderr, "Usage: clamctl [flags] scan [scan flags] FILE...")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.mode, "mode", modeInstream, "instream sends the files to clamd, scan lets clamd read them")
+	fs.BoolVar(&opts.noSummary, "no-summary", false, "do not print the summary")
+	fs.BoolVar(&opts.recursive, "r", false, "scan directories recursively")
+	fs.Var(&opts.include, "include", "scan only files matching the glob, by name or by path if it has a / (repeatable)")
+	fs.Var(&opts.exclude, "exclude", "skip files and directories matching the glob, like -include (repeatable)")
+	fs.Var(&opts.maxSize, "max-size", "skip files larger than this, e.g. 25M, 0 for no limit")
+	fs.StringVar(&opts.symlinks, "symlinks", symlinksSkip, "symbolic links found in directories: skip or follow")
+	fs.IntVar(&opts.concurrency, "concurrency", 4, "files scanned at the same time")
+	fs.BoolVar(&opts.progress, "progress", false, "print progress to stderr")
+	fs.StringVar(&opts.quarantine, "quarantine", "", "move infected files to this directory")
+	fs.BoolVar(&opts.remove, "remove", false, "delete infected files")
+	fs.StringVar(&opts.checkpoint, "checkpoint", "", "record the verdicts of scanned files in this file, to resume an interrupted scan")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	switch {
+	case fs.NArg() == 0:
+		fs.Usage()
+		return exitError
+	case opts.mode != modeInstream && opts.mode != modeScan:
+		return c.fail(fmt.Errorf("%w: mode %q", errUsage, opts.mode))
+	case opts.symlinks != symlinksSkip && opts.symlinks != symlinksFollow:
+		return c.fail(fmt.Errorf("%w: symlinks %q", errUsage, opts.symlinks))
+	case opts.concurrency < 1:
+		return c.fail(fmt.Errorf("%w: concurrency must be positive", errUsage))
+	case opts.quarantine != "" && opts.remove:
+		return c.fail(fmt.Errorf("%w: -quarantine and -remove are exclusive", errUsage))
+	}
+
+	t, release, err := c.scanTarget(opts.concurrency)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer release()
+
+	cp, err := openCheckpoint(opts.checkpoint)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	s := &scanner{command: c, target: t, opts: opts, checkpoint: cp}
+	report := s.run(ctx, fs.Args())
+
+	interrupted := ctx.Err() != nil
+	if err := cp.close(!interrupted); err != nil {
+		fmt.Fprintf(c.stderr, "clamctl: %v\n", err)
+	}
+
+	switch {
+	case c.opts.json:
+		c.print(output{data: report})
+	case !opts.noSummary:
+		fmt.Fprintf(c.stdout, "\n----------- SCAN SUMMARY -----------\n")
+		fmt.Fprintf(c.stdout, "Scanned files: %d\n", report.Scanned)
+		fmt.Fprintf(c.stdout, "Infected files: %d\n", report.Infected)
+		fmt.Fprintf(c.stdout, "Errors: %d\n", report.Errors)
+		if report.Skipped > 0 {
+			fmt.Fprintf(c.stdout, "Skipped files: %d\n", report.Skipped)
+		}
+		if report.Resumed > 0 {
+			fmt.Fprintf(c.stdout, "Already scanned files: %d\n", report.Resumed)
+		}
+		fmt.Fprintf(c.stdout, "Data scanned: %s\n", formatBytes(report.Bytes))
+		fmt.Fprintf(c.stdout, "Time: %.3f sec\n", report.DurationMs/1000)
+	}
+
+	if interrupted {
+		if opts.checkpoint != "" {
+			fmt.Fprintf(c.stderr, "clamctl: scan interrupted, resume it with -checkpoint %s\n", opts.checkpoint)
+		} else {
+			fmt.Fprintln(c.stderr, "clamctl: scan interrupted")
+		}
+		return exitError
+	}
+	return report.exitCode()
+}
+
+// scanTarget returns the target to scan files concurrently, through a
+// coordinator when talking to clamd directly, and how to release it.
+func (c *command) scanTarget(concurrency int) (target, func(), error) {
+	direct, ok := c.target.(*clamdTarget)
+	if !ok {
+		return c.target, func() {}, nil
+	}
+	coordinator, err := newCoordinatorTarget(direct, concurrency, c.opts.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return coordinator, coordinator.close, nil
+}
+
+// scanner walks the files to scan and scans them concurrently.
+type scanner struct {
+	*command
+	target     target
+	opts       scanOptions
+	checkpoint *checkpoint
+
+	// visited are the directories walked, against symlink loops
+	visited map[string]bool
+	skipped int
+	resumed int
+}
+
+// scanItem is a file to scan, or an error listing it.
+type scanItem struct {
+	path string
+	size int64
+	err  error
+}
+
+// run scans the files of the arguments, until done or ctx is cancelled.
+func (s *scanner) run(ctx context.Context, args []string) scanReport {
+	start := time.Now()
+	items := make(chan scanItem)
+	verdicts := make(chan verdict)
+
+	go func() {
+		defer close(items)
+		s.visited = map[string]bool{}
+		for _, arg := range args {
+			s.walkArg(ctx, arg, items)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range s.opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				v := s.scanItem(ctx, item)
+				if ctx.Err() != nil && v.Status == string(clamd.StatusError) {
+					// cancelled, it will be scanned when resuming
+					continue
+				}
+				verdicts <- v
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(verdicts)
+	}()
+
+	// infected files found before an interruption, maybe moved away since
+	report := scanReport{Files: []verdict{}}
+	for _, v := range s.checkpoint.infected() {
+		report.Files = append(report.Files, v)
+		report.Infected++
+		if !s.command.opts.json {
+			fmt.Fprintln(s.stdout, verdictLine(v))
+		}
+	}
+
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+	for done := false; !done; {
+		select {
+		case v, ok := <-verdicts:
+			if !ok {
+				done = true
+				continue
+			}
+			s.act(&v)
+			report.add(v)
+			if !s.command.opts.json {
+				fmt.Fprintln(s.stdout, verdictLine(v))
+			}
+			if v.Status != string(clamd.StatusError) {
+				if err := s.checkpoint.record(v); err != nil {
+					fmt.Fprintf(s.stderr, "clamctl: %v\n", err)
+				}
+			}
+		case <-progress.C:
+			if s.opts.progress {
+				fmt.Fprintf(s.stderr, "scanned %d files, %s, %d infected, %d errors\n",
+					report.Scanned, formatBytes(report.Bytes), report.Infected, report.Errors)
+			}
+		}
+	}
+
+	// the walker is done once verdicts are closed
+	report.Skipped = s.skipped
+	report.Resumed = s.resumed
+	report.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].File < report.Files[j].File })
+	return report
+}
+
+// walkArg lists a file or directory given as argument.  Symbolic links
+// given as arguments are always followed.
+func (s *scanner) walkArg(ctx context.Context, arg string, items chan<- scanItem) {
+	if arg == "-" {
+		s.send(ctx, items, scanItem{path: arg})
+		return
+	}
+
+	info, err := os.Stat(arg)
+	switch {
+	case err != nil:
+		s.send(ctx, items, scanItem{path: arg, err: err})
+	case info.IsDir() && !s.opts.recursive:
+		s.send(ctx, items, scanItem{path: arg, err: errIsDirectory})
+	case info.IsDir():
+		s.walkDir(ctx, arg, arg, items)
+	default:
+		s.file(ctx, arg, arg, info, items)
+	}
+}
+
+// walkDir lists the files under dir, root being the argument walked.
+func (s *scanner) walkDir(ctx context.Context, root string, dir string, items chan<- scanItem) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		s.send(ctx, items, scanItem{path: dir, err: err})
+		return
+	}
+	if s.visited[real] {
+		return
+	}
+	s.visited[real] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.send(ctx, items, scanItem{path: dir, err: err})
+		return
+	}
+
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		path := filepath.Join(dir, e.Name())
+		if matchAny(s.opts.exclude, root, path) {
+			continue
+		}
+
+		switch {
+		case e.Type()&os.ModeSymlink != 0:
+			if s.opts.symlinks != symlinksFollow {
+				s.skipped++
+				continue
+			}
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				s.send(ctx, items, scanItem{path: path, err: err})
+			case info.IsDir():
+				s.walkDir(ctx, root, path, items)
+			default:
+				s.file(ctx, root, path, info, items)
+			}
+		case e.IsDir():
+			s.walkDir(ctx, root, path, items)
+		default:
+			info, err := e.Info()
+			if err != nil {
+				s.send(ctx, items, scanItem{path: path, err: err})
+				continue
+			}
+			s.file(ctx, root, path, info, items)
+		}
+	}
+}
+
+// file lists a file, unless filtered out or already scanned.
+func (s *scanner) file(ctx context.Context, root string, path string, info os.FileInfo, items chan<- scanItem) {
+	switch {
+	case !info.Mode().IsRegular():
+		// devices, sockets and pipes
+		s.skipped++
+	case len(s.opts.include) > 0 && !matchAny(s.opts.include, root, path):
+		s.skipped++
+	case s.opts.maxSize > 0 && info.Size() > int64(s.opts.maxSize):
+		s.skipped++
+	case s.checkpoint.done(path):
+		s.resumed++
+	default:
+		s.send(ctx, items, scanItem{path: path, size: info.Size()})
+	}
+}
+
+func (s *scanner) send(ctx context.Context, items chan<- scanItem, item scanItem) {
+	select {
+	case items <- item:
+	case <-ctx.Done():
+	}
+}
+
+// scanItem scans a file, turning errors into an ERROR verdict.
+func (s *scanner) scanItem(ctx context.Context, item scanItem) verdict {
+	var v verdict
+	err := item.err
+	switch {
+	case err != nil:
+	case item.path == "-":
+		v, err = s.target.Scan(ctx, "stdin", s.stdin)
+	case s.opts.mode == modeScan:
+		v, err = s.target.ScanPath(ctx, item.path)
+	default:
+		var f *os.File
+		if f, err = os.Open(item.path); err == nil {
+			v, err = s.target.Scan(ctx, item.path, f)
+			_ = f.Close()
+		}
+	}
+	if err != nil {
+		v = verdict{Status: string(clamd.StatusError), Error: err.Error()}
+	}
+	v.File = item.path
+	v.Size = item.size
+	return v
+}
+
+// verdictLine formats a verdict like clamdscan.
+func verdictLine(v verdict) string {
+	var line string
+	switch clamd.ScanStatus(v.Status) {
+	case clamd.StatusFound:
+		line = fmt.Sprintf("%s: %s FOUND", v.File, v.Virus)
+	case clamd.StatusError:
+		line = fmt.Sprintf("%s: %s ERROR", v.File, v.Error)
+	default:
+		line = fmt.Sprintf("%s: %s", v.File, v.Status)
+	}
+	if v.Action != "" {
+		line += " (" + v.Action + ")"
+	}
+	return line
+}
+
+// act quarantines or removes an infected file, as set by the flags.
+func (s *scanner) act(v *verdict) {
+	if v.Status != string(clamd.StatusFound) || v.File == "-" {
+		return
+	}
+
+	switch {
+	case s.opts.quarantine != "":
+		dst, err := moveInto(v.File, s.opts.quarantine)
+		if err != nil {
+			v.Action = "quarantine failed: " + err.Error()
+			return
+		}
+		v.Action = "moved to " + dst
+	case s.opts.remove:
+		if err := os.Remove(v.File); err != nil {
+			v.Action = "removal failed: " + err.Error()
+			return
+		}
+		v.Action = "removed"
+	}
+}
+
+// moveInto moves the file into dir, not replacing files with the same
+// name, and returns where it was moved.
+func moveInto(file string, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	base := filepath.Base(file)
+	dst := filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%d", base, i))
+	}
+
+	if err := os.Rename(file, dst); err == nil {
+		return dst, nil
+	}
+
+	// across file systems, e.g. from an NFS share, copy and remove
+	if err := copyFile(file, dst); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(file)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// matchAny tells if the path matches any of the globs: by name, or by path
+// relative to root if the glob has a /.
+func matchAny(patterns []string, root string, path string) bool {
+	for _, p := range patterns {
+		name := filepath.Base(path)
+		if strings.Contains(p, "/") {
+			if rel, err := filepath.Rel(root, path); err == nil {
+				name = filepath.ToSlash(rel)
+			}
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpoint records the verdicts of the files scanned, one JSON object per
+// line, to skip them when resuming an interrupted scan and still report the
+// infected ones.  Files that could not be scanned are not recorded, to be
+// retried.
+type checkpoint struct {
+	file    *os.File
+	scanned map[string]verdict
+}
+
+// openCheckpoint opens the checkpoint file, reading the verdicts of the
+// files already scanned.  An empty path disables checkpoints.
+func openCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{scanned: map[string]verdict{}}
+	if path == "" {
+		return cp, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open checkpoint: %w", err)
+	}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var v verdict
+		if err := json.Unmarshal(lines.Bytes(), &v); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("unable to read checkpoint: %w", err)
+		}
+		cp.scanned[v.File] = v
+	}
+	if err := lines.Err(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+	cp.file = f
+	return cp, nil
+}
+
+func (cp *checkpoint) done(path string) bool {
+	_, ok := cp.scanned[path]
+	return ok
+}
+
+// infected returns the infected files recorded, by path.
+func (cp *checkpoint) infected() []verdict {
+	var infected []verdict
+	for _, v := range cp.scanned {
+		if v.Status == string(clamd.StatusFound) {
+			infected = append(infected, v)
+		}
+	}
+	sort.Slice(infected, func(i, j int) bool { return infected[i].File < infected[j].File })
+	return infected
+}
+
+func (cp *checkpoint) record(v verdict) error {
+	if cp.file == nil || v.File == "-" {
+		return nil
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	if _, err := fmt.Fprintf(cp.file, "%s\n", line); err != nil {
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// close closes the checkpoint file, removing it if the scan is complete.
+func (cp *checkpoint) close(complete bool) error {
+	if cp.file == nil {
+		return nil
+	}
+	if err := cp.file.Close(); err != nil {
+		return err
+	}
+	if complete {
+		return os.Remove(cp.file.Name())
+	}
+	return nil
+}
+
+// formatBytes formats n with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestScanRecursive(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	root := writeTestTree(t, map[string]string{
+		"a/clean.txt":         "hello",
+		"a/b/eicar.com":       clamdtest.EICAR,
+		"a/b/big.txt":         strings.Repeat("x", 2048),
+		"cache/eicar.com":     clamdtest.EICAR,
+		"a/b/notes.md":        "notes",
+		"a/b/c/deep/deep.txt": "deep",
+	})
+
+	// execute
+	code, report := scanJSON(t, fake, "-r", "-include", "*.txt", "-include", "*.com",
+		"-exclude", "cache", "-max-size", "1K", root)
+
+	// assert
+	assert.Equal(t, exitInfected, code)
+	assert.Equal(t, []string{"a/b/c/deep/deep.txt", "a/b/eicar.com", "a/clean.txt"}, relFiles(t, root, report))
+	assert.Equal(t, 1, report.Infected)
+	assert.Equal(t, 2, report.Skipped, "big.txt by size and notes.md by include")
+}
+
+func TestScanDirectoryNeedsRecursive(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	root := writeTestTree(t, map[string]string{"clean.txt": "hello"})
+
+	// execute
+	code, report := scanJSON(t, fake, root)
+
+	// assert
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, report.Files[0].Error, "is a directory")
+}
+
+func TestScanSymlinks(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	outside := writeTestTree(t, map[string]string{"eicar.com": clamdtest.EICAR})
+	root := writeTestTree(t, map[string]string{"clean.txt": "hello"})
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "loop")))
+
+	// execute
+	skipCode, skipReport := scanJSON(t, fake, "-r", root)
+	followCode, followReport := scanJSON(t, fake, "-r", "-symlinks", "follow", root)
+
+	// assert
+	assert.Equal(t, exitClean, skipCode)
+	assert.Equal(t, []string{"clean.txt"}, relFiles(t, root, skipReport))
+	assert.Equal(t, 2, skipReport.Skipped)
+	assert.Equal(t, exitInfected, followCode)
+	assert.Equal(t, []string{"clean.txt", "link/eicar.com"}, relFiles(t, root, followReport))
+}
+
+func TestScanQuarantine(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	root := writeTestTree(t, map[string]string{
+		"a/eicar.com": clamdtest.EICAR,
+		"b/eicar.com": clamdtest.EICAR,
+		"clean.txt":   "hello",
+	})
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+
+	// execute
+	code, report := scanJSON(t, fake, "-r", "-quarantine", quarantine, root)
+
+	// assert
+	assert.Equal(t, exitInfected, code)
+	assert.ElementsMatch(t, []string{
+		"moved to " + filepath.Join(quarantine, "eicar.com"),
+		"moved to " + filepath.Join(quarantine, "eicar.com.1"),
+	}, []string{report.Files[0].Action, report.Files[1].Action})
+	assert.NoFileExists(t, filepath.Join(root, "a/eicar.com"))
+	assert.NoFileExists(t, filepath.Join(root, "b/eicar.com"))
+	assert.FileExists(t, filepath.Join(root, "clean.txt"))
+	assert.FileExists(t, filepath.Join(quarantine, "eicar.com.1"))
+}
+
+func TestScanRemove(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	root := writeTestTree(t, map[string]string{"eicar.com": clamdtest.EICAR})
+
+	// execute
+	code, report := scanJSON(t, fake, "-r", "-remove", root)
+
+	// assert
+	assert.Equal(t, exitInfected, code)
+	assert.Equal(t, "removed", report.Files[0].Action)
+	assert.NoFileExists(t, filepath.Join(root, "eicar.com"))
+}
+
+func TestScanCheckpoint(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	root := writeTestTree(t, map[string]string{
+		"one.txt":   "1",
+		"two.txt":   "2",
+		"three.txt": "3",
+	})
+	checkpoint := filepath.Join(t.TempDir(), "scan.checkpoint")
+	// as left by an interrupted scan, that quarantined an infected file
+	writeCheckpoint(t, checkpoint,
+		verdict{File: filepath.Join(root, "one.txt"), Size: 1, Status: "OK"},
+		verdict{File: filepath.Join(root, "eicar.com"), Size: 68, Status: "FOUND", Virus: "Eicar-Signature", Action: "moved to /quarantine/eicar.com"})
+
+	// execute
+	code, report := scanJSON(t, fake, "-r", "-checkpoint", checkpoint, root)
+
+	// assert
+	assert.Equal(t, exitInfected, code, "infected files found before the interruption count")
+	assert.Equal(t, []string{"eicar.com", "three.txt", "two.txt"}, relFiles(t, root, report))
+	assert.Equal(t, 1, report.Infected)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, 1, report.Resumed)
+	assert.NoFileExists(t, checkpoint, "checkpoint of a complete scan is removed")
+}
+
+func TestScanCheckpointRecordsVerdicts(t *testing.T) {
+	// prepare
+	root := writeTestTree(t, map[string]string{"eicar.com": clamdtest.EICAR})
+	file := filepath.Join(t.TempDir(), "scan.checkpoint")
+	cp, err := openCheckpoint(file)
+	require.NoError(t, err)
+	infected := verdict{File: filepath.Join(root, "eicar.com"), Size: 68, Status: "FOUND", Virus: "Eicar-Signature"}
+
+	// execute
+	require.NoError(t, cp.record(infected))
+	require.NoError(t, cp.close(false))
+	resumed, err := openCheckpoint(file)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resumed.close(true) })
+
+	// assert
+	assert.True(t, resumed.done(infected.File))
+	assert.Equal(t, []verdict{infected}, resumed.infected())
+}
+
+func TestSizeFlag(t *testing.T) {
+	var s size
+	require.NoError(t, s.Set("25M"))
+	assert.Equal(t, size(25<<20), s)
+	require.Error(t, s.Set("25MB"))
+	require.Error(t, s.Set("-1"))
+}
+
+// helpers
+
+func scanJSON(t *testing.T, fake *clamdtest.Server, args ...string) (int, scanReport) {
+	t.Helper()
+
+	flags := append(clamdFlags(fake), "-json", "scan")
+	code, stdout, stderr := runClamctl(t, append(flags, args...)...)
+	var report scanReport
+	require.NoError(t, json.Unmarshal([]byte(stdout), &report), stderr)
+	return code, report
+}
+
+func writeTestTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return root
+}
+
+func writeCheckpoint(t *testing.T, file string, verdicts ...verdict) {
+	t.Helper()
+
+	var lines []byte
+	for _, v := range verdicts {
+		line, err := json.Marshal(v)
+		require.NoError(t, err)
+		lines = append(append(lines, line...), '\n')
+	}
+	require.NoError(t, os.WriteFile(file, lines, 0o600))
+}
+
+func relFiles(t *testing.T, root string, report scanReport) []string {
+	t.Helper()
+
+	files := make([]string, 0, len(report.Files))
+	for _, f := range report.Files {
+		rel, err := filepath.Rel(root, f.File)
+		require.NoError(t, err)
+		files = append(files, filepath.ToSlash(rel))
+	}
+	return files
+}
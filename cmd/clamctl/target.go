@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+)
+
+var (
+	errUnsupported = errors.New("not supported through restclam")
+	errServer      = errors.New("restclam error")
+)
+
+// target is what clamctl talks to: clamd or a restclam server.
+type target interface {
+	Ping(ctx context.Context) (string, error)
+	Version(ctx context.Context) (string, error)
+	Stats(ctx context.Context) (output, error)
+	// Scan streams the content to scan, named name
+	Scan(ctx context.Context, name string, r io.Reader) (verdict, error)
+	// ScanPath scans a file that clamd can read
+	ScanPath(ctx context.Context, path string) (verdict, error)
+	Reload(ctx context.Context) (string, error)
+	Shutdown(ctx context.Context) error
+}
+
+// output is the result of a command, printed as text, or as JSON with
+// -json.
+type output struct {
+	text string
+	data any
+}
+
+// verdict is the scan result of a file.
+type verdict struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size,omitempty"`
+	Status string `json:"status"`
+	Virus  string `json:"virus,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Action is what was done to an infected file, if anything
+	Action string `json:"action,omitempty"`
+
+	// queueWait is how long the scan waited for a clamd session, if known
+	queueWait time.Duration
+}
+
+func newVerdict(file string, sr *clamd.ScanResult) verdict {
+	return verdict{
+		File:      file,
+		Status:    string(sr.Status),
+		Virus:     sr.Virus,
+		Error:     sr.Error,
+		queueWait: sr.Metadata.QueueDuration,
+	}
+}
+
+// clamdTarget talks to clamd directly.  Commands are bound by the clamd
+// timeouts rather than by the context.
+type clamdTarget struct {
+	clamd *clamd.Clamd
+}
+
+func (t *clamdTarget) Ping(context.Context) (string, error) {
+	return t.clamd.Ping()
+}
+
+func (t *clamdTarget) Version(context.Context) (string, error) {
+	return t.clamd.Version()
+}
+
+func (t *clamdTarget) Stats(context.Context) (output, error) {
+	reply, err := t.clamd.Stats()
+	if err != nil {
+		return output{}, err
+	}
+	stats, err := clamd.ParseStats(reply)
+	if err != nil {
+		return output{}, err
+	}
+	return output{text: reply, data: api.NewStatsResponse(stats)}, nil
+}
+
+func (t *clamdTarget) Scan(_ context.Context, name string, r io.Reader) (verdict, error) {
+	sr, err := t.clamd.Instream(r)
+	if err != nil {
+		return verdict{}, err
+	}
+	return newVerdict(name, sr), nil
+}
+
+func (t *clamdTarget) ScanPath(_ context.Context, path string) (verdict, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return verdict{}, err
+	}
+	sr, err := t.clamd.Scan(abs)
+	if err != nil {
+		return verdict{}, err
+	}
+	return newVerdict(path, sr), nil
+}
+
+func (t *clamdTarget) Reload(context.Context) (string, error) {
+	return t.clamd.Reload()
+}
+
+func (t *clamdTarget) Shutdown(context.Context) error {
+	return t.clamd.Shutdown()
+}
+
+// coordinatorTarget scans files concurrently through a coordinator of
+// clamd sessions, other commands go to clamd directly.
+type coordinatorTarget struct {
+	*clamdTarget
+	coordinator *clamd.Coordinator
+	timeout     time.Duration
+}
+
+func newCoordinatorTarget(t *clamdTarget, workers int, timeout time.Duration) (*coordinatorTarget, error) {
+	c := &clamd.Coordinator{
+		MinWorkers:      workers,
+		MaxWorkers:      workers,
+		ShutdownTimeout: timeout,
+		// fail rather than wait forever if clamd is unreachable
+		MaxQueueWait: timeout,
+	}
+	if err := c.InitCoordinator([]clamd.Clamd{*t.clamd}, clamd.SessionOpts{HeartbeatInterval: 10 * time.Second}); err != nil {
+		return nil, err
+	}
+	return &coordinatorTarget{clamdTarget: t, coordinator: c, timeout: timeout}, nil
+}
+
+func (t *coordinatorTarget) Scan(ctx context.Context, name string, r io.Reader) (verdict, error) {
+	sr, err := t.coordinator.Instream(r, t.jobOptions(ctx)...)
+	if err != nil {
+		return verdict{}, err
+	}
+	return newVerdict(name, sr), nil
+}
+
+func (t *coordinatorTarget) ScanPath(ctx context.Context, path string) (verdict, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return verdict{}, err
+	}
+	sr, err := t.coordinator.Scan(abs, t.jobOptions(ctx)...)
+	if err != nil {
+		return verdict{}, err
+	}
+	return newVerdict(path, sr), nil
+}
+
+func (t *coordinatorTarget) jobOptions(ctx context.Context) []clamd.JobOption {
+	return []clamd.JobOption{
+		clamd.WithContext(ctx),
+		clamd.WithTimeout(t.timeout),
+		clamd.WithPriority(clamd.PriorityBulk),
+	}
+}
+
+func (t *coordinatorTarget) close() {
+	t.coordinator.Shutdown()
+}
+
+// httpTarget talks to clamd through the v1 API of a restclam server.
+type httpTarget struct {
+	base    string
+	client  *http.Client
+	timeout time.Duration
+	headers http.Header
+}
+
+func newHTTPTarget(opts options) *httpTarget {
+	headers := http.Header{}
+	if opts.apiKey != "" {
+		headers.Set(opts.apiKeyHeader, opts.apiKey)
+	}
+	if opts.token != "" {
+		headers.Set("Authorization", "Bearer "+opts.token)
+	}
+	return &httpTarget{
+		base:    strings.TrimSuffix(opts.server, "/"),
+		client:  &http.Client{},
+		timeout: opts.timeout,
+		headers: headers,
+	}
+}
+
+func (t *httpTarget) Ping(ctx context.Context) (string, error) {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := t.do(ctx, http.MethodGet, "/api/v1/clamav/ping", nil, "", &resp); err != nil {
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+func (t *httpTarget) Version(context.Context) (string, error) {
+	return "", fmt.Errorf("%w: version", errUnsupported)
+}
+
+func (t *httpTarget) Stats(ctx context.Context) (output, error) {
+	var metrics api.MetricsResponse
+	if err := t.do(ctx, http.MethodGet, "/api/v1/clamav/metrics", nil, "", &metrics); err != nil {
+		return output{}, err
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "workers:\t%d\n", metrics.Workers)
+	fmt.Fprintf(w, "queue length:\t%d\n", metrics.QueueLength)
+	fmt.Fprintf(w, "submitted:\t%d\n", metrics.Submitted)
+	fmt.Fprintf(w, "completed:\t%d\n", metrics.Completed)
+	fmt.Fprintf(w, "shed:\t%d\n", metrics.Shed)
+	fmt.Fprintf(w, "queue timeouts:\t%d\n", metrics.QueueTimeouts)
+	fmt.Fprintf(w, "job timeouts:\t%d\n", metrics.JobTimeouts)
+	fmt.Fprintf(w, "retries:\t%d\n", metrics.Retries)
+	fmt.Fprintf(w, "hedges:\t%d\n", metrics.Hedges)
+	fmt.Fprintf(w, "cancelled:\t%d\n", metrics.Cancelled)
+	fmt.Fprintf(w, "avg job duration:\t%.1fms\n", metrics.AvgJobDurationMs)
+	backends := make([]string, 0, len(metrics.Circuits))
+	for backend := range metrics.Circuits {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	for _, backend := range backends {
+		fmt.Fprintf(w, "circuit %s:\t%s\n", backend, metrics.Circuits[backend])
+	}
+	_ = w.Flush()
+
+	return output{text: strings.TrimSuffix(b.String(), "\n"), data: metrics}, nil
+}
+
+func (t *httpTarget) Scan(ctx context.Context, name string, r io.Reader) (verdict, error) {
+	// stream the multipart body, not to buffer the whole file
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(name))
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var resp api.ScanResponse
+	if err := t.do(ctx, http.MethodPost, "/api/v1/clamav/scan", pr, mw.FormDataContentType(), &resp); err != nil {
+		_ = pr.CloseWithError(err)
+		return verdict{}, err
+	}
+	return verdict{
+		File:      name,
+		Status:    resp.Status,
+		Virus:     resp.Virus,
+		Error:     resp.Error,
+		queueWait: time.Duration(resp.Metadata.QueueDurationMs * float64(time.Millisecond)),
+	}, nil
+}
+
+func (t *httpTarget) ScanPath(context.Context, string) (verdict, error) {
+	return verdict{}, fmt.Errorf("%w: scan of paths readable by clamd", errUnsupported)
+}
+
+func (t *httpTarget) Reload(context.Context) (string, error) {
+	return "", fmt.Errorf("%w: reload", errUnsupported)
+}
+
+func (t *httpTarget) Shutdown(context.Context) error {
+	return fmt.Errorf("%w: shutdown", errUnsupported)
+}
+
+// do sends a request to restclam and decodes the JSON response into v, or
+// the error response into an error.
+func (t *httpTarget) do(ctx context.Context, method string, path string, body io.Reader, contentType string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, t.base+path, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e render.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code == "" {
+			return fmt.Errorf("%w: HTTP %d", errServer, resp.StatusCode)
+		}
+		return fmt.Errorf("%w: %s: %s (HTTP %d)", errServer, e.Code, e.Message, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: invalid response: %w", errServer, err)
+	}
+	return nil
+}
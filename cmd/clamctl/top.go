@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// snapshot is what top shows at a point in time.  Parts that could not be
+// read are left out, with the reason in Errors.
+type snapshot struct {
+	Time     string             `json:"time"`
+	Target   string             `json:"target"`
+	Clamd    *api.StatsResponse `json:"clamd,omitempty"`
+	Restclam *restclamSnapshot  `json:"restclam,omitempty"`
+	Rates    *verdictRates      `json:"rates,omitempty"`
+	Errors   []string           `json:"errors,omitempty"`
+	metrics  *api.MetricsResponse
+	taken    time.Time
+}
+
+// restclamSnapshot is the state of the coordinator of restclam.
+type restclamSnapshot struct {
+	Metrics  api.MetricsResponse   `json:"metrics"`
+	InFlight int                   `json:"inFlight"`
+	Backends []api.BackendResponse `json:"backends,omitempty"`
+	Workers  []api.WorkerResponse  `json:"workers,omitempty"`
+}
+
+// verdictRates are the scans per second since the previous snapshot.
+type verdictRates struct {
+	IntervalMs float64 `json:"intervalMs"`
+	Scans      float64 `json:"scans"`
+	Clean      float64 `json:"clean"`
+	Infected   float64 `json:"infected"`
+	Errors     float64 `json:"errors"`
+	Shed       float64 `json:"shed"`
+}
+
+// introspector is a target that top can poll.
+type introspector interface {
+	snapshot(ctx context.Context) snapshot
+}
+
+// topOptions are the flags of top.
+type topOptions struct {
+	interval time.Duration
+	once     bool
+}
+
+func (c *command) top(ctx context.Context, args []string) int {
+	var opts topOptions
+	fs := flag.NewFlagSet("clamctl top", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(c.stderr, "Usage: clamctl [flags] top [top flags]")
+		fs.PrintDefaults()
+	}
+	fs.DurationVar(&opts.interval, "interval", 2*time.Second, "refresh interval, and how long rates are measured over with -once")
+	fs.BoolVar(&opts.once, "once", false, "print a single snapshot and exit, the exit code is 2 if any part is unavailable")
+	fs.BoolVar(&c.opts.json, "json", c.opts.json, "print snapshots as JSON, one per line")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	switch {
+	case fs.NArg() != 0:
+		fs.Usage()
+		return exitError
+	case opts.interval <= 0:
+		return c.fail(fmt.Errorf("%w: interval must be positive", errUsage))
+	}
+
+	t, ok := c.target.(introspector)
+	if !ok {
+		return c.fail(fmt.Errorf("%w: top", errUnsupported))
+	}
+
+	prev := t.snapshot(ctx)
+	if opts.once {
+		// rates need two snapshots, one interval apart
+		if prev.metrics != nil {
+			select {
+			case <-ctx.Done():
+				return exitError
+			case <-time.After(opts.interval):
+			}
+			next := t.snapshot(ctx)
+			next.rates(prev)
+			prev = next
+		}
+		c.printSnapshot(prev, opts)
+		if len(prev.Errors) > 0 {
+			return exitError
+		}
+		return exitClean
+	}
+
+	c.printSnapshot(prev, opts)
+	tick := time.NewTicker(opts.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return exitClean
+		case <-tick.C:
+		}
+		next := t.snapshot(ctx)
+		next.rates(prev)
+		c.printSnapshot(next, opts)
+		prev = next
+	}
+}
+
+// rates computes the verdict rates since the previous snapshot.
+func (s *snapshot) rates(prev snapshot) {
+	if s.metrics == nil || prev.metrics == nil {
+		return
+	}
+	elapsed := s.taken.Sub(prev.taken).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := func(cur uint64, prev uint64) float64 {
+		if cur < prev {
+			// restarted
+			return 0
+		}
+		return float64(cur-prev) / elapsed
+	}
+	cur, old := s.metrics, prev.metrics
+	s.Rates = &verdictRates{
+		IntervalMs: elapsed * 1000,
+		Scans:      rate(cur.Clean+cur.Infected+cur.ScanErrors, old.Clean+old.Infected+old.ScanErrors),
+		Clean:      rate(cur.Clean, old.Clean),
+		Infected:   rate(cur.Infected, old.Infected),
+		Errors:     rate(cur.ScanErrors, old.ScanErrors),
+		Shed:       rate(cur.Shed, old.Shed),
+	}
+}
+
+func newSnapshot(target string) snapshot {
+	now := time.Now()
+	return snapshot{Time: now.UTC().Format(time.RFC3339Nano), Target: target, taken: now}
+}
+
+func (s *snapshot) fail(part string, err error) {
+	s.Errors = append(s.Errors, part+": "+err.Error())
+}
+
+func (t *clamdTarget) snapshot(context.Context) snapshot {
+	s := newSnapshot("clamd " + t.clamd.Network + ":" + t.clamd.Address)
+	reply, err := t.clamd.Stats()
+	if err != nil {
+		s.fail("clamd stats", err)
+		return s
+	}
+	stats, err := clamd.ParseStats(reply)
+	if err != nil {
+		s.fail("clamd stats", err)
+		return s
+	}
+	resp := api.NewStatsResponse(stats)
+	s.Clamd = &resp
+	return s
+}
+
+func (t *httpTarget) snapshot(ctx context.Context) snapshot {
+	s := newSnapshot("restclam " + t.base)
+
+	var stats api.StatsResponse
+	if err := t.do(ctx, http.MethodGet, "/api/v1/clamav/stats", nil, "", &stats); err != nil {
+		s.fail("clamd stats", err)
+	} else {
+		s.Clamd = &stats
+	}
+
+	var metrics api.MetricsResponse
+	if err := t.do(ctx, http.MethodGet, "/api/v1/clamav/metrics", nil, "", &metrics); err != nil {
+		s.fail("metrics", err)
+		return s
+	}
+	s.metrics = &metrics
+	s.Restclam = &restclamSnapshot{Metrics: metrics}
+
+	// the admin scope may be missing, the metrics are still worth showing
+	if err := t.do(ctx, http.MethodGet, "/api/v1/admin/backends", nil, "", &s.Restclam.Backends); err != nil {
+		s.fail("backends", err)
+	}
+	for _, b := range s.Restclam.Backends {
+		s.Restclam.InFlight += b.InFlight
+	}
+	if err := t.do(ctx, http.MethodGet, "/api/v1/admin/workers", nil, "", &s.Restclam.Workers); err != nil {
+		s.fail("workers", err)
+	}
+	return s
+}
+
+// printSnapshot refreshes the terminal with the snapshot, or prints it as
+// a JSON line with -json.
+func (c *command) printSnapshot(s snapshot, opts topOptions) {
+	if c.opts.json {
+		if err := json.NewEncoder(c.stdout).Encode(s); err != nil {
+			fmt.Fprintf(c.stderr, "clamctl: %v\n", err)
+		}
+		return
+	}
+
+	var b strings.Builder
+	if !opts.once {
+		b.WriteString(clearScreen)
+	}
+	renderSnapshot(&b, s, opts.interval)
+	fmt.Fprint(c.stdout, b.String())
+}
+
+func renderSnapshot(out io.Writer, s snapshot, interval time.Duration) {
+	fmt.Fprintf(out, "%s  %s  every %s\n\n", s.Target, s.taken.Format(time.TimeOnly), interval)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if st := s.Clamd; st != nil {
+		fmt.Fprintf(w, "clamd:\t%s, %d pools\n", st.State, st.Pools)
+		fmt.Fprintf(w, "threads:\tlive %d, idle %d, max %d, idle timeout %ds\n",
+			st.Threads.Live, st.Threads.Idle, st.Threads.Max, st.Threads.IdleTimeout)
+		fmt.Fprintf(w, "queue:\t%d items\n", st.Queue)
+		fmt.Fprintf(w, "memory:\theap %s, mmap %s, used %s, free %s, releasable %s\n",
+			st.Memory.Heap, st.Memory.Mmap, st.Memory.Used, st.Memory.Free, st.Memory.Releasable)
+		fmt.Fprintf(w, "pools:\t%d, used %s of %s\n", st.Memory.Pools, st.Memory.PoolsUsed, st.Memory.PoolsTotal)
+	}
+	if r := s.Restclam; r != nil {
+		m := r.Metrics
+		fmt.Fprintf(w, "restclam:\t%d workers, %d queued, %d in flight, avg job %.1fms\n",
+			m.Workers, m.QueueLength, r.InFlight, m.AvgJobDurationMs)
+		fmt.Fprintf(w, "jobs:\tsubmitted %d, completed %d, shed %d, queue timeouts %d, job timeouts %d, retries %d, hedges %d\n",
+			m.Submitted, m.Completed, m.Shed, m.QueueTimeouts, m.JobTimeouts, m.Retries, m.Hedges)
+		fmt.Fprintf(w, "verdicts:\tclean %d, infected %d, errors %d\n", m.Clean, m.Infected, m.ScanErrors)
+	}
+	if r := s.Rates; r != nil {
+		fmt.Fprintf(w, "rates:\t%.1f scans/s, clean %.1f/s, infected %.1f/s, errors %.1f/s, shed %.1f/s\n",
+			r.Scans, r.Clean, r.Infected, r.Errors, r.Shed)
+	}
+	_ = w.Flush()
+
+	if r := s.Restclam; r != nil && len(r.Backends) > 0 {
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "BACKEND\tCIRCUIT\tENABLED\tWORKERS\tIN FLIGHT\tJOBS")
+		for _, b := range r.Backends {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%d\t%d\n", b.Address, b.Circuit, b.Enabled, b.Workers, b.InFlight, b.JobsProcessed)
+		}
+		_ = w.Flush()
+	}
+	if r := s.Restclam; r != nil && len(r.Workers) > 0 {
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "WORKER\tBACKEND\tSTATE\tJOBS\tCURRENT JOB")
+		for _, wk := range r.Workers {
+			current := "-"
+			if wk.CurrentJobAgeMs > 0 {
+				current = fmt.Sprintf("%.0fms", wk.CurrentJobAgeMs)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", wk.ID, wk.Backend, wk.State, wk.JobsProcessed, current)
+		}
+		_ = w.Flush()
+	}
+
+	if len(s.Errors) > 0 {
+		fmt.Fprintln(out)
+		for _, e := range s.Errors {
+			fmt.Fprintf(out, "unavailable: %s\n", e)
+		}
+	}
+}
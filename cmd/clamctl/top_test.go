@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestTopOnceClamd(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, append(clamdFlags(fake), "top", "-once", "-json")...)
+
+	// assert
+	require.Equal(t, exitClean, code)
+	var s snapshot
+	require.NoError(t, json.Unmarshal([]byte(stdout), &s))
+	require.NotNil(t, s.Clamd)
+	assert.Equal(t, 12, s.Clamd.Threads.Max)
+	assert.Equal(t, "1369.152M", s.Clamd.Memory.PoolsTotal)
+	assert.Nil(t, s.Restclam)
+	assert.Nil(t, s.Rates)
+}
+
+func TestTopOnceRestclam(t *testing.T) {
+	// prepare
+	server := newTestRestclam(t)
+	clean, infected := writeTestFiles(t)
+	code, _, _ := runClamctl(t, "-server", server, "-api-key", testAPIKey, "scan", clean, infected)
+	require.Equal(t, exitInfected, code)
+
+	// execute
+	code, stdout, _ := runClamctl(t, "-server", server, "-api-key", testAPIKey, "top", "-once", "-json", "-interval", "10ms")
+
+	// assert
+	require.Equal(t, exitClean, code)
+	var s snapshot
+	require.NoError(t, json.Unmarshal([]byte(stdout), &s))
+	assert.Empty(t, s.Errors)
+	require.NotNil(t, s.Clamd)
+	assert.Equal(t, "VALID PRIMARY", s.Clamd.State)
+	require.NotNil(t, s.Restclam)
+	assert.Equal(t, uint64(1), s.Restclam.Metrics.Clean)
+	assert.Equal(t, uint64(1), s.Restclam.Metrics.Infected)
+	assert.Len(t, s.Restclam.Backends, 1)
+	assert.Len(t, s.Restclam.Workers, 1)
+	require.NotNil(t, s.Rates)
+	assert.Zero(t, s.Rates.Scans)
+}
+
+func TestTopText(t *testing.T) {
+	// prepare
+	server := newTestRestclam(t)
+
+	// execute
+	code, stdout, _ := runClamctl(t, "-server", server, "-api-key", testAPIKey, "top", "-once", "-interval", "10ms")
+
+	// assert
+	require.Equal(t, exitClean, code)
+	assert.NotContains(t, stdout, clearScreen)
+	for _, line := range []string{"threads:", "restclam:", "rates:", "BACKEND", "WORKER"} {
+		assert.True(t, strings.Contains(stdout, line), "missing %q in:\n%s", line, stdout)
+	}
+}
+
+func TestTopUnavailable(t *testing.T) {
+	// prepare
+	fake, err := clamdtest.NewServer()
+	require.NoError(t, err)
+	args := clamdFlags(fake)
+	require.NoError(t, fake.Close())
+
+	// execute
+	code, stdout, _ := runClamctl(t, append(args, "top", "-once")...)
+
+	// assert
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stdout, "unavailable: clamd stats:")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/tomrss/restclam/pkg/clamd"
+)
+
+// watchOptions are the flags of watch.
+type watchOptions struct {
+	output      string
+	quarantine  string
+	debounce    time.Duration
+	existing    bool
+	include     globs
+	exclude     globs
+	concurrency int
+	log         string
+}
+
+// watchRecord is a line of the NDJSON log of watch.
+type watchRecord struct {
+	Time string `json:"time"`
+	verdict
+}
+
+func (c *command) watch(ctx context.Context, args []string) int {
+	var opts watchOptions
+	fs := flag.NewFlagSet("clamctl watch", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(c.stderr, "Usage: clamctl [flags] watch [watch flags] DIR")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.output, "output", "", "move clean files to this directory, or leave them in place")
+	fs.StringVar(&opts.quarantine, "quarantine", "", "move infected files to this directory, or leave them in place")
+	fs.DurationVar(&opts.debounce, "debounce", 2*time.Second, "scan files not written, nor changed in size or time, for this long, as still being written before")
+	fs.BoolVar(&opts.existing, "existing", true, "scan the files already in the directory at start")
+	fs.Var(&opts.include, "include", "scan only files matching the glob (repeatable)")
+	fs.Var(&opts.exclude, "exclude", "ignore files matching the glob, e.g. temporary files (repeatable)")
+	fs.IntVar(&opts.concurrency, "concurrency", 4, "files scanned at the same time")
+	fs.StringVar(&opts.log, "log", "", "append the NDJSON results to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	switch {
+	case fs.NArg() != 1:
+		fs.Usage()
+		return exitError
+	case opts.debounce <= 0:
+		return c.fail(fmt.Errorf("%w: debounce must be positive", errUsage))
+	case opts.concurrency < 1:
+		return c.fail(fmt.Errorf("%w: concurrency must be positive", errUsage))
+	case sameDir(opts.output, fs.Arg(0)) || sameDir(opts.quarantine, fs.Arg(0)):
+		return c.fail(fmt.Errorf("%w: -output and -quarantine must not be the watched directory", errUsage))
+	}
+
+	out := c.stdout
+	if opts.log != "" {
+		f, err := os.OpenFile(opts.log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return c.fail(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	t, release, err := c.scanTarget(opts.concurrency)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer release()
+
+	w := &watcher{command: c, target: t, opts: opts, dir: fs.Arg(0), log: json.NewEncoder(out)}
+	if err := w.run(ctx); err != nil {
+		return c.fail(err)
+	}
+	return exitClean
+}
+
+// watcher scans the files written in a directory, once they are not
+// written for the debounce duration, and moves them according to the
+// verdict.  Files changed while scanned are scanned again.
+type watcher struct {
+	*command
+	target target
+	opts   watchOptions
+	dir    string
+	log    *json.Encoder
+}
+
+// run watches until ctx is done, then waits for the scans in progress.
+func (w *watcher) run(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	if err := fsw.Add(w.dir); err != nil {
+		return fmt.Errorf("unable to watch %s: %w", w.dir, err)
+	}
+
+	// pending are the files written, with when to scan them
+	pending := map[string]pendingFile{}
+	if w.opts.existing {
+		entries, err := os.ReadDir(w.dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			path := filepath.Join(w.dir, e.Name())
+			if !w.ignored(path) {
+				pending[path] = newPendingFile(path, 0)
+			}
+		}
+	}
+
+	paths := make(chan string)
+	results := make(chan watchResult)
+	var wg sync.WaitGroup
+	for range w.opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				results <- w.scan(ctx, path)
+			}
+		}()
+	}
+	defer func() {
+		close(paths)
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		for r := range results {
+			if !r.changed {
+				w.record(r.verdict)
+			}
+		}
+	}()
+
+	// scanning are the files being scanned, not to scan twice at once
+	scanning := map[string]bool{}
+	tick := time.NewTicker(max(w.opts.debounce/4, 10*time.Millisecond))
+	defer tick.Stop()
+	for {
+		// offer a due file to the workers, if any
+		var next string
+		var work chan<- string
+		for path, p := range pending {
+			if scanning[path] || time.Now().Before(p.due) {
+				continue
+			}
+			if !p.unchanged(path) {
+				// written without an event, or the event is still to come
+				pending[path] = newPendingFile(path, w.opts.debounce)
+				continue
+			}
+			next, work = path, paths
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case work <- next:
+			delete(pending, next)
+			scanning[next] = true
+		case r := <-results:
+			delete(scanning, r.File)
+			if r.changed {
+				pending[r.File] = newPendingFile(r.File, w.opts.debounce)
+			} else {
+				w.record(r.verdict)
+			}
+		case event := <-fsw.Events:
+			switch {
+			case w.ignored(event.Name):
+			case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+				pending[event.Name] = newPendingFile(event.Name, w.opts.debounce)
+			case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+				delete(pending, event.Name)
+			}
+		case err := <-fsw.Errors:
+			fmt.Fprintf(w.stderr, "clamctl: error watching %s: %v\n", w.dir, err)
+		case <-tick.C:
+		}
+	}
+}
+
+// pendingFile is a file written, to scan once due if its size and
+// modification time did not change since.
+type pendingFile struct {
+	due   time.Time
+	size  int64
+	mtime time.Time
+}
+
+// newPendingFile returns the file written, due after debounce.
+func newPendingFile(path string, debounce time.Duration) pendingFile {
+	p := pendingFile{due: time.Now().Add(debounce)}
+	if info, err := os.Lstat(path); err == nil {
+		p.size, p.mtime = info.Size(), info.ModTime()
+	}
+	return p
+}
+
+// unchanged tells if the file has still the size and time it had when
+// pending.
+func (p pendingFile) unchanged(path string) bool {
+	current := newPendingFile(path, 0)
+	return current.size == p.size && current.mtime.Equal(p.mtime)
+}
+
+// watchResult is the verdict of a file, unless changed while scanned.
+type watchResult struct {
+	verdict
+	changed bool
+}
+
+// scan scans a file and moves it according to the verdict.  Directories,
+// special and filtered out files are skipped with an empty verdict.  Files
+// changed while scanned are left in place.
+func (w *watcher) scan(ctx context.Context, path string) watchResult {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() ||
+		(len(w.opts.include) > 0 && !matchAny(w.opts.include, w.dir, path)) ||
+		matchAny(w.opts.exclude, w.dir, path) {
+		// gone, moved away or not to scan
+		return watchResult{verdict: verdict{File: path}}
+	}
+
+	v, err := w.scanFile(ctx, path)
+	if err != nil && ctx.Err() != nil {
+		// stopped, it will be scanned at the next start
+		return watchResult{verdict: verdict{File: path}}
+	}
+	if after, statErr := os.Lstat(path); statErr != nil || after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		// still being written, the verdict may be stale
+		return watchResult{verdict: verdict{File: path}, changed: true}
+	}
+	if err != nil {
+		return watchResult{verdict: verdict{File: path, Size: info.Size(), Status: string(clamd.StatusError), Error: err.Error()}}
+	}
+	v.Size = info.Size()
+
+	dir := w.opts.output
+	if v.Status == string(clamd.StatusFound) {
+		dir = w.opts.quarantine
+	}
+	if dir != "" && v.Status != string(clamd.StatusError) {
+		if dst, err := moveInto(path, dir); err != nil {
+			v.Action = "move failed: " + err.Error()
+		} else {
+			v.Action = "moved to " + dst
+		}
+	}
+	return watchResult{verdict: v}
+}
+
+func (w *watcher) scanFile(ctx context.Context, path string) (verdict, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return verdict{}, err
+	}
+	defer f.Close()
+
+	v, err := w.target.Scan(ctx, path, f)
+	v.File = path
+	return v, err
+}
+
+// record logs the verdict as a NDJSON line, unless skipped.
+func (w *watcher) record(v verdict) {
+	if v.Status == "" {
+		return
+	}
+	r := watchRecord{Time: time.Now().UTC().Format(time.RFC3339Nano), verdict: v}
+	if err := w.log.Encode(r); err != nil {
+		fmt.Fprintf(w.stderr, "clamctl: unable to log result: %v\n", err)
+	}
+}
+
+// ignored tells if the path is the output or quarantine directory, or in
+// them, when inside the watched directory.
+func (w *watcher) ignored(path string) bool {
+	return inside(w.opts.output, path) || inside(w.opts.quarantine, path)
+}
+
+// sameDir tells if a and b are the same directory, once absolute.
+func sameDir(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// inside tells if path is dir or under it, once absolute.
+func inside(dir string, path string) bool {
+	if dir == "" {
+		return false
+	}
+	absDir, errDir := filepath.Abs(dir)
+	absPath, errPath := filepath.Abs(path)
+	if errDir != nil || errPath != nil {
+		return false
+	}
+	return absPath == absDir || strings.HasPrefix(absPath, absDir+string(filepath.Separator))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestWatch(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	dir := writeTestTree(t, map[string]string{"existing.txt": "hello"})
+	output := filepath.Join(t.TempDir(), "clean")
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	log := filepath.Join(t.TempDir(), "watch.ndjson")
+
+	cancel, done := startWatch(t, fake,
+		"-debounce", "100ms", "-output", output, "-quarantine", quarantine,
+		"-exclude", "*.part", "-log", log, dir)
+
+	// execute
+	// written in two steps, scanned once complete
+	eicar, err := os.Create(filepath.Join(dir, "upload.com"))
+	require.NoError(t, err)
+	_, err = eicar.WriteString(clamdtest.EICAR[:20])
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = eicar.WriteString(clamdtest.EICAR[20:])
+	require.NoError(t, err)
+	require.NoError(t, eicar.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "upload.part"), []byte("partial"), 0o600))
+
+	// assert
+	assert.Eventually(t, func() bool { return len(readWatchLog(t, log)) == 2 }, 5*time.Second, 20*time.Millisecond)
+	cancel()
+	assert.Equal(t, exitClean, <-done)
+
+	records := map[string]watchRecord{}
+	for _, r := range readWatchLog(t, log) {
+		records[filepath.Base(r.File)] = r
+	}
+	assert.Equal(t, "OK", records["existing.txt"].Status)
+	assert.Equal(t, "moved to "+filepath.Join(output, "existing.txt"), records["existing.txt"].Action)
+	assert.Equal(t, "FOUND", records["upload.com"].Status)
+	assert.Equal(t, "moved to "+filepath.Join(quarantine, "upload.com"), records["upload.com"].Action)
+	assert.FileExists(t, filepath.Join(quarantine, "upload.com"))
+	assert.FileExists(t, filepath.Join(dir, "upload.part"), "excluded files are left in place")
+	assert.Equal(t, 2, fake.Scans(), "files are scanned once written completely")
+}
+
+func TestWatchRescansChangedFiles(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	fake.SetScanDelay(300 * time.Millisecond)
+	dir := t.TempDir()
+	output := filepath.Join(t.TempDir(), "clean")
+	log := filepath.Join(t.TempDir(), "watch.ndjson")
+	cancel, done := startWatch(t, fake, "-debounce", "50ms", "-output", output, "-log", log, dir)
+
+	// execute
+	// written again while scanned, after a pause longer than debounce
+	file := filepath.Join(dir, "upload.txt")
+	require.NoError(t, os.WriteFile(file, []byte("first"), 0o600))
+	require.Eventually(t, func() bool { return fake.Scans() == 1 }, 5*time.Second, 10*time.Millisecond)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(" second")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// assert
+	assert.Eventually(t, func() bool { return len(readWatchLog(t, log)) == 1 }, 5*time.Second, 20*time.Millisecond)
+	cancel()
+	assert.Equal(t, exitClean, <-done)
+
+	records := readWatchLog(t, log)
+	require.Len(t, records, 1)
+	assert.Equal(t, int64(len("first second")), records[0].Size)
+	assert.Equal(t, "moved to "+filepath.Join(output, "upload.txt"), records[0].Action)
+	assert.Equal(t, 2, fake.Scans(), "the stale verdict is discarded")
+}
+
+func TestWatchIgnoresOutputInside(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	dir := writeTestTree(t, map[string]string{
+		"upload.txt":           "hello",
+		"clean/previous.txt":   "scanned before",
+		"quarantine/eicar.com": clamdtest.EICAR,
+	})
+	log := filepath.Join(t.TempDir(), "watch.ndjson")
+
+	// execute
+	cancel, done := startWatch(t, fake,
+		"-debounce", "50ms", "-output", filepath.Join(dir, "clean"), "-quarantine", filepath.Join(dir, "quarantine"),
+		"-log", log, dir)
+	assert.Eventually(t, func() bool { return len(readWatchLog(t, log)) == 1 }, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	// assert
+	assert.Equal(t, exitClean, <-done)
+	require.Len(t, readWatchLog(t, log), 1)
+	assert.FileExists(t, filepath.Join(dir, "clean", "upload.txt"))
+	assert.Equal(t, 1, fake.Scans(), "moved files are not scanned again")
+}
+
+func TestWatchOutputIsWatched(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	dir := t.TempDir()
+
+	// execute
+	code, _, stderr := runClamctl(t, append(clamdFlags(fake), "watch", "-output", dir, dir)...)
+
+	// assert
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "must not be the watched directory")
+}
+
+// helpers
+
+// startWatch runs watch in background, until cancelled, returning its exit
+// code on done.
+func startWatch(t *testing.T, fake *clamdtest.Server, args ...string) (context.CancelFunc, <-chan int) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int, 1)
+	go func() {
+		cmd := &command{
+			opts:   options{network: fake.Network(), address: fake.Address(), timeout: 5 * time.Second},
+			stdout: io.Discard,
+			stderr: io.Discard,
+		}
+		cmd.target = newTarget(cmd.opts)
+		done <- cmd.watch(ctx, args)
+	}()
+	t.Cleanup(cancel)
+	time.Sleep(100 * time.Millisecond)
+
+	return cancel, done
+}
+
+func readWatchLog(t *testing.T, path string) []watchRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []watchRecord
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var r watchRecord
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &r))
+		records = append(records, r)
+	}
+	return records
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
+	"github.com/tomrss/restclam/pkg/version"
+)
+
+const usage = `Usage:
+  restclam [flags]                    run the server
+  restclam [flags] config validate    check the configuration and exit
+  restclam [flags] config print       print the effective configuration
+  restclam config schema              print the JSON Schema of the configuration
+
+Flags:
+`
+
+// overrides collects the repeated --set flags.
+type overrides []string
+
+func (o *overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrides) Set(s string) error {
+	if k, _, ok := strings.Cut(s, "="); !ok || k == "" {
+		return fmt.Errorf("%w: %q, expected key=value", config.ErrInvalidOverride, s)
+	}
+	*o = append(*o, s)
+	return nil
+}
+
+// run parses the flags and runs the server or the command of the
+// arguments, returning the exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	var opts config.Options
+	var showVersion bool
+	fs := flag.NewFlagSet("restclam", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.File, "config", "", "config file, instead of searching config.yaml in /etc/restclam, $HOME/.restclam and .")
+	fs.Var((*overrides)(&opts.Overrides), "set", "set a property as key=value, over config file and env (repeatable)")
+	fs.BoolVar(&showVersion, "version", false, "print version and build information")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch cmd := fs.Args(); {
+	case showVersion:
+		fmt.Fprintf(stdout, "restclam %s\n", version.Get())
+		return 0
+	case len(cmd) == 0:
+		serve(opts)
+		return 0
+	case len(cmd) == 2 && cmd[0] == "config" && cmd[1] == "validate":
+		return configValidate(opts, stdout, stderr)
+	case len(cmd) == 2 && cmd[0] == "config" && cmd[1] == "print":
+		return configPrint(opts, stdout, stderr)
+	case len(cmd) == 2 && cmd[0] == "config" && cmd[1] == "schema":
+		return configSchema(stdout, stderr)
+	default:
+		fs.Usage()
+		return 2
+	}
+}
+
+// configValidate loads and validates the configuration, printing every
+// invalid property.
+func configValidate(opts config.Options, stdout io.Writer, stderr io.Writer) int {
+	loaded, err := config.Load(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to read configuration: %v\n", err)
+		return 1
+	}
+	file := loaded.File
+	if file == "" {
+		file = "no config file"
+	}
+	for _, d := range loaded.Deprecations {
+		fmt.Fprintf(stderr, "%s: warning: %s\n", file, d)
+	}
+
+	if err := validateConfig(loaded.Config); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", file, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", file)
+	return 0
+}
+
+// configPrint prints every property of the effective configuration with
+// where its value comes from, redacting secrets.
+func configPrint(opts config.Options, stdout io.Writer, stderr io.Writer) int {
+	loaded, err := config.Load(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to read configuration: %v\n", err)
+		return 1
+	}
+
+	if loaded.File != "" {
+		fmt.Fprintf(stdout, "# config file: %s\n", loaded.File)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROPERTY\tVALUE\tSOURCE")
+	for _, p := range loaded.Properties() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.Path, p.Value, p.Source)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(stderr, "unable to print configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// configSchema prints the JSON Schema of the configuration.
+func configSchema(stdout io.Writer, stderr io.Writer) int {
+	schema, err := config.Schema()
+	if err != nil {
+		fmt.Fprintf(stderr, "unable to build configuration schema: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s\n", schema)
+	return 0
+}
+
+// validateConfig validates the configuration, including what only the
+// server packages know.
+func validateConfig(c config.AppConfig) error {
+	return c.Validate(checkAuth, checkRateLimit)
+}
+
+func checkAuth(c config.AppConfig, v *config.Validator) {
+	for i, k := range c.Auth.APIKeys {
+		v.CheckErr(auth.ValidateKeys([]config.APIKeyConfig{k}), fmt.Sprintf("auth.apiKeys[%d]", i))
+	}
+	for i, alg := range c.Auth.JWT.Algorithms {
+		v.CheckErr(auth.CheckJWTAlgorithm(alg), fmt.Sprintf("auth.jwt.algorithms[%d]", i))
+	}
+	for i, m := range c.Auth.JWT.ScopeMappings {
+		for j, s := range m.Scopes {
+			_, err := auth.ParseScope(s)
+			v.CheckErr(err, fmt.Sprintf("auth.jwt.scopeMappings[%d].scopes[%d]", i, j))
+		}
+	}
+}
+
+func checkRateLimit(c config.AppConfig, v *config.Validator) {
+	_, err := ratelimit.NewStore(c.RateLimit.Store)
+	v.CheckErr(err, "rateLimit.store")
+}
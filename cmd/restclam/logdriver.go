@@ -16,7 +16,6 @@ type clamdLogDriver struct {
 	logger *zerolog.Logger
 }
 
-//nolint:unused
 func newClamdLogDriver(logger *zerolog.Logger) *clamdLogDriver {
 	return &clamdLogDriver{logger}
 }
@@ -1,22 +1,36 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
 	"github.com/rs/zerolog"
+	"github.com/tomrss/restclam/pkg/backoff"
 	"github.com/tomrss/restclam/pkg/clamd"
 	clamdv0 "github.com/tomrss/restclam/pkg/clamdv0"
 	"github.com/tomrss/restclam/pkg/server"
 	"github.com/tomrss/restclam/pkg/server/api"
 	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/auth"
 	"github.com/tomrss/restclam/pkg/server/config"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
 )
 
 func main() {
-	// read configuration
-	conf, err := config.LoadConfig()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func serve(opts config.Options) {
+	// read and validate configuration, failing fast
+	loaded, err := config.Load(opts)
+	conf := loaded.Config
+	if err == nil {
+		err = validateConfig(conf)
+	}
 	if err != nil {
 		fallbackLogger := httplog.NewLogger("restclam", httplog.Options{JSON: false})
 		fallbackLogger.Fatal().Err(err).Msg("unable to read configuration")
@@ -28,51 +42,124 @@ func main() {
 		Concise:  conf.Log.Concise,
 		JSON:     conf.Log.JSON,
 		Tags:     map[string]string{"environment": conf.Environment},
+		// never log credentials
+		SkipHeaders: []string{conf.Auth.APIKeyHeader},
 	})
+	for _, d := range loaded.Deprecations {
+		logger.Warn().Msg(d)
+	}
+
+	// init authentication
+	authenticator, err := auth.NewAuthenticator(conf.Auth)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to init authentication")
+	}
+
+	// init rate limiting
+	rateLimitStore, err := ratelimit.NewStore(conf.RateLimit.Store)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to init rate limiting")
+	}
+	limiter := ratelimit.NewLimiter(ratelimit.LimitsFromConfig(conf.RateLimit), rateLimitStore)
+
+	// middlewares replaced on configuration reload
+	mws := reloadables{
+		logRequest: middleware.NewReloadable(middleware.LogRequest(conf.Log, logger)),
+		cors:       middleware.NewReloadable(middleware.Cors(conf.Cors)),
+		rateLimit:  middleware.NewReloadable(middleware.RateLimit(conf.RateLimit, limiter)),
+		scanQuota:  middleware.NewReloadable(middleware.ScanQuota(conf.RateLimit, limiter)),
+	}
+	scanQuota := mws.scanQuota.Handler
+
+	lifecycle := server.NewLifecycle(conf.Server.DrainDelay)
+
+	// reload configuration on config file changes and SIGHUP
+	reloader := config.NewReloader(loaded, opts, validateConfig)
+	onReloadServer(reloader, mws, logger, limiter, authenticator.Keys())
 
 	// create router
 	r := chi.NewRouter()
-	r.Use(middleware.LogRequest(conf.Log, logger))
-	r.Use(middleware.Cors(conf.Cors))
-
-	// init clamd client v0 and register apiv0
-	if conf.FeatureFlags.ApiV0 {
-		clamdPool, err := initSessionPool(conf.Clam, logger)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("unable to setup clamd connection pool")
-		}
-		defer clamdPool.Close()
-
-		// middleware that injects clamd sessions in http request handling
-		sessionMiddleware := middleware.ClamdSession(clamdPool)
+	r.Use(mws.logRequest.Handler)
+	r.Use(mws.cors.Handler)
 
-		// register the v0 api
-		r.With(sessionMiddleware).Mount("/api/v0/clamav", api.ClamavV0())
+	// probes are not authenticated
+	r.Get("/healthz", lifecycle.LivenessHandler)
+	r.Get("/readyz", lifecycle.ReadinessHandler)
 
-		logger.Info().Msg("using clamd v0 session pool at /api/v0")
+	// the API description is public, like the source
+	if conf.FeatureFlags.ApiV1 {
+		r.Get("/api/v1/openapi.json", api.HandleOpenAPI)
 	}
 
-	// init clamd client v1 and register apiv1
-	if conf.FeatureFlags.ApiV1 {
-		coordinator, err := runCoordinator(conf.Clam, logger)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("unable to init clamd session coordinator")
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Authenticate(conf.Auth, authenticator, logger))
+		r.Use(mws.rateLimit.Handler)
+
+		// init clamd client v0 and register apiv0
+		if conf.FeatureFlags.ApiV0 {
+			clamdPool, err := initSessionPool(conf.Clam, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("unable to setup clamd connection pool")
+			}
+			lifecycle.OnShutdown("clamd session pool", func(context.Context) error {
+				clamdPool.Close()
+				return nil
+			})
+
+			// middleware that injects clamd sessions in http request handling
+			sessionMiddleware := middleware.ClamdSession(clamdPool)
+
+			// register the v0 api
+			r.With(sessionMiddleware).Mount("/api/v0/clamav", api.ClamavV0(scanQuota))
+
+			logger.Info().Msg("using clamd v0 session pool at /api/v0")
 		}
-		defer coordinator.Shutdown()
 
-		// register the v1 api
-		r.Mount("/api/v1/clamav", api.ClamavV1(coordinator))
+		// init clamd client v1 and register apiv1
+		if conf.FeatureFlags.ApiV1 {
+			tlsConfigs := clamdTLS{}
+			coordinator, err := runCoordinator(conf.Clam, tlsConfigs, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("unable to init clamd session coordinator")
+			}
+			lifecycle.AddCheck("clamd", coordinator.Ready)
+			// jobs scan on the coordinator, drain them first
+			jobs := api.NewJobs()
+			lifecycle.OnShutdown("scan jobs", jobs.Drain)
+			lifecycle.OnShutdown("clamd session coordinator", coordinator.Drain)
+			onReloadCoordinator(reloader, coordinator, tlsConfigs)
 
-		logger.Info().Msg("using clamd v1 session coordinator at /api/v1")
-	}
+			// register the v1 api
+			r.Mount("/api/v1/clamav", api.ClamavV1(coordinator, jobs, scanQuota))
+			r.Mount("/api/v1/admin", api.Admin(coordinator))
+
+			logger.Info().Msg("using clamd v1 session coordinator at /api/v1")
+		}
+	})
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go func() {
+		if err := reloader.Watch(watchCtx); err != nil {
+			logger.Error().Err(err).Msg("unable to watch configuration, reload disabled")
+		}
+	}()
+	lifecycle.OnShutdown("configuration watcher", func(context.Context) error {
+		stopWatching()
+		return nil
+	})
 
 	// start server
-	server.HTTPListenAndServe(r, conf.Server)
+	server.HTTPListenAndServe(r, conf.Server, lifecycle)
 
 	logger.Info().Msg("shutdown completed")
 }
 
 func initSessionPool(c config.ClamConfig, logger zerolog.Logger) (*clamdv0.SessionPool, error) {
+	connectBackoff, err := newBackoff(c.ConnectBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("connectBackoff: %w", err)
+	}
+
 	clamdPool, err := clamdv0.InitSessionPool(clamdv0.SessionPoolOpts{
 		PrewarmthSessions: c.MinWorkers,
 		MaxIdleSessions:   c.MaxWorkers,
@@ -89,11 +176,8 @@ func initSessionPool(c config.ClamConfig, logger zerolog.Logger) (*clamdv0.Sessi
 				Address:           c.Address,
 				HeartbeatInterval: c.HeartbeatInterval,
 				ConnectRetries: clamdv0.RetryOpts{
-					MaxRetries: 10,
-					Backoff: func(retryCount int) time.Duration {
-						// linear backoff (TODO conf)
-						return time.Duration(retryCount) * 2 * time.Second
-					},
+					MaxRetries: c.ConnectMaxRetries,
+					Backoff:    connectBackoff,
 				},
 				CommandRetries: clamdv0.RetryOpts{},
 			})
@@ -103,30 +187,57 @@ func initSessionPool(c config.ClamConfig, logger zerolog.Logger) (*clamdv0.Sessi
 	return clamdPool, err
 }
 
-func runCoordinator(c config.ClamConfig, _ zerolog.Logger) (*clamd.Coordinator, error) {
+func runCoordinator(c config.ClamConfig, tlsConfigs clamdTLS, logger zerolog.Logger) (*clamd.Coordinator, error) {
+	backends, err := clamdBackends(c, tlsConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	backoffs, err := newClamdBackoffs(c)
+	if err != nil {
+		return nil, err
+	}
+
 	coord := clamd.Coordinator{
 		MinWorkers:      c.MinWorkers,
 		MaxWorkers:      c.MaxWorkers,
 		Autoscale:       false,
 		ShutdownTimeout: 10 * time.Second,
+		PriorityWeights: map[clamd.Priority]int{
+			clamd.PriorityInteractive: c.Scheduling.InteractiveWeight,
+			clamd.PriorityBulk:        c.Scheduling.BulkWeight,
+		},
+		MaxQueueWait:     c.Scheduling.MaxQueueWait,
+		MaxQueueLength:   c.Scheduling.MaxQueueLength,
+		MaxAdmissionWait: c.Scheduling.MaxAdmissionWait,
+		JobTimeout:       c.JobTimeout,
+		MaxJobTimeout:    c.MaxJobTimeout,
+		Spool: clamd.SpoolOpts{
+			MemoryLimit: c.Retries.SpoolMemoryLimit,
+			MaxSize:     c.Retries.SpoolMaxSize,
+			Dir:         c.Retries.SpoolDir,
+		},
+		HedgePercentile: c.Retries.HedgePercentile,
+		Breaker: clamd.BreakerOpts{
+			ConsecutiveFailures: c.CircuitBreaker.ConsecutiveFailures,
+			ErrorRate:           c.CircuitBreaker.ErrorRate,
+			Window:              c.CircuitBreaker.Window,
+			Backoff:             backoffs.probe,
+			HalfOpenProbes:      c.CircuitBreaker.HalfOpenProbes,
+		},
+		Logger: newClamdLogDriver(&logger),
 	}
-	err := coord.InitCoordinator(
-		[]clamd.Clamd{{
-			Network:         c.Network,
-			Address:         c.Address,
-			ConnectTimeout:  c.ConnectTimeout,
-			ReadTimeout:     c.ReadTimeout,
-			WriteTimeout:    c.WriteTimeout,
-			StreamChunkSize: c.StreamChunkSize,
-		}},
+	err = coord.InitCoordinator(
+		backends,
 		clamd.SessionOpts{
 			HeartbeatInterval: c.HeartbeatInterval,
 			ConnectRetries: clamd.RetryOpts{
 				MaxRetries: c.ConnectMaxRetries,
-				Backoff: func(retryCount int) time.Duration {
-					// linear backoff (TODO make algorithm configurable)
-					return time.Duration(retryCount) * c.ConnectRetryInterval
-				},
+				Backoff:    backoffs.connect,
+			},
+			CommandRetries: clamd.RetryOpts{
+				MaxRetries: c.Retries.MaxRetries,
+				Backoff:    backoffs.command,
 			},
 		},
 	)
@@ -136,3 +247,86 @@ func runCoordinator(c config.ClamConfig, _ zerolog.Logger) (*clamd.Coordinator,
 
 	return &coord, nil
 }
+
+// clamdBackoffs are the delays between retries towards clamd.
+type clamdBackoffs struct {
+	connect backoff.Func
+	command backoff.Func
+	probe   backoff.Func
+}
+
+func newClamdBackoffs(c config.ClamConfig) (clamdBackoffs, error) {
+	var b clamdBackoffs
+	var err error
+
+	if b.connect, err = newBackoff(c.ConnectBackoff); err != nil {
+		return b, fmt.Errorf("connectBackoff: %w", err)
+	}
+	if b.command, err = newBackoff(c.Retries.Backoff); err != nil {
+		return b, fmt.Errorf("retries.backoff: %w", err)
+	}
+	if b.probe, err = newBackoff(c.CircuitBreaker.Backoff); err != nil {
+		return b, fmt.Errorf("circuitBreaker.backoff: %w", err)
+	}
+	return b, nil
+}
+
+func newBackoff(c config.BackoffConfig) (backoff.Func, error) {
+	return backoff.New(backoff.Config{
+		Strategy:   backoff.Strategy(c.Strategy),
+		Initial:    c.Initial,
+		Max:        c.Max,
+		Multiplier: c.Multiplier,
+	})
+}
+
+// clamdTLS keeps the TLS reloaders of the clamd backends by settings, so
+// that a reload keeps the backends whose TLS settings did not change.  The
+// reloaders pick up certificates rotated in place.  Reloads are serialized,
+// it is not safe for concurrent use.
+type clamdTLS map[config.ClamTLSConfig]*clamd.TLSReloader
+
+func (t clamdTLS) reloader(c config.ClamTLSConfig) (*clamd.TLSReloader, error) {
+	if r, ok := t[c]; ok {
+		return r, nil
+	}
+
+	r, err := clamd.NewTLSReloader(clamd.TLSOpts{
+		CAFile:             c.CAFile,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t[c] = r
+	return r, nil
+}
+
+func clamdBackends(c config.ClamConfig, tlsConfigs clamdTLS) ([]clamd.Clamd, error) {
+	backends := make([]clamd.Clamd, 0, len(c.BackendList()))
+	for _, b := range c.BackendList() {
+		backend := clamd.Clamd{
+			Network:         b.Network,
+			Address:         b.Address,
+			ConnectTimeout:  c.ConnectTimeout,
+			ReadTimeout:     c.ReadTimeout,
+			WriteTimeout:    c.WriteTimeout,
+			StreamChunkSize: c.StreamChunkSize,
+		}
+
+		if b.TLS.Enabled {
+			reloader, err := tlsConfigs.reloader(b.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("backend %s: %w", b.Address, err)
+			}
+			backend.TLSReloader = reloader
+		}
+
+		backends = append(backends, backend)
+	}
+
+	return backends, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
+)
+
+// reloadables are the middlewares replaced when the configuration is
+// reloaded.
+type reloadables struct {
+	logRequest *middleware.Reloadable
+	cors       *middleware.Reloadable
+	rateLimit  *middleware.Reloadable
+	scanQuota  *middleware.Reloadable
+}
+
+// onReloadServer applies live the changes of logging, CORS, rate limits and
+// API keys.
+func onReloadServer(
+	reloader *config.Reloader,
+	mws reloadables,
+	logger zerolog.Logger,
+	limiter *ratelimit.Limiter,
+	keys *auth.KeyStore,
+) {
+	reloader.OnReload("log level", []string{"log.level"}, func(_, c config.AppConfig) (func() error, error) {
+		level, err := zerolog.ParseLevel(strings.ToLower(c.Log.Level))
+		return func() error {
+			zerolog.SetGlobalLevel(level)
+			return nil
+		}, err
+	})
+
+	reloader.OnReload("request logging", []string{"log.logRequests"}, func(_, c config.AppConfig) (func() error, error) {
+		return func() error {
+			mws.logRequest.Set(middleware.LogRequest(c.Log, logger))
+			return nil
+		}, nil
+	})
+
+	reloader.OnReload("cors", []string{"cors"}, func(_, c config.AppConfig) (func() error, error) {
+		return func() error {
+			mws.cors.Set(middleware.Cors(c.Cors))
+			return nil
+		}, nil
+	})
+
+	rateLimits := []string{
+		"rateLimit.enabled",
+		"rateLimit.requestsPerSecond",
+		"rateLimit.burst",
+		"rateLimit.maxConcurrentScans",
+		"rateLimit.bytesPerMinute",
+	}
+	reloader.OnReload("rate limits", rateLimits, func(_, c config.AppConfig) (func() error, error) {
+		return func() error {
+			limiter.SetLimits(ratelimit.LimitsFromConfig(c.RateLimit))
+			mws.rateLimit.Set(middleware.RateLimit(c.RateLimit, limiter))
+			mws.scanQuota.Set(middleware.ScanQuota(c.RateLimit, limiter))
+			return nil
+		}, nil
+	})
+
+	reloader.OnReload("API keys", []string{"auth.apiKeys"}, func(_, c config.AppConfig) (func() error, error) {
+		if err := auth.ValidateKeys(c.Auth.APIKeys); err != nil {
+			return nil, err
+		}
+		return func() error { return keys.SetKeys(c.Auth.APIKeys) }, nil
+	})
+}
+
+// onReloadCoordinator applies live the changes of the clamd backends and of
+// the worker bounds.  Backends with new connection settings get new workers.
+func onReloadCoordinator(reloader *config.Reloader, coordinator *clamd.Coordinator, tlsConfigs clamdTLS) {
+	backends := []string{
+		"clam.network",
+		"clam.address",
+		"clam.tls",
+		"clam.backends",
+		"clam.connectTimeout",
+		"clam.readTimeout",
+		"clam.writeTimeout",
+		"clam.streamChunkSize",
+	}
+	reloader.OnReload("clamd backends", backends, func(_, c config.AppConfig) (func() error, error) {
+		next, err := clamdBackends(c.Clam, tlsConfigs)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return coordinator.SetBackends(next) }, nil
+	})
+
+	workers := []string{"clam.minWorkers", "clam.maxWorkers"}
+	reloader.OnReload("clamd workers", workers, func(_, c config.AppConfig) (func() error, error) {
+		return func() error { return coordinator.Resize(c.Clam.MinWorkers, c.Clam.MaxWorkers) }, nil
+	})
+}
@@ -0,0 +1,130 @@
+// Package backoff computes how long to wait before retrying an operation.
+package backoff
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	// ErrUnknownStrategy is returned for strategies other than the ones
+	// listed in Strategies.
+	ErrUnknownStrategy = errors.New("unknown backoff strategy")
+	// ErrInvalidConfig is returned for negative delays, a cap lower than
+	// the initial delay or a multiplier lower than 1.
+	ErrInvalidConfig = errors.New("invalid backoff config")
+)
+
+// Strategy is how delays grow between retries.
+type Strategy string
+
+const (
+	// Constant waits Initial before every retry.
+	Constant Strategy = "constant"
+	// Linear waits Initial more before every retry.
+	Linear Strategy = "linear"
+	// Exponential multiplies the delay by Multiplier before every retry.
+	Exponential Strategy = "exponential"
+	// DecorrelatedJitter waits a random delay between Initial and
+	// Multiplier times the previous bound, to spread the retries of many
+	// clients failing at once.
+	DecorrelatedJitter Strategy = "decorrelatedJitter"
+)
+
+// Strategies are the supported strategies.
+var Strategies = []Strategy{Constant, Linear, Exponential, DecorrelatedJitter}
+
+const (
+	defaultMultiplier       = 2
+	defaultJitterMultiplier = 3
+)
+
+// Config tunes a backoff strategy.
+type Config struct {
+	Strategy Strategy
+	// Initial is the delay before the first retry, and the step of the
+	// linear strategy
+	Initial time.Duration
+	// Max caps delays, zero means no cap
+	Max time.Duration
+	// Multiplier is the growth of the exponential strategy, 2 by default,
+	// and of the jitter bound, 3 by default
+	Multiplier float64
+}
+
+// Func returns the delay before a retry, counting retries from zero.  It
+// is safe for concurrent use.
+type Func func(retry int) time.Duration
+
+// New returns the backoff function of c.
+func New(c Config) (Func, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	switch c.Strategy {
+	case Constant:
+		return func(int) time.Duration {
+			return c.capped(float64(c.Initial))
+		}, nil
+	case Linear:
+		return func(retry int) time.Duration {
+			return c.capped(float64(c.Initial) * float64(retry+1))
+		}, nil
+	case Exponential:
+		m := c.multiplier(defaultMultiplier)
+		return func(retry int) time.Duration {
+			return c.capped(float64(c.Initial) * math.Pow(m, float64(retry)))
+		}, nil
+	case DecorrelatedJitter:
+		// the previous bound is derived from the retry count rather than
+		// kept between calls, so that the function has no state
+		m := c.multiplier(defaultJitterMultiplier)
+		return func(retry int) time.Duration {
+			bound := c.capped(float64(c.Initial) * math.Pow(m, float64(retry)))
+			if bound <= c.Initial {
+				return bound
+			}
+			return c.Initial + rand.N(bound-c.Initial+1)
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q, expected one of %v", ErrUnknownStrategy, c.Strategy, Strategies)
+	}
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.Initial < 0 || c.Max < 0:
+		return fmt.Errorf("%w: negative delay", ErrInvalidConfig)
+	case c.Max > 0 && c.Max < c.Initial:
+		return fmt.Errorf("%w: max %s lower than initial %s", ErrInvalidConfig, c.Max, c.Initial)
+	case c.Multiplier != 0 && c.Multiplier < 1:
+		return fmt.Errorf("%w: multiplier %g lower than 1", ErrInvalidConfig, c.Multiplier)
+	}
+	return nil
+}
+
+func (c Config) multiplier(def float64) float64 {
+	if c.Multiplier == 0 {
+		return def
+	}
+	return c.Multiplier
+}
+
+// capped converts d to a duration no longer than Max, without overflowing.
+func (c Config) capped(d float64) time.Duration {
+	limit := float64(math.MaxInt64)
+	if c.Max > 0 {
+		limit = float64(c.Max)
+	}
+	if d >= limit {
+		if c.Max > 0 {
+			return c.Max
+		}
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,117 @@
+package backoff
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected []time.Duration
+	}{
+		{
+			name:     "constant",
+			config:   Config{Strategy: Constant, Initial: time.Second},
+			expected: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "linear",
+			config:   Config{Strategy: Linear, Initial: 2 * time.Second},
+			expected: []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second},
+		},
+		{
+			name:     "linear capped",
+			config:   Config{Strategy: Linear, Initial: 2 * time.Second, Max: 5 * time.Second},
+			expected: []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+		{
+			name:     "exponential",
+			config:   Config{Strategy: Exponential, Initial: 100 * time.Millisecond},
+			expected: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			name:     "exponential with multiplier",
+			config:   Config{Strategy: Exponential, Initial: time.Second, Multiplier: 10, Max: time.Minute},
+			expected: []time.Duration{time.Second, 10 * time.Second, time.Minute},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for retry, expected := range tt.expected {
+				if got := f(retry); got != expected {
+					t.Errorf("retry %d: expected %s, got %s", retry, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecorrelatedJitter(t *testing.T) {
+	f, err := New(Config{Strategy: DecorrelatedJitter, Initial: 100 * time.Millisecond, Max: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f(0); got != 100*time.Millisecond {
+		t.Errorf("expected initial delay on first retry, got %s", got)
+	}
+
+	distinct := map[time.Duration]bool{}
+	for range 100 {
+		d := f(2)
+		if d < 100*time.Millisecond || d > 900*time.Millisecond {
+			t.Fatalf("delay %s out of [100ms, 900ms]", d)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 10 {
+		t.Errorf("expected jittered delays, got %d distinct ones", len(distinct))
+	}
+
+	for range 100 {
+		if d := f(50); d > 2*time.Second {
+			t.Fatalf("delay %s over the cap", d)
+		}
+	}
+}
+
+func TestNoOverflow(t *testing.T) {
+	f, err := New(Config{Strategy: Exponential, Initial: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := f(1000); d <= 0 {
+		t.Errorf("expected huge positive delay, got %s", d)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected error
+	}{
+		{"unknown strategy", Config{Strategy: "fibonacci"}, ErrUnknownStrategy},
+		{"empty strategy", Config{Initial: time.Second}, ErrUnknownStrategy},
+		{"negative delay", Config{Strategy: Constant, Initial: -time.Second}, ErrInvalidConfig},
+		{"max below initial", Config{Strategy: Linear, Initial: time.Second, Max: time.Millisecond}, ErrInvalidConfig},
+		{"shrinking", Config{Strategy: Exponential, Initial: time.Second, Multiplier: 0.5}, ErrInvalidConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
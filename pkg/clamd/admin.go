@@ -0,0 +1,413 @@
+package clamd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrUnknownBackend is returned when controlling a backend not
+	// configured.
+	ErrUnknownBackend = errors.New("unknown backend")
+	// ErrUnknownWorker is returned when controlling a worker not running.
+	ErrUnknownWorker = errors.New("unknown worker")
+	// ErrInvalidWorkers is returned when resizing to negative bounds or to
+	// a min greater than max.
+	ErrInvalidWorkers = errors.New("invalid worker bounds")
+)
+
+// WorkerState is what a worker is doing.
+type WorkerState string
+
+const (
+	// WorkerConnecting is opening a session
+	WorkerConnecting WorkerState = "connecting"
+	// WorkerIdle waits for jobs
+	WorkerIdle WorkerState = "idle"
+	// WorkerBusy runs a job
+	WorkerBusy WorkerState = "busy"
+	// WorkerPaused does not take jobs, as its backend is drained or its
+	// circuit is open
+	WorkerPaused WorkerState = "paused"
+	// WorkerDisconnected has no session and waits to open one again
+	WorkerDisconnected WorkerState = "disconnected"
+	// WorkerStopping completes its job, if any, then stops
+	WorkerStopping WorkerState = "stopping"
+)
+
+// WorkerInfo describes a running worker.
+type WorkerInfo struct {
+	ID      uint
+	Backend string
+	State   WorkerState
+	// JobsProcessed is the number of jobs the worker run
+	JobsProcessed uint64
+	// LastHeartbeat is the time of the last successful heartbeat or job,
+	// zero if none yet
+	LastHeartbeat time.Time
+	// CurrentJobAge is how long the running job has been running, zero if
+	// the worker is not busy
+	CurrentJobAge time.Duration
+}
+
+// BackendInfo describes a backend.
+type BackendInfo struct {
+	Address string
+	Circuit BreakerState
+	// Enabled is false for backends drained with DrainBackend
+	Enabled bool
+	// Workers is the number of workers bound to the backend
+	Workers int
+	// InFlight is the number of jobs running on the backend
+	InFlight int
+	// JobsProcessed is the number of jobs the backend run
+	JobsProcessed uint64
+}
+
+// backendState is the runtime state of a backend, shared by its workers.
+type backendState struct {
+	clamd   *Clamd
+	breaker *breaker
+
+	workers   atomic.Int64
+	inFlight  atomic.Int64
+	processed atomic.Uint64
+
+	mu       sync.Mutex
+	disabled bool
+	// toggled is closed, and replaced, when the backend is drained or
+	// enabled again
+	toggled chan struct{}
+}
+
+func newBackendState(clamd *Clamd, opts BreakerOpts, log Logger) *backendState {
+	return &backendState{
+		clamd:   clamd,
+		breaker: newBreaker(clamd.Address, opts, log),
+		toggled: make(chan struct{}),
+	}
+}
+
+// enabled tells if workers can run jobs on the backend, and returns a
+// channel closed when it changes.
+func (b *backendState) enabled() (bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.disabled, b.toggled
+}
+
+func (b *backendState) setEnabled(enabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.disabled == !enabled {
+		return
+	}
+	b.disabled = !enabled
+	close(b.toggled)
+	b.toggled = make(chan struct{})
+}
+
+// usable tells if jobs can be sent to the backend: it has workers, it is
+// enabled and its circuit is not open.
+func (b *backendState) usable() bool {
+	enabled, _ := b.enabled()
+	return enabled && b.workers.Load() > 0 && b.breaker.ready()
+}
+
+func (b *backendState) info() BackendInfo {
+	enabled, _ := b.enabled()
+	return BackendInfo{
+		Address:       b.clamd.Address,
+		Circuit:       b.breaker.State(),
+		Enabled:       enabled,
+		Workers:       int(b.workers.Load()),
+		InFlight:      int(b.inFlight.Load()),
+		JobsProcessed: b.processed.Load(),
+	}
+}
+
+// Workers describes the running workers, by ID.
+func (c *Coordinator) Workers() []WorkerInfo {
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+
+	infos := make([]WorkerInfo, 0, len(c.workers))
+	for _, w := range c.workers {
+		infos = append(infos, w.info())
+	}
+	slices.SortFunc(infos, func(a, b WorkerInfo) int { return int(a.ID) - int(b.ID) })
+	return infos
+}
+
+// Backends describes the backends, in configuration order.
+func (c *Coordinator) Backends() []BackendInfo {
+	backends := c.backendList()
+	infos := make([]BackendInfo, 0, len(backends))
+	for _, b := range backends {
+		infos = append(infos, b.info())
+	}
+	return infos
+}
+
+// DrainBackend stops sending jobs to a backend.  Running jobs complete,
+// and workers keep their sessions to resume quickly with EnableBackend.
+func (c *Coordinator) DrainBackend(address string) error {
+	b, err := c.backend(address)
+	if err != nil {
+		return err
+	}
+
+	b.setEnabled(false)
+	c.Logger.Info().Str("backend", address).Msg("backend drained")
+	return nil
+}
+
+// EnableBackend sends jobs again to a backend drained with DrainBackend.
+func (c *Coordinator) EnableBackend(address string) error {
+	b, err := c.backend(address)
+	if err != nil {
+		return err
+	}
+
+	b.setEnabled(true)
+	c.Logger.Info().Str("backend", address).Msg("backend enabled")
+	return nil
+}
+
+// Resize sets the worker bounds, starting or stopping workers to have
+// MinWorkers running.  Workers are added to the backends with the fewest
+// and removed from the ones with the most, stopping ones complete their
+// job first.
+func (c *Coordinator) Resize(minWorkers int, maxWorkers int) error {
+	if minWorkers < 0 || maxWorkers < minWorkers {
+		return fmt.Errorf("%w: min %d, max %d", ErrInvalidWorkers, minWorkers, maxWorkers)
+	}
+
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+
+	if c.queue.isClosed() {
+		return ErrCoordinatorClosed
+	}
+
+	c.MinWorkers = minWorkers
+	c.MaxWorkers = maxWorkers
+	c.queue.resize(maxWorkers)
+	c.rebalance()
+
+	c.Logger.Info().Int("minWorkers", minWorkers).Int("maxWorkers", maxWorkers).Msg("workers resized")
+	return nil
+}
+
+// SetBackends replaces the backends, spreading MinWorkers among them.
+// Backends are identified by address: the ones kept with the same settings
+// keep their workers and circuit breaker, the workers of the removed ones,
+// and of the ones with new settings, stop after their job.
+func (c *Coordinator) SetBackends(backends []Clamd) error {
+	if len(backends) == 0 {
+		return fmt.Errorf("%w: empty backend list", ErrNoBackend)
+	}
+
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+
+	if c.queue.isClosed() {
+		return ErrCoordinatorClosed
+	}
+
+	current := map[string]*backendState{}
+	for _, b := range c.backendList() {
+		current[b.clamd.Address] = b
+	}
+
+	next := make([]*backendState, 0, len(backends))
+	for i := range backends {
+		address := backends[i].Address
+		b, ok := current[address]
+		delete(current, address)
+		switch {
+		case ok && sameSettings(b.clamd, &backends[i]):
+			next = append(next, b)
+			continue
+		case ok:
+			c.Logger.Info().Str("backend", address).Msg("backend settings changed, replacing workers")
+		default:
+			c.Logger.Info().Str("backend", address).Msg("backend added")
+		}
+		next = append(next, newBackendState(&backends[i], c.Breaker, c.Logger))
+	}
+	c.backends.Store(&next)
+
+	for address := range current {
+		c.Logger.Info().Str("backend", address).Msg("backend removed")
+	}
+	c.rebalance()
+
+	return nil
+}
+
+// sameSettings tells if two backends connect the same way.  TLS configs,
+// TLS reloaders and dialers are compared by identity.
+func sameSettings(a *Clamd, b *Clamd) bool {
+	return a.Network == b.Network &&
+		a.Address == b.Address &&
+		a.ConnectTimeout == b.ConnectTimeout &&
+		a.ReadTimeout == b.ReadTimeout &&
+		a.WriteTimeout == b.WriteTimeout &&
+		a.StreamChunkSize == b.StreamChunkSize &&
+		a.TLS == b.TLS &&
+		a.TLSReloader == b.TLSReloader &&
+		reflect.ValueOf(a.Dialer).Pointer() == reflect.ValueOf(b.Dialer).Pointer()
+}
+
+// rebalance starts and stops workers to have MinWorkers running, spread
+// evenly among the backends.  It must be called holding workersMu.
+func (c *Coordinator) rebalance() {
+	backends := c.backendList()
+	running := make(map[*backendState][]*sessionWorker, len(backends))
+	for _, b := range backends {
+		running[b] = nil
+	}
+
+	count := 0
+	for _, w := range c.workers {
+		if w.stop.Load() {
+			continue
+		}
+		if _, ok := running[w.target]; !ok {
+			// backend removed
+			w.requestStop()
+			continue
+		}
+		running[w.target] = append(running[w.target], w)
+		count++
+	}
+
+	fewest := func() *backendState {
+		return slices.MinFunc(backends, func(a, b *backendState) int {
+			return len(running[a]) - len(running[b])
+		})
+	}
+	most := func() *backendState {
+		return slices.MaxFunc(backends, func(a, b *backendState) int {
+			return len(running[a]) - len(running[b])
+		})
+	}
+	start := func(b *backendState) {
+		running[b] = append(running[b], c.startWorker(b))
+	}
+	stop := func(b *backendState) {
+		last := len(running[b]) - 1
+		running[b][last].requestStop()
+		running[b] = running[b][:last]
+	}
+
+	for ; count < c.MinWorkers; count++ {
+		start(fewest())
+	}
+	for ; count > c.MinWorkers; count-- {
+		stop(most())
+	}
+	for {
+		from, to := most(), fewest()
+		if len(running[from])-len(running[to]) <= 1 {
+			return
+		}
+		stop(from)
+		start(to)
+	}
+}
+
+// RecycleWorker makes a worker END its session and open a new one, after
+// its current job if any.
+func (c *Coordinator) RecycleWorker(id uint) error {
+	c.workersMu.Lock()
+	w, ok := c.workers[id]
+	c.workersMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownWorker, id)
+	}
+
+	w.recycle.Store(true)
+	w.wakeUp()
+	c.Logger.Info().Uint("workerId", id).Msg("worker recycle requested")
+	return nil
+}
+
+// backendList returns the current backends, not to be modified.
+func (c *Coordinator) backendList() []*backendState {
+	return *c.backends.Load()
+}
+
+func (c *Coordinator) backend(address string) (*backendState, error) {
+	for _, b := range c.backendList() {
+		if b.clamd.Address == address {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, address)
+}
+
+// setStatus records what the worker is doing.
+func (w *sessionWorker) setStatus(status WorkerState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if status == WorkerBusy {
+		w.jobStarted = time.Now()
+	} else {
+		w.jobStarted = time.Time{}
+	}
+	if w.stop.Load() {
+		status = WorkerStopping
+	}
+	w.status = status
+}
+
+// alive records a successful heartbeat or job.
+func (w *sessionWorker) alive() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lastHeartbeat = time.Now()
+}
+
+func (w *sessionWorker) info() WorkerInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info := WorkerInfo{
+		ID:            w.id,
+		Backend:       w.backend,
+		State:         w.status,
+		JobsProcessed: w.jobs.Load(),
+		LastHeartbeat: w.lastHeartbeat,
+	}
+	if !w.jobStarted.IsZero() {
+		info.CurrentJobAge = time.Since(w.jobStarted)
+	}
+	return info
+}
+
+func (w *sessionWorker) requestStop() {
+	w.stop.Store(true)
+	w.setStatus(WorkerStopping)
+	w.wakeUp()
+}
+
+// wakeUp makes an idle worker check for recycle and stop requests.
+func (w *sessionWorker) wakeUp() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+		// already kicked
+	}
+}
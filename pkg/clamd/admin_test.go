@@ -0,0 +1,287 @@
+package clamd
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestCoordinator_Introspection(t *testing.T) {
+	first, second := newFakeClamd(t), newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 2, first, second)
+
+	waitFor(t, "workers idle", func() bool {
+		workers := c.Workers()
+		return len(workers) == 2 && workers[0].State == WorkerIdle && workers[1].State == WorkerIdle
+	})
+
+	if _, err := c.Instream(strings.NewReader(clamdtest.EICAR)); err != nil {
+		t.Fatal(err)
+	}
+
+	workers := c.Workers()
+	if workers[0].Backend != first.Address() || workers[1].Backend != second.Address() {
+		t.Errorf("expected a worker per backend, got %+v", workers)
+	}
+	var jobs uint64
+	for _, w := range workers {
+		jobs += w.JobsProcessed
+		if w.JobsProcessed > 0 && w.LastHeartbeat.IsZero() {
+			t.Errorf("expected last heartbeat after a job, got %+v", w)
+		}
+		if w.CurrentJobAge != 0 {
+			t.Errorf("expected no running job, got %+v", w)
+		}
+	}
+	if jobs != 1 {
+		t.Errorf("expected 1 job processed, got %d", jobs)
+	}
+
+	backends := c.Backends()
+	if len(backends) != 2 || backends[0].Address != first.Address() {
+		t.Fatalf("unexpected backends: %+v", backends)
+	}
+	for _, b := range backends {
+		if !b.Enabled || b.Workers != 1 || b.InFlight != 0 || b.Circuit != BreakerClosed {
+			t.Errorf("unexpected backend: %+v", b)
+		}
+	}
+	if backends[0].JobsProcessed+backends[1].JobsProcessed != 1 {
+		t.Errorf("expected 1 job processed, got %+v", backends)
+	}
+}
+
+func TestCoordinator_BusyWorker(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(300 * time.Millisecond)
+	c := newAdminTestCoordinator(t, 1, fake)
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Instream(strings.NewReader("slow"))
+		done <- err
+	}()
+
+	waitFor(t, "worker busy", func() bool {
+		return c.Workers()[0].State == WorkerBusy
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	if age := c.Workers()[0].CurrentJobAge; age < 50*time.Millisecond {
+		t.Errorf("expected current job age of at least 50ms, got %s", age)
+	}
+	if inFlight := c.Backends()[0].InFlight; inFlight != 1 {
+		t.Errorf("expected 1 job in flight, got %d", inFlight)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoordinator_DrainBackend(t *testing.T) {
+	first, second := newFakeClamd(t), newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 2, first, second)
+
+	if err := c.DrainBackend(first.Address()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "worker paused", func() bool {
+		return c.Workers()[0].State == WorkerPaused
+	})
+
+	for range 3 {
+		if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.Scans() != 0 || second.Scans() != 3 {
+		t.Errorf("expected all scans on the enabled backend, got %d and %d", first.Scans(), second.Scans())
+	}
+	if c.Backends()[0].Enabled {
+		t.Error("expected drained backend disabled")
+	}
+
+	if err := c.DrainBackend(second.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Instream(strings.NewReader("clean")); !errors.Is(err, ErrNoBackend) {
+		t.Errorf("expected ErrNoBackend, got %v", err)
+	}
+
+	if err := c.EnableBackend(first.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+		t.Fatal(err)
+	}
+	if first.Scans() != 1 {
+		t.Errorf("expected scan on the enabled backend, got %d", first.Scans())
+	}
+
+	if err := c.DrainBackend("unknown:3310"); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("expected ErrUnknownBackend, got %v", err)
+	}
+}
+
+func TestCoordinator_Resize(t *testing.T) {
+	fake := newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 1, fake)
+
+	if err := c.Resize(3, 4); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "3 workers", func() bool {
+		return len(c.Workers()) == 3
+	})
+	if m := c.Metrics(); m.Workers != 3 {
+		t.Errorf("expected 3 workers in metrics, got %d", m.Workers)
+	}
+
+	if err := c.Resize(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "1 worker", func() bool {
+		return len(c.Workers()) == 1
+	})
+	if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.Resize(-1, 1); !errors.Is(err, ErrInvalidWorkers) {
+		t.Errorf("expected ErrInvalidWorkers, got %v", err)
+	}
+	if err := c.Resize(2, 1); !errors.Is(err, ErrInvalidWorkers) {
+		t.Errorf("expected ErrInvalidWorkers, got %v", err)
+	}
+}
+
+func TestCoordinator_SetBackends(t *testing.T) {
+	first, second, third := newFakeClamd(t), newFakeClamd(t), newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 4, first, second)
+
+	err := c.SetBackends([]Clamd{
+		{Network: second.Network(), Address: second.Address()},
+		{Network: third.Network(), Address: third.Address()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "workers moved", func() bool {
+		backends := c.Backends()
+		return len(c.Workers()) == 4 && backends[0].Workers == 2 && backends[1].Workers == 2
+	})
+	if backends := c.Backends(); backends[0].Address != second.Address() || backends[1].Address != third.Address() {
+		t.Errorf("unexpected backends: %+v", backends)
+	}
+
+	for range 4 {
+		if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.Scans() != 0 {
+		t.Errorf("expected no scans on the removed backend, got %d", first.Scans())
+	}
+
+	if err := c.SetBackends(nil); !errors.Is(err, ErrNoBackend) {
+		t.Errorf("expected ErrNoBackend, got %v", err)
+	}
+}
+
+func TestCoordinator_SetBackendsSettings(t *testing.T) {
+	fake := newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 2, fake)
+	workerIDs := func() []uint {
+		var ids []uint
+		for _, w := range c.Workers() {
+			if w.State != WorkerStopping {
+				ids = append(ids, w.ID)
+			}
+		}
+		return ids
+	}
+	before := workerIDs()
+
+	// same settings, workers kept
+	if err := c.SetBackends([]Clamd{{Network: fake.Network(), Address: fake.Address()}}); err != nil {
+		t.Fatal(err)
+	}
+	if after := workerIDs(); !slices.Equal(before, after) {
+		t.Errorf("expected workers kept, had %v, have %v", before, after)
+	}
+
+	// new settings, workers replaced
+	changed := Clamd{Network: fake.Network(), Address: fake.Address(), ReadTimeout: time.Minute}
+	if err := c.SetBackends([]Clamd{changed}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "workers replaced", func() bool {
+		after := workerIDs()
+		return len(c.Workers()) == 2 && len(after) == 2 && !slices.ContainsFunc(after, func(id uint) bool {
+			return slices.Contains(before, id)
+		})
+	})
+	if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoordinator_RecycleWorker(t *testing.T) {
+	fake := newFakeClamd(t)
+	c := newAdminTestCoordinator(t, 1, fake)
+
+	waitFor(t, "worker idle", func() bool {
+		return c.Workers()[0].State == WorkerIdle
+	})
+	if err := c.RecycleWorker(c.Workers()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake clamd reads END asynchronously
+	waitFor(t, "session recycled", func() bool {
+		opened, ended := fake.Sessions()
+		return opened == 2 && ended == 1
+	})
+	if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.RecycleWorker(42); !errors.Is(err, ErrUnknownWorker) {
+		t.Errorf("expected ErrUnknownWorker, got %v", err)
+	}
+}
+
+// helpers
+
+func newAdminTestCoordinator(t *testing.T, workers int, fakes ...*clamdtest.Server) *Coordinator {
+	t.Helper()
+
+	backends := make([]Clamd, 0, len(fakes))
+	for _, fake := range fakes {
+		backends = append(backends, Clamd{Network: fake.Network(), Address: fake.Address()})
+	}
+
+	c := &Coordinator{MinWorkers: workers, MaxWorkers: workers, ShutdownTimeout: time.Second}
+	if err := c.InitCoordinator(backends, SessionOpts{HeartbeatInterval: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Shutdown)
+
+	return c
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
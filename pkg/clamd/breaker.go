@@ -0,0 +1,339 @@
+package clamd
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerWindow      = 20
+	defaultBreakerOpenTimeout = 10 * time.Second
+	defaultBreakerProbes      = 1
+)
+
+// ErrNoBackend is returned when the circuits of all backends are open.
+var ErrNoBackend = errors.New("no clamd backend available")
+
+// BreakerState is the state of the circuit breaker of a backend.
+type BreakerState int
+
+const (
+	// BreakerClosed lets jobs run on the backend
+	BreakerClosed BreakerState = iota
+	// BreakerOpen keeps jobs off the backend until OpenTimeout elapses
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe jobs run on the backend, closing
+	// the circuit if they succeed and opening it again otherwise
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerOpts configures the circuit breakers of the backends.  Failures
+// are transport errors and job timeouts, not scans finding a virus or
+// failing on the content.  With neither ConsecutiveFailures nor ErrorRate
+// set, circuits are always closed.
+type BreakerOpts struct {
+	// ConsecutiveFailures opens the circuit after as many failures in a
+	// row, zero disables the check
+	ConsecutiveFailures int
+	// ErrorRate opens the circuit when the share of failures among the
+	// last Window outcomes exceeds it, zero disables the check
+	ErrorRate float64
+	// Window is how many outcomes the error rate is computed on, 20 by
+	// default.  The error rate is not checked before the window is full
+	Window int
+	// OpenTimeout is how long the circuit stays open before probing the
+	// backend again, 10s by default
+	OpenTimeout time.Duration
+	// Backoff, if set, replaces OpenTimeout with a timeout growing every
+	// time probes fail, counting from zero when the circuit opens
+	Backoff func(retryCount int) time.Duration
+	// HalfOpenProbes is how many jobs probe a half-open backend at once,
+	// and how many must succeed to close the circuit, 1 by default
+	HalfOpenProbes int
+}
+
+func (o BreakerOpts) enabled() bool {
+	return o.ConsecutiveFailures > 0 || o.ErrorRate > 0
+}
+
+// breaker is the circuit breaker shared by the workers of a backend.
+type breaker struct {
+	backend string
+	opts    BreakerOpts
+	log     Logger
+	now     func() time.Time
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	outcomes    []bool
+	next        int
+	failures    int
+	openedAt    time.Time
+	openFor     time.Duration
+	reopens     int
+	probes      int
+	probed      int
+	// changed is closed, and replaced, on every transition
+	changed chan struct{}
+}
+
+func newBreaker(backend string, opts BreakerOpts, log Logger) *breaker {
+	if opts.Window <= 0 {
+		opts.Window = defaultBreakerWindow
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = defaultBreakerProbes
+	}
+
+	return &breaker{
+		backend: backend,
+		opts:    opts,
+		log:     log,
+		now:     time.Now,
+		changed: make(chan struct{}),
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	return b.state
+}
+
+// ready tells if the backend may be contacted, i.e. the circuit is not
+// open.
+func (b *breaker) ready() bool {
+	return b.State() != BreakerOpen
+}
+
+// acquire tells if a job can run on the backend.  When half-open, the job
+// is a probe and its slot must be given back with done or release.
+func (b *breaker) acquire() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	switch b.state {
+	case BreakerClosed:
+		return false, true
+	case BreakerHalfOpen:
+		if b.probes >= b.opts.HalfOpenProbes {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// release gives back the slot of a job acquired but not run.
+func (b *breaker) release(probe bool) {
+	if !probe {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// done records the outcome of a job acquired with acquire.
+func (b *breaker) done(probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+	b.record(failed)
+}
+
+// failure records a failure outside of jobs, like a missed heartbeat.
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.record(true)
+}
+
+// wait returns how long the circuit stays open, zero if it is not, and a
+// channel closed on the next transition.
+func (b *breaker) wait() (time.Duration, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+	if b.state != BreakerOpen {
+		return 0, b.changed
+	}
+	return b.openFor - b.now().Sub(b.openedAt), b.changed
+}
+
+func (b *breaker) record(failed bool) {
+	if !b.opts.enabled() {
+		return
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.reopens++
+			b.open("probe failed")
+			return
+		}
+		b.probed++
+		if b.probed >= b.opts.HalfOpenProbes {
+			b.transition(BreakerClosed, "probes succeeded")
+		}
+	case BreakerClosed:
+		b.observe(failed)
+		if b.tripped() {
+			b.open("too many failures")
+		}
+	default:
+		// late outcome of a job started before the circuit opened
+	}
+}
+
+// observe adds an outcome to the consecutive failures and to the window.
+func (b *breaker) observe(failed bool) {
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	if len(b.outcomes) < b.opts.Window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.opts.Window
+	}
+	if failed {
+		b.failures++
+	}
+}
+
+func (b *breaker) tripped() bool {
+	if b.opts.ConsecutiveFailures > 0 && b.consecutive >= b.opts.ConsecutiveFailures {
+		return true
+	}
+	return b.opts.ErrorRate > 0 &&
+		len(b.outcomes) == b.opts.Window &&
+		b.errorRate() > b.opts.ErrorRate
+}
+
+func (b *breaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	return float64(b.failures) / float64(len(b.outcomes))
+}
+
+func (b *breaker) open(reason string) {
+	b.openedAt = b.now()
+	b.openFor = b.opts.OpenTimeout
+	if b.opts.Backoff != nil {
+		b.openFor = b.opts.Backoff(b.reopens)
+	}
+	b.transition(BreakerOpen, reason)
+}
+
+// expire turns an open circuit to half-open once its timeout elapsed.
+func (b *breaker) expire() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openFor {
+		b.transition(BreakerHalfOpen, "open timeout elapsed")
+	}
+}
+
+func (b *breaker) transition(to BreakerState, reason string) {
+	from := b.state
+	b.state = to
+	b.probes = 0
+	b.probed = 0
+
+	var event LogEvent
+	switch to {
+	case BreakerOpen:
+		event = b.log.Warn().
+			Int("consecutiveFailures", b.consecutive).
+			Str("errorRate", strconv.FormatFloat(b.errorRate(), 'f', 2, 64)).
+			Str("openTimeout", b.openFor.String())
+	case BreakerClosed:
+		b.reopens = 0
+		b.consecutive = 0
+		b.outcomes = b.outcomes[:0]
+		b.next = 0
+		b.failures = 0
+		event = b.log.Info()
+	default:
+		event = b.log.Info()
+	}
+	event.
+		Str("backend", b.backend).
+		Str("from", from.String()).
+		Str("to", to.String()).
+		Str("reason", reason).
+		Msg("circuit breaker state changed")
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// available tells if some backend with workers is enabled and has a
+// circuit not open.
+func (c *Coordinator) available() bool {
+	for _, b := range c.backendList() {
+		if b.usable() {
+			return true
+		}
+	}
+	return false
+}
+
+// Circuits returns the state of the circuit breaker of each backend, by
+// address.
+func (c *Coordinator) Circuits() map[string]BreakerState {
+	backends := c.backendList()
+	circuits := make(map[string]BreakerState, len(backends))
+	for _, b := range backends {
+		circuits[b.clamd.Address] = b.breaker.State()
+	}
+	return circuits
+}
+
+// backendFailed tells if a job failed because of the backend, rather than
+// of the coordinator or the caller: dial, write and reply errors and job
+// timeouts.
+func backendFailed(err error) bool {
+	return errors.Is(err, ErrJobTimeout) || retryable(err)
+}
@@ -0,0 +1,287 @@
+package clamd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	b, clock := newTestBreaker(BreakerOpts{ConsecutiveFailures: 3, OpenTimeout: 10 * time.Second})
+
+	b.done(false, true)
+	b.done(false, true)
+	b.done(false, false)
+	b.done(false, true)
+	b.done(false, true)
+	if state := b.State(); state != BreakerClosed {
+		t.Fatalf("expected closed circuit after non consecutive failures, got %s", state)
+	}
+
+	b.done(false, true)
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("expected open circuit, got %s", state)
+	}
+	if _, ok := b.acquire(); ok {
+		t.Error("open circuit must not run jobs")
+	}
+	if wait, _ := b.wait(); wait != 10*time.Second {
+		t.Errorf("expected to wait 10s, got %s", wait)
+	}
+
+	*clock = clock.Add(10 * time.Second)
+	probe, ok := b.acquire()
+	if !probe || !ok {
+		t.Fatal("expected a probe on half-open circuit")
+	}
+	if _, ok := b.acquire(); ok {
+		t.Error("expected one probe at a time")
+	}
+
+	b.done(probe, false)
+	if state := b.State(); state != BreakerClosed {
+		t.Errorf("expected closed circuit after successful probe, got %s", state)
+	}
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b, _ := newTestBreaker(BreakerOpts{ErrorRate: 0.5, Window: 10})
+
+	// half of the window fails
+	for i := range 10 {
+		b.done(false, i%2 == 1)
+	}
+	if state := b.State(); state != BreakerClosed {
+		t.Fatalf("expected closed circuit at error rate 0.5, got %s", state)
+	}
+
+	b.done(false, true)
+	if state := b.State(); state != BreakerOpen {
+		t.Errorf("expected open circuit at error rate 0.6, got %s", state)
+	}
+}
+
+func TestBreaker_ProbeFailure(t *testing.T) {
+	b, clock := newTestBreaker(BreakerOpts{ConsecutiveFailures: 1, OpenTimeout: time.Second})
+
+	b.failure()
+	*clock = clock.Add(time.Second)
+
+	probe, ok := b.acquire()
+	if !ok {
+		t.Fatal("expected a probe on half-open circuit")
+	}
+	b.done(probe, true)
+
+	if state := b.State(); state != BreakerOpen {
+		t.Errorf("expected circuit open again, got %s", state)
+	}
+	if wait, _ := b.wait(); wait != time.Second {
+		t.Errorf("expected open timeout restarted, got %s", wait)
+	}
+}
+
+func TestBreaker_Backoff(t *testing.T) {
+	b, clock := newTestBreaker(BreakerOpts{
+		ConsecutiveFailures: 1,
+		Backoff: func(retryCount int) time.Duration {
+			return time.Duration(retryCount+1) * time.Second
+		},
+	})
+
+	b.failure()
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		wait, _ := b.wait()
+		if wait != expected {
+			t.Errorf("expected open for %s, got %s", expected, wait)
+		}
+
+		*clock = clock.Add(wait)
+		probe, _ := b.acquire()
+		b.done(probe, true)
+	}
+
+	// a successful probe starts over
+	*clock = clock.Add(4 * time.Second)
+	probe, _ := b.acquire()
+	b.done(probe, false)
+	b.failure()
+	if wait, _ := b.wait(); wait != time.Second {
+		t.Errorf("expected backoff reset, got %s", wait)
+	}
+}
+
+func TestBreaker_Disabled(t *testing.T) {
+	b, _ := newTestBreaker(BreakerOpts{})
+
+	for range 100 {
+		b.failure()
+	}
+	if state := b.State(); state != BreakerClosed {
+		t.Errorf("expected disabled breaker always closed, got %s", state)
+	}
+}
+
+func TestCoordinator_CircuitOpen(t *testing.T) {
+	broken := newFakeClamd(t)
+	broken.DropScans(1000)
+	healthy := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      2,
+		MaxWorkers:      2,
+		ShutdownTimeout: time.Second,
+		Breaker:         BreakerOpts{ConsecutiveFailures: 2, OpenTimeout: time.Minute},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{
+			{Network: broken.Network(), Address: broken.Address()},
+			{Network: healthy.Network(), Address: healthy.Address()},
+		},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// until the broken backend fails enough
+	path := tempfile(t, "clean")
+	for range 100 {
+		if c.Circuits()[broken.Address()] == BreakerOpen {
+			break
+		}
+		_, _ = c.Scan(path)
+	}
+	if state := c.Circuits()[broken.Address()]; state != BreakerOpen {
+		t.Fatalf("expected open circuit of broken backend, got %s", state)
+	}
+
+	for range 5 {
+		scan, err := c.Scan(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scan.Metadata.Backend != healthy.Address() {
+			t.Errorf("expected scan by healthy backend, got %s", scan.Metadata.Backend)
+		}
+	}
+}
+
+func TestCoordinator_NoBackend(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.DropScans(1000)
+
+	c := Coordinator{
+		MinWorkers:      1,
+		MaxWorkers:      1,
+		ShutdownTimeout: time.Second,
+		Breaker:         BreakerOpts{ConsecutiveFailures: 1, OpenTimeout: time.Minute},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if _, err := c.Instream(strings.NewReader("dropped")); err == nil {
+		t.Fatal("expected transport error")
+	}
+
+	start := time.Now()
+	_, err = c.Instream(strings.NewReader("fail fast"))
+	if !errors.Is(err, ErrNoBackend) {
+		t.Errorf("expected ErrNoBackend, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected immediate failure, took %s", elapsed)
+	}
+}
+
+func TestCoordinator_UploadErrorKeepsCircuitClosed(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      1,
+		MaxWorkers:      1,
+		ShutdownTimeout: time.Second,
+		Breaker:         BreakerOpts{ConsecutiveFailures: 1, OpenTimeout: time.Minute},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{
+			HeartbeatInterval: time.Minute,
+			CommandRetries:    RetryOpts{MaxRetries: 2},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	for range 3 {
+		upload := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("client gone")))
+		if _, err := c.Instream(upload); !errors.Is(err, ErrUpload) {
+			t.Fatalf("expected ErrUpload, got %v", err)
+		}
+	}
+
+	if state := c.Circuits()[fake.Address()]; state != BreakerClosed {
+		t.Errorf("expected closed circuit after upload errors, got %s", state)
+	}
+	if retries := c.Metrics().Retries; retries != 0 {
+		t.Errorf("expected upload errors not retried, got %d retries", retries)
+	}
+	if _, err := c.Instream(strings.NewReader("clean")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoordinator_SpooledUploadError(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      1,
+		MaxWorkers:      1,
+		ShutdownTimeout: time.Second,
+		Spool:           SpoolOpts{MemoryLimit: 4, MaxSize: 1024, Dir: t.TempDir()},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{
+			HeartbeatInterval: time.Minute,
+			CommandRetries:    RetryOpts{MaxRetries: 2},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// failing in memory and on disk
+	for _, partial := range []string{"", "partial"} {
+		upload := io.MultiReader(strings.NewReader(partial), iotest.ErrReader(errors.New("client gone")))
+		if _, err := c.Instream(upload); !errors.Is(err, ErrUpload) {
+			t.Errorf("expected ErrUpload spooling %q, got %v", partial, err)
+		}
+	}
+
+	if state := c.Circuits()[fake.Address()]; state != BreakerClosed {
+		t.Errorf("expected closed circuit after upload errors, got %s", state)
+	}
+}
+
+// helpers
+
+func newTestBreaker(opts BreakerOpts) (*breaker, *time.Time) {
+	clock := time.Now()
+	b := newBreaker("test", opts, &noopLogger{})
+	b.now = func() time.Time { return clock }
+	return b, &clock
+}
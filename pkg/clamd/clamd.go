@@ -1,6 +1,9 @@
 package clamd
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -14,6 +17,9 @@ const (
 	defaultStreamChunkSize int           = 2048
 )
 
+// DialFunc opens the transport connection to clamd.
+type DialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
 type Clamd struct {
 	Network         string
 	Address         string
@@ -21,6 +27,15 @@ type Clamd struct {
 	ReadTimeout     time.Duration
 	WriteTimeout    time.Duration
 	StreamChunkSize int
+
+	// TLS, if not nil, secures the connection to clamd
+	TLS *tls.Config
+	// TLSReloader, if not nil, secures the connection to clamd in place
+	// of TLS, with the certificates of its files as they change
+	TLSReloader *TLSReloader
+	// Dialer, if not nil, replaces the default dialer, e.g. to inject a
+	// custom transport
+	Dialer DialFunc
 }
 
 func Connect(network string, address string) (*Connection, error) {
@@ -37,6 +52,12 @@ func Connect(network string, address string) (*Connection, error) {
 }
 
 func (c *Clamd) Connect() (*Connection, error) {
+	// workers share the backend, defaults apply to a copy
+	cfg := c.withDefaults()
+	return cfg.connect()
+}
+
+func (c Clamd) withDefaults() Clamd {
 	if c.ConnectTimeout == 0 {
 		c.ConnectTimeout = defaultConnectTimeout
 	}
@@ -49,8 +70,11 @@ func (c *Clamd) Connect() (*Connection, error) {
 	if c.StreamChunkSize == 0 {
 		c.StreamChunkSize = defaultStreamChunkSize
 	}
+	return c
+}
 
-	conn, err := net.DialTimeout(c.Network, c.Address, c.ConnectTimeout)
+func (c *Clamd) connect() (*Connection, error) {
+	conn, err := c.dial()
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrClamd, err)
 	}
@@ -60,9 +84,51 @@ func (c *Clamd) Connect() (*Connection, error) {
 		writeTimeout:    c.WriteTimeout,
 		streamChunkSize: c.StreamChunkSize,
 		conn:            conn,
+		reader:          bufio.NewReader(conn),
 	}, nil
 }
 
+func (c *Clamd) dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ConnectTimeout)
+	defer cancel()
+
+	dial := c.Dialer
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	conn, err := dial(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.TLS
+	if c.TLSReloader != nil {
+		cfg = c.TLSReloader.Config()
+	}
+	if cfg == nil {
+		return conn, nil
+	}
+
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		// verify the server certificate against the host we connect to
+		cfg = cfg.Clone()
+		if host, _, err := net.SplitHostPort(c.Address); err == nil {
+			cfg.ServerName = host
+		} else {
+			cfg.ServerName = c.Address
+		}
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	return tlsConn, nil
+}
+
 func (c *Clamd) Ping() (string, error) {
 	conn, err := c.Connect()
 	if err != nil {
@@ -96,6 +162,27 @@ func (c *Clamd) Stats() (string, error) {
 	return stats, err
 }
 
+func (c *Clamd) Reload() (string, error) {
+	conn, err := c.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, reply, err := conn.Reload()
+	return reply, err
+}
+
+func (c *Clamd) Shutdown() error {
+	conn, err := c.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Shutdown()
+}
+
 func (c *Clamd) Scan(path string) (*ScanResult, error) {
 	conn, err := c.Connect()
 	if err != nil {
@@ -0,0 +1,360 @@
+// Package clamdtest provides an in-process fake clamd, speaking enough of the
+// clamd protocol to exercise clients without a real ClamAV installation.
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EICAR is the standard antivirus test file.
+	EICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+	// EICARSignature is the signature name reported when EICAR is found.
+	EICARSignature = "Win.Test.EICAR_HDB-1"
+
+	// Version is the VERSION reply of the fake clamd.
+	Version = "ClamAV 1.4.2/27500/Mon Jan  6 09:00:00 2025"
+
+	maxChunkSize = 25 * 1024 * 1024
+)
+
+const stats = `POOLS: 1
+
+STATE: VALID PRIMARY
+THREADS: live 1 idle 0 max 12 idle-timeout 30
+QUEUE: 0 items
+STATS 0.000011
+
+MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1369.103M pools_total 1369.152M
+END`
+
+// Server is a fake clamd listening on a local TCP port.
+type Server struct {
+	listener    net.Listener
+	mu          sync.Mutex
+	conns       map[net.Conn]struct{}
+	scans       int
+	scanDelay   time.Duration
+	streamDelay time.Duration
+	drops       int
+	sessions    int
+	ended       int
+	closed      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewServer starts a fake clamd on a random local TCP port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return newServer(l), nil
+}
+
+// NewTLSServer starts a fake clamd on a random local TCP port, behind TLS
+// like a clamd fronted by stunnel.
+func NewTLSServer(config *tls.Config) (*Server, error) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newServer(l), nil
+}
+
+func newServer(l net.Listener) *Server {
+	s := &Server{
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Network returns the network of the fake clamd listener.
+func (s *Server) Network() string {
+	return s.listener.Addr().Network()
+}
+
+// Address returns the address of the fake clamd listener.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// SetScanDelay sets how long to wait before replying to every SCAN or
+// INSTREAM, e.g. to simulate a slow or stuck clamd.
+func (s *Server) SetScanDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scanDelay = d
+}
+
+// SetStreamDelay sets how long to wait before reading the content of every
+// INSTREAM, e.g. to simulate a clamd too busy to read uploads.
+func (s *Server) SetStreamDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streamDelay = d
+}
+
+// DropScans makes the next n SCAN or INSTREAM drop the connection instead
+// of replying, like a crashing clamd.
+func (s *Server) DropScans(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drops = n
+}
+
+// Scans returns the number of SCAN and INSTREAM commands served so far.
+func (s *Server) Scans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.scans
+}
+
+// Sessions returns the number of sessions opened with IDSESSION and the
+// number of them ended with END.
+func (s *Server) Sessions() (opened int, ended int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions, s.ended
+}
+
+// Close stops the listener and drops every open connection.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	close(s.closed)
+
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// handle serves one connection, either a single command or a whole
+// IDSESSION.
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	session := false
+	requestID := 0
+
+	for {
+		cmd, terminator, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		if cmd == "IDSESSION" {
+			session = true
+			s.count(&s.sessions)
+			continue
+		}
+		if cmd == "END" && session {
+			s.count(&s.ended)
+		}
+		if cmd == "END" || cmd == "SHUTDOWN" {
+			return
+		}
+
+		requestID++
+		replies, err := s.execute(cmd, r)
+		for _, reply := range replies {
+			if session {
+				reply = fmt.Sprintf("%d: %s", requestID, reply)
+			}
+			if _, err := conn.Write(append([]byte(reply), terminator)); err != nil {
+				return
+			}
+		}
+		if err != nil || !session {
+			return
+		}
+	}
+}
+
+func (s *Server) execute(cmd string, r *bufio.Reader) ([]string, error) {
+	switch {
+	case cmd == "PING":
+		return []string{"PONG"}, nil
+	case cmd == "VERSION":
+		return []string{Version}, nil
+	case cmd == "STATS":
+		return []string{stats}, nil
+	case cmd == "RELOAD":
+		return []string{"RELOADING"}, nil
+	case strings.HasPrefix(cmd, "SCAN "):
+		path := strings.TrimPrefix(cmd, "SCAN ")
+		if s.drop() {
+			return nil, errDropped
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			msg := fmt.Sprintf("%s: lstat() failed: No such file or directory. ERROR", path)
+			return []string{msg, msg}, nil
+		}
+		return []string{s.verdict(path, content)}, nil
+	case cmd == "INSTREAM":
+		s.wait(func() time.Duration { return s.streamDelay })
+		content, err := readStream(r)
+		if err != nil {
+			return []string{"INSTREAM size limit exceeded. ERROR"}, err
+		}
+		if s.drop() {
+			return nil, errDropped
+		}
+		return []string{s.verdict("stream", content)}, nil
+	default:
+		return []string{"UNKNOWN COMMAND"}, nil
+	}
+}
+
+func (s *Server) count(counter *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*counter++
+}
+
+// wait sleeps for the delay, unless the server is closed first.
+func (s *Server) wait(delay func() time.Duration) {
+	s.mu.Lock()
+	d := delay()
+	s.mu.Unlock()
+
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-s.closed:
+	}
+}
+
+func (s *Server) drop() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.drops == 0 {
+		return false
+	}
+	s.drops--
+	return true
+}
+
+func (s *Server) verdict(name string, content []byte) string {
+	s.count(&s.scans)
+	s.wait(func() time.Duration { return s.scanDelay })
+
+	if bytes.Contains(content, []byte(EICAR)) {
+		return fmt.Sprintf("%s: %s FOUND", name, EICARSignature)
+	}
+	return name + ": OK"
+}
+
+// readCommand reads a 'z' (null terminated) or 'n' (newline terminated)
+// command and returns it along with the terminator to use in replies.
+func readCommand(r *bufio.Reader) (string, byte, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var terminator byte
+	switch prefix {
+	case 'z':
+		terminator = 0x00
+	case 'n':
+		terminator = '\n'
+	default:
+		return "", 0, fmt.Errorf("%w: prefix %q", errUnsupportedCommand, prefix)
+	}
+
+	cmd, err := r.ReadString(terminator)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return strings.TrimSuffix(cmd, string(terminator)), terminator, nil
+}
+
+var (
+	errUnsupportedCommand = errors.New("unsupported command")
+	errChunkTooLarge      = errors.New("stream chunk too large")
+	errDropped            = errors.New("connection dropped")
+)
+
+func readStream(r *bufio.Reader) ([]byte, error) {
+	var content bytes.Buffer
+	size := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return nil, err
+		}
+
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			return content.Bytes(), nil
+		}
+		if n > maxChunkSize {
+			return nil, errChunkTooLarge
+		}
+
+		if _, err := io.CopyN(&content, r, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -26,6 +26,10 @@ const (
 
 var ErrClamd = errors.New("clamd error")
 
+// ErrUpload is returned when the content to scan cannot be read, a failure
+// of the caller rather than of clamd.
+var ErrUpload = errors.New("unable to read upload")
+
 type ScanStatus string
 
 const (
@@ -41,6 +45,7 @@ type ScanResult struct {
 	Virus    string
 	FileName string
 	Details  []string
+	Metadata ScanMetadata
 }
 
 type Connection struct {
@@ -48,7 +53,8 @@ type Connection struct {
 	writeTimeout    time.Duration
 	streamChunkSize int
 
-	conn net.Conn
+	conn   net.Conn
+	reader *bufio.Reader
 }
 
 func (c *Connection) Close() error {
@@ -70,6 +76,15 @@ func (c *Connection) Stats() (int, string, error) {
 	return c.simpleCommand("STATS")
 }
 
+func (c *Connection) Reload() (int, string, error) {
+	return c.simpleCommand("RELOAD")
+}
+
+// Shutdown stops clamd, which closes the connection without replying.
+func (c *Connection) Shutdown() error {
+	return c.sendCommand("SHUTDOWN")
+}
+
 func (c *Connection) Scan(path string) (int, *ScanResult, error) {
 	if err := c.sendCommand("SCAN " + path); err != nil {
 		return -1, nil, err
@@ -92,7 +107,7 @@ func (c *Connection) Instream(r io.Reader) (int, *ScanResult, error) {
 		// begin read with offset 4 because 4 bytes are reserved to chunk length
 		n, err := r.Read(buf[4:])
 		if err != nil && err != io.EOF {
-			return -1, nil, fmt.Errorf("%w: error reading stream chunk: %w", ErrClamd, err)
+			return -1, nil, fmt.Errorf("%w: error reading stream chunk: %w", ErrUpload, err)
 		}
 		if n == 0 {
 			// end of read
@@ -162,10 +177,8 @@ func (c *Connection) recvLine() (string, error) {
 		return "", fmt.Errorf("%w: unable to set read timeout: %w", ErrClamd, err)
 	}
 
-	r := bufio.NewReader(c.conn)
-
 	var ignoreEOF error
-	line, err := r.ReadString(cmdTerminator)
+	line, err := c.reader.ReadString(cmdTerminator)
 	if err == io.EOF {
 		// nothing to do
 		ignoreEOF = nil
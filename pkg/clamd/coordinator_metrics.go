@@ -0,0 +1,158 @@
+package clamd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shedLogInterval throttles overload logs, one per interval at most
+	shedLogInterval = time.Second
+	// jobDurationWeight is the weight of the last job in the moving
+	// average of job durations
+	jobDurationWeight = 0.1
+
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
+)
+
+// CoordinatorMetrics are counters and gauges of a Coordinator.
+type CoordinatorMetrics struct {
+	// Workers is the number of running session workers
+	Workers int
+	// QueueLength is the number of jobs waiting for a worker
+	QueueLength int
+	// Submitted is the number of jobs submitted, rejected ones included
+	Submitted uint64
+	// Completed is the number of jobs run by a worker
+	Completed uint64
+	// Shed is the number of jobs rejected with ErrOverloaded
+	Shed uint64
+	// QueueTimeouts is the number of jobs failed with ErrQueueTimeout
+	QueueTimeouts uint64
+	// JobTimeouts is the number of jobs aborted with ErrJobTimeout
+	JobTimeouts uint64
+	// Retries is the number of jobs run again after transport errors
+	Retries uint64
+	// Hedges is the number of duplicates of slow jobs
+	Hedges uint64
+	// Cancelled is the number of jobs whose context was done while queued
+	Cancelled uint64
+	// Clean is the number of scans that found no virus
+	Clean uint64
+	// Infected is the number of scans that found a virus
+	Infected uint64
+	// ScanErrors is the number of scans that clamd answered with an error
+	ScanErrors uint64
+	// AvgJobDuration is the moving average of the time workers take to
+	// run a job
+	AvgJobDuration time.Duration
+}
+
+type coordinatorMetrics struct {
+	workers       atomic.Int64
+	submitted     atomic.Uint64
+	completed     atomic.Uint64
+	shed          atomic.Uint64
+	queueTimeouts atomic.Uint64
+	jobTimeouts   atomic.Uint64
+	retries       atomic.Uint64
+	hedges        atomic.Uint64
+	cancelled     atomic.Uint64
+	clean         atomic.Uint64
+	infected      atomic.Uint64
+	scanErrors    atomic.Uint64
+	scanLatencies latencyWindow
+
+	mu             sync.Mutex
+	avgJobDuration time.Duration
+	lastShedLog    time.Time
+	shedSinceLog   uint
+}
+
+// jobCompleted counts a job run by a worker in d.
+func (m *coordinatorMetrics) jobCompleted(d time.Duration) {
+	m.completed.Add(1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.avgJobDuration == 0 {
+		m.avgJobDuration = d
+		return
+	}
+	m.avgJobDuration += time.Duration(jobDurationWeight * float64(d-m.avgJobDuration))
+}
+
+// scanned counts the verdict of a scan, once per scan whatever the retries
+// and hedges.
+func (m *coordinatorMetrics) scanned(result *ScanResult) {
+	if result == nil {
+		return
+	}
+	switch result.Status {
+	case StatusOK:
+		m.clean.Add(1)
+	case StatusFound:
+		m.infected.Add(1)
+	case StatusError:
+		m.scanErrors.Add(1)
+	}
+}
+
+// jobShed counts a job rejected with ErrOverloaded.  It returns how many
+// jobs were shed since the last time it returned true, which happens at
+// most once per shedLogInterval to not flood logs under overload.
+func (m *coordinatorMetrics) jobShed() (uint, bool) {
+	m.shed.Add(1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shedSinceLog++
+	if time.Since(m.lastShedLog) < shedLogInterval {
+		return 0, false
+	}
+
+	n := m.shedSinceLog
+	m.shedSinceLog = 0
+	m.lastShedLog = time.Now()
+	return n, true
+}
+
+func (m *coordinatorMetrics) avgJob() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.avgJobDuration
+}
+
+// Metrics returns the current metrics of the coordinator.
+func (c *Coordinator) Metrics() CoordinatorMetrics {
+	return CoordinatorMetrics{
+		Workers:        int(c.metrics.workers.Load()),
+		QueueLength:    c.queue.len(),
+		Submitted:      c.metrics.submitted.Load(),
+		Completed:      c.metrics.completed.Load(),
+		Shed:           c.metrics.shed.Load(),
+		QueueTimeouts:  c.metrics.queueTimeouts.Load(),
+		JobTimeouts:    c.metrics.jobTimeouts.Load(),
+		Retries:        c.metrics.retries.Load(),
+		Hedges:         c.metrics.hedges.Load(),
+		Cancelled:      c.metrics.cancelled.Load(),
+		Clean:          c.metrics.clean.Load(),
+		Infected:       c.metrics.infected.Load(),
+		ScanErrors:     c.metrics.scanErrors.Load(),
+		AvgJobDuration: c.metrics.avgJob(),
+	}
+}
+
+// RetryAfter estimates when an overloaded coordinator may accept jobs
+// again, i.e. the time workers take to run the queued jobs.
+func (c *Coordinator) RetryAfter() time.Duration {
+	workers := max(c.metrics.workers.Load(), 1)
+	drain := time.Duration(int64(c.queue.len()) * int64(c.metrics.avgJob()) / workers)
+
+	return min(max(drain, minRetryAfter), maxRetryAfter)
+}
@@ -0,0 +1,97 @@
+package clamd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sniffLen is the number of bytes used to detect the MIME type, see
+// http.DetectContentType.
+const sniffLen = 512
+
+// ScanMetadata describes how and what a scan was performed on.
+type ScanMetadata struct {
+	// Size is the number of bytes scanned (only for streams)
+	Size int64
+	// SHA256 is the hex encoded SHA-256 of the scanned bytes (only for streams)
+	SHA256 string
+	// SHA1 is the hex encoded SHA-1 of the scanned bytes (only for streams)
+	SHA1 string
+	// MD5 is the hex encoded MD5 of the scanned bytes (only for streams)
+	MD5 string
+	// MimeType is the MIME type detected from the first bytes (only for streams)
+	MimeType string
+	// QueueDuration is the time the job waited for a free worker
+	QueueDuration time.Duration
+	// ScanDuration is the time the worker spent executing the job
+	ScanDuration time.Duration
+	// WorkerID is the id of the worker that executed the job
+	WorkerID uint
+	// Backend is the address of the clamd that executed the job
+	Backend string
+	// SignatureVersion is the version of the signature database of the clamd
+	SignatureVersion string
+}
+
+// digestReader computes size, hashes and MIME type of everything read
+// through it.
+type digestReader struct {
+	r      io.Reader
+	size   int64
+	sniff  []byte
+	sha256 hash.Hash
+	sha1   hash.Hash
+	md5    hash.Hash
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{
+		r:      r,
+		sniff:  make([]byte, 0, sniffLen),
+		sha256: sha256.New(),
+		sha1:   sha1.New(),
+		md5:    md5.New(),
+	}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		chunk := p[:n]
+		d.size += int64(n)
+		if missing := sniffLen - len(d.sniff); missing > 0 {
+			d.sniff = append(d.sniff, chunk[:min(missing, n)]...)
+		}
+		// hash writes never return errors
+		d.sha256.Write(chunk)
+		d.sha1.Write(chunk)
+		d.md5.Write(chunk)
+	}
+	return n, err
+}
+
+// fill copies the digest of what was read so far into meta.
+func (d *digestReader) fill(meta *ScanMetadata) {
+	meta.Size = d.size
+	meta.SHA256 = hex.EncodeToString(d.sha256.Sum(nil))
+	meta.SHA1 = hex.EncodeToString(d.sha1.Sum(nil))
+	meta.MD5 = hex.EncodeToString(d.md5.Sum(nil))
+	meta.MimeType = http.DetectContentType(d.sniff)
+}
+
+// parseSignatureVersion extracts the signature database version from a
+// VERSION reply like "ClamAV 1.0.1/26800/Mon Jan 29 08:25:35 2024".
+func parseSignatureVersion(version string) string {
+	parts := strings.Split(version, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,99 @@
+package clamd
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestDigestReader(t *testing.T) {
+	d := newDigestReader(strings.NewReader("hello world"))
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		t.Fatal(err)
+	}
+
+	var meta ScanMetadata
+	d.fill(&meta)
+
+	if meta.Size != 11 {
+		t.Errorf("wrong size: %d", meta.Size)
+	}
+	if meta.SHA256 != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" {
+		t.Errorf("wrong sha256: %s", meta.SHA256)
+	}
+	if meta.SHA1 != "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed" {
+		t.Errorf("wrong sha1: %s", meta.SHA1)
+	}
+	if meta.MD5 != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf("wrong md5: %s", meta.MD5)
+	}
+	if meta.MimeType != "text/plain; charset=utf-8" {
+		t.Errorf("wrong mime type: %s", meta.MimeType)
+	}
+}
+
+func TestParseSignatureVersion(t *testing.T) {
+	if v := parseSignatureVersion("ClamAV 1.0.1/26800/Mon Jan 29 08:25:35 2024"); v != "26800" {
+		t.Errorf("wrong signature version: %s", v)
+	}
+	if v := parseSignatureVersion("ClamAV 1.0.1"); v != "" {
+		t.Errorf("expected no signature version, got %s", v)
+	}
+}
+
+func TestCoordinator_InstreamMetadata(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	scan, err := c.Instream(strings.NewReader(clamdtest.EICAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scan.Status != StatusFound {
+		t.Errorf("Expected status FOUND, got %s", scan.Status)
+	}
+	meta := scan.Metadata
+	if meta.Size != int64(len(clamdtest.EICAR)) {
+		t.Errorf("wrong size: %d", meta.Size)
+	}
+	if meta.SHA256 != "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f" {
+		t.Errorf("wrong sha256: %s", meta.SHA256)
+	}
+	if meta.WorkerID != 1 {
+		t.Errorf("wrong worker id: %d", meta.WorkerID)
+	}
+	if meta.Backend != fake.Address() {
+		t.Errorf("wrong backend: %s", meta.Backend)
+	}
+	if meta.SignatureVersion != "27500" {
+		t.Errorf("wrong signature version: %s", meta.SignatureVersion)
+	}
+	if meta.ScanDuration <= 0 {
+		t.Errorf("expected scan duration, got %s", meta.ScanDuration)
+	}
+}
+
+func newFakeClamd(t *testing.T) *clamdtest.Server {
+	t.Helper()
+
+	fake, err := clamdtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fake.Close() })
+
+	return fake
+}
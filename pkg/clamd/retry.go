@@ -0,0 +1,249 @@
+package clamd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is how many recent scan latencies are kept to
+	// compute the hedging threshold
+	latencyWindowSize = 512
+	// minHedgeSamples is how many scan latencies are needed before hedging
+	minHedgeSamples = 20
+)
+
+// jobTraits tell how a job can be run again.
+type jobTraits struct {
+	// replayable jobs are retried after transport errors
+	replayable bool
+	// hedgeable jobs are duplicated on another backend when slow
+	hedgeable bool
+}
+
+// submit runs a job and waits for its output.  Replayable jobs failed by
+// transport errors are retried as configured by SessionOpts.CommandRetries,
+// on another backend if possible.
+func (c *Coordinator) submit(jobID uint, fun jobFun, traits jobTraits, opts []JobOption) jobOutput {
+	o := c.jobOptions(opts)
+	c.metrics.submitted.Add(1)
+
+	avoid := ""
+	for attempt := 0; ; attempt++ {
+		result := c.attempt(jobID, fun, traits, o, attempt, avoid)
+		if !traits.replayable || !retryable(result.Error) || attempt >= c.retries.MaxRetries {
+			return result
+		}
+
+		c.metrics.retries.Add(1)
+		c.Logger.Warn().
+			Err(result.Error).
+			Uint("jobId", jobID).
+			Int("attempt", attempt+1).
+			Str("backend", result.Backend).
+			Msg("job failed, retrying")
+
+		if c.retries.Backoff != nil {
+			if err := sleepContext(o.ctx, c.retries.Backoff(attempt)); err != nil {
+				return jobOutput{JobID: jobID, Error: err}
+			}
+		}
+		avoid = c.alternativeTo(result.Backend)
+	}
+}
+
+// attempt queues a job and waits for its output.  If the job is hedgeable
+// and runs longer than HedgePercentile of recent scans, a duplicate is
+// queued for another backend and the first success wins.
+func (c *Coordinator) attempt(jobID uint, fun jobFun, traits jobTraits, o jobOptions, attempt int, avoid string) jobOutput {
+	out := make(chan jobOutput, 2)
+	j := newJob(jobID, fun, out, o)
+	j.Attempt = attempt
+	j.Avoid = avoid
+	j.Hedgeable = traits.hedgeable
+
+	if !c.available() {
+		return jobOutput{JobID: jobID, Error: ErrNoBackend}
+	}
+	if err := c.admit(o.ctx, j); err != nil {
+		return jobOutput{JobID: jobID, Error: err}
+	}
+
+	var timeout <-chan time.Time
+	if o.maxQueueWait > 0 {
+		timer := time.NewTimer(o.maxQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var hedge <-chan time.Time
+	started := j.started
+	if !traits.hedgeable || c.HedgePercentile <= 0 {
+		started = nil
+	}
+
+	done := o.ctx.Done()
+	queued := []*job{j}
+	pending := 1
+
+	for {
+		select {
+		case result := <-out:
+			pending--
+			if result.Error == nil || pending == 0 {
+				for _, q := range queued {
+					c.queue.cancel(q)
+				}
+				return result
+			}
+			// the other one may still succeed
+		case <-timeout:
+			timeout = nil
+			if c.queue.cancel(j) {
+				c.metrics.queueTimeouts.Add(1)
+				return jobOutput{JobID: jobID, Error: fmt.Errorf("%w: waited %s", ErrQueueTimeout, o.maxQueueWait)}
+			}
+		case <-done:
+			done = nil
+			if c.queue.cancel(j) {
+				c.metrics.cancelled.Add(1)
+				return jobOutput{JobID: jobID, Error: o.ctx.Err()}
+			}
+			// too late, a worker is already running the job
+		case <-started:
+			started = nil
+			if threshold := c.metrics.scanLatencies.percentile(c.HedgePercentile); threshold > 0 {
+				timer := time.NewTimer(threshold)
+				defer timer.Stop()
+				hedge = timer.C
+			}
+		case <-hedge:
+			hedge = nil
+			avoid := c.alternativeTo(j.backend)
+			if avoid == "" {
+				// no other backend to ask
+				continue
+			}
+
+			d := newJob(jobID, fun, out, o)
+			d.Attempt = attempt
+			d.Avoid = avoid
+			if _, err := c.queue.push(d, 0); err != nil {
+				continue
+			}
+			queued = append(queued, d)
+			pending++
+			c.metrics.hedges.Add(1)
+			c.Logger.Debug().Uint("jobId", jobID).Str("slowBackend", avoid).Msg("hedging slow job")
+		}
+	}
+}
+
+func (c *Coordinator) jobOptions(opts []JobOption) jobOptions {
+	o := jobOptions{maxQueueWait: c.MaxQueueWait, timeout: c.JobTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if c.MaxJobTimeout > 0 && (o.timeout <= 0 || o.timeout > c.MaxJobTimeout) {
+		o.timeout = c.MaxJobTimeout
+	}
+	if o.weight <= 0 {
+		o.weight = 1
+	}
+	if o.ctx == nil {
+		o.ctx = context.Background()
+	}
+	return o
+}
+
+// alternativeTo returns the backend to avoid when running again a job
+// failed or slow on backend, or empty if there is no other usable
+// backend.
+func (c *Coordinator) alternativeTo(backend string) string {
+	for _, b := range c.backendList() {
+		if b.clamd.Address != backend && b.usable() {
+			return backend
+		}
+	}
+	return ""
+}
+
+// retryable tells if a job failed for a transport error, so that it may
+// succeed on another session.  Job timeouts are not retried, as clamd
+// would likely get stuck again on the same content, nor uploads that
+// cannot be read.
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	final := []error{
+		ErrJobTimeout,
+		ErrUpload,
+		errAbandoned,
+		ErrQueueTimeout,
+		ErrOverloaded,
+		ErrCoordinatorClosed,
+		ErrUnknownPriority,
+		ErrNoBackend,
+		context.Canceled,
+		context.DeadlineExceeded,
+	}
+	for _, e := range final {
+		if errors.Is(err, e) {
+			return false
+		}
+	}
+	return true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// latencyWindow keeps the most recent latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile returns the p-th percentile, with p in (0, 1], of the
+// recent latencies, or zero if there are too few.
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	w.mu.Lock()
+	sorted := slices.Clone(w.samples)
+	w.mu.Unlock()
+
+	if p <= 0 || len(sorted) < minHedgeSamples {
+		return 0
+	}
+
+	slices.Sort(sorted)
+	i := min(int(p*float64(len(sorted))), len(sorted)-1)
+	return sorted[i]
+}
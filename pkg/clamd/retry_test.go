@@ -0,0 +1,258 @@
+package clamd
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+
+	for i := range minHedgeSamples - 1 {
+		w.record(time.Duration(i) * time.Millisecond)
+	}
+	if p := w.percentile(0.9); p != 0 {
+		t.Errorf("expected no percentile with few samples, got %s", p)
+	}
+
+	for i := range 100 {
+		w.record(time.Duration(i+1) * time.Millisecond)
+	}
+	if p := w.percentile(0.9); p < 85*time.Millisecond || p > 95*time.Millisecond {
+		t.Errorf("expected 90th percentile near 90ms, got %s", p)
+	}
+
+	for range latencyWindowSize {
+		w.record(time.Second)
+	}
+	if p := w.percentile(0.5); p != time.Second {
+		t.Errorf("expected old samples evicted, got %s", p)
+	}
+}
+
+func TestCoordinator_RetryOnTransportError(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.DropScans(1)
+
+	c := Coordinator{
+		MinWorkers:      1,
+		MaxWorkers:      1,
+		ShutdownTimeout: time.Second,
+		Spool:           SpoolOpts{MemoryLimit: 1024, MaxSize: 1024},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{
+			HeartbeatInterval: time.Minute,
+			CommandRetries:    RetryOpts{MaxRetries: 2},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	scan, err := c.Instream(strings.NewReader(clamdtest.EICAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scan.Status != StatusFound {
+		t.Errorf("Expected status FOUND, got %s", scan.Status)
+	}
+	if scan.Metadata.Size != int64(len(clamdtest.EICAR)) {
+		t.Errorf("wrong size: %d", scan.Metadata.Size)
+	}
+	if retries := c.Metrics().Retries; retries != 1 {
+		t.Errorf("expected 1 retry, got %d", retries)
+	}
+}
+
+func TestCoordinator_NoReplayWithoutSpool(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.DropScans(1)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{
+			HeartbeatInterval: time.Minute,
+			CommandRetries:    RetryOpts{MaxRetries: 2},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	if _, err := c.Instream(strings.NewReader("not spooled")); err == nil {
+		t.Error("expected transport error")
+	}
+
+	// the worker recovered with a fresh session
+	if _, err := c.Instream(strings.NewReader("not spooled")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoordinator_RetryOnAnotherBackend(t *testing.T) {
+	broken := newFakeClamd(t)
+	broken.DropScans(100)
+	healthy := newFakeClamd(t)
+
+	c := Coordinator{MinWorkers: 2, MaxWorkers: 2, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{
+			{Network: broken.Network(), Address: broken.Address()},
+			{Network: healthy.Network(), Address: healthy.Address()},
+		},
+		SessionOpts{
+			HeartbeatInterval: time.Minute,
+			CommandRetries:    RetryOpts{MaxRetries: 1},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	path := tempfile(t, "clean")
+	for range 5 {
+		scan, err := c.Scan(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scan.Metadata.Backend != healthy.Address() {
+			t.Errorf("expected scan by healthy backend, got %s", scan.Metadata.Backend)
+		}
+	}
+}
+
+func TestCoordinator_Hedging(t *testing.T) {
+	slow := newFakeClamd(t)
+	fast := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      2,
+		MaxWorkers:      2,
+		ShutdownTimeout: time.Second,
+		Spool:           SpoolOpts{MemoryLimit: 1024, MaxSize: 1024},
+		HedgePercentile: 0.9,
+	}
+	err := c.InitCoordinator(
+		[]Clamd{
+			{Network: slow.Network(), Address: slow.Address()},
+			{Network: fast.Network(), Address: fast.Address()},
+		},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// learn the usual latency
+	for range minHedgeSamples {
+		if _, err := c.Instream(strings.NewReader("warm up")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// then a backend gets stuck
+	slow.SetScanDelay(time.Minute)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scan, err := c.Instream(strings.NewReader(clamdtest.EICAR))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if scan.Metadata.Backend != fast.Address() {
+				t.Errorf("expected result of fast backend, got %s", scan.Metadata.Backend)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected hedged scans to complete quickly, took %s", elapsed)
+	}
+	if hedges := c.Metrics().Hedges; hedges == 0 {
+		t.Error("expected hedged jobs")
+	}
+}
+
+func TestCoordinator_HedgeLoserKeepsSession(t *testing.T) {
+	first := newFakeClamd(t)
+	second := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      2,
+		MaxWorkers:      2,
+		ShutdownTimeout: time.Second,
+		// on disk, so that the loser reads a file the winner deletes
+		Spool:           SpoolOpts{MemoryLimit: 1, MaxSize: 32 << 20, Dir: t.TempDir()},
+		HedgePercentile: 0.5,
+		Breaker:         BreakerOpts{ConsecutiveFailures: 1, OpenTimeout: time.Minute},
+	}
+	err := c.InitCoordinator(
+		[]Clamd{
+			{Network: first.Network(), Address: first.Address()},
+			{Network: second.Network(), Address: second.Address()},
+		},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	for range minHedgeSamples {
+		if _, err := c.Instream(strings.NewReader("warm up")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// whichever wins, the hedge of the second backend is still reading
+	// the upload when the first one replies, hedges start after a few
+	// milliseconds
+	first.SetScanDelay(100 * time.Millisecond)
+	second.SetScanDelay(100 * time.Millisecond)
+	second.SetStreamDelay(300 * time.Millisecond)
+
+	// larger than the socket buffers
+	content := strings.Repeat("hedged ", 3<<20)
+	for range 3 {
+		if _, err := c.Instream(strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hedges := c.Metrics().Hedges; hedges == 0 {
+		t.Fatal("expected hedged jobs")
+	}
+
+	// let the losers complete
+	time.Sleep(time.Second)
+
+	for _, fake := range []*clamdtest.Server{first, second} {
+		if opened, _ := fake.Sessions(); opened != 1 {
+			t.Errorf("expected the session of %s kept, opened %d", fake.Address(), opened)
+		}
+		if state := c.Circuits()[fake.Address()]; state != BreakerClosed {
+			t.Errorf("expected closed circuit of %s, got %s", fake.Address(), state)
+		}
+	}
+	if entries, _ := os.ReadDir(c.Spool.Dir); len(entries) != 0 {
+		t.Errorf("expected spool files removed, found %d files", len(entries))
+	}
+}
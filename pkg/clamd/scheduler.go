@@ -0,0 +1,443 @@
+package clamd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Priority is the scheduling class of a job.  Classes share the workers
+// according to their weights, so that bulk work cannot starve interactive
+// work and vice versa.
+type Priority int
+
+const (
+	// PriorityInteractive is for jobs someone is waiting for.
+	PriorityInteractive Priority = iota
+	// PriorityBulk is for background and batch jobs.
+	PriorityBulk
+
+	numPriorities = 2
+)
+
+const (
+	defaultInteractiveWeight = 4
+	defaultBulkWeight        = 1
+)
+
+var (
+	// ErrUnknownPriority is returned when parsing an unknown priority.
+	ErrUnknownPriority = errors.New("unknown priority")
+	// ErrQueueTimeout is returned when a job waits in queue longer than
+	// its max queue wait.
+	ErrQueueTimeout = errors.New("timeout waiting in queue")
+	// ErrOverloaded is returned when the job queue is full and no room
+	// is freed within the max admission wait.
+	ErrOverloaded = errors.New("overloaded")
+	// ErrCoordinatorClosed is returned when submitting jobs to a
+	// coordinator that was shut down.
+	ErrCoordinatorClosed = errors.New("coordinator closed")
+)
+
+// ParsePriority parses a priority name.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "interactive":
+		return PriorityInteractive, nil
+	case "bulk":
+		return PriorityBulk, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownPriority, s)
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// JobOption customizes how a job is scheduled.
+type JobOption func(o *jobOptions)
+
+type jobOptions struct {
+	priority     Priority
+	tenant       string
+	weight       float64
+	maxQueueWait time.Duration
+	timeout      time.Duration
+	ctx          context.Context
+}
+
+// WithPriority sets the scheduling class of the job, interactive by
+// default.
+func WithPriority(p Priority) JobOption {
+	return func(o *jobOptions) {
+		o.priority = p
+	}
+}
+
+// WithTenant sets who the job is run for.  Within a class, tenants with
+// pending jobs share the workers in proportion to their weight, so that
+// none can monopolize them.  Weights not positive count as 1.
+func WithTenant(tenant string, weight float64) JobOption {
+	return func(o *jobOptions) {
+		o.tenant = tenant
+		o.weight = weight
+	}
+}
+
+// WithMaxQueueWait overrides Coordinator.MaxQueueWait for the job.
+func WithMaxQueueWait(d time.Duration) JobOption {
+	return func(o *jobOptions) {
+		o.maxQueueWait = d
+	}
+}
+
+// WithTimeout overrides Coordinator.JobTimeout for the job, up to
+// Coordinator.MaxJobTimeout.
+func WithTimeout(d time.Duration) JobOption {
+	return func(o *jobOptions) {
+		o.timeout = d
+	}
+}
+
+// WithContext ties the job to ctx: if ctx is done while the job is still
+// queued, the job is dropped and the context error returned.
+func WithContext(ctx context.Context) JobOption {
+	return func(o *jobOptions) {
+		o.ctx = ctx
+	}
+}
+
+type jobState int
+
+const (
+	jobQueued jobState = iota
+	jobRunning
+	jobCancelled
+)
+
+// jobQueue schedules jobs with weighted fair queueing at two levels:
+// between priority classes, then between tenants of the same class.  Both
+// levels use stride scheduling: every flow has a virtual pass advanced by
+// the inverse of its weight at every pick, and the flow with the lowest
+// pass goes next.
+type jobQueue struct {
+	mu      sync.Mutex
+	classes [numPriorities]classQueue
+	length  int
+	closed  bool
+
+	// wake signals idle workers that jobs were pushed
+	wake chan struct{}
+	// done is closed when the queue is closed
+	done chan struct{}
+	// room is closed, and replaced, when jobs leave the queue
+	room chan struct{}
+}
+
+type classQueue struct {
+	weight float64
+	pass   float64
+	// vtime is the pass of the last picked tenant, new tenants start from
+	// here to not be favored over tenants queued since long
+	vtime   float64
+	tenants map[string]*tenantFlow
+	length  int
+}
+
+type tenantFlow struct {
+	pass  float64
+	jobs  []*job
+	alive int
+}
+
+func newJobQueue(weights map[Priority]int, workers int) *jobQueue {
+	q := &jobQueue{
+		wake: make(chan struct{}, max(workers, 1)),
+		done: make(chan struct{}),
+		room: make(chan struct{}),
+	}
+
+	for p := range q.classes {
+		weight := weights[Priority(p)]
+		if weight <= 0 {
+			weight = defaultWeight(Priority(p))
+		}
+		q.classes[p] = classQueue{
+			weight:  float64(weight),
+			tenants: map[string]*tenantFlow{},
+		}
+	}
+
+	return q
+}
+
+func defaultWeight(p Priority) int {
+	if p == PriorityBulk {
+		return defaultBulkWeight
+	}
+	return defaultInteractiveWeight
+}
+
+// push enqueues a job and wakes an idle worker.  If limit is positive and
+// the queue has already limit jobs, it fails with ErrOverloaded and returns
+// a channel closed when some room is freed.
+func (q *jobQueue) push(j *job, limit int) (<-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrCoordinatorClosed
+	}
+
+	if j.Priority < 0 || int(j.Priority) >= numPriorities {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPriority, j.Priority)
+	}
+
+	if limit > 0 && q.length >= limit {
+		return q.room, fmt.Errorf("%w: %d jobs queued", ErrOverloaded, q.length)
+	}
+
+	c := &q.classes[j.Priority]
+	if c.length == 0 {
+		// the class was idle, it does not get credit for that
+		c.pass = max(c.pass, q.minActivePass())
+	}
+
+	t, ok := c.tenants[j.Tenant]
+	if !ok {
+		t = &tenantFlow{pass: c.vtime}
+		c.tenants[j.Tenant] = t
+	}
+	if j.Attempt > 0 {
+		// retries already waited their turn
+		t.jobs = append([]*job{j}, t.jobs...)
+	} else {
+		t.jobs = append(t.jobs, j)
+	}
+	t.alive++
+	c.length++
+	q.length++
+
+	q.signal(j.Avoid != "")
+
+	return nil, nil
+}
+
+// signal wakes an idle worker, or all of them if the job is not for
+// everyone.
+func (q *jobQueue) signal(all bool) {
+	for {
+		select {
+		case q.wake <- struct{}{}:
+			if all {
+				continue
+			}
+		default:
+			// enough wake ups pending already
+		}
+		return
+	}
+}
+
+// pop dequeues the next job for a worker of backend, or returns nil if
+// there are none.  Jobs avoiding backend are left to other workers, unless
+// the queue is closed.
+func (q *jobQueue) pop(backend string) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	eligible := func(j *job) bool {
+		return q.closed || j.Avoid == "" || j.Avoid != backend
+	}
+
+	for _, c := range q.classesByPass() {
+		j := c.pop(eligible)
+		if j == nil {
+			continue
+		}
+
+		c.pass += 1 / c.weight
+		c.length--
+		q.length--
+		j.state = jobRunning
+		j.backend = backend
+		close(j.started)
+		q.freeRoom()
+		return j
+	}
+
+	return nil
+}
+
+// cancel removes a job from the queue, if it is still queued.  Cancelled
+// jobs are skipped when popped.
+func (q *jobQueue) cancel(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if j.state != jobQueued {
+		return false
+	}
+
+	j.state = jobCancelled
+	c := &q.classes[j.Priority]
+	t := c.tenants[j.Tenant]
+	t.alive--
+	if t.alive == 0 {
+		delete(c.tenants, j.Tenant)
+	}
+	c.length--
+	q.length--
+	q.freeRoom()
+	return true
+}
+
+// close rejects next pushes and wakes all idle workers.  Queued jobs can
+// still be popped.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+		close(q.done)
+	}
+}
+
+// resize sizes the wake ups pending to the number of workers.  Idle
+// workers are woken to wait on the new channel.
+func (q *jobQueue) resize(workers int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := max(workers, 1)
+	if q.closed || cap(q.wake) == size {
+		return
+	}
+	close(q.wake)
+	q.wake = make(chan struct{}, size)
+}
+
+// closing returns a channel closed when the queue is closed.
+func (q *jobQueue) closing() <-chan struct{} {
+	return q.done
+}
+
+// isClosed tells if the queue is closed.
+func (q *jobQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closed
+}
+
+// idle tells if the queue is closed and has no jobs left, otherwise it
+// returns the channel signaling new jobs.
+func (q *jobQueue) idle() (bool, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closed && q.length == 0, q.wake
+}
+
+// len returns the number of queued jobs.
+func (q *jobQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.length
+}
+
+// freeRoom signals jobs waiting for admission.  It must be called holding
+// the lock.
+func (q *jobQueue) freeRoom() {
+	close(q.room)
+	q.room = make(chan struct{})
+}
+
+// classesByPass returns the classes with queued jobs, lowest pass first.
+func (q *jobQueue) classesByPass() []*classQueue {
+	classes := make([]*classQueue, 0, numPriorities)
+	for i := range q.classes {
+		if q.classes[i].length > 0 {
+			classes = append(classes, &q.classes[i])
+		}
+	}
+	slices.SortStableFunc(classes, func(a, b *classQueue) int {
+		return cmp.Compare(a.pass, b.pass)
+	})
+	return classes
+}
+
+func (q *jobQueue) minActivePass() float64 {
+	var minPass float64
+	found := false
+	for i := range q.classes {
+		c := &q.classes[i]
+		if c.length > 0 && (!found || c.pass < minPass) {
+			minPass = c.pass
+			found = true
+		}
+	}
+	return minPass
+}
+
+// pop dequeues the head job of the tenant with the lowest pass, among
+// tenants whose head job is eligible.  It returns nil if there are none.
+func (c *classQueue) pop(eligible func(j *job) bool) *job {
+	var key string
+	var next *tenantFlow
+	for k, t := range c.tenants {
+		head := t.head()
+		if head == nil || !eligible(head) {
+			continue
+		}
+		if next == nil || t.pass < next.pass || (t.pass == next.pass && k < key) {
+			key, next = k, t
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	j := next.jobs[0]
+	next.jobs[0] = nil
+	next.jobs = next.jobs[1:]
+	next.alive--
+	c.vtime = next.pass
+	next.pass += 1 / j.Weight
+
+	if next.alive == 0 {
+		// forget idle tenants, cancelled jobs left behind go with them
+		delete(c.tenants, key)
+	}
+
+	return j
+}
+
+// head returns the first queued job of the tenant, dropping the jobs
+// cancelled while queued.
+func (t *tenantFlow) head() *job {
+	if t.alive == 0 {
+		return nil
+	}
+
+	for t.jobs[0].state == jobCancelled {
+		t.jobs[0] = nil
+		t.jobs = t.jobs[1:]
+	}
+	return t.jobs[0]
+}
@@ -0,0 +1,335 @@
+package clamd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestJobQueue_FairAcrossTenants(t *testing.T) {
+	q := newJobQueue(nil, 1)
+
+	// a burst of a tenant, then few jobs of another
+	for range 10 {
+		pushTestJob(t, q, PriorityBulk, "burst", 1)
+	}
+	pushTestJob(t, q, PriorityBulk, "other", 1)
+	pushTestJob(t, q, PriorityBulk, "other", 1)
+
+	order := popTenants(q)
+
+	if len(order) != 12 {
+		t.Fatalf("expected 12 jobs, got %d", len(order))
+	}
+	if got := strings.Join(order[:5], ","); got != "burst,other,burst,other,burst" {
+		t.Errorf("unfair order: %s", got)
+	}
+}
+
+func TestJobQueue_TenantWeights(t *testing.T) {
+	q := newJobQueue(nil, 1)
+
+	for range 6 {
+		pushTestJob(t, q, PriorityInteractive, "heavy", 2)
+		pushTestJob(t, q, PriorityInteractive, "light", 1)
+	}
+
+	order := popTenants(q)
+
+	heavy := strings.Count(strings.Join(order[:6], ","), "heavy")
+	if heavy != 4 {
+		t.Errorf("expected 4 of 6 jobs from heavy tenant, got %d: %v", heavy, order)
+	}
+}
+
+func TestJobQueue_PriorityWeights(t *testing.T) {
+	q := newJobQueue(map[Priority]int{PriorityInteractive: 3, PriorityBulk: 1}, 1)
+
+	for range 8 {
+		pushTestJob(t, q, PriorityBulk, "batch", 1)
+	}
+	for range 8 {
+		pushTestJob(t, q, PriorityInteractive, "user", 1)
+	}
+
+	order := popTenants(q)
+
+	interactive := strings.Count(strings.Join(order[:8], ","), "user")
+	if interactive != 6 {
+		t.Errorf("expected 6 of 8 interactive jobs, got %d: %v", interactive, order)
+	}
+}
+
+func TestJobQueue_Cancel(t *testing.T) {
+	q := newJobQueue(nil, 1)
+
+	first := pushTestJob(t, q, PriorityInteractive, "a", 1)
+	cancelled := pushTestJob(t, q, PriorityInteractive, "a", 1)
+	last := pushTestJob(t, q, PriorityInteractive, "a", 1)
+
+	if !q.cancel(cancelled) {
+		t.Fatal("expected queued job to be cancelled")
+	}
+
+	if j := q.pop(""); j != first {
+		t.Errorf("expected first job, got %v", j)
+	}
+	if q.cancel(first) {
+		t.Error("running job must not be cancelled")
+	}
+	if j := q.pop(""); j != last {
+		t.Errorf("expected last job, got %v", j)
+	}
+	if j := q.pop(""); j != nil {
+		t.Errorf("expected empty queue, got %v", j)
+	}
+}
+
+func TestJobQueue_Closed(t *testing.T) {
+	q := newJobQueue(nil, 1)
+	queued := pushTestJob(t, q, PriorityInteractive, "a", 1)
+
+	q.close()
+
+	if _, err := q.push(&job{Weight: 1}, 0); !errors.Is(err, ErrCoordinatorClosed) {
+		t.Errorf("expected ErrCoordinatorClosed, got %v", err)
+	}
+	if closed, _ := q.idle(); closed {
+		t.Error("closed queue with jobs left must not be idle")
+	}
+	if j := q.pop(""); j != queued {
+		t.Errorf("expected queued job, got %v", j)
+	}
+	if closed, _ := q.idle(); !closed {
+		t.Error("expected closed and empty queue")
+	}
+}
+
+func TestJobQueue_Limit(t *testing.T) {
+	q := newJobQueue(nil, 1)
+	pushTestJob(t, q, PriorityInteractive, "a", 1)
+
+	room, err := q.push(&job{Tenant: "b", Weight: 1, started: make(chan struct{})}, 1)
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+
+	q.pop("")
+
+	select {
+	case <-room:
+	default:
+		t.Error("expected room to be signaled")
+	}
+	if _, err := q.push(&job{Tenant: "b", Weight: 1, started: make(chan struct{})}, 1); err != nil {
+		t.Errorf("expected job admitted, got %v", err)
+	}
+}
+
+func TestJobQueue_Resize(t *testing.T) {
+	q := newJobQueue(nil, 1)
+	_, waiting := q.idle()
+
+	q.resize(3)
+
+	select {
+	case <-waiting:
+	default:
+		t.Error("expected idle workers woken")
+	}
+	for range 3 {
+		pushTestJob(t, q, PriorityInteractive, "a", 1)
+	}
+	if _, wake := q.idle(); len(wake) != 3 {
+		t.Errorf("expected 3 wake ups pending, got %d", len(wake))
+	}
+}
+
+func TestCoordinator_Overloaded(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(300 * time.Millisecond)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, MaxQueueLength: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// one job running, one queued
+	results := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := c.Instream(strings.NewReader("slow"))
+			results <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err = c.Instream(strings.NewReader("shed"))
+	if !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected ErrOverloaded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected immediate rejection, took %s", elapsed)
+	}
+	if retryAfter := c.RetryAfter(); retryAfter < time.Second {
+		t.Errorf("expected retry after at least 1s, got %s", retryAfter)
+	}
+
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+
+	m := c.Metrics()
+	if m.Submitted != 3 || m.Completed != 2 || m.Shed != 1 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+	if m.AvgJobDuration < 300*time.Millisecond {
+		t.Errorf("expected average job duration of at least 300ms, got %s", m.AvgJobDuration)
+	}
+}
+
+func TestCoordinator_AdmissionWait(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(100 * time.Millisecond)
+
+	c := Coordinator{
+		MinWorkers:       1,
+		MaxWorkers:       1,
+		MaxQueueLength:   1,
+		MaxAdmissionWait: time.Second,
+		ShutdownTimeout:  time.Second,
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	results := make(chan error, 4)
+	for range 4 {
+		go func() {
+			_, err := c.Instream(strings.NewReader("queued"))
+			results <- err
+		}()
+	}
+
+	for range 4 {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+	if shed := c.Metrics().Shed; shed != 0 {
+		t.Errorf("expected no shed jobs, got %d", shed)
+	}
+}
+
+func TestCoordinator_MaxQueueWait(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(300 * time.Millisecond)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// keep the only worker busy
+	busy := make(chan error)
+	go func() {
+		_, err := c.Instream(strings.NewReader("slow"))
+		busy <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = c.Instream(strings.NewReader("waiting"), WithMaxQueueWait(20*time.Millisecond))
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected ErrQueueTimeout, got %v", err)
+	}
+	if err := <-busy; err != nil {
+		t.Error(err)
+	}
+	if fake.Scans() != 1 {
+		t.Errorf("timed out job must not be scanned, got %d scans", fake.Scans())
+	}
+}
+
+func TestCoordinator_JobTimeout(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	c := Coordinator{
+		MinWorkers:      1,
+		MaxWorkers:      1,
+		JobTimeout:      2 * time.Second,
+		ShutdownTimeout: time.Second,
+	}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	// clamd hangs on the first scan
+	fake.SetScanDelay(time.Minute)
+	start := time.Now()
+	_, err = c.Instream(strings.NewReader("pathological"), WithTimeout(100*time.Millisecond))
+	if !errors.Is(err, ErrJobTimeout) {
+		t.Errorf("expected ErrJobTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected abort after the job timeout, took %s", elapsed)
+	}
+
+	// the worker goes on with a fresh session
+	fake.SetScanDelay(0)
+	scan, err := c.Instream(strings.NewReader(clamdtest.EICAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.Status != StatusFound {
+		t.Errorf("Expected status FOUND, got %s", scan.Status)
+	}
+	if timeouts := c.Metrics().JobTimeouts; timeouts != 1 {
+		t.Errorf("expected 1 job timeout, got %d", timeouts)
+	}
+}
+
+// helpers
+
+func pushTestJob(t *testing.T, q *jobQueue, p Priority, tenant string, weight float64) *job {
+	t.Helper()
+
+	j := &job{Priority: p, Tenant: tenant, Weight: weight, started: make(chan struct{})}
+	if _, err := q.push(j, 0); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func popTenants(q *jobQueue) []string {
+	var order []string
+	for j := q.pop(""); j != nil; j = q.pop("") {
+		order = append(order, j.Tenant)
+	}
+	return order
+}
@@ -78,6 +78,16 @@ func (s *Session) Close() error {
 	return nil
 }
 
+// abort closes the connection without ending the session, unblocking the
+// command in progress if any.  The session is unusable afterwards.
+func (s *Session) abort() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
 // delegate command methods
 
 func (s *Session) Ping() (int, string, error) {
@@ -2,149 +2,326 @@ package clamd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrJobTimeout is returned when a job runs longer than its timeout.  The
+// session running it is discarded, as clamd may be stuck on it.
+var ErrJobTimeout = errors.New("job timeout")
+
 type Coordinator struct {
-	MinWorkers      int
+	// MinWorkers are the workers running
+	MinWorkers int
+	// MaxWorkers bounds MinWorkers when resized, and the idle workers
+	// woken at once
 	MaxWorkers      int
 	Autoscale       bool
 	ShutdownTimeout time.Duration
 
-	backends      []Clamd
+	// PriorityWeights are the shares of workers of each priority class
+	// when all classes have queued jobs, defaults to 4 interactive and 1
+	// bulk
+	PriorityWeights map[Priority]int
+	// MaxQueueWait is how long jobs can wait for a worker before failing
+	// with ErrQueueTimeout, zero means forever
+	MaxQueueWait time.Duration
+	// MaxQueueLength is how many jobs can wait for a worker, zero means
+	// unbounded.  Jobs beyond are rejected with ErrOverloaded
+	MaxQueueLength int
+	// MaxAdmissionWait is how long jobs can wait for room in a full queue
+	// before being rejected, zero means they are rejected immediately
+	MaxAdmissionWait time.Duration
+
+	// JobTimeout is how long workers can run a job before aborting it
+	// with ErrJobTimeout, zero means forever
+	JobTimeout time.Duration
+	// MaxJobTimeout caps timeouts set per job with WithTimeout, zero
+	// means no cap
+	MaxJobTimeout time.Duration
+
+	// Spool bounds the buffer of uploads, needed to retry and hedge
+	// INSTREAM.  Other commands are retried anyway
+	Spool SpoolOpts
+	// HedgePercentile, if positive, hedges scans running longer than this
+	// percentile of recent scans, e.g. 0.95, with a duplicate on another
+	// backend
+	HedgePercentile float64
+
+	// Breaker configures the circuit breaker of each backend.  When
+	// enabled, workers reconnect to a failing backend once per open
+	// timeout instead of retrying as set by SessionOpts.ConnectRetries
+	Breaker BreakerOpts
+
+	// Logger defaults to no logging
+	Logger Logger
+
+	backends      atomic.Pointer[[]*backendState]
+	sessionOpts   SessionOpts
+	retries       RetryOpts
 	workerID      sequence
 	jobID         sequence
-	jobs          chan job
+	queue         *jobQueue
+	metrics       coordinatorMetrics
 	activeWorkers sync.WaitGroup
+
+	// workersMu guards workers, and the worker bounds once initialized
+	workersMu sync.Mutex
+	workers   map[uint]*sessionWorker
 }
 
 func (c *Coordinator) InitCoordinator(backends []Clamd, opts SessionOpts) error {
 	c.workerID = newSequence(1)
 	c.jobID = newSequence(1)
-	c.jobs = make(chan job, c.MaxWorkers)
-	c.backends = backends
+	c.queue = newJobQueue(c.PriorityWeights, c.MaxWorkers)
+	if c.Logger == nil {
+		c.Logger = &noopLogger{}
+	}
+
+	c.retries = opts.CommandRetries
+	if c.Breaker.enabled() {
+		opts.ConnectRetries = RetryOpts{}
+	}
+	c.sessionOpts = opts
+
+	states := make([]*backendState, 0, len(backends))
+	for i := range backends {
+		states = append(states, newBackendState(&backends[i], c.Breaker, c.Logger))
+	}
+	c.backends.Store(&states)
 
-	numBackends := len(backends)
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+
+	c.workers = make(map[uint]*sessionWorker, c.MinWorkers)
 	for i := range c.MinWorkers {
-		go c.spawnWorker(&backends[i%numBackends], opts)
+		c.startWorker(states[i%len(states)])
 	}
 
 	return nil
 }
 
+// Shutdown drains the coordinator, waiting at most ShutdownTimeout.
 func (c *Coordinator) Shutdown() {
-	fmt.Println("[coord] initiated graceful shutdown...")
-
-	close(c.jobs)
-
 	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
 	defer cancel()
 
-	allClosed := make(chan bool)
+	if err := c.Drain(ctx); err != nil {
+		c.Logger.Warn().Err(err).Msg("timeout waiting workers graceful shutdown, force shutdown")
+	}
+}
+
+// Drain stops accepting jobs, failing new ones with ErrCoordinatorClosed,
+// then waits for queued and running jobs to complete and for workers to
+// END their sessions.  If ctx is done first, it returns the context error
+// and workers are left to complete in background.
+func (c *Coordinator) Drain(ctx context.Context) error {
+	c.Logger.Info().Int("queued", c.queue.len()).Msg("coordinator graceful shutdown initiated")
+
+	c.workersMu.Lock()
+	c.queue.close()
+	c.workersMu.Unlock()
 
+	allClosed := make(chan struct{})
 	go func() {
 		c.activeWorkers.Wait()
-		allClosed <- true
+		close(allClosed)
 	}()
 
 	select {
 	case <-allClosed:
-		fmt.Println("[coord] all workers successfully closed gracefully")
+		c.Logger.Info().Msg("all workers closed gracefully")
+		return nil
 	case <-ctx.Done():
-		fmt.Println("[coord] timeout waiting worker graceful shutdown, force shutdown")
+		return fmt.Errorf("unable to drain coordinator: %w", ctx.Err())
 	}
 }
 
-func (c *Coordinator) spawnWorker(clamd *Clamd, opts SessionOpts) {
+// Ready tells if the coordinator accepts jobs: it returns
+// ErrCoordinatorClosed once draining and ErrNoBackend while the circuits
+// of all backends are open.
+func (c *Coordinator) Ready() error {
+	select {
+	case <-c.queue.closing():
+		return ErrCoordinatorClosed
+	default:
+	}
+
+	if !c.available() {
+		return ErrNoBackend
+	}
+	return nil
+}
+
+// startWorker runs a new worker of backend b.  It must be called holding
+// workersMu.
+func (c *Coordinator) startWorker(b *backendState) *sessionWorker {
+	w := &sessionWorker{
+		id:      c.workerID.next(),
+		backend: b.clamd.Address,
+		log:     c.Logger,
+		metrics: &c.metrics,
+		target:  b,
+		status:  WorkerConnecting,
+		kick:    make(chan struct{}, 1),
+	}
+	c.workers[w.id] = w
+	b.workers.Add(1)
+	c.metrics.workers.Add(1)
 	c.activeWorkers.Add(1)
-	defer c.activeWorkers.Done()
 
-	w := sessionWorker{c.workerID.next()}
-	if err := w.run(clamd, opts, c.jobs); err != nil {
-		// TODO spawn another worker!
-		panic(fmt.Errorf("[worker %d] died: %w", w.id, err))
+	go func() {
+		defer c.activeWorkers.Done()
+
+		w.run(b.clamd, c.sessionOpts, c.queue)
+
+		c.workersMu.Lock()
+		delete(c.workers, w.id)
+		c.workersMu.Unlock()
+		b.workers.Add(-1)
+		c.metrics.workers.Add(-1)
+		c.Logger.Debug().Uint("workerId", w.id).Msg("worker graceful shutdown")
+	}()
+
+	return w
+}
+
+// admit queues a job.  If the queue is full, it waits up to
+// MaxAdmissionWait for room, then sheds the job with ErrOverloaded.
+func (c *Coordinator) admit(ctx context.Context, j *job) error {
+	var timeout <-chan time.Time
+	if c.MaxAdmissionWait > 0 {
+		timer := time.NewTimer(c.MaxAdmissionWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		room, err := c.queue.push(j, c.MaxQueueLength)
+		if !errors.Is(err, ErrOverloaded) {
+			return err
+		}
+		if timeout == nil {
+			c.shed(j, err)
+			return err
+		}
+
+		select {
+		case <-room:
+			// retry
+		case <-timeout:
+			c.shed(j, err)
+			return err
+		case <-ctx.Done():
+			c.metrics.cancelled.Add(1)
+			return ctx.Err()
+		}
 	}
-	fmt.Printf("[worker %d] graceful shutdown", w.id)
 }
 
-func (c *Coordinator) simpleCommand(cmd func(s *Session) (string, error)) (string, error) {
-	out := make(chan jobOutput)
-	jobID := c.jobID.next()
-	c.jobs <- job{
-		ID: jobID,
-		Fun: func(s *Session) jobOutput {
-			resp, err := cmd(s)
-			return jobOutput{
-				JobID: jobID,
-				Resp:  resp,
-				Error: err,
-			}
-		},
-		RespChan: out,
+func (c *Coordinator) shed(j *job, err error) {
+	if n, ok := c.metrics.jobShed(); ok {
+		c.Logger.Warn().
+			Err(err).
+			Uint("shed", n).
+			Str("priority", j.Priority.String()).
+			Str("tenant", j.Tenant).
+			Msg("overloaded, shedding jobs")
 	}
-	result := <-out
+}
+
+func (c *Coordinator) simpleCommand(cmd func(s *Session) (string, error), opts []JobOption) (string, error) {
+	jobID := c.jobID.next()
+	result := c.submit(jobID, func(s *Session) jobOutput {
+		resp, err := cmd(s)
+		return jobOutput{
+			JobID: jobID,
+			Resp:  resp,
+			Error: err,
+		}
+	}, jobTraits{replayable: true}, opts)
 	return result.Resp, result.Error
 }
 
-func (c *Coordinator) Ping() (string, error) {
+func (c *Coordinator) Ping(opts ...JobOption) (string, error) {
 	return c.simpleCommand(func(s *Session) (string, error) {
 		_, pong, err := s.Ping()
 		return pong, err
-	})
+	}, opts)
 }
 
-func (c *Coordinator) Version() (string, error) {
+func (c *Coordinator) Version(opts ...JobOption) (string, error) {
 	return c.simpleCommand(func(s *Session) (string, error) {
 		_, version, err := s.Version()
 		return version, err
-	})
+	}, opts)
 }
 
-func (c *Coordinator) Stats() (string, error) {
+func (c *Coordinator) Stats(opts ...JobOption) (string, error) {
 	return c.simpleCommand(func(s *Session) (string, error) {
 		_, stats, err := s.Stats()
 		return stats, err
-	})
+	}, opts)
 }
 
-func (c *Coordinator) Scan(path string) (*ScanResult, error) {
-	out := make(chan jobOutput)
+func (c *Coordinator) Scan(path string, opts ...JobOption) (*ScanResult, error) {
 	jobID := c.jobID.next()
-	c.jobs <- job{
-		ID: jobID,
-		Fun: func(s *Session) jobOutput {
-			_, scan, err := s.Scan(path)
-			return jobOutput{
-				JobID:      jobID,
-				ScanResult: scan,
-				Error:      err,
-			}
-		},
-		RespChan: out,
-	}
-	result := <-out
+	result := c.submit(jobID, func(s *Session) jobOutput {
+		_, scan, err := s.Scan(path)
+		return jobOutput{
+			JobID:      jobID,
+			ScanResult: scan,
+			Error:      err,
+		}
+	}, jobTraits{replayable: true, hedgeable: true}, opts)
+	c.metrics.scanned(result.ScanResult)
 	return result.ScanResult, result.Error
 }
 
-func (c *Coordinator) Instream(r io.Reader) (*ScanResult, error) {
-	out := make(chan jobOutput)
+// Instream scans the content of r. Besides the scan outcome, the result
+// metadata carries size, hashes and MIME type computed on the fly while
+// streaming r to clamd.  To be retried or hedged, r is first spooled
+// within the bounds of Coordinator.Spool.
+func (c *Coordinator) Instream(r io.Reader, opts ...JobOption) (*ScanResult, error) {
+	digest := newDigestReader(r)
+
+	var traits jobTraits
+	upload := func() (io.Reader, func(), error) { return digest, func() {}, nil }
+	if c.Spool.MaxSize > 0 && (c.retries.MaxRetries > 0 || c.HedgePercentile > 0) {
+		sp, err := newSpool(digest, c.Spool)
+		if err != nil {
+			return nil, err
+		}
+		// attempts still running, like hedges that lost, keep reading it
+		defer sp.Close()
+
+		upload = sp.open
+		traits = jobTraits{replayable: sp.replayable(), hedgeable: sp.replayable()}
+	}
+
 	jobID := c.jobID.next()
-	c.jobs <- job{
-		ID: jobID,
-		Fun: func(s *Session) jobOutput {
-			_, scan, err := s.Instream(r)
-			return jobOutput{
-				JobID:      jobID,
-				ScanResult: scan,
-				Error:      err,
-			}
-		},
-		RespChan: out,
+	result := c.submit(jobID, func(s *Session) jobOutput {
+		r, release, err := upload()
+		if err != nil {
+			return jobOutput{JobID: jobID, Error: err}
+		}
+		defer release()
+
+		_, scan, err := s.Instream(r)
+		return jobOutput{
+			JobID:      jobID,
+			ScanResult: scan,
+			Error:      err,
+		}
+	}, traits, opts)
+	if result.ScanResult != nil {
+		digest.fill(&result.ScanResult.Metadata)
 	}
-	result := <-out
+	c.metrics.scanned(result.ScanResult)
 	return result.ScanResult, result.Error
 }
 
@@ -167,7 +344,27 @@ func (s *sequence) next() uint {
 }
 
 type sessionWorker struct {
-	id uint
+	id      uint
+	backend string
+	log     Logger
+	metrics *coordinatorMetrics
+	target  *backendState
+
+	// kick wakes the worker up to recycle its session or to stop
+	kick    chan struct{}
+	recycle atomic.Bool
+	stop    atomic.Bool
+	jobs    atomic.Uint64
+
+	// mu guards what the worker is doing, for introspection
+	mu            sync.Mutex
+	status        WorkerState
+	lastHeartbeat time.Time
+	jobStarted    time.Time
+
+	// signatureVersion is the last known signature database version of
+	// the backend, refreshed on every heartbeat
+	signatureVersion string
 }
 
 type jobOutput struct {
@@ -175,6 +372,8 @@ type jobOutput struct {
 	Resp       string
 	ScanResult *ScanResult
 	Error      error
+	// Backend is the address of the backend that run the job
+	Backend string
 }
 
 type jobFun func(s *Session) jobOutput
@@ -183,42 +382,248 @@ type job struct {
 	ID       uint
 	Fun      jobFun
 	RespChan chan<- jobOutput
+	Enqueued time.Time
+	Priority Priority
+	Tenant   string
+	Weight   float64
+	Timeout  time.Duration
+
+	// Attempt counts the retries of the job
+	Attempt int
+	// Avoid is the backend the job should not run on, if possible
+	Avoid string
+	// Hedgeable jobs can be duplicated, so their latency is tracked
+	Hedgeable bool
+
+	// state and backend are guarded by the queue lock, started is closed
+	// when a worker of backend pops the job
+	state   jobState
+	backend string
+	started chan struct{}
 }
 
-func (w *sessionWorker) run(clamd *Clamd, opts SessionOpts, jobs chan job) error {
-	s, err := OpenSessionWithOpts(clamd, opts)
-	if err != nil {
-		return err
+func newJob(jobID uint, fun jobFun, out chan<- jobOutput, o jobOptions) *job {
+	return &job{
+		ID:       jobID,
+		Fun:      fun,
+		RespChan: out,
+		Enqueued: time.Now(),
+		Priority: o.priority,
+		Tenant:   o.tenant,
+		Weight:   o.weight,
+		Timeout:  o.timeout,
+		started:  make(chan struct{}),
 	}
+}
+
+// run serves the jobs of the queue until it is closed or the worker is
+// stopped.  When the session fails, the worker opens another one as soon as
+// the circuit breaker of the backend allows it, or on the next heartbeat.
+func (w *sessionWorker) run(clamd *Clamd, opts SessionOpts, queue *jobQueue) {
+	s := w.connect(clamd, opts)
 
 	heartbeatTicker := time.NewTicker(opts.HeartbeatInterval)
 
 	defer func() {
 		heartbeatTicker.Stop()
-		s.Close()
-		fmt.Printf("[worker %d] closed gracefully\n", w.id)
+		if s != nil {
+			s.Close()
+		}
+		w.log.Debug().Uint("workerId", w.id).Msg("worker closed gracefully")
 	}()
 
+	breaker := w.target.breaker
 	for {
+		if closed, _ := queue.idle(); closed || w.stop.Load() {
+			// coordinator is shutting down and no jobs are left, or the
+			// worker has been removed, meaning this session worker should
+			// be gracefully closed
+			return
+		}
+
+		if w.recycle.Swap(false) && s != nil {
+			s.Close()
+			s = nil
+			w.log.Info().Uint("workerId", w.id).Str("backend", w.backend).Msg("session recycled")
+		}
+
+		if s == nil && breaker.ready() {
+			s = w.connect(clamd, opts)
+		}
+
+		enabled, toggled := w.target.enabled()
+		serving := false
+		if s != nil && enabled {
+			probe, ok := breaker.acquire()
+			if ok {
+				if job := queue.pop(w.backend); job != nil {
+					// launch the job and return result on the client response channel
+					result, poisoned := w.process(s, job)
+					breaker.done(probe, backendFailed(result.Error))
+					job.RespChan <- result
+
+					if poisoned {
+						// clamd may still be stuck on the job or the session may be
+						// out of sync, start over
+						_ = s.abort()
+						s = nil
+					}
+					continue
+				}
+				breaker.release(probe)
+			}
+			serving = ok
+		}
+
+		switch {
+		case serving:
+			w.setStatus(WorkerIdle)
+		case s != nil:
+			w.setStatus(WorkerPaused)
+		default:
+			w.setStatus(WorkerDisconnected)
+		}
+
+		_, wake := queue.idle()
+		wait, changed := breaker.wait()
+
+		var reopen <-chan time.Time
+		var closing <-chan struct{}
+		if !serving {
+			// leave wake ups to the workers that can serve jobs
+			wake = nil
+			closing = queue.closing()
+			if wait > 0 {
+				reopen = time.After(wait)
+			}
+		}
+
 		select {
 		case <-heartbeatTicker.C:
-			if _, err := s.heartbeat(); err != nil {
-				// this worker died
-				return fmt.Errorf("[worker %d] missed heartbeat: %w", w.id, err)
+			if s == nil {
+				// try again to connect
+				continue
 			}
-			fmt.Printf("[worker %d] heartbeat\n", w.id)
-		case job, channelOpen := <-jobs:
-			if !channelOpen {
-				// client closed the channel, meaning this session
-				// worker should be gracefully closed
-				return nil
+			if _, err := s.heartbeat(); err != nil {
+				breaker.failure()
+				w.log.Warn().Err(err).Uint("workerId", w.id).Str("backend", w.backend).Msg("missed heartbeat")
+				_ = s.abort()
+				s = nil
+				continue
 			}
+			w.alive()
+			w.refreshSignatureVersion(s)
+			w.log.Trace().Uint("workerId", w.id).Msg("heartbeat")
+		case <-wake:
+		case <-w.kick:
+		case <-toggled:
+		case <-changed:
+		case <-reopen:
+		case <-closing:
+			// jobs left, if any, are up to the workers that can serve them
+			return
+		}
+	}
+}
+
+// process runs a job, accounting it to the worker and its backend.
+func (w *sessionWorker) process(s *Session, job *job) (jobOutput, bool) {
+	w.setStatus(WorkerBusy)
+	w.target.inFlight.Add(1)
+	defer w.target.inFlight.Add(-1)
 
-			// launch the job and return result on the client response channel
-			fmt.Printf("[job %d] processing by worker %d...\n", job.ID, w.id)
-			result := job.Fun(s)
-			fmt.Printf("[job %d] processed by worker %d\n", job.ID, w.id)
-			job.RespChan <- result
+	result, poisoned := w.runJob(s, job)
+
+	w.jobs.Add(1)
+	w.target.processed.Add(1)
+	if !poisoned {
+		w.alive()
+	}
+	return result, poisoned
+}
+
+// runJob runs a job on the session, aborting the session if the job
+// exceeds its timeout.  It returns whether the session is no longer
+// usable, after timeouts and transport errors.
+func (w *sessionWorker) runJob(s *Session, job *job) (jobOutput, bool) {
+	w.log.Trace().Uint("jobId", job.ID).Uint("workerId", w.id).Msg("processing job")
+	start := time.Now()
+
+	var timer *time.Timer
+	if job.Timeout > 0 {
+		timer = time.AfterFunc(job.Timeout, func() {
+			_ = s.abort()
+		})
+	}
+
+	result := job.Fun(s)
+
+	aborted := timer != nil && !timer.Stop()
+	if aborted {
+		w.metrics.jobTimeouts.Add(1)
+		w.log.Warn().
+			Uint("jobId", job.ID).
+			Uint("workerId", w.id).
+			Str("backend", w.backend).
+			Str("timeout", job.Timeout.String()).
+			Msg("job timeout, discarding session")
+
+		// the job may have completed right before the abort
+		if result.Error != nil {
+			result = jobOutput{
+				JobID: job.ID,
+				Error: fmt.Errorf("%w: aborted after %s", ErrJobTimeout, job.Timeout),
+			}
 		}
 	}
+
+	result.Backend = w.backend
+	w.fillMetadata(&result, job.Enqueued, start)
+	w.metrics.jobCompleted(time.Since(start))
+	if job.Hedgeable && result.Error == nil {
+		w.metrics.scanLatencies.record(time.Since(start))
+	}
+	w.log.Trace().Uint("jobId", job.ID).Uint("workerId", w.id).Msg("job processed")
+
+	// abandoned jobs did not even start on the session
+	poisoned := aborted || (result.Error != nil && !errors.Is(result.Error, errAbandoned))
+	return result, poisoned
+}
+
+// connect opens a session, reporting failures to the circuit breaker.
+func (w *sessionWorker) connect(clamd *Clamd, opts SessionOpts) *Session {
+	w.setStatus(WorkerConnecting)
+	s, err := OpenSessionWithOpts(clamd, opts)
+	if err != nil {
+		w.target.breaker.failure()
+		w.log.Warn().Err(err).Uint("workerId", w.id).Str("backend", w.backend).Msg("unable to open session")
+		return nil
+	}
+
+	w.refreshSignatureVersion(s)
+	w.log.Debug().Uint("workerId", w.id).Str("backend", w.backend).Msg("session opened")
+
+	return s
+}
+
+// fillMetadata adds to a job result what only the worker knows.
+func (w *sessionWorker) fillMetadata(result *jobOutput, enqueued time.Time, start time.Time) {
+	if result.ScanResult == nil {
+		return
+	}
+
+	meta := &result.ScanResult.Metadata
+	meta.QueueDuration = start.Sub(enqueued)
+	meta.ScanDuration = time.Since(start)
+	meta.WorkerID = w.id
+	meta.Backend = w.backend
+	meta.SignatureVersion = w.signatureVersion
+}
+
+// refreshSignatureVersion asks clamd for its signature version.  Failures
+// are ignored: the version is informational and the last known one is kept.
+func (w *sessionWorker) refreshSignatureVersion(s *Session) {
+	if _, version, err := s.Version(); err == nil {
+		w.signatureVersion = parseSignatureVersion(version)
+	}
 }
@@ -1,11 +1,15 @@
 package clamd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
 )
 
 func TestCoordinator_6InStream(t *testing.T) {
@@ -223,3 +227,118 @@ func TestCoordinator_Mix1(t *testing.T) {
 		t.Errorf("Expected err")
 	}
 }
+
+func TestCoordinator_Drain(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(200 * time.Millisecond)
+
+	c := Coordinator{MinWorkers: 2, MaxWorkers: 2, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one scan running, one queued
+	inFlight := make(chan error, 2)
+	for range 3 {
+		go func() {
+			_, err := c.Instream(strings.NewReader("in flight"))
+			inFlight <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := c.Ready(); err != nil {
+		t.Errorf("expected ready coordinator, got %v", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- c.Drain(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := c.Ready(); !errors.Is(err, ErrCoordinatorClosed) {
+		t.Errorf("expected not ready while draining, got %v", err)
+	}
+	if _, err := c.Ping(); !errors.Is(err, ErrCoordinatorClosed) {
+		t.Errorf("expected new jobs rejected, got %v", err)
+	}
+
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if completed := c.Metrics().Completed; completed != 3 {
+		t.Errorf("drain returned before in-flight scans completed, %d of 3", completed)
+	}
+	for range 3 {
+		if err := <-inFlight; err != nil {
+			t.Errorf("expected in-flight scans completed, got %v", err)
+		}
+	}
+
+	// the fake clamd reads END asynchronously
+	opened, ended := fake.Sessions()
+	for deadline := time.Now().Add(time.Second); ended < opened && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		opened, ended = fake.Sessions()
+	}
+	if opened != 2 || ended != 2 {
+		t.Errorf("expected 2 sessions ended, got %d of %d", ended, opened)
+	}
+}
+
+func TestCoordinator_VerdictMetrics(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	for _, content := range []string{"clean", clamdtest.EICAR, "clean again"} {
+		if _, err := c.Instream(strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := c.Metrics()
+	if m.Clean != 2 || m.Infected != 1 || m.ScanErrors != 0 {
+		t.Errorf("expected 2 clean, 1 infected and no errors, got %d, %d and %d", m.Clean, m.Infected, m.ScanErrors)
+	}
+}
+
+func TestCoordinator_DrainTimeout(t *testing.T) {
+	fake := newFakeClamd(t)
+	fake.SetScanDelay(time.Minute)
+
+	c := Coordinator{MinWorkers: 1, MaxWorkers: 1, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _, _ = c.Instream(strings.NewReader("stuck")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := c.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected drain timeout, got %v", err)
+	}
+}
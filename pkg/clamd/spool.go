@@ -0,0 +1,188 @@
+package clamd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// errAbandoned fails the jobs that start reading a spool after the caller
+// has given up on them, e.g. hedges that lost the race.  The session is
+// left untouched.
+var errAbandoned = errors.New("job abandoned by the caller")
+
+// SpoolOpts bounds the buffer where uploads are kept to replay them when
+// INSTREAM is retried or hedged.
+type SpoolOpts struct {
+	// MemoryLimit is how much of an upload is kept in memory, the rest
+	// goes to a temporary file
+	MemoryLimit int64
+	// MaxSize is the size of the largest upload spooled, larger ones are
+	// streamed once without retries.  Zero disables spooling
+	MaxSize int64
+	// Dir is where temporary files are created, the system default if
+	// empty
+	Dir string
+}
+
+// spool is an upload buffered in memory or in a temporary file, that can
+// be read many times, even concurrently.
+type spool struct {
+	mem  []byte
+	file *os.File
+	size int64
+
+	// rest is the part of the upload beyond the max size, if any
+	rest io.Reader
+
+	// mu guards the readers opened and whether the spool is closed: the
+	// temporary file is deleted once both closed and no longer read
+	mu      sync.Mutex
+	readers int
+	closed  bool
+}
+
+// newSpool buffers r within the bounds of opts.  Errors reading r are
+// ErrUpload, the others are about the temporary file.
+func newSpool(r io.Reader, opts SpoolOpts) (*spool, error) {
+	memLimit := min(opts.MemoryLimit, opts.MaxSize)
+	upload := &uploadReader{r: r}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, upload, memLimit+1)
+	if errors.Is(err, io.EOF) {
+		return &spool{mem: buf.Bytes(), size: n}, nil
+	}
+	if err != nil {
+		return nil, upload.wrap(err)
+	}
+
+	if memLimit >= opts.MaxSize {
+		// too big to spool
+		return &spool{mem: buf.Bytes(), size: n, rest: r}, nil
+	}
+
+	f, err := os.CreateTemp(opts.Dir, "restclam-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to spool upload: %w", err)
+	}
+	s := &spool{file: f}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("unable to spool upload: %w", err)
+	}
+	m, err := io.CopyN(f, upload, opts.MaxSize-n+1)
+	s.size = n + m
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return s, nil
+	case err != nil:
+		_ = s.Close()
+		return nil, upload.wrap(err)
+	default:
+		// too big to spool
+		s.rest = r
+		return s, nil
+	}
+}
+
+// uploadReader remembers if reading the upload failed, to tell it from
+// failures writing the spool.
+type uploadReader struct {
+	r      io.Reader
+	failed bool
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		u.failed = true
+	}
+	return n, err
+}
+
+// wrap describes an error spooling the upload.
+func (u *uploadReader) wrap(err error) error {
+	if u.failed {
+		return fmt.Errorf("%w: %w", ErrUpload, err)
+	}
+	return fmt.Errorf("unable to spool upload: %w", err)
+}
+
+// replayable tells if the whole upload was spooled.
+func (s *spool) replayable() bool {
+	return s.rest == nil
+}
+
+// reader returns a new reader of the upload.  If the upload is not
+// replayable, only the first reader returns it whole.
+func (s *spool) reader() io.Reader {
+	var spooled io.Reader
+	if s.file != nil {
+		spooled = io.NewSectionReader(s.file, 0, s.size)
+	} else {
+		spooled = bytes.NewReader(s.mem)
+	}
+
+	if s.rest != nil {
+		return io.MultiReader(spooled, s.rest)
+	}
+	return spooled
+}
+
+// open returns a new reader of the upload and the function to call once
+// done reading it.  It fails with errAbandoned after Close.
+func (s *spool) open() (io.Reader, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, nil, errAbandoned
+	}
+	s.readers++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.readers--
+			if s.closed && s.readers == 0 {
+				_ = s.remove()
+			}
+		})
+	}
+	return s.reader(), release, nil
+}
+
+// Close deletes the temporary file, if any, as soon as the readers opened
+// are released.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.readers > 0 {
+		return nil
+	}
+	return s.remove()
+}
+
+// remove deletes the temporary file, if any, with the lock held.
+func (s *spool) remove() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	if removeErr := os.Remove(s.file.Name()); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
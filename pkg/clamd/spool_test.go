@@ -0,0 +1,117 @@
+package clamd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool_Memory(t *testing.T) {
+	sp, err := newSpool(strings.NewReader("small upload"), SpoolOpts{MemoryLimit: 100, MaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	if sp.file != nil {
+		t.Error("expected upload in memory")
+	}
+	assertReplays(t, sp, "small upload")
+}
+
+func TestSpool_Disk(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("x", 500)
+
+	sp, err := newSpool(strings.NewReader(content), SpoolOpts{MemoryLimit: 100, MaxSize: 1000, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sp.file == nil {
+		t.Fatal("expected upload on disk")
+	}
+	assertReplays(t, sp, content)
+
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected temp file removed, found %d files", len(entries))
+	}
+}
+
+func TestSpool_TooBig(t *testing.T) {
+	content := strings.Repeat("x", 2000)
+
+	sp, err := newSpool(strings.NewReader(content), SpoolOpts{MemoryLimit: 100, MaxSize: 1000, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	if sp.replayable() {
+		t.Error("expected not replayable upload")
+	}
+	got, err := io.ReadAll(sp.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("expected whole upload on first read, got %d bytes", len(got))
+	}
+}
+
+func TestSpool_ReadAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("x", 500)
+
+	sp, err := newSpool(strings.NewReader(content), SpoolOpts{MemoryLimit: 100, MaxSize: 1000, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, release, err := sp.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller is done while another attempt is still reading
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sp.open(); !errors.Is(err, errAbandoned) {
+		t.Errorf("expected errAbandoned opening a closed spool, got %v", err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("expected %d bytes, got %d", len(content), len(got))
+	}
+
+	release()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected temp file removed after the last reader, found %d files", len(entries))
+	}
+}
+
+func assertReplays(t *testing.T, sp *spool, expected string) {
+	t.Helper()
+
+	if !sp.replayable() {
+		t.Fatal("expected replayable upload")
+	}
+	for range 2 {
+		got, err := io.ReadAll(sp.reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("expected %d bytes, got %d", len(expected), len(got))
+		}
+	}
+}
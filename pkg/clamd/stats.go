@@ -0,0 +1,107 @@
+package clamd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Stats is the reply of the STATS command.
+type Stats struct {
+	Pools   int
+	State   string
+	Threads ThreadStats
+	// Queue is the number of commands waiting for a thread
+	Queue  int
+	Memory MemoryStats
+}
+
+// ThreadStats are the threads of clamd.
+type ThreadStats struct {
+	Live        int
+	Idle        int
+	Max         int
+	IdleTimeout int
+}
+
+// MemoryStats is the memory used by clamd, as reported: sizes have a unit
+// suffix like 1369.103M, or are N/A where unavailable.
+type MemoryStats struct {
+	Heap       string
+	Mmap       string
+	Used       string
+	Free       string
+	Releasable string
+	Pools      int
+	PoolsUsed  string
+	PoolsTotal string
+}
+
+// ParseStats parses the reply of the STATS command.  Unknown lines, like
+// the commands in the queue, are ignored.
+func ParseStats(reply string) (Stats, error) {
+	var s Stats
+	for _, line := range strings.Split(reply, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "POOLS":
+			s.Pools, err = strconv.Atoi(value)
+		case "STATE":
+			s.State = value
+		case "THREADS":
+			f := fields(value)
+			s.Threads = ThreadStats{
+				Live:        atoi(f["live"], &err),
+				Idle:        atoi(f["idle"], &err),
+				Max:         atoi(f["max"], &err),
+				IdleTimeout: atoi(f["idle-timeout"], &err),
+			}
+		case "QUEUE":
+			s.Queue, err = strconv.Atoi(strings.TrimSuffix(value, " items"))
+		case "MEMSTATS":
+			f := fields(value)
+			s.Memory = MemoryStats{
+				Heap:       f["heap"],
+				Mmap:       f["mmap"],
+				Used:       f["used"],
+				Free:       f["free"],
+				Releasable: f["releasable"],
+				Pools:      atoi(f["pools"], &err),
+				PoolsUsed:  f["pools_used"],
+				PoolsTotal: f["pools_total"],
+			}
+		}
+		if err != nil {
+			return Stats{}, fmt.Errorf("%w: unparseable stats line '%s': %w", ErrClamd, line, err)
+		}
+	}
+	return s, nil
+}
+
+// fields parses a list of "name value" pairs.
+func fields(s string) map[string]string {
+	f := strings.Fields(s)
+	m := make(map[string]string, len(f)/2)
+	for i := 0; i+1 < len(f); i += 2 {
+		m[f[i]] = f[i+1]
+	}
+	return m
+}
+
+// atoi parses s, zero if empty, keeping the first error.
+func atoi(s string, err *error) int {
+	if s == "" || s == "N/A" {
+		return 0
+	}
+	n, e := strconv.Atoi(s)
+	if e != nil && *err == nil {
+		*err = e
+	}
+	return n
+}
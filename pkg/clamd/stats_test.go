@@ -0,0 +1,50 @@
+package clamd
+
+import (
+	"testing"
+)
+
+func TestParseStats(t *testing.T) {
+	reply := `POOLS: 1
+
+STATE: VALID PRIMARY
+THREADS: live 3  idle 1 max 12 idle-timeout 30
+QUEUE: 2 items
+	INSTREAM 0.000172
+	INSTREAM 0.000095
+STATS 0.000011
+
+MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1369.103M pools_total 1369.152M
+END`
+
+	stats, err := ParseStats(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Stats{
+		Pools:   1,
+		State:   "VALID PRIMARY",
+		Threads: ThreadStats{Live: 3, Idle: 1, Max: 12, IdleTimeout: 30},
+		Queue:   2,
+		Memory: MemoryStats{
+			Heap:       "N/A",
+			Mmap:       "N/A",
+			Used:       "N/A",
+			Free:       "N/A",
+			Releasable: "N/A",
+			Pools:      1,
+			PoolsUsed:  "1369.103M",
+			PoolsTotal: "1369.152M",
+		},
+	}
+	if stats != want {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+}
+
+func TestParseStats_Invalid(t *testing.T) {
+	if _, err := ParseStats("THREADS: live many idle 0 max 12 idle-timeout 30"); err == nil {
+		t.Error("expected error on invalid thread count")
+	}
+}
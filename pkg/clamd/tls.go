@@ -0,0 +1,134 @@
+package clamd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+// TLSOpts describe how to secure connections to a clamd behind TLS, like
+// a clamd fronted by stunnel or by a TLS terminating proxy.
+type TLSOpts struct {
+	// CAFile is a PEM bundle of the CAs to trust; the system ones if empty
+	CAFile string
+	// CertFile is the PEM client certificate, for mutual TLS
+	CertFile string
+	// KeyFile is the PEM key of the client certificate
+	KeyFile string
+	// ServerName is the name to verify the server certificate against;
+	// the host of the clamd address if empty
+	ServerName string
+	// InsecureSkipVerify disables server certificate verification.
+	// Use it only in development
+	InsecureSkipVerify bool
+	// ReloadInterval is how often a TLSReloader checks if the files
+	// changed, 30s if zero
+	ReloadInterval time.Duration
+}
+
+// TLSConfig builds the TLS client configuration described by the options.
+func (o TLSOpts) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to read CA file: %w", ErrClamd, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in CA file %s", ErrClamd, o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to load client certificate: %w", ErrClamd, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// TLSReloader serves the TLS client configuration of TLSOpts, loading the
+// CA and the client certificate again when their files change, e.g. when
+// rotated.  If they cannot be loaded, the previous configuration is kept.
+type TLSReloader struct {
+	opts     TLSOpts
+	interval time.Duration
+
+	mu        sync.Mutex
+	current   *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// NewTLSReloader loads the TLS configuration of the options.
+func NewTLSReloader(o TLSOpts) (*TLSReloader, error) {
+	r := &TLSReloader{opts: o, interval: o.ReloadInterval}
+	if r.interval == 0 {
+		r.interval = defaultTLSReloadInterval
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reloadLocked(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+// Config returns the current TLS configuration, reloading it if the files
+// changed.
+func (r *TLSReloader) Config() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= r.interval {
+		r.lastCheck = time.Now()
+		// on errors the previous config is kept, connections tell if it
+		// is no longer valid
+		_ = r.reloadLocked()
+	}
+	return r.current
+}
+
+func (r *TLSReloader) reloadLocked() error {
+	var modTimes []time.Time
+	for _, f := range []string{r.opts.CAFile, r.opts.CertFile, r.opts.KeyFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrClamd, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	if r.current != nil && slices.Equal(modTimes, r.modTimes) {
+		return nil
+	}
+
+	cfg, err := r.opts.TLSConfig()
+	if err != nil {
+		return err
+	}
+	r.current = cfg
+	r.modTimes = modTimes
+	return nil
+}
@@ -0,0 +1,167 @@
+package clamd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+)
+
+func TestConnect_TLS(t *testing.T) {
+	caFile, serverCert := selfSignedCert(t)
+
+	fake, err := clamdtest.NewTLSServer(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	tlsConfig, err := TLSOpts{CAFile: caFile}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Clamd{Network: "tcp", Address: fake.Address(), TLS: tlsConfig}
+	pong, err := c.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong != "PONG" {
+		t.Errorf("Expected 'PONG', got %s", pong)
+	}
+}
+
+func TestConnect_TLSUntrusted(t *testing.T) {
+	_, serverCert := selfSignedCert(t)
+
+	fake, err := clamdtest.NewTLSServer(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	// system CAs do not trust the self signed certificate
+	tlsConfig, err := TLSOpts{}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Clamd{Network: "tcp", Address: fake.Address(), TLS: tlsConfig}
+	if _, err := c.Ping(); err == nil {
+		t.Error("Expected TLS verification error")
+	}
+}
+
+func TestConnect_TLSReloader(t *testing.T) {
+	caFile, _ := selfSignedCert(t)
+	rotatedCAFile, serverCert := selfSignedCert(t)
+
+	fake, err := clamdtest.NewTLSServer(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	reloader, err := NewTLSReloader(TLSOpts{CAFile: caFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Clamd{Network: "tcp", Address: fake.Address(), TLSReloader: reloader}
+	if _, err := c.Ping(); err == nil {
+		t.Fatal("Expected TLS verification error before rotation")
+	}
+
+	// rotate the CA in place
+	rotated, err := os.ReadFile(rotatedCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, rotated, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Ping(); err != nil {
+		t.Errorf("Expected rotated CA to be trusted, got %v", err)
+	}
+}
+
+func TestConnect_Dialer(t *testing.T) {
+	fake := newFakeClamd(t)
+
+	dials := 0
+	c := Clamd{
+		Network: "custom",
+		Address: "ignored",
+		Dialer: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			dials++
+			return (&net.Dialer{}).DialContext(ctx, fake.Network(), fake.Address())
+		},
+	}
+
+	if _, err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 {
+		t.Errorf("Expected custom dialer to be used once, got %d", dials)
+	}
+}
+
+// selfSignedCert creates a certificate for 127.0.0.1, returning the path of
+// its PEM and the certificate itself.
+func selfSignedCert(t *testing.T) (string, tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clamd"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
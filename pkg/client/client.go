@@ -0,0 +1,398 @@
+// Package client is a client of the v1 API of restclam.
+//
+// Requests failing with errors that may go away, like an overloaded
+// server or a transport error, are retried with backoff.  Errors replied
+// by the server are *Error, wrapping one error per code to test with
+// errors.Is:
+//
+//	result, err := c.ScanFile(ctx, "upload.pdf")
+//	if errors.Is(err, client.ErrOverloaded) {
+//		// still overloaded after the retries
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/backoff"
+)
+
+// Headers of the scan options, like the server's.
+const (
+	priorityHeader = "X-Scan-Priority"
+	timeoutHeader  = "X-Scan-Timeout"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultMaxRetries   = 3
+	defaultPollInterval = time.Second
+)
+
+var defaultBackoff = backoff.Config{
+	Strategy: backoff.DecorrelatedJitter,
+	Initial:  100 * time.Millisecond,
+	Max:      5 * time.Second,
+}
+
+// errNotReplayable stops the retries of a request whose body cannot be
+// read again.
+var errNotReplayable = errors.New("request body not replayable")
+
+// Config configures a Client.
+type Config struct {
+	// BaseURL is the URL of the server, e.g. https://restclam.example.com
+	BaseURL string
+	// APIKey is sent in APIKeyHeader, X-API-Key by default
+	APIKey       string
+	APIKeyHeader string
+	// Token is sent as bearer token, e.g. a JWT
+	Token string
+	// HTTPClient sends the requests, a new http.Client by default
+	HTTPClient *http.Client
+	// MaxRetries is how many times failed requests are retried, 3 by
+	// default, negative not to retry
+	MaxRetries int
+	// Backoff is the delay between retries, a decorrelated jitter from
+	// 100ms to 5s by default.  The Retry-After of the server is honored
+	// when longer.
+	Backoff *backoff.Config
+}
+
+// Client calls the v1 API of a restclam server.  It is safe for
+// concurrent use.
+type Client struct {
+	base       string
+	http       *http.Client
+	headers    http.Header
+	maxRetries int
+	backoff    backoff.Func
+}
+
+// New returns a client of the server of c.
+func New(c Config) (*Client, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("%w: base URL %q is not an absolute URL", ErrInvalidConfig, c.BaseURL)
+	}
+
+	backoffConf := defaultBackoff
+	if c.Backoff != nil {
+		backoffConf = *c.Backoff
+	}
+	bo, err := backoff.New(backoffConf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	headers := http.Header{}
+	if c.APIKey != "" {
+		header := c.APIKeyHeader
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		headers.Set(header, c.APIKey)
+	}
+	if c.Token != "" {
+		headers.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	maxRetries := c.MaxRetries
+	switch {
+	case maxRetries == 0:
+		maxRetries = defaultMaxRetries
+	case maxRetries < 0:
+		maxRetries = 0
+	}
+
+	return &Client{
+		base:       strings.TrimSuffix(base.String(), "/"),
+		http:       httpClient,
+		headers:    headers,
+		maxRetries: maxRetries,
+		backoff:    bo,
+	}, nil
+}
+
+// ScanOption tunes a scan.
+type ScanOption func(h http.Header)
+
+// WithPriority sets the priority class of the scan, "interactive" or
+// "bulk".  Interactive requires the interactive scope.
+func WithPriority(priority string) ScanOption {
+	return func(h http.Header) {
+		h.Set(priorityHeader, priority)
+	}
+}
+
+// WithTimeout sets how long clamd may take to scan, capped by the server.
+func WithTimeout(d time.Duration) ScanOption {
+	return func(h http.Header) {
+		h.Set(timeoutHeader, d.String())
+	}
+}
+
+// Ping checks that the server reaches clamd, returning its reply.
+func (c *Client) Ping(ctx context.Context) (string, error) {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/clamav/ping", nil, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+// ScanFile scans the file at path.
+func (c *Client) ScanFile(ctx context.Context, path string, opts ...ScanOption) (*ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return c.ScanReader(ctx, filepath.Base(path), f, opts...)
+}
+
+// ScanReader scans the content of r, streamed to the server as it is
+// read.  The scan is retried only if r is an io.Seeker, to read it again.
+func (c *Client) ScanReader(ctx context.Context, name string, r io.Reader, opts ...ScanOption) (*ScanResult, error) {
+	var result ScanResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/clamav/scan", upload(name, r), opts, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ScanMany scans the files at paths, concurrency at a time, returning
+// their results in the order of paths.
+func (c *Client) ScanMany(ctx context.Context, paths []string, concurrency int, opts ...ScanOption) []FileResult {
+	results := make([]FileResult, len(paths))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result, err := c.ScanFile(ctx, paths[i], opts...)
+				results[i] = FileResult{Path: paths[i], Result: result, Err: err}
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// SubmitJob uploads the content of r to be scanned in the background,
+// returning the pending job to poll with Job or WaitJob.
+func (c *Client) SubmitJob(ctx context.Context, name string, r io.Reader, opts ...ScanOption) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, http.MethodPost, "/api/v1/clamav/jobs", upload(name, r), opts, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Job returns the current state of the job.  Jobs are kept for a while
+// after they finish, then they are ErrNotFound.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, http.MethodGet, "/api/v1/clamav/jobs/"+url.PathEscape(id), nil, nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls the job every interval, one second if not positive, until
+// it finishes.  The error of a failed job is returned as *Error.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*ScanResult, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		job, err := c.Job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case job.Status == JobFailed && job.Error != nil:
+			return nil, job.Error
+		case job.Done():
+			return job.Result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// body returns the body of an attempt of a request and its content type.
+type body func() (io.Reader, string, error)
+
+// upload returns the multipart body of a file upload, streamed from r.
+func upload(name string, r io.Reader) body {
+	seeker, _ := r.(io.Seeker)
+	start := int64(-1)
+	attempts := 0
+	// copied is closed when the previous attempt stops reading r
+	var copied chan struct{}
+
+	return func() (io.Reader, string, error) {
+		attempts++
+		if copied != nil {
+			<-copied
+		}
+		switch {
+		case attempts > 1 && seeker == nil:
+			return nil, "", errNotReplayable
+		case seeker != nil && start < 0:
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, "", err
+			}
+			start = offset
+		case seeker != nil:
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, "", err
+			}
+		}
+
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		copied = make(chan struct{})
+		go func() {
+			defer close(copied)
+			part, err := mw.CreateFormFile("file", name)
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, mw.FormDataContentType(), nil
+	}
+}
+
+// do sends a request, retrying while the errors may go away, and decodes
+// the response into v.
+func (c *Client) do(ctx context.Context, method string, path string, b body, opts []ScanOption, v any) error {
+	var lastErr error
+	for retry := 0; ; retry++ {
+		var r io.Reader
+		var contentType string
+		if b != nil {
+			var err error
+			r, contentType, err = b()
+			if errors.Is(err, errNotReplayable) && lastErr != nil {
+				return lastErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err := c.send(ctx, method, path, r, contentType, opts, v)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		wait, ok := c.retryDelay(ctx, err, retry)
+		if !ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying after err, if the
+// request should be retried.
+func (c *Client) retryDelay(ctx context.Context, err error, retry int) (time.Duration, bool) {
+	if retry >= c.maxRetries || ctx.Err() != nil {
+		return 0, false
+	}
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		// transport errors
+		var urlErr *url.Error
+		return c.backoff(retry), errors.As(err, &urlErr)
+	}
+	if !apiErr.retryable() {
+		return 0, false
+	}
+	return max(c.backoff(retry), apiErr.RetryAfter), true
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body io.Reader, contentType string, opts []ScanOption, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, opt := range opts {
+		opt(req.Header)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		// proxies and internal errors may not reply an error body
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return apiErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: invalid response: %w", ErrServer, err)
+	}
+	return nil
+}
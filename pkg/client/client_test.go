@@ -0,0 +1,324 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/backoff"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+	"github.com/tomrss/restclam/pkg/server/api"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+const (
+	testAPIKey  = "test-key"
+	otherAPIKey = "other-key"
+)
+
+func TestPing(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+
+	// execute
+	pong, err := srv.client(t, testAPIKey).Ping(context.Background())
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, "PONG", pong)
+}
+
+func TestScanFile(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	c := srv.client(t, testAPIKey)
+	clean, infected := writeTestFiles(t)
+
+	// execute
+	cleanResult, cleanErr := c.ScanFile(context.Background(), clean)
+	infectedResult, infectedErr := c.ScanFile(context.Background(), infected, WithPriority("bulk"), WithTimeout(time.Minute))
+
+	// assert
+	require.NoError(t, cleanErr)
+	assert.Equal(t, StatusOK, cleanResult.Status)
+	assert.Equal(t, "clean.txt", cleanResult.Filename)
+	assert.Equal(t, int64(5), cleanResult.Metadata.Size)
+	require.NoError(t, infectedErr)
+	assert.True(t, infectedResult.Infected())
+	assert.Equal(t, clamdtest.EICARSignature, infectedResult.Virus)
+}
+
+func TestScanReader(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	c := srv.client(t, testAPIKey)
+	content := strings.Repeat("stream ", 100_000)
+
+	// execute, not seekable
+	result, err := c.ScanReader(context.Background(), "stream.txt", io.MultiReader(strings.NewReader(content)))
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, result.Status)
+	assert.Equal(t, int64(len(content)), result.Metadata.Size)
+}
+
+func TestScanMany(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	c := srv.client(t, testAPIKey)
+	clean, infected := writeTestFiles(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	// execute
+	results := c.ScanMany(context.Background(), []string{infected, missing, clean}, 2)
+
+	// assert
+	require.Len(t, results, 3)
+	assert.Equal(t, infected, results[0].Path)
+	require.NoError(t, results[0].Err)
+	assert.True(t, results[0].Result.Infected())
+	assert.ErrorIs(t, results[1].Err, os.ErrNotExist)
+	require.NoError(t, results[2].Err)
+	assert.Equal(t, StatusOK, results[2].Result.Status)
+}
+
+func TestJobs(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	c := srv.client(t, testAPIKey)
+
+	// execute
+	job, err := c.SubmitJob(context.Background(), "eicar.com", strings.NewReader(clamdtest.EICAR))
+	require.NoError(t, err)
+	result, waitErr := c.WaitJob(context.Background(), job.ID, 10*time.Millisecond)
+	finished, getErr := c.Job(context.Background(), job.ID)
+	_, otherErr := srv.client(t, otherAPIKey).Job(context.Background(), job.ID)
+	_, unknownErr := c.Job(context.Background(), "unknown")
+
+	// assert
+	assert.Equal(t, JobPending, job.Status)
+	assert.Equal(t, "eicar.com", job.Filename)
+	require.NoError(t, waitErr)
+	assert.Equal(t, clamdtest.EICARSignature, result.Virus)
+	require.NoError(t, getErr)
+	assert.Equal(t, JobCompleted, finished.Status)
+	assert.NotNil(t, finished.FinishedAt)
+	assert.ErrorIs(t, otherErr, ErrNotFound, "jobs are visible to their owner only")
+	assert.ErrorIs(t, unknownErr, ErrNotFound)
+}
+
+func TestJobFailed(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	srv.fake.SetScanDelay(time.Second)
+	c := srv.client(t, testAPIKey)
+
+	// execute
+	job, err := c.SubmitJob(context.Background(), "slow.txt", strings.NewReader("slow"), WithTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	_, waitErr := c.WaitJob(context.Background(), job.ID, 10*time.Millisecond)
+
+	// assert
+	assert.ErrorIs(t, waitErr, ErrScanTimeout)
+	var apiErr *Error
+	require.ErrorAs(t, waitErr, &apiErr)
+	assert.Equal(t, CodeScanTimeout, apiErr.Code)
+}
+
+func TestErrors(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	clean, _ := writeTestFiles(t)
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		opts     []ScanOption
+		expected error
+		status   int
+	}{
+		{"unauthorized", "wrong", nil, ErrUnauthorized, http.StatusUnauthorized},
+		{"forbidden priority", testAPIKey, []ScanOption{WithPriority("interactive")}, ErrForbidden, http.StatusForbidden},
+		{"invalid timeout", testAPIKey, []ScanOption{WithTimeout(-time.Second)}, ErrBadRequest, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// execute
+			_, err := srv.client(t, tt.apiKey).ScanFile(context.Background(), clean, tt.opts...)
+
+			// assert
+			assert.ErrorIs(t, err, tt.expected)
+			var apiErr *Error
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.status, apiErr.StatusCode)
+		})
+	}
+	assert.Zero(t, srv.failed.Load(), "client errors are not retried")
+}
+
+func TestRetries(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	clean, _ := writeTestFiles(t)
+
+	t.Run("retried", func(t *testing.T) {
+		srv.failing.Store(2)
+		srv.failed.Store(0)
+
+		// execute
+		result, err := srv.client(t, testAPIKey).ScanFile(context.Background(), clean)
+
+		// assert
+		require.NoError(t, err)
+		assert.Equal(t, StatusOK, result.Status)
+		assert.Equal(t, int64(2), srv.failed.Load())
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		srv.failing.Store(10)
+		srv.failed.Store(0)
+
+		// execute
+		_, err := srv.client(t, testAPIKey).ScanFile(context.Background(), clean)
+
+		// assert
+		assert.ErrorIs(t, err, ErrOverloaded)
+		assert.Equal(t, int64(defaultMaxRetries+1), srv.failed.Load())
+	})
+
+	t.Run("not replayable", func(t *testing.T) {
+		srv.failing.Store(2)
+		srv.failed.Store(0)
+
+		// execute
+		_, err := srv.client(t, testAPIKey).ScanReader(context.Background(), "pipe", io.MultiReader(strings.NewReader("once")))
+
+		// assert
+		assert.ErrorIs(t, err, ErrOverloaded)
+		assert.Equal(t, int64(1), srv.failed.Load())
+	})
+}
+
+func TestContext(t *testing.T) {
+	// prepare
+	srv := newTestServer(t)
+	srv.fake.SetScanDelay(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// execute
+	_, err := srv.client(t, testAPIKey).ScanReader(ctx, "slow.txt", strings.NewReader("slow"))
+
+	// assert
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	// execute
+	_, urlErr := New(Config{BaseURL: "localhost:8080"})
+	_, backoffErr := New(Config{BaseURL: "http://localhost:8080", Backoff: &backoff.Config{Strategy: "random"}})
+
+	// assert
+	assert.ErrorIs(t, urlErr, ErrInvalidConfig)
+	assert.ErrorIs(t, backoffErr, ErrInvalidConfig)
+}
+
+// helpers
+
+// testServer is a restclam v1 API backed by a fake clamd, whose scans
+// fail as overloaded while failing is positive.
+type testServer struct {
+	url     string
+	fake    *clamdtest.Server
+	failing atomic.Int64
+	failed  atomic.Int64
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	fake, err := clamdtest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = fake.Close() })
+
+	c := &clamd.Coordinator{MinWorkers: 2, MaxWorkers: 2, ShutdownTimeout: time.Second}
+	err = c.InitCoordinator(
+		[]clamd.Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		clamd.SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	require.NoError(t, err)
+	t.Cleanup(c.Shutdown)
+
+	conf := config.AuthConfig{
+		Enabled:      true,
+		APIKeyHeader: "X-API-Key",
+		APIKeys: []config.APIKeyConfig{
+			{ID: "app", Hash: auth.HashKey(testAPIKey), Scopes: []string{"scan"}},
+			{ID: "other", Hash: auth.HashKey(otherAPIKey), Scopes: []string{"scan"}},
+		},
+	}
+	authenticator, err := auth.NewAuthenticator(conf)
+	require.NoError(t, err)
+
+	srv := &testServer{fake: fake}
+	overloaded := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if srv.failing.Add(-1) >= 0 {
+				srv.failed.Add(1)
+				render.Error(w, http.StatusServiceUnavailable, render.CodeOverloaded, "too many scans in progress, retry later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.Authenticate(conf, authenticator, zerolog.Nop()))
+	r.Mount("/api/v1/clamav", api.ClamavV1(c, api.NewJobs(), overloaded))
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	srv.url = server.URL
+	return srv
+}
+
+func (s *testServer) client(t *testing.T, apiKey string) *Client {
+	t.Helper()
+
+	c, err := New(Config{
+		BaseURL: s.url,
+		APIKey:  apiKey,
+		Backoff: &backoff.Config{Strategy: backoff.Constant, Initial: time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	return c
+}
+
+func writeTestFiles(t *testing.T) (clean string, infected string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	clean = filepath.Join(dir, "clean.txt")
+	infected = filepath.Join(dir, "eicar.com")
+	require.NoError(t, os.WriteFile(clean, []byte("hello"), 0o600))
+	require.NoError(t, os.WriteFile(infected, []byte(clamdtest.EICAR), 0o600))
+
+	return clean, infected
+}
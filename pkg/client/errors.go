@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error codes of the server, in Error.Code.
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeRateLimited  = "rate_limited"
+	CodeQueueTimeout = "queue_timeout"
+	CodeOverloaded   = "overloaded"
+	CodeScanTimeout  = "scan_timeout"
+	CodeUnavailable  = "unavailable"
+	CodeInternal     = "internal"
+)
+
+var (
+	// ErrInvalidConfig is returned by New for a config it cannot use.
+	ErrInvalidConfig = errors.New("invalid client config")
+
+	// The errors an Error wraps, one per code, to test with errors.Is.
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrQueueTimeout = errors.New("queue timeout")
+	ErrOverloaded   = errors.New("overloaded")
+	ErrScanTimeout  = errors.New("scan timeout")
+	ErrUnavailable  = errors.New("unavailable")
+	// ErrServer is wrapped by internal server errors and by errors without
+	// a known code, e.g. of proxies.
+	ErrServer = errors.New("server error")
+)
+
+var codeErrors = map[string]error{
+	CodeBadRequest:   ErrBadRequest,
+	CodeUnauthorized: ErrUnauthorized,
+	CodeForbidden:    ErrForbidden,
+	CodeNotFound:     ErrNotFound,
+	CodeRateLimited:  ErrRateLimited,
+	CodeQueueTimeout: ErrQueueTimeout,
+	CodeOverloaded:   ErrOverloaded,
+	CodeScanTimeout:  ErrScanTimeout,
+	CodeUnavailable:  ErrUnavailable,
+	CodeInternal:     ErrServer,
+}
+
+// Error is an error replied by the server, or the failure of a job.
+type Error struct {
+	// StatusCode is the HTTP status, zero for failed jobs
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// RetryAfter is when the server asked to retry, if it did
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Code
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s (HTTP %d)", msg, e.StatusCode)
+	}
+	return "restclam: " + msg
+}
+
+// Unwrap returns the error of the code, like ErrOverloaded.
+func (e *Error) Unwrap() error {
+	if err, ok := codeErrors[e.Code]; ok {
+		return err
+	}
+	return ErrServer
+}
+
+// retryable tells whether the same request may succeed later.
+func (e *Error) retryable() bool {
+	switch e.Code {
+	case CodeRateLimited, CodeOverloaded, CodeQueueTimeout, CodeUnavailable:
+		return true
+	case "":
+		// proxies in front of the server
+		return e.StatusCode == http.StatusBadGateway ||
+			e.StatusCode == http.StatusServiceUnavailable ||
+			e.StatusCode == http.StatusGatewayTimeout
+	}
+	return false
+}
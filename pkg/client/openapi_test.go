@@ -0,0 +1,173 @@
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/server/api"
+)
+
+// The OpenAPI document of the server is the source of truth of the types
+// of the client: these tests fail when they drift from it.
+
+func TestTypesMatchOpenAPI(t *testing.T) {
+	// prepare
+	schemas := openAPISchemas(t)
+
+	tests := []struct {
+		typ    reflect.Type
+		schema string
+	}{
+		{reflect.TypeOf(ScanResult{}), "ScanResponse"},
+		{reflect.TypeOf(ScanMetadata{}), "ScanMetadata"},
+		{reflect.TypeOf(Job{}), "JobResponse"},
+		{reflect.TypeOf(Error{}), "ErrorResponse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ.Name(), func(t *testing.T) {
+			// execute
+			problems := matchSchema(schemas, tt.typ, schemas[tt.schema], tt.schema)
+
+			// assert
+			assert.Empty(t, problems)
+		})
+	}
+}
+
+func TestEnumsMatchOpenAPI(t *testing.T) {
+	// prepare
+	schemas := openAPISchemas(t)
+
+	// execute
+	codes := enum(schemas, "ErrorResponse", "code")
+	statuses := enum(schemas, "ScanResponse", "status")
+	jobStatuses := enum(schemas, "JobResponse", "status")
+
+	// assert
+	assert.ElementsMatch(t, []string{
+		CodeBadRequest, CodeUnauthorized, CodeForbidden, CodeNotFound, CodeRateLimited,
+		CodeQueueTimeout, CodeOverloaded, CodeScanTimeout, CodeUnavailable, CodeInternal,
+	}, codes)
+	for _, code := range codes {
+		assert.Contains(t, codeErrors, code, "code without error")
+	}
+	assert.ElementsMatch(t, []string{string(StatusOK), string(StatusFound), string(StatusError)}, statuses)
+	assert.ElementsMatch(t, []string{string(JobPending), string(JobCompleted), string(JobFailed)}, jobStatuses)
+}
+
+// helpers
+
+func openAPISchemas(t *testing.T) map[string]map[string]any {
+	t.Helper()
+
+	var spec struct {
+		Components struct {
+			Schemas map[string]map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(api.OpenAPISpec(), &spec))
+	require.NotEmpty(t, spec.Components.Schemas)
+
+	return spec.Components.Schemas
+}
+
+func enum(schemas map[string]map[string]any, schema string, property string) []string {
+	values, _ := schemas[schema]["properties"].(map[string]any)[property].(map[string]any)["enum"].([]any)
+	enum := make([]string, 0, len(values))
+	for _, v := range values {
+		enum = append(enum, v.(string))
+	}
+	return enum
+}
+
+// matchSchema lists where the JSON encoding of a type differs from the
+// schema: missing or unknown properties and incompatible types.
+func matchSchema(schemas map[string]map[string]any, typ reflect.Type, schema map[string]any, at string) []string {
+	schema = resolveSchema(schemas, schema)
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if typ == reflect.TypeOf(time.Time{}) {
+		if !schemaHasType(schema, "string") || schema["format"] != "date-time" {
+			return []string{at + ": time is not a date-time string"}
+		}
+		return nil
+	}
+
+	var problems []string
+	switch typ.Kind() {
+	case reflect.String:
+		if !schemaHasType(schema, "string") {
+			problems = append(problems, at+": not a string")
+		}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		if !schemaHasType(schema, "integer") {
+			problems = append(problems, at+": not an integer")
+		}
+	case reflect.Float64:
+		if !schemaHasType(schema, "number") {
+			problems = append(problems, at+": not a number")
+		}
+	case reflect.Struct:
+		properties, _ := schema["properties"].(map[string]any)
+		seen := map[string]bool{}
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			seen[name] = true
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				problems = append(problems, at+"."+name+": not in the schema")
+				continue
+			}
+			problems = append(problems, matchSchema(schemas, field.Type, property, at+"."+name)...)
+		}
+		for name := range properties {
+			if !seen[name] {
+				problems = append(problems, at+"."+name+": not in the type")
+			}
+		}
+	default:
+		problems = append(problems, at+": unexpected kind "+typ.Kind().String())
+	}
+	return problems
+}
+
+// resolveSchema follows a reference, or the non null alternative of a
+// nullable one.
+func resolveSchema(schemas map[string]map[string]any, schema map[string]any) map[string]any {
+	if ref, ok := schema["$ref"].(string); ok {
+		return resolveSchema(schemas, schemas[strings.TrimPrefix(ref, "#/components/schemas/")])
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		for _, alternative := range oneOf {
+			if alternative := alternative.(map[string]any); alternative["type"] != "null" {
+				return resolveSchema(schemas, alternative)
+			}
+		}
+	}
+	return schema
+}
+
+func schemaHasType(schema map[string]any, typ string) bool {
+	switch types := schema["type"].(type) {
+	case string:
+		return types == typ
+	case []any:
+		for _, t := range types {
+			if t == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package client
+
+import "time"
+
+// Status is the outcome of a scan.
+type Status string
+
+const (
+	StatusOK    Status = "OK"
+	StatusFound Status = "FOUND"
+	StatusError Status = "ERROR"
+)
+
+// ScanResult is the verdict of a scan.
+type ScanResult struct {
+	Status   Status       `json:"status"`
+	Virus    string       `json:"virus"`
+	Error    string       `json:"error"`
+	Filename string       `json:"filename"`
+	Metadata ScanMetadata `json:"metadata"`
+}
+
+// Infected tells whether a virus was found.
+func (r *ScanResult) Infected() bool {
+	return r.Status == StatusFound
+}
+
+// ScanMetadata describes the scanned content and how the scan was
+// performed.
+type ScanMetadata struct {
+	Size             int64   `json:"size"`
+	SHA256           string  `json:"sha256"`
+	SHA1             string  `json:"sha1"`
+	MD5              string  `json:"md5"`
+	MimeType         string  `json:"mimeType"`
+	QueueDurationMs  float64 `json:"queueDurationMs"`
+	ScanDurationMs   float64 `json:"scanDurationMs"`
+	WorkerID         uint    `json:"workerId"`
+	Backend          string  `json:"backend"`
+	SignatureVersion string  `json:"signatureVersion"`
+}
+
+// JobStatus is the progress of a job.
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is a scan run in the background by the server.  Result is set once
+// completed, Error once failed.
+type Job struct {
+	ID         string      `json:"id"`
+	Status     JobStatus   `json:"status"`
+	Filename   string      `json:"filename"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	FinishedAt *time.Time  `json:"finishedAt"`
+	Result     *ScanResult `json:"result"`
+	Error      *Error      `json:"error"`
+}
+
+// Done tells whether the job is finished, successfully or not.
+func (j *Job) Done() bool {
+	return j.Status != JobPending
+}
+
+// FileResult is the outcome of the scan of a file of ScanMany.
+type FileResult struct {
+	Path   string
+	Result *ScanResult
+	Err    error
+}
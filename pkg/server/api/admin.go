@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/audit"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+// Admin serves the inspection and control of the session coordinator.  All
+// routes require the admin scope, and control actions are audited.
+func Admin(c *clamd.Coordinator) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequireScope(auth.ScopeAdmin))
+
+	h := adminHandler{c}
+
+	r.Get("/workers", h.handleWorkers)
+	r.Post("/workers/resize", h.handleResize)
+	r.Post("/workers/{id}/recycle", h.handleRecycle)
+	r.Get("/backends", h.handleBackends)
+	r.Post("/backends/drain", h.handleDrain)
+	r.Post("/backends/enable", h.handleEnable)
+	return r
+}
+
+type adminHandler struct {
+	c *clamd.Coordinator
+}
+
+func (h *adminHandler) handleWorkers(w http.ResponseWriter, _ *http.Request) {
+	render.JSON(w, http.StatusOK, newWorkersResponse(h.c.Workers()))
+}
+
+func (h *adminHandler) handleBackends(w http.ResponseWriter, _ *http.Request) {
+	render.JSON(w, http.StatusOK, newBackendsResponse(h.c.Backends()))
+}
+
+func (h *adminHandler) handleResize(w http.ResponseWriter, r *http.Request) {
+	var req ResizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "invalid request body")
+		return
+	}
+
+	err := h.c.Resize(req.MinWorkers, req.MaxWorkers)
+	audit.Allowed(log.Logger, r, "resize-workers").
+		Int("minWorkers", req.MinWorkers).
+		Int("maxWorkers", req.MaxWorkers).
+		Err(err).
+		Msg("workers resized")
+	if err != nil {
+		renderAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) handleRecycle(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 0)
+	if err != nil {
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "invalid worker id")
+		return
+	}
+
+	err = h.c.RecycleWorker(uint(id))
+	audit.Allowed(log.Logger, r, "recycle-worker").
+		Uint64("workerId", id).
+		Err(err).
+		Msg("worker recycle requested")
+	if err != nil {
+		renderAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *adminHandler) handleDrain(w http.ResponseWriter, r *http.Request) {
+	h.toggleBackend(w, r, "drain-backend", h.c.DrainBackend)
+}
+
+func (h *adminHandler) handleEnable(w http.ResponseWriter, r *http.Request) {
+	h.toggleBackend(w, r, "enable-backend", h.c.EnableBackend)
+}
+
+func (h *adminHandler) toggleBackend(w http.ResponseWriter, r *http.Request, action string, toggle func(string) error) {
+	var req BackendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Address == "" {
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "invalid request body, expected a backend address")
+		return
+	}
+
+	err := toggle(req.Address)
+	audit.Allowed(log.Logger, r, action).
+		Str("backend", req.Address).
+		Err(err).
+		Msg("backend toggled")
+	if err != nil {
+		renderAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func renderAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, clamd.ErrUnknownBackend), errors.Is(err, clamd.ErrUnknownWorker):
+		render.Error(w, http.StatusNotFound, render.CodeNotFound, err.Error())
+	case errors.Is(err, clamd.ErrInvalidWorkers):
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, err.Error())
+	case errors.Is(err, clamd.ErrCoordinatorClosed):
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "shutting down")
+	default:
+		log.Error().Err(err).Msg("admin action failed")
+		render.Error(w, http.StatusInternalServerError, render.CodeInternal, "admin action failed")
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+func TestAdmin_Workers(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	c := newTestCoordinator(t, fake)
+
+	// execute
+	resp := serveAdmin(t, c, admin(), "GET", "/workers", "")
+
+	// assert
+	require.Equal(t, http.StatusOK, resp.Code)
+	var workers []WorkerResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &workers))
+	require.Len(t, workers, 2)
+	assert.Equal(t, fake.Address(), workers[0].Backend)
+	assert.NotEmpty(t, workers[0].State)
+}
+
+func TestAdmin_Backends(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	c := newTestCoordinator(t, fake)
+
+	// execute
+	drained := serveAdmin(t, c, admin(), "POST", "/backends/drain", `{"address":"`+fake.Address()+`"}`)
+	resp := serveAdmin(t, c, admin(), "GET", "/backends", "")
+
+	// assert
+	require.Equal(t, http.StatusNoContent, drained.Code)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var backends []BackendResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &backends))
+	require.Len(t, backends, 1)
+	assert.Equal(t, BackendResponse{
+		Address: fake.Address(),
+		Circuit: "closed",
+		Enabled: false,
+		Workers: 2,
+	}, backends[0])
+
+	// execute
+	enabled := serveAdmin(t, c, admin(), "POST", "/backends/enable", `{"address":"`+fake.Address()+`"}`)
+
+	// assert
+	require.Equal(t, http.StatusNoContent, enabled.Code)
+	assert.True(t, c.Backends()[0].Enabled)
+}
+
+func TestAdmin_Resize(t *testing.T) {
+	// prepare
+	c := newTestCoordinator(t, newTestClamd(t))
+
+	// execute
+	resp := serveAdmin(t, c, admin(), "POST", "/workers/resize", `{"minWorkers":3,"maxWorkers":3}`)
+
+	// assert
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Eventually(t, func() bool { return len(c.Workers()) == 3 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAdmin_Recycle(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	c := newTestCoordinator(t, fake)
+	id := c.Workers()[0].ID
+
+	// execute
+	resp := serveAdmin(t, c, admin(), "POST", "/workers/"+strconv.FormatUint(uint64(id), 10)+"/recycle", "")
+
+	// assert
+	require.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Eventually(t, func() bool {
+		opened, _ := fake.Sessions()
+		return opened == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAdmin_Errors(t *testing.T) {
+	c := newTestCoordinator(t, newTestClamd(t))
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		expected  int
+	}{
+		{name: "missing admin scope", principal: scanner(), method: "GET", path: "/workers", expected: http.StatusForbidden},
+		{name: "unknown backend", principal: admin(), method: "POST", path: "/backends/drain", body: `{"address":"nowhere:3310"}`, expected: http.StatusNotFound},
+		{name: "missing backend", principal: admin(), method: "POST", path: "/backends/enable", body: `{}`, expected: http.StatusBadRequest},
+		{name: "unknown worker", principal: admin(), method: "POST", path: "/workers/42/recycle", expected: http.StatusNotFound},
+		{name: "invalid worker id", principal: admin(), method: "POST", path: "/workers/first/recycle", expected: http.StatusBadRequest},
+		{name: "invalid bounds", principal: admin(), method: "POST", path: "/workers/resize", body: `{"minWorkers":2,"maxWorkers":1}`, expected: http.StatusBadRequest},
+		{name: "invalid body", principal: admin(), method: "POST", path: "/workers/resize", body: `{`, expected: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// execute
+			resp := serveAdmin(t, c, tt.principal, tt.method, tt.path, tt.body)
+
+			// assert
+			assert.Equal(t, tt.expected, resp.Code)
+		})
+	}
+}
+
+// helpers
+
+func newTestClamd(t *testing.T) *clamdtest.Server {
+	t.Helper()
+
+	fake, err := clamdtest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = fake.Close() })
+
+	return fake
+}
+
+func newTestCoordinator(t *testing.T, fake *clamdtest.Server) *clamd.Coordinator {
+	t.Helper()
+
+	c := &clamd.Coordinator{MinWorkers: 2, MaxWorkers: 2, ShutdownTimeout: time.Second}
+	err := c.InitCoordinator(
+		[]clamd.Clamd{{Network: fake.Network(), Address: fake.Address()}},
+		clamd.SessionOpts{HeartbeatInterval: time.Minute},
+	)
+	require.NoError(t, err)
+	t.Cleanup(c.Shutdown)
+
+	return c
+}
+
+func serveAdmin(t *testing.T, c *clamd.Coordinator, p *auth.Principal, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = r.WithContext(auth.NewContext(r.Context(), p))
+	w := httptest.NewRecorder()
+	Admin(c).ServeHTTP(w, r)
+
+	return w
+}
+
+func admin() *auth.Principal {
+	return &auth.Principal{ID: "ops", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeAdmin}}
+}
+
+func scanner() *auth.Principal {
+	return &auth.Principal{ID: "app", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeScan}}
+}
@@ -7,15 +7,21 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 	clamd "github.com/tomrss/restclam/pkg/clamdv0"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/auth"
 )
 
-func ClamavV0() http.Handler {
+// ClamavV0 serves the v0 API on the session of the request.  The scan
+// middlewares are applied to scans only, after the scope check.
+func ClamavV0(scanMiddlewares ...func(http.Handler) http.Handler) http.Handler {
 	r := chi.NewRouter()
 
 	h := clamavV0Handler{}
 
 	r.Get("/ping", h.handlePing)
-	r.Post("/scan", h.handleScan)
+	r.With(middleware.RequireScope(auth.ScopeScan)).
+		With(scanMiddlewares...).
+		Post("/scan", h.handleScan)
 	return r
 }
 
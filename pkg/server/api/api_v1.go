@@ -1,26 +1,42 @@
 package api
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/auth"
 )
 
-func ClamavV1(c *clamd.Coordinator) http.Handler {
+// ClamavV1 serves the v1 API on the session coordinator.  The scan
+// middlewares are applied to scans only, after the scope check.  Jobs are
+// scans run in the background, polled by the client that submitted them.
+func ClamavV1(c *clamd.Coordinator, jobs *Jobs, scanMiddlewares ...func(http.Handler) http.Handler) http.Handler {
 	r := chi.NewRouter()
 
-	h := clamavV1handler{c}
+	h := clamavV1handler{c: c, jobs: jobs}
 
 	r.Get("/ping", h.handlePing)
-	r.Post("/scan", h.handleScan)
+	r.With(middleware.RequireScope(auth.ScopeReadStats)).Get("/metrics", h.handleMetrics)
+	r.With(middleware.RequireScope(auth.ScopeReadStats)).Get("/stats", h.handleStats)
+	r.With(middleware.RequireScope(auth.ScopeScan)).
+		With(scanMiddlewares...).
+		Post("/scan", h.handleScan)
+	r.With(middleware.RequireScope(auth.ScopeScan)).
+		With(scanMiddlewares...).
+		Post("/jobs", h.handleSubmitJob)
+	r.With(middleware.RequireScope(auth.ScopeScan)).Get("/jobs/{id}", h.handleGetJob)
 	return r
 }
 
 type clamavV1handler struct {
-	c *clamd.Coordinator
+	c    *clamd.Coordinator
+	jobs *Jobs
 }
 
 // func (h *ClamavV1Handler) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
@@ -31,25 +47,16 @@ func (h *clamavV1handler) handlePing(w http.ResponseWriter, _ *http.Request) {
 	// execute
 	pong, err := h.c.Ping()
 	if err != nil {
-		// todo json response
 		log.Error().Err(err).Msg("error pinging clamd")
-		w.WriteHeader(http.StatusInternalServerError)
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "clamav unavailable, retry later")
 		return
 	}
 
 	log.Debug().Str("ping", pong).Msg("ping success")
 
-	// marshal response
-	w.Header().Set("Content-Type", "application/json")
-	resp := struct {
+	render.JSON(w, http.StatusOK, struct {
 		Message string `json:"message"`
-	}{pong}
-
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Error().Err(err).Msg("Error marshalling response")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	}{pong})
 }
 
 func (h *clamavV1handler) handleScan(w http.ResponseWriter, r *http.Request) {
@@ -57,20 +64,59 @@ func (h *clamavV1handler) handleScan(w http.ResponseWriter, r *http.Request) {
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		panic(err)
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "missing file")
+		return
+	}
+
+	opts, err := jobOptions(r)
+	switch {
+	case errors.Is(err, ErrPriorityNotAllowed):
+		render.Error(w, http.StatusForbidden, render.CodeForbidden, err.Error())
+		return
+	case err != nil:
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, err.Error())
+		return
 	}
 
 	log.Debug().Str("filename", header.Filename).Msg("scanning file")
 
 	// execute
-	scan, err := h.c.Instream(file)
-	if err != nil {
-		// todo json response
+	scan, err := h.c.Instream(file, opts...)
+	switch {
+	case errors.Is(err, clamd.ErrOverloaded):
+		// already logged by the coordinator, throttled
+		render.RetryAfter(w, h.c.RetryAfter())
+		render.Error(w, http.StatusServiceUnavailable, render.CodeOverloaded, "too many scans in progress, retry later")
+		return
+	case errors.Is(err, clamd.ErrQueueTimeout):
+		log.Warn().Str("filename", header.Filename).Err(err).Msg("scan not started in time")
+		render.RetryAfter(w, h.c.RetryAfter())
+		render.Error(w, http.StatusServiceUnavailable, render.CodeQueueTimeout, "scan not started in time, retry later")
+		return
+	case errors.Is(err, clamd.ErrJobTimeout):
+		log.Warn().Str("filename", header.Filename).Err(err).Msg("scan timeout")
+		render.Error(w, http.StatusGatewayTimeout, render.CodeScanTimeout, "scan took too long")
+		return
+	case errors.Is(err, clamd.ErrNoBackend):
+		log.Warn().Str("filename", header.Filename).Err(err).Msg("scan refused, all clamd backends failing")
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "clamav unavailable, retry later")
+		return
+	case errors.Is(err, clamd.ErrCoordinatorClosed):
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "shutting down")
+		return
+	case errors.Is(err, context.Canceled):
+		log.Debug().Str("filename", header.Filename).Msg("scan cancelled by client")
+		return
+	case errors.Is(err, clamd.ErrUpload):
+		log.Warn().Str("filename", header.Filename).Err(err).Msg("unable to read upload")
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "unable to read upload")
+		return
+	case err != nil:
 		log.Error().
 			Str("filename", header.Filename).
 			Err(err).
 			Msg("error scanning file")
-		w.WriteHeader(http.StatusInternalServerError)
+		render.Error(w, http.StatusInternalServerError, render.CodeInternal, "unable to scan the file")
 		return
 	}
 
@@ -79,21 +125,36 @@ func (h *clamavV1handler) handleScan(w http.ResponseWriter, r *http.Request) {
 		Str("virus", scan.Virus).
 		Str("error", scan.Error).
 		Str("status", string(scan.Status)).
+		Str("sha256", scan.Metadata.SHA256).
+		Uint("workerId", scan.Metadata.WorkerID).
+		Str("backend", scan.Metadata.Backend).
 		Msg("file scan complete")
 
-	// marshal response
-	w.Header().Set("Content-Type", "application/json")
-	// TODO non-anonymous struct please!
-	resp := struct {
-		Status   string `json:"status"`
-		Virus    string `json:"virus"`
-		Error    string `json:"error"`
-		Filename string `json:"filename"`
-	}{string(scan.Status), scan.Virus, scan.Error, header.Filename}
-
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Error().Err(err).Msg("Error marshalling response")
-		w.WriteHeader(http.StatusInternalServerError)
+	render.JSON(w, http.StatusOK, newScanResponse(scan, header.Filename))
+}
+
+func (h *clamavV1handler) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	render.JSON(w, http.StatusOK, newMetricsResponse(h.c.Metrics(), h.c.Circuits()))
+}
+
+func (h *clamavV1handler) handleStats(w http.ResponseWriter, _ *http.Request) {
+	reply, err := h.c.Stats()
+	switch {
+	case errors.Is(err, clamd.ErrOverloaded), errors.Is(err, clamd.ErrQueueTimeout):
+		render.RetryAfter(w, h.c.RetryAfter())
+		render.Error(w, http.StatusServiceUnavailable, render.CodeOverloaded, "too many jobs in progress, retry later")
+		return
+	case err != nil:
+		log.Warn().Err(err).Msg("error getting clamd stats")
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "clamav unavailable, retry later")
+		return
+	}
+
+	stats, err := clamd.ParseStats(reply)
+	if err != nil {
+		log.Error().Err(err).Msg("error parsing clamd stats")
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "invalid clamav stats")
 		return
 	}
+	render.JSON(w, http.StatusOK, NewStatsResponse(stats))
 }
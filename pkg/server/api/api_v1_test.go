@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+	"github.com/tomrss/restclam/pkg/server/api/middleware"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
+)
+
+func TestClamavV1_Stats(t *testing.T) {
+	// prepare
+	c := ClamavV1(newTestCoordinator(t, newTestClamd(t)), NewJobs())
+
+	// execute
+	resp := serveClamavV1(t, c, reader(), http.MethodGet, "/stats", nil, "")
+
+	// assert
+	require.Equal(t, http.StatusOK, resp.Code)
+	var stats StatsResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Equal(t, "VALID PRIMARY", stats.State)
+	assert.Equal(t, 12, stats.Threads.Max)
+	assert.Equal(t, "1369.152M", stats.Memory.PoolsTotal)
+}
+
+func TestClamavV1_StatsForbidden(t *testing.T) {
+	// prepare
+	c := ClamavV1(newTestCoordinator(t, newTestClamd(t)), NewJobs())
+
+	// execute
+	resp := serveClamavV1(t, c, scanner(), http.MethodGet, "/stats", nil, "")
+
+	// assert
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestClamavV1_Errors(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	fake.DropScans(1)
+	c := ClamavV1(newTestCoordinator(t, fake), NewJobs())
+	closed := newTestCoordinator(t, newTestClamd(t))
+	closed.Shutdown()
+	body, contentType := multipartFile(t, "clean.txt", "clean")
+
+	// execute
+	scan := serveClamavV1(t, c, scanner(), http.MethodPost, "/scan", body, contentType)
+	ping := serveClamavV1(t, ClamavV1(closed, NewJobs()), reader(), http.MethodGet, "/ping", nil, "")
+
+	// assert
+	assert.Equal(t, http.StatusInternalServerError, scan.Code)
+	assert.JSONEq(t, `{"code":"internal","message":"unable to scan the file"}`, scan.Body.String())
+	assert.Equal(t, http.StatusServiceUnavailable, ping.Code)
+	assert.JSONEq(t, `{"code":"unavailable","message":"clamav unavailable, retry later"}`, ping.Body.String())
+}
+
+func TestClamavV1_Jobs(t *testing.T) {
+	// prepare
+	c := ClamavV1(newTestCoordinator(t, newTestClamd(t)), NewJobs())
+	body, contentType := multipartFile(t, "eicar.com", clamdtest.EICAR)
+
+	// execute
+	submitted := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+
+	// assert
+	require.Equal(t, http.StatusAccepted, submitted.Code)
+	var job JobResponse
+	require.NoError(t, json.Unmarshal(submitted.Body.Bytes(), &job))
+	assert.Equal(t, JobPending, job.Status)
+	assert.Equal(t, "/jobs/"+job.ID, submitted.Header().Get("Location"))
+
+	// execute
+	assert.Eventually(t, func() bool {
+		resp := serveClamavV1(t, c, scanner(), http.MethodGet, "/jobs/"+job.ID, nil, "")
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &job))
+		return job.Status != JobPending
+	}, 2*time.Second, 10*time.Millisecond)
+	other := serveClamavV1(t, c, reader(), http.MethodGet, "/jobs/"+job.ID, nil, "")
+
+	// assert
+	assert.Equal(t, JobCompleted, job.Status)
+	require.NotNil(t, job.Result)
+	assert.Equal(t, clamdtest.EICARSignature, job.Result.Virus)
+	assert.NotNil(t, job.FinishedAt)
+	assert.Equal(t, http.StatusForbidden, other.Code)
+}
+
+func TestClamavV1_JobsErrors(t *testing.T) {
+	// prepare
+	c := ClamavV1(newTestCoordinator(t, newTestClamd(t)), NewJobs())
+	body, contentType := multipartFile(t, "clean.txt", "clean")
+	submitted := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+	require.Equal(t, http.StatusAccepted, submitted.Code)
+	var job JobResponse
+	require.NoError(t, json.Unmarshal(submitted.Body.Bytes(), &job))
+	otherScanner := &auth.Principal{ID: "other", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeScan}}
+
+	// execute
+	missingFile := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", strings.NewReader(""), "multipart/form-data; boundary=x")
+	unknown := serveClamavV1(t, c, scanner(), http.MethodGet, "/jobs/unknown", nil, "")
+	notOwned := serveClamavV1(t, c, otherScanner, http.MethodGet, "/jobs/"+job.ID, nil, "")
+
+	// assert
+	assert.Equal(t, http.StatusBadRequest, missingFile.Code)
+	assert.Equal(t, http.StatusNotFound, unknown.Code)
+	assert.Equal(t, http.StatusNotFound, notOwned.Code)
+}
+
+func TestClamavV1_JobsKeepScanSlot(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	fake.SetScanDelay(200 * time.Millisecond)
+	conf := config.RateLimitConfig{Enabled: true, MaxConcurrentScans: 1}
+	limiter := ratelimit.NewLimiter(ratelimit.LimitsFromConfig(conf), ratelimit.NewMemoryStore())
+	c := ClamavV1(newTestCoordinator(t, fake), NewJobs(), middleware.ScanQuota(conf, limiter))
+	submit := func() *httptest.ResponseRecorder {
+		body, contentType := multipartFile(t, "slow.txt", "slow")
+		return serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+	}
+
+	// execute
+	first := submit()
+	second := submit()
+
+	// assert
+	assert.Equal(t, http.StatusAccepted, first.Code)
+	assert.Equal(t, http.StatusTooManyRequests, second.Code, "the first scan holds the slot")
+	assert.Eventually(t, func() bool {
+		return submit().Code == http.StatusAccepted
+	}, 2*time.Second, 50*time.Millisecond, "the slot is released once the scan is done")
+}
+
+func TestJobs_Drain(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	fake.SetScanDelay(200 * time.Millisecond)
+	jobs := NewJobs()
+	c := ClamavV1(newTestCoordinator(t, fake), jobs)
+	body, contentType := multipartFile(t, "slow.txt", "slow")
+	submitted := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+	require.Equal(t, http.StatusAccepted, submitted.Code)
+	var job JobResponse
+	require.NoError(t, json.Unmarshal(submitted.Body.Bytes(), &job))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// execute
+	err := jobs.Drain(ctx)
+	resp := serveClamavV1(t, c, scanner(), http.MethodGet, "/jobs/"+job.ID, nil, "")
+	body, contentType = multipartFile(t, "late.txt", "late")
+	late := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+
+	// assert
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &job))
+	assert.Equal(t, JobCompleted, job.Status, "scans in progress complete")
+	assert.Equal(t, http.StatusServiceUnavailable, late.Code)
+}
+
+func TestJobs_DrainTimeout(t *testing.T) {
+	// prepare
+	fake := newTestClamd(t)
+	fake.SetScanDelay(time.Second)
+	jobs := NewJobs()
+	c := ClamavV1(newTestCoordinator(t, fake), jobs)
+	var ids []string
+	for range 3 {
+		body, contentType := multipartFile(t, "slow.txt", "slow")
+		submitted := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+		require.Equal(t, http.StatusAccepted, submitted.Code)
+		var job JobResponse
+		require.NoError(t, json.Unmarshal(submitted.Body.Bytes(), &job))
+		ids = append(ids, job.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// execute
+	err := jobs.Drain(ctx)
+
+	// assert
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Eventually(t, func() bool {
+		for _, id := range ids {
+			var job JobResponse
+			resp := serveClamavV1(t, c, scanner(), http.MethodGet, "/jobs/"+id, nil, "")
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &job))
+			if job.Status == JobFailed && job.Error.Code == render.CodeUnavailable {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond, "the queued scan is cancelled")
+}
+
+func TestJobs_PendingLimits(t *testing.T) {
+	// prepare
+	s := NewJobs()
+	s.maxPending = 3
+	s.maxPendingClient = 2
+	add := func(id string, owner string) error {
+		return s.add(&asyncJob{id: id, owner: owner, created: time.Now()})
+	}
+
+	// execute
+	require.NoError(t, add("a1", "a"))
+	require.NoError(t, add("a2", "a"))
+	clientFull := add("a3", "a")
+	require.NoError(t, add("b1", "b"))
+	full := add("c1", "c")
+	s.finish("a1", &ScanResponse{}, nil)
+	afterFinish := add("a3", "a")
+
+	// assert
+	assert.ErrorIs(t, clientFull, errTooManyClientJobs)
+	assert.ErrorIs(t, full, errTooManyJobs)
+	assert.NoError(t, afterFinish)
+}
+
+func TestJobs_ReservedBeforeSpool(t *testing.T) {
+	// prepare
+	jobs := NewJobs()
+	jobs.maxPendingClient = 1
+	fake := newTestClamd(t)
+	fake.SetScanDelay(200 * time.Millisecond)
+	coordinator := newTestCoordinator(t, fake)
+	coordinator.Spool.Dir = t.TempDir()
+	c := ClamavV1(coordinator, jobs)
+	body, contentType := multipartFile(t, "slow.txt", "slow")
+	first := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", body, contentType)
+	require.Equal(t, http.StatusAccepted, first.Code)
+	spooled, err := filepath.Glob(filepath.Join(coordinator.Spool.Dir, "restclam-job-*"))
+	require.NoError(t, err)
+
+	// execute
+	body, contentType = multipartFile(t, "over.txt", "over")
+	upload := &countingReader{r: body}
+	over := serveClamavV1(t, c, scanner(), http.MethodPost, "/jobs", upload, contentType)
+	body, contentType = multipartFile(t, "other.txt", strings.Repeat("other", 1000))
+	broken := io.MultiReader(io.LimitReader(body, 1000), iotest.ErrReader(errors.New("client gone")))
+	otherScanner := &auth.Principal{ID: "other", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeScan}}
+	failed := serveClamavV1(t, c, otherScanner, http.MethodPost, "/jobs", broken, contentType)
+
+	// assert
+	assert.Len(t, spooled, 1, "spooled into the configured dir")
+	assert.Equal(t, http.StatusTooManyRequests, over.Code)
+	assert.Zero(t, upload.n, "the upload is not read over the cap")
+	assert.Equal(t, http.StatusBadRequest, failed.Code)
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	assert.Equal(t, 1, jobs.pending, "the failed upload releases its slot")
+}
+
+// helpers
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func multipartFile(t *testing.T, name string, content string) (io.Reader, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = io.WriteString(part, content)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	return &body, mw.FormDataContentType()
+}
+
+func serveClamavV1(t *testing.T, c http.Handler, p *auth.Principal, method string, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	r = r.WithContext(auth.NewContext(r.Context(), p))
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+
+	return w
+}
+
+func reader() *auth.Principal {
+	return &auth.Principal{ID: "monitoring", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeReadStats}}
+}
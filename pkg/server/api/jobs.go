@@ -0,0 +1,423 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
+)
+
+// Job statuses of JobResponse.
+const (
+	JobPending   = "pending"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+const (
+	// jobTTL is how long finished jobs are kept for polling
+	jobTTL = 10 * time.Minute
+	// maxPendingJobs bounds the uploads spooled on disk waiting for a scan
+	maxPendingJobs = 1000
+	// maxPendingClientJobs bounds the pending jobs of each client, so that
+	// one cannot take all of them
+	maxPendingClientJobs = 100
+)
+
+var (
+	errTooManyJobs       = errors.New("too many jobs pending")
+	errTooManyClientJobs = errors.New("too many jobs pending for the client")
+	errJobsClosed        = errors.New("jobs draining")
+	errMissingFile       = errors.New("missing file")
+)
+
+// JobResponse describes an asynchronous scan.  Result is set once
+// completed, Error once failed.
+type JobResponse struct {
+	ID         string                `json:"id"`
+	Status     string                `json:"status"`
+	Filename   string                `json:"filename"`
+	CreatedAt  string                `json:"createdAt"`
+	FinishedAt *string               `json:"finishedAt"`
+	Result     *ScanResponse         `json:"result"`
+	Error      *render.ErrorResponse `json:"error"`
+}
+
+// asyncJob is a scan run in the background, owned by the client that
+// submitted it.
+type asyncJob struct {
+	id       string
+	owner    string
+	filename string
+	created  time.Time
+	finished time.Time
+	result   *ScanResponse
+	err      *render.ErrorResponse
+}
+
+func (j *asyncJob) response() JobResponse {
+	resp := JobResponse{
+		ID:        j.id,
+		Status:    JobPending,
+		Filename:  j.filename,
+		CreatedAt: j.created.UTC().Format(time.RFC3339Nano),
+		Result:    j.result,
+		Error:     j.err,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished.UTC().Format(time.RFC3339Nano)
+		resp.FinishedAt = &finished
+		resp.Status = JobCompleted
+		if j.err != nil {
+			resp.Status = JobFailed
+		}
+	}
+	return resp
+}
+
+// Jobs keeps the asynchronous scans in memory, until jobTTL after they
+// finish.  Drain it on shutdown, before the coordinator, so that the scans
+// in progress complete.
+type Jobs struct {
+	maxPending       int
+	maxPendingClient int
+
+	// ctx is the context of the scans, cancelled when draining times out
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	mu            sync.Mutex
+	jobs          map[string]*asyncJob
+	pending       int
+	pendingClient map[string]int
+	closed        bool
+}
+
+// NewJobs returns an empty job store.
+func NewJobs() *Jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Jobs{
+		maxPending:       maxPendingJobs,
+		maxPendingClient: maxPendingClientJobs,
+		ctx:              ctx,
+		cancel:           cancel,
+		jobs:             map[string]*asyncJob{},
+		pendingClient:    map[string]int{},
+	}
+}
+
+// Drain stops accepting jobs, then waits for the scans in progress.  If
+// ctx is done first, the scans are cancelled: the queued ones fail right
+// away, the ones already sent to clamd complete in background.
+func (s *Jobs) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("unable to drain jobs: %w", ctx.Err())
+	}
+}
+
+// add registers a pending job, unless draining or too many are, in total
+// or of its owner.  The scan must call done once over, or abort if it
+// cannot start.
+func (s *Jobs) add(j *asyncJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	switch {
+	case s.closed:
+		return errJobsClosed
+	case s.pendingClient[j.owner] >= s.maxPendingClient:
+		return errTooManyClientJobs
+	case s.pending >= s.maxPending:
+		return errTooManyJobs
+	}
+	s.pending++
+	s.pendingClient[j.owner]++
+	s.jobs[j.id] = j
+	s.running.Add(1)
+	return nil
+}
+
+// named sets the filename of a job added, once its upload is spooled, and
+// returns the job.
+func (s *Jobs) named(id string, filename string) JobResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := s.jobs[id]
+	j.filename = filename
+	return j.response()
+}
+
+// abort removes a job added whose scan could not start, e.g. as its upload
+// could not be spooled.
+func (s *Jobs) abort(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		delete(s.jobs, id)
+		s.unpend(j)
+		s.running.Done()
+	}
+}
+
+// done tells that the scan of a job added is over.
+func (s *Jobs) done() {
+	s.running.Done()
+}
+
+// finish records the outcome of a job.
+func (s *Jobs) finish(id string, result *ScanResponse, err *render.ErrorResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		j.finished = time.Now()
+		j.result = result
+		j.err = err
+		s.unpend(j)
+	}
+}
+
+// unpend counts a job as no longer pending, with the lock held.
+func (s *Jobs) unpend(j *asyncJob) {
+	s.pending--
+	s.pendingClient[j.owner]--
+	if s.pendingClient[j.owner] == 0 {
+		delete(s.pendingClient, j.owner)
+	}
+}
+
+// get returns the job of the owner, if any.
+func (s *Jobs) get(id string, owner string) (JobResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	j, ok := s.jobs[id]
+	if !ok || j.owner != owner {
+		return JobResponse{}, false
+	}
+	return j.response(), true
+}
+
+// prune removes the jobs expired, with the lock held.
+func (s *Jobs) prune() {
+	for id, j := range s.jobs {
+		if !j.finished.IsZero() && time.Since(j.finished) > jobTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// handleSubmitJob spools the uploaded file and scans it in the background,
+// replying right away with the job to poll.  The job is counted against
+// the pending caps before the upload is read.
+func (h *clamavV1handler) handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	opts, err := jobOptions(r)
+	switch {
+	case errors.Is(err, ErrPriorityNotAllowed):
+		render.Error(w, http.StatusForbidden, render.CodeForbidden, err.Error())
+		return
+	case err != nil:
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, err.Error())
+		return
+	}
+	// the scan outlives the request
+	opts = append(opts, clamd.WithContext(h.jobs.ctx))
+
+	id, err := newJobID()
+	if err != nil {
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "unable to create the job, retry later")
+		return
+	}
+	job := &asyncJob{id: id, owner: auth.ClientKey(r), created: time.Now()}
+	switch err := h.jobs.add(job); {
+	case errors.Is(err, errJobsClosed):
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "shutting down")
+		return
+	case errors.Is(err, errTooManyClientJobs):
+		render.RetryAfter(w, h.c.RetryAfter())
+		render.Error(w, http.StatusTooManyRequests, render.CodeRateLimited, "too many jobs pending for the client, retry later")
+		return
+	case err != nil:
+		render.RetryAfter(w, h.c.RetryAfter())
+		render.Error(w, http.StatusServiceUnavailable, render.CodeOverloaded, "too many jobs pending, retry later")
+		return
+	}
+
+	spooled, filename, err := spoolUpload(r, h.c.Spool.Dir)
+	switch {
+	case errors.Is(err, errMissingFile):
+		h.jobs.abort(id)
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "missing file")
+		return
+	case errors.Is(err, clamd.ErrUpload):
+		h.jobs.abort(id)
+		log.Warn().Err(err).Str("jobId", id).Msg("unable to read job upload")
+		render.Error(w, http.StatusBadRequest, render.CodeBadRequest, "unable to read upload")
+		return
+	case err != nil:
+		h.jobs.abort(id)
+		log.Error().Err(err).Str("jobId", id).Msg("unable to spool job upload")
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, "unable to store the upload, retry later")
+		return
+	}
+	// before the scan updates the job
+	resp := h.jobs.named(id, filename)
+	// the scan counts against the concurrent scans of the client until done
+	release := ratelimit.KeepScanSlot(r.Context())
+
+	go func() {
+		defer h.jobs.done()
+		defer release()
+		defer spooled.discard()
+
+		scan, err := h.c.Instream(spooled, opts...)
+		if err != nil {
+			log.Warn().Err(err).Str("jobId", id).Str("filename", filename).Msg("job scan failed")
+			h.jobs.finish(id, nil, scanError(err))
+			return
+		}
+		result := newScanResponse(scan, filename)
+		h.jobs.finish(id, &result, nil)
+	}()
+
+	w.Header().Set("Location", r.URL.Path+"/"+id)
+	render.JSON(w, http.StatusAccepted, resp)
+}
+
+func (h *clamavV1handler) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.get(chi.URLParam(r, "id"), auth.ClientKey(r))
+	if !ok {
+		render.Error(w, http.StatusNotFound, render.CodeNotFound, "unknown or expired job")
+		return
+	}
+	render.JSON(w, http.StatusOK, job)
+}
+
+// scanError describes why a scan failed, like the synchronous scan would
+// reply.
+func scanError(err error) *render.ErrorResponse {
+	switch {
+	case errors.Is(err, clamd.ErrOverloaded):
+		return &render.ErrorResponse{Code: render.CodeOverloaded, Message: "too many scans in progress, retry later"}
+	case errors.Is(err, clamd.ErrQueueTimeout):
+		return &render.ErrorResponse{Code: render.CodeQueueTimeout, Message: "scan not started in time, retry later"}
+	case errors.Is(err, clamd.ErrJobTimeout):
+		return &render.ErrorResponse{Code: render.CodeScanTimeout, Message: "scan took too long"}
+	case errors.Is(err, context.Canceled), errors.Is(err, clamd.ErrCoordinatorClosed):
+		return &render.ErrorResponse{Code: render.CodeUnavailable, Message: "shutting down"}
+	default:
+		return &render.ErrorResponse{Code: render.CodeUnavailable, Message: "clamav unavailable, retry later"}
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// spooledFile is an upload copied to a temporary file, to be read after
+// the request is over.
+type spooledFile struct {
+	*os.File
+}
+
+// spoolUpload copies the file of a multipart upload to a temporary file of
+// dir, the system default if empty, returning it with its name.  Errors
+// reading the upload are clamd.ErrUpload.
+func spoolUpload(r *http.Request, dir string) (*spooledFile, string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", errMissingFile, err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, "", errMissingFile
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", clamd.ErrUpload, err)
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		spooled, err := spool(part, dir)
+		return spooled, part.FileName(), err
+	}
+}
+
+func spool(r io.Reader, dir string) (*spooledFile, error) {
+	f, err := os.CreateTemp(dir, "restclam-job-*")
+	if err != nil {
+		return nil, err
+	}
+	sf := &spooledFile{f}
+	upload := &uploadReader{r: r}
+	if _, err := io.Copy(f, upload); err != nil {
+		sf.discard()
+		if upload.err != nil {
+			return nil, fmt.Errorf("%w: %w", clamd.ErrUpload, err)
+		}
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		sf.discard()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// uploadReader remembers the error reading the upload, to tell it from
+// errors writing the spool.
+type uploadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		u.err = err
+	}
+	return n, err
+}
+
+func (f *spooledFile) discard() {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
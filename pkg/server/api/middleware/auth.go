@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/audit"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+// Authenticate is a middleware that authenticates every request with an API
+// key or a bearer JWT, and puts the caller principal in the request context.
+// Requests without valid credentials are rejected with 401.
+func Authenticate(conf config.AuthConfig, a *auth.Authenticator, logger zerolog.Logger) func(next http.Handler) http.Handler {
+	if !conf.Enabled {
+		// no authentication, everyone is allowed to do everything
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := auth.NewContext(r.Context(), auth.Anonymous())
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.AuthenticateRequest(r)
+			if err != nil {
+				audit.Denied(logger, r, "authenticate").Err(err).Msg("request not authenticated")
+				render.Error(w, http.StatusUnauthorized, render.CodeUnauthorized, "missing or invalid credentials")
+				return
+			}
+
+			ctx := auth.NewContext(r.Context(), p)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireScope is a middleware that lets through only callers granted the
+// scope.  Other callers are rejected with 403.
+func RequireScope(scope auth.Scope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := auth.FromContext(r.Context())
+			if !ok {
+				// authentication middleware is missing, this is a bug
+				log.Error().Msg("no principal in request context")
+				render.Error(w, http.StatusUnauthorized, render.CodeUnauthorized, "missing or invalid credentials")
+				return
+			}
+
+			if !p.HasScope(scope) {
+				audit.Denied(log.Logger, r, "authorize").
+					Str("scope", string(scope)).
+					Msg("request not authorized")
+				render.Error(w, http.StatusForbidden, render.CodeForbidden, "missing scope "+string(scope))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -3,8 +3,10 @@ package middleware
 import (
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
 	"github.com/rs/zerolog"
+	"github.com/tomrss/restclam/pkg/server/auth"
 	"github.com/tomrss/restclam/pkg/server/config"
 )
 
@@ -19,6 +21,16 @@ func LogRequest(conf config.LogConfig, logger zerolog.Logger) func(next http.Han
 		}
 	}
 
-	// use logging middleware from chi
-	return httplog.RequestLogger(logger)
+	// use logging middleware from chi, adding the client certificate
+	// identity when using mTLS
+	return chi.Chain(httplog.RequestLogger(logger), logClientCert).Handler
+}
+
+func logClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientCert := auth.ClientCertIdentity(r.TLS); clientCert != "" {
+			httplog.LogEntrySetField(r.Context(), "clientCert", clientCert)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
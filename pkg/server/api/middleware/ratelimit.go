@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+	"github.com/tomrss/restclam/pkg/server/ratelimit"
+)
+
+// RateLimit is a middleware that limits the request rate of every client.
+// Requests over the limit are rejected with 429.
+func RateLimit(conf config.RateLimitConfig, l *ratelimit.Limiter) func(next http.Handler) http.Handler {
+	if !conf.Enabled {
+		// no limits, just serve the next handler
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := auth.ClientKey(r)
+			if ok, retryAfter := l.AllowRequest(client); !ok {
+				tooManyRequests(w, client, retryAfter, "request rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ScanQuota is a middleware that limits the concurrent scans and the
+// scanned bytes of every client.  Requests over the limits are rejected
+// with 429.
+func ScanQuota(conf config.RateLimitConfig, l *ratelimit.Limiter) func(next http.Handler) http.Handler {
+	if !conf.Enabled {
+		// no limits, just serve the next handler
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := auth.ClientKey(r)
+
+			release, ok := l.AcquireScan(client)
+			if !ok {
+				tooManyRequests(w, client, time.Second, "concurrent scans limit exceeded")
+				return
+			}
+			// scans going on in background keep the slot
+			ctx, done := ratelimit.WithScanSlot(r.Context(), release)
+			defer done()
+			r = r.WithContext(ctx)
+
+			if r.ContentLength >= 0 {
+				// size known in advance, charge it now
+				if ok, retryAfter := l.AllowBytes(client, r.ContentLength); !ok {
+					tooManyRequests(w, client, retryAfter, "scanned bytes quota exceeded")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// size unknown, charge it after the scan
+			body := &countingReader{r: r.Body}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}
+			defer func() { l.ChargeBytes(client, body.n) }()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, client string, retryAfter time.Duration, msg string) {
+	log.Warn().Str("client", client).Dur("retryAfter", retryAfter).Msg(msg)
+
+	render.RetryAfter(w, retryAfter)
+	render.Error(w, http.StatusTooManyRequests, render.CodeRateLimited, msg)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Reloadable is a middleware that can be replaced while serving, e.g. when
+// the configuration is reloaded.
+type Reloadable struct {
+	current atomic.Pointer[func(next http.Handler) http.Handler]
+}
+
+// NewReloadable returns a reloadable middleware running mw.
+func NewReloadable(mw func(next http.Handler) http.Handler) *Reloadable {
+	r := &Reloadable{}
+	r.Set(mw)
+	return r
+}
+
+// Set replaces the middleware for next requests.
+func (r *Reloadable) Set(mw func(next http.Handler) http.Handler) {
+	r.current.Store(&mw)
+}
+
+// Handler is the middleware, running the current one on every request.
+func (r *Reloadable) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mw := *r.current.Load()
+		mw(next).ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI document of the v1 API, kept in sync with the
+// handlers by the contract tests.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPISpec returns the OpenAPI document of the v1 API.
+func OpenAPISpec() []byte {
+	return openAPISpec
+}
+
+// HandleOpenAPI serves the OpenAPI document of the v1 API.
+func HandleOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
@@ -0,0 +1,337 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd/clamdtest"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+func TestOpenAPI_Routes(t *testing.T) {
+	// prepare
+	spec := loadOpenAPI(t)
+	c := newTestCoordinator(t, newTestClamd(t))
+	routers := map[string]chi.Routes{
+		"/api/v1/clamav": ClamavV1(c, NewJobs()).(chi.Routes),
+		"/api/v1/admin":  Admin(c).(chi.Routes),
+	}
+
+	// execute
+	served := []string{"GET /api/v1/openapi.json"}
+	for prefix, router := range routers {
+		err := chi.Walk(router, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			served = append(served, method+" "+prefix+route)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// assert
+	var documented []string
+	for path, item := range spec.paths() {
+		for method := range item {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	assert.ElementsMatch(t, served, documented)
+}
+
+func TestOpenAPI_Contract(t *testing.T) {
+	// prepare
+	spec := loadOpenAPI(t)
+	fake := newTestClamd(t)
+	coordinator := newTestCoordinator(t, fake)
+	clamav := ClamavV1(coordinator, NewJobs())
+	admin := Admin(coordinator)
+	completed := submitJob(t, clamav, "eicar.com", clamdtest.EICAR)
+	waitJob(t, clamav, completed)
+	workerID := strconv.FormatUint(uint64(coordinator.Workers()[0].ID), 10)
+	everything := &auth.Principal{ID: "all", Method: auth.MethodAPIKey, Scopes: auth.AllScopes()}
+
+	type upload struct{ name, content string }
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		method    string
+		route     string
+		path      string
+		upload    *upload
+		body      string
+		headers   map[string]string
+		status    int
+	}{
+		{name: "ping", method: "GET", route: "/api/v1/clamav/ping", status: 200},
+		{name: "metrics", method: "GET", route: "/api/v1/clamav/metrics", status: 200},
+		{name: "metrics forbidden", principal: scanner(), method: "GET", route: "/api/v1/clamav/metrics", status: 403},
+		{name: "stats", method: "GET", route: "/api/v1/clamav/stats", status: 200},
+		{name: "scan clean", method: "POST", route: "/api/v1/clamav/scan", upload: &upload{"clean.txt", "clean"}, status: 200},
+		{name: "scan infected", method: "POST", route: "/api/v1/clamav/scan", upload: &upload{"eicar.com", clamdtest.EICAR}, status: 200},
+		{name: "scan missing file", method: "POST", route: "/api/v1/clamav/scan", status: 400},
+		{name: "scan invalid timeout", method: "POST", route: "/api/v1/clamav/scan", upload: &upload{"clean.txt", "clean"}, headers: map[string]string{TimeoutHeader: "soon"}, status: 400},
+		{name: "scan priority forbidden", principal: scanner(), method: "POST", route: "/api/v1/clamav/scan", upload: &upload{"clean.txt", "clean"}, headers: map[string]string{PriorityHeader: "interactive"}, status: 403},
+		{name: "submit job", method: "POST", route: "/api/v1/clamav/jobs", upload: &upload{"clean.txt", "clean"}, status: 202},
+		{name: "completed job", principal: scanner(), method: "GET", route: "/api/v1/clamav/jobs/{id}", path: "/api/v1/clamav/jobs/" + completed, status: 200},
+		{name: "unknown job", method: "GET", route: "/api/v1/clamav/jobs/{id}", path: "/api/v1/clamav/jobs/unknown", status: 404},
+		{name: "workers", method: "GET", route: "/api/v1/admin/workers", status: 200},
+		{name: "resize", method: "POST", route: "/api/v1/admin/workers/resize", body: `{"minWorkers":2,"maxWorkers":2}`, status: 204},
+		{name: "resize invalid", method: "POST", route: "/api/v1/admin/workers/resize", body: `{"minWorkers":2,"maxWorkers":1}`, status: 400},
+		{name: "recycle", method: "POST", route: "/api/v1/admin/workers/{id}/recycle", path: "/api/v1/admin/workers/" + workerID + "/recycle", status: 202},
+		{name: "recycle unknown", method: "POST", route: "/api/v1/admin/workers/{id}/recycle", path: "/api/v1/admin/workers/42/recycle", status: 404},
+		{name: "backends", method: "GET", route: "/api/v1/admin/backends", status: 200},
+		{name: "drain unknown", method: "POST", route: "/api/v1/admin/backends/drain", body: `{"address":"nowhere:3310"}`, status: 404},
+		{name: "enable", method: "POST", route: "/api/v1/admin/backends/enable", body: `{"address":"` + fake.Address() + `"}`, status: 204},
+		{name: "enable invalid", method: "POST", route: "/api/v1/admin/backends/enable", body: `{}`, status: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = tt.route
+			}
+			principal := tt.principal
+			if principal == nil {
+				principal = everything
+			}
+			handler, prefix := clamav, "/api/v1/clamav"
+			if strings.HasPrefix(path, "/api/v1/admin") {
+				handler, prefix = admin, "/api/v1/admin"
+			}
+			var body io.Reader = strings.NewReader(tt.body)
+			contentType := "application/json"
+			if tt.upload != nil {
+				body, contentType = multipartFile(t, tt.upload.name, tt.upload.content)
+			}
+
+			// execute
+			r := httptest.NewRequest(tt.method, strings.TrimPrefix(path, prefix), body)
+			r.Header.Set("Content-Type", contentType)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			r = r.WithContext(auth.NewContext(r.Context(), principal))
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, r)
+
+			// assert
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			documented, ok := spec.response(tt.route, tt.method, resp.Code)
+			require.True(t, ok, "undocumented status")
+			schema, ok := spec.jsonSchema(documented)
+			if !ok {
+				assert.Empty(t, resp.Body.String(), "undocumented body")
+				return
+			}
+			assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+			var v any
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &v))
+			assert.Empty(t, spec.validate(schema, v, "$"), resp.Body.String())
+		})
+	}
+}
+
+func TestOpenAPI_Served(t *testing.T) {
+	// prepare
+	w := httptest.NewRecorder()
+
+	// execute
+	HandleOpenAPI(w, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+
+	// assert
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(OpenAPISpec()), w.Body.String())
+}
+
+// helpers
+
+// openAPI validates JSON values against the schemas of the OpenAPI
+// document, supporting the subset of JSON Schema that it uses.
+type openAPI struct {
+	doc map[string]any
+}
+
+func loadOpenAPI(t *testing.T) openAPI {
+	t.Helper()
+
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(OpenAPISpec(), &doc))
+	return openAPI{doc}
+}
+
+func (o openAPI) paths() map[string]map[string]any {
+	paths := map[string]map[string]any{}
+	for path, item := range o.doc["paths"].(map[string]any) {
+		paths[path] = item.(map[string]any)
+	}
+	return paths
+}
+
+// response returns the response of an operation with the status, if
+// documented.
+func (o openAPI) response(path string, method string, status int) (map[string]any, bool) {
+	op, ok := o.paths()[path][strings.ToLower(method)].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	resp, ok := op["responses"].(map[string]any)[strconv.Itoa(status)].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return o.resolve(resp), true
+}
+
+// jsonSchema returns the schema of the JSON body of a response, if it has
+// one.
+func (o openAPI) jsonSchema(resp map[string]any) (map[string]any, bool) {
+	content, ok := resp["content"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	media, ok := content["application/json"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return media["schema"].(map[string]any), true
+}
+
+// resolve follows the $ref of v, if any.
+func (o openAPI) resolve(v map[string]any) map[string]any {
+	ref, ok := v["$ref"].(string)
+	if !ok {
+		return v
+	}
+	var node any = o.doc
+	for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]any)[name]
+	}
+	return o.resolve(node.(map[string]any))
+}
+
+// validate returns where v does not match the schema.
+func (o openAPI) validate(schema map[string]any, v any, path string) []string {
+	schema = o.resolve(schema)
+
+	if alternatives, ok := schema["oneOf"].([]any); ok {
+		matched := 0
+		for _, alt := range alternatives {
+			if len(o.validate(alt.(map[string]any), v, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return []string{fmt.Sprintf("%s: matches %d schemas of oneOf", path, matched)}
+		}
+		return nil
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return hasType(v, t) }) {
+		return []string{fmt.Sprintf("%s: %v is not %v", path, v, types)}
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return []string{fmt.Sprintf("%s: %v is not one of %v", path, v, enum)}
+	}
+
+	var errs []string
+	switch v := v.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing %s", path, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch prop, ok := properties[name].(map[string]any); {
+			case ok:
+				errs = append(errs, o.validate(prop, v[name], path+"."+name)...)
+			case schema["additionalProperties"] == false:
+				errs = append(errs, fmt.Sprintf("%s: undocumented %s", path, name))
+			default:
+				if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+					errs = append(errs, o.validate(additional, v[name], path+"."+name)...)
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				errs = append(errs, o.validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return errs
+}
+
+func schemaTypes(schema map[string]any) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := make([]string, 0, len(t))
+		for _, name := range t {
+			types = append(types, name.(string))
+		}
+		return types
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v))
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	}
+	return false
+}
+
+func submitJob(t *testing.T, h http.Handler, name string, content string) string {
+	t.Helper()
+
+	body, contentType := multipartFile(t, name, content)
+	resp := serveClamavV1(t, h, scanner(), http.MethodPost, "/jobs", body, contentType)
+	require.Equal(t, http.StatusAccepted, resp.Code)
+	var job JobResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &job))
+
+	return job.ID
+}
+
+func waitJob(t *testing.T, h http.Handler, id string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		resp := serveClamavV1(t, h, scanner(), http.MethodGet, "/jobs/"+id, nil, "")
+		var job JobResponse
+		return json.Unmarshal(resp.Body.Bytes(), &job) == nil && job.Status != JobPending
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,54 @@
+// Package render writes JSON responses.
+package render
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Error codes of ErrorResponse.
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeRateLimited  = "rate_limited"
+	CodeQueueTimeout = "queue_timeout"
+	CodeOverloaded   = "overloaded"
+	CodeScanTimeout  = "scan_timeout"
+	CodeUnavailable  = "unavailable"
+	CodeInternal     = "internal"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON writes v as JSON response body with the given status.
+func JSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Error marshalling response")
+	}
+}
+
+// Error writes an ErrorResponse with the given status.
+func Error(w http.ResponseWriter, status int, code string, message string) {
+	JSON(w, status, ErrorResponse{Code: code, Message: message})
+}
+
+// RetryAfter sets the Retry-After header, rounding d up to whole seconds
+// and at least one.
+func RetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := max(1, int(math.Ceil(d.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
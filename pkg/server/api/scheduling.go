@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+// PriorityHeader lets callers choose the priority class of their scans,
+// either "interactive" or "bulk".
+const PriorityHeader = "X-Scan-Priority"
+
+// TimeoutHeader lets callers set the timeout of their scans, as a Go
+// duration like "30s".  It is capped by the configured max job timeout.
+const TimeoutHeader = "X-Scan-Timeout"
+
+var (
+	// ErrPriorityNotAllowed is returned when a caller asks for interactive
+	// priority without the interactive scope.
+	ErrPriorityNotAllowed = errors.New("priority not allowed")
+	// ErrInvalidTimeout is returned when the requested timeout is not a
+	// positive duration.
+	ErrInvalidTimeout = errors.New("invalid timeout")
+)
+
+// jobOptions schedules the jobs of a request with its priority, queued
+// fairly among clients, and applies its timeout if any.
+func jobOptions(r *http.Request) ([]clamd.JobOption, error) {
+	priority, err := requestPriority(r)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []clamd.JobOption{
+		clamd.WithPriority(priority),
+		clamd.WithTenant(auth.ClientKey(r), 1),
+		clamd.WithContext(r.Context()),
+	}
+
+	if h := r.Header.Get(TimeoutHeader); h != "" {
+		timeout, err := time.ParseDuration(h)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTimeout, h)
+		}
+		opts = append(opts, clamd.WithTimeout(timeout))
+	}
+
+	return opts, nil
+}
+
+// requestPriority reads the priority from PriorityHeader, defaulting to
+// interactive for callers with the interactive scope and to bulk for the
+// others.
+func requestPriority(r *http.Request) (clamd.Priority, error) {
+	interactiveAllowed := true
+	if p, ok := auth.FromContext(r.Context()); ok {
+		interactiveAllowed = p.HasScope(auth.ScopeInteractive)
+	}
+
+	priority := clamd.PriorityBulk
+	if interactiveAllowed {
+		priority = clamd.PriorityInteractive
+	}
+
+	if h := r.Header.Get(PriorityHeader); h != "" {
+		requested, err := clamd.ParsePriority(h)
+		if err != nil {
+			return 0, err
+		}
+		if requested == clamd.PriorityInteractive && !interactiveAllowed {
+			return 0, fmt.Errorf("%w: %s requires scope %s", ErrPriorityNotAllowed, requested, auth.ScopeInteractive)
+		}
+		priority = requested
+	}
+
+	return priority, nil
+}
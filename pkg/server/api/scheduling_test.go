@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/clamd"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+func TestRequestPriority(t *testing.T) {
+	interactive := &auth.Principal{ID: "ui", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeScan, auth.ScopeInteractive}}
+	batch := &auth.Principal{ID: "batch", Method: auth.MethodAPIKey, Scopes: []auth.Scope{auth.ScopeScan}}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		header    string
+		expected  clamd.Priority
+		expectErr error
+	}{
+		{name: "interactive scope defaults to interactive", principal: interactive, expected: clamd.PriorityInteractive},
+		{name: "interactive scope can ask bulk", principal: interactive, header: "bulk", expected: clamd.PriorityBulk},
+		{name: "no interactive scope defaults to bulk", principal: batch, expected: clamd.PriorityBulk},
+		{name: "no interactive scope cannot ask interactive", principal: batch, header: "interactive", expectErr: ErrPriorityNotAllowed},
+		{name: "unknown priority", principal: interactive, header: "urgent", expectErr: clamd.ErrUnknownPriority},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// prepare
+			r := httptest.NewRequest("POST", "/scan", nil)
+			r = r.WithContext(auth.NewContext(r.Context(), tt.principal))
+			if tt.header != "" {
+				r.Header.Set(PriorityHeader, tt.header)
+			}
+
+			// execute
+			priority, err := requestPriority(r)
+
+			// assert
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, priority)
+		})
+	}
+}
+
+func TestJobOptionsTimeout(t *testing.T) {
+	for _, h := range []string{"30s", "1m30s"} {
+		r := httptest.NewRequest("POST", "/scan", nil)
+		r.Header.Set(TimeoutHeader, h)
+
+		_, err := jobOptions(r)
+
+		require.NoError(t, err, h)
+	}
+
+	for _, h := range []string{"30", "-1s", "0s", "soon"} {
+		r := httptest.NewRequest("POST", "/scan", nil)
+		r.Header.Set(TimeoutHeader, h)
+
+		_, err := jobOptions(r)
+
+		require.ErrorIs(t, err, ErrInvalidTimeout, h)
+	}
+}
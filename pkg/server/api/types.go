@@ -0,0 +1,220 @@
+package api
+
+import (
+	"time"
+
+	"github.com/tomrss/restclam/pkg/clamd"
+)
+
+// ScanResponse is the response of a file scan.
+type ScanResponse struct {
+	Status   string       `json:"status"`
+	Virus    string       `json:"virus"`
+	Error    string       `json:"error"`
+	Filename string       `json:"filename"`
+	Metadata ScanMetadata `json:"metadata"`
+}
+
+// ScanMetadata describes the scanned content and how the scan was performed.
+type ScanMetadata struct {
+	Size             int64   `json:"size"`
+	SHA256           string  `json:"sha256"`
+	SHA1             string  `json:"sha1"`
+	MD5              string  `json:"md5"`
+	MimeType         string  `json:"mimeType"`
+	QueueDurationMs  float64 `json:"queueDurationMs"`
+	ScanDurationMs   float64 `json:"scanDurationMs"`
+	WorkerID         uint    `json:"workerId"`
+	Backend          string  `json:"backend"`
+	SignatureVersion string  `json:"signatureVersion"`
+}
+
+func newScanResponse(scan *clamd.ScanResult, filename string) ScanResponse {
+	meta := scan.Metadata
+	return ScanResponse{
+		Status:   string(scan.Status),
+		Virus:    scan.Virus,
+		Error:    scan.Error,
+		Filename: filename,
+		Metadata: ScanMetadata{
+			Size:             meta.Size,
+			SHA256:           meta.SHA256,
+			SHA1:             meta.SHA1,
+			MD5:              meta.MD5,
+			MimeType:         meta.MimeType,
+			QueueDurationMs:  millis(meta.QueueDuration),
+			ScanDurationMs:   millis(meta.ScanDuration),
+			WorkerID:         meta.WorkerID,
+			Backend:          meta.Backend,
+			SignatureVersion: meta.SignatureVersion,
+		},
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// MetricsResponse are the metrics of the scan job queue.
+type MetricsResponse struct {
+	Workers          int               `json:"workers"`
+	QueueLength      int               `json:"queueLength"`
+	Submitted        uint64            `json:"submitted"`
+	Completed        uint64            `json:"completed"`
+	Shed             uint64            `json:"shed"`
+	QueueTimeouts    uint64            `json:"queueTimeouts"`
+	JobTimeouts      uint64            `json:"jobTimeouts"`
+	Retries          uint64            `json:"retries"`
+	Hedges           uint64            `json:"hedges"`
+	Cancelled        uint64            `json:"cancelled"`
+	Clean            uint64            `json:"clean"`
+	Infected         uint64            `json:"infected"`
+	ScanErrors       uint64            `json:"scanErrors"`
+	AvgJobDurationMs float64           `json:"avgJobDurationMs"`
+	Circuits         map[string]string `json:"circuits"`
+}
+
+func newMetricsResponse(m clamd.CoordinatorMetrics, circuits map[string]clamd.BreakerState) MetricsResponse {
+	states := make(map[string]string, len(circuits))
+	for backend, state := range circuits {
+		states[backend] = state.String()
+	}
+
+	return MetricsResponse{
+		Workers:          m.Workers,
+		QueueLength:      m.QueueLength,
+		Submitted:        m.Submitted,
+		Completed:        m.Completed,
+		Shed:             m.Shed,
+		QueueTimeouts:    m.QueueTimeouts,
+		JobTimeouts:      m.JobTimeouts,
+		Retries:          m.Retries,
+		Hedges:           m.Hedges,
+		Cancelled:        m.Cancelled,
+		Clean:            m.Clean,
+		Infected:         m.Infected,
+		ScanErrors:       m.ScanErrors,
+		AvgJobDurationMs: millis(m.AvgJobDuration),
+		Circuits:         states,
+	}
+}
+
+// StatsResponse is the parsed reply of clamd STATS.
+type StatsResponse struct {
+	Pools   int          `json:"pools"`
+	State   string       `json:"state"`
+	Threads ThreadsStats `json:"threads"`
+	Queue   int          `json:"queue"`
+	Memory  MemoryStats  `json:"memory"`
+}
+
+// ThreadsStats describes the clamd thread pool.
+type ThreadsStats struct {
+	Live        int `json:"live"`
+	Idle        int `json:"idle"`
+	Max         int `json:"max"`
+	IdleTimeout int `json:"idleTimeout"`
+}
+
+// MemoryStats describes the clamd memory, sizes as reported by clamd.
+type MemoryStats struct {
+	Heap       string `json:"heap"`
+	Mmap       string `json:"mmap"`
+	Used       string `json:"used"`
+	Free       string `json:"free"`
+	Releasable string `json:"releasable"`
+	Pools      int    `json:"pools"`
+	PoolsUsed  string `json:"poolsUsed"`
+	PoolsTotal string `json:"poolsTotal"`
+}
+
+// NewStatsResponse converts parsed clamd STATS.
+func NewStatsResponse(s clamd.Stats) StatsResponse {
+	return StatsResponse{
+		Pools: s.Pools,
+		State: s.State,
+		Threads: ThreadsStats{
+			Live:        s.Threads.Live,
+			Idle:        s.Threads.Idle,
+			Max:         s.Threads.Max,
+			IdleTimeout: s.Threads.IdleTimeout,
+		},
+		Queue: s.Queue,
+		Memory: MemoryStats{
+			Heap:       s.Memory.Heap,
+			Mmap:       s.Memory.Mmap,
+			Used:       s.Memory.Used,
+			Free:       s.Memory.Free,
+			Releasable: s.Memory.Releasable,
+			Pools:      s.Memory.Pools,
+			PoolsUsed:  s.Memory.PoolsUsed,
+			PoolsTotal: s.Memory.PoolsTotal,
+		},
+	}
+}
+
+// WorkerResponse describes a session worker.
+type WorkerResponse struct {
+	ID              uint    `json:"id"`
+	Backend         string  `json:"backend"`
+	State           string  `json:"state"`
+	JobsProcessed   uint64  `json:"jobsProcessed"`
+	LastHeartbeat   *string `json:"lastHeartbeat"`
+	CurrentJobAgeMs float64 `json:"currentJobAgeMs"`
+}
+
+func newWorkersResponse(workers []clamd.WorkerInfo) []WorkerResponse {
+	resp := make([]WorkerResponse, 0, len(workers))
+	for _, w := range workers {
+		var lastHeartbeat *string
+		if !w.LastHeartbeat.IsZero() {
+			t := w.LastHeartbeat.UTC().Format(time.RFC3339Nano)
+			lastHeartbeat = &t
+		}
+		resp = append(resp, WorkerResponse{
+			ID:              w.ID,
+			Backend:         w.Backend,
+			State:           string(w.State),
+			JobsProcessed:   w.JobsProcessed,
+			LastHeartbeat:   lastHeartbeat,
+			CurrentJobAgeMs: millis(w.CurrentJobAge),
+		})
+	}
+	return resp
+}
+
+// BackendResponse describes a clamd backend.
+type BackendResponse struct {
+	Address       string `json:"address"`
+	Circuit       string `json:"circuit"`
+	Enabled       bool   `json:"enabled"`
+	Workers       int    `json:"workers"`
+	InFlight      int    `json:"inFlight"`
+	JobsProcessed uint64 `json:"jobsProcessed"`
+}
+
+func newBackendsResponse(backends []clamd.BackendInfo) []BackendResponse {
+	resp := make([]BackendResponse, 0, len(backends))
+	for _, b := range backends {
+		resp = append(resp, BackendResponse{
+			Address:       b.Address,
+			Circuit:       b.Circuit.String(),
+			Enabled:       b.Enabled,
+			Workers:       b.Workers,
+			InFlight:      b.InFlight,
+			JobsProcessed: b.JobsProcessed,
+		})
+	}
+	return resp
+}
+
+// BackendRequest selects a backend to drain or enable.
+type BackendRequest struct {
+	Address string `json:"address"`
+}
+
+// ResizeRequest sets the worker bounds.
+type ResizeRequest struct {
+	MinWorkers int `json:"minWorkers"`
+	MaxWorkers int `json:"maxWorkers"`
+}
@@ -0,0 +1,57 @@
+// Package audit records security relevant events.
+//
+// Audit records are regular log events, marked with the "audit" field so
+// that they can be routed apart from the application logs.
+package audit
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/tomrss/restclam/pkg/server/auth"
+)
+
+// Allowed starts an audit record of an allowed action on a request.
+//
+//nolint:zerologlint
+func Allowed(logger zerolog.Logger, r *http.Request, action string) *zerolog.Event {
+	return record(logger.Info(), r, action, "allowed")
+}
+
+// Denied starts an audit record of a denied action on a request.
+//
+//nolint:zerologlint
+func Denied(logger zerolog.Logger, r *http.Request, action string) *zerolog.Event {
+	return record(logger.Warn(), r, action, "denied")
+}
+
+// DeniedConnection starts an audit record of a TLS connection refused
+// during the handshake.
+//
+//nolint:zerologlint
+func DeniedConnection(logger zerolog.Logger, cs *tls.ConnectionState) *zerolog.Event {
+	return logger.Warn().
+		Bool("audit", true).
+		Str("action", "tls-handshake").
+		Str("outcome", "denied").
+		Str("clientCert", auth.ClientCertIdentity(cs))
+}
+
+func record(e *zerolog.Event, r *http.Request, action string, outcome string) *zerolog.Event {
+	e = e.Bool("audit", true).
+		Str("action", action).
+		Str("outcome", outcome).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("remoteAddr", r.RemoteAddr)
+
+	if clientCert := auth.ClientCertIdentity(r.TLS); clientCert != "" {
+		e = e.Str("clientCert", clientCert)
+	}
+	if p, ok := auth.FromContext(r.Context()); ok {
+		e = e.Str("principal", p.ID).Str("authMethod", string(p.Method))
+	}
+
+	return e
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/server/config"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	hashPrefix = "sha256:"
+
+	defaultKeyFileCheckInterval = 10 * time.Second
+)
+
+// ErrInvalidKeyHash is returned when a configured key hash is malformed.
+var ErrInvalidKeyHash = errors.New("invalid API key hash")
+
+// HashKey returns the hash of an API key, in the format expected in the
+// configuration and in the key file.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// keyFile is the format of the API key file.
+type keyFile struct {
+	Keys []config.APIKeyConfig `yaml:"keys"`
+}
+
+// KeyStore validates API keys against the hashed keys of the configuration
+// and of an optional key file.  The key file is checked for changes
+// periodically, so that keys can be rotated without restarting.
+type KeyStore struct {
+	mu          sync.RWMutex
+	configKeys  map[string]*Principal
+	fileKeys    map[string]*Principal
+	file        string
+	fileModTime time.Time
+
+	checkInterval time.Duration
+	checkMu       sync.Mutex
+	lastCheck     time.Time
+}
+
+// NewKeyStore creates a key store with the keys of the configuration and
+// of the configured key file.
+func NewKeyStore(conf config.AuthConfig) (*KeyStore, error) {
+	s := &KeyStore{
+		file:          conf.KeyFile,
+		checkInterval: conf.KeyFileCheckInterval,
+		fileKeys:      map[string]*Principal{},
+	}
+	if s.checkInterval == 0 {
+		s.checkInterval = defaultKeyFileCheckInterval
+	}
+
+	if err := s.SetKeys(conf.APIKeys); err != nil {
+		return nil, err
+	}
+
+	if s.file != "" {
+		if err := s.reloadFile(); err != nil {
+			return nil, err
+		}
+		s.lastCheck = time.Now()
+	}
+
+	return s, nil
+}
+
+// SetKeys replaces the keys coming from the configuration.
+func (s *KeyStore) SetKeys(keys []config.APIKeyConfig) error {
+	parsed, err := parseKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.configKeys = parsed
+	return nil
+}
+
+// ValidateKeys checks the keys as SetKeys would, without setting them.
+func ValidateKeys(keys []config.APIKeyConfig) error {
+	_, err := parseKeys(keys)
+	return err
+}
+
+// Authenticate returns the principal owning the key.
+func (s *KeyStore) Authenticate(key string) (*Principal, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: missing API key", ErrUnauthenticated)
+	}
+
+	s.checkFile()
+
+	hash := HashKey(key)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.configKeys[hash]; ok {
+		return p, nil
+	}
+	if p, ok := s.fileKeys[hash]; ok {
+		return p, nil
+	}
+
+	return nil, fmt.Errorf("%w: invalid API key", ErrUnauthenticated)
+}
+
+// checkFile reloads the key file if it changed since last check.  If the
+// file was removed its keys are revoked, on other errors, likely transient,
+// they are kept.
+func (s *KeyStore) checkFile() {
+	if s.file == "" {
+		return
+	}
+
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+
+	if time.Since(s.lastCheck) < s.checkInterval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	err := s.reloadFile()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if s.revokeFileKeys() {
+			log.Warn().Str("file", s.file).Msg("API key file removed, revoking its keys")
+		}
+	case err != nil:
+		log.Error().Err(err).Str("file", s.file).Msg("unable to reload API key file, keeping previous keys")
+	}
+}
+
+// revokeFileKeys drops the keys of the file, telling if there were any
+// loaded.
+func (s *KeyStore) revokeFileKeys() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loaded := !s.fileModTime.IsZero()
+	s.fileKeys = map[string]*Principal{}
+	s.fileModTime = time.Time{}
+	return loaded
+}
+
+func (s *KeyStore) reloadFile() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return fmt.Errorf("unable to stat API key file: %w", err)
+	}
+
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.fileModTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("unable to read API key file: %w", err)
+	}
+
+	var kf keyFile
+	if err := yaml.Unmarshal(content, &kf); err != nil {
+		return fmt.Errorf("unable to parse API key file: %w", err)
+	}
+
+	parsed, err := parseKeys(kf.Keys)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fileKeys = parsed
+	s.fileModTime = info.ModTime()
+
+	log.Info().Str("file", s.file).Int("keys", len(parsed)).Msg("API key file loaded")
+	return nil
+}
+
+func parseKeys(keys []config.APIKeyConfig) (map[string]*Principal, error) {
+	parsed := make(map[string]*Principal, len(keys))
+
+	for _, k := range keys {
+		hash := strings.ToLower(k.Hash)
+		if !strings.HasPrefix(hash, hashPrefix) || len(hash) != len(hashPrefix)+2*sha256.Size {
+			return nil, fmt.Errorf("%w for key %q: expected %s<hex>", ErrInvalidKeyHash, k.ID, hashPrefix)
+		}
+		if _, err := hex.DecodeString(strings.TrimPrefix(hash, hashPrefix)); err != nil {
+			return nil, fmt.Errorf("%w for key %q: %w", ErrInvalidKeyHash, k.ID, err)
+		}
+
+		scopes := make([]Scope, 0, len(k.Scopes))
+		for _, s := range k.Scopes {
+			scope, err := ParseScope(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scopes for key %q: %w", k.ID, err)
+			}
+			scopes = append(scopes, scope)
+		}
+
+		parsed[hash] = &Principal{
+			ID:     k.ID,
+			Method: MethodAPIKey,
+			Scopes: scopes,
+		}
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+func TestKeyStoreConfigKeys(t *testing.T) {
+	// prepare
+	s, err := NewKeyStore(config.AuthConfig{
+		APIKeys: []config.APIKeyConfig{
+			{ID: "scanner", Hash: HashKey("s3cr3t"), Scopes: []string{"scan"}},
+			{ID: "admin", Hash: HashKey("adm1n"), Scopes: []string{"scan", "admin"}},
+		},
+	})
+	require.NoError(t, err)
+
+	// execute
+	scanner, errScanner := s.Authenticate("s3cr3t")
+	admin, errAdmin := s.Authenticate("adm1n")
+	_, errWrong := s.Authenticate("wrong")
+	_, errMissing := s.Authenticate("")
+
+	// assert
+	require.NoError(t, errScanner)
+	require.NoError(t, errAdmin)
+	assert.Equal(t, "scanner", scanner.ID)
+	assert.True(t, scanner.HasScope(ScopeScan))
+	assert.False(t, scanner.HasScope(ScopeAdmin))
+	assert.Equal(t, MethodAPIKey, scanner.Method)
+	assert.True(t, admin.HasScope(ScopeAdmin))
+	require.ErrorIs(t, errWrong, ErrUnauthenticated)
+	require.ErrorIs(t, errMissing, ErrUnauthenticated)
+}
+
+func TestKeyStoreInvalidConfig(t *testing.T) {
+	_, errHash := NewKeyStore(config.AuthConfig{
+		APIKeys: []config.APIKeyConfig{{ID: "plain", Hash: "s3cr3t", Scopes: []string{"scan"}}},
+	})
+	_, errScope := NewKeyStore(config.AuthConfig{
+		APIKeys: []config.APIKeyConfig{{ID: "bad", Hash: HashKey("k"), Scopes: []string{"root"}}},
+	})
+
+	require.ErrorIs(t, errHash, ErrInvalidKeyHash)
+	require.ErrorIs(t, errScope, ErrUnknownScope)
+}
+
+func TestKeyStoreFileRotation(t *testing.T) {
+	// prepare
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, file, "old", time.Now().Add(-time.Minute))
+
+	s, err := NewKeyStore(config.AuthConfig{
+		KeyFile:              file,
+		KeyFileCheckInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+
+	_, errOld := s.Authenticate("old")
+	require.NoError(t, errOld)
+
+	// execute: rotate the key
+	writeKeyFile(t, file, "new", time.Now())
+
+	// assert
+	_, errOld = s.Authenticate("old")
+	p, errNew := s.Authenticate("new")
+	require.ErrorIs(t, errOld, ErrUnauthenticated)
+	require.NoError(t, errNew)
+	assert.Equal(t, "rotated", p.ID)
+	assert.Equal(t, []Scope{ScopeScan, ScopeReadStats}, p.Scopes)
+}
+
+func TestKeyStoreFileRemoved(t *testing.T) {
+	// prepare
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, file, "old", time.Now().Add(-time.Minute))
+
+	s, err := NewKeyStore(config.AuthConfig{
+		KeyFile:              file,
+		KeyFileCheckInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+
+	// execute
+	require.NoError(t, os.Remove(file))
+	_, errRemoved := s.Authenticate("old")
+	writeKeyFile(t, file, "new", time.Now())
+	_, errRecreated := s.Authenticate("new")
+
+	// assert
+	require.ErrorIs(t, errRemoved, ErrUnauthenticated, "keys of a removed file are revoked")
+	require.NoError(t, errRecreated)
+}
+
+func TestKeyStoreFileInvalid(t *testing.T) {
+	// prepare
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, file, "old", time.Now().Add(-time.Minute))
+
+	s, err := NewKeyStore(config.AuthConfig{
+		KeyFile:              file,
+		KeyFileCheckInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+
+	// execute
+	require.NoError(t, os.WriteFile(file, []byte("keys: [\n"), 0o600))
+	_, errOld := s.Authenticate("old")
+
+	// assert
+	require.NoError(t, errOld, "keys are kept on parse errors")
+}
+
+// helpers
+
+func writeKeyFile(t *testing.T, file string, key string, modTime time.Time) {
+	t.Helper()
+
+	content := "keys:\n" +
+		"  - id: rotated\n" +
+		"    hash: " + HashKey(key) + "\n" +
+		"    scopes: [scan, read-stats]\n"
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	require.NoError(t, os.Chtimes(file, modTime, modTime))
+}
@@ -0,0 +1,109 @@
+// Package auth authenticates API callers and describes what they are allowed to do.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// Scope is a permission granted to a caller.
+type Scope string
+
+const (
+	// ScopeScan allows to scan files.
+	ScopeScan Scope = "scan"
+	// ScopeReadStats allows to read clamd and restclam statistics.
+	ScopeReadStats Scope = "read-stats"
+	// ScopeAdmin allows to inspect and control restclam at runtime.
+	ScopeAdmin Scope = "admin"
+	// ScopeInteractive allows to scan with interactive priority.  Scans of
+	// callers without it are scheduled as bulk.
+	ScopeInteractive Scope = "interactive"
+)
+
+// AllScopes are all the known scopes.
+func AllScopes() []Scope {
+	return []Scope{ScopeScan, ScopeReadStats, ScopeAdmin, ScopeInteractive}
+}
+
+// ParseScope validates a scope name.
+func ParseScope(s string) (Scope, error) {
+	scope := Scope(s)
+	if !slices.Contains(AllScopes(), scope) {
+		return "", fmt.Errorf("%w: %q", ErrUnknownScope, s)
+	}
+	return scope, nil
+}
+
+// Method is the way a caller was authenticated.
+type Method string
+
+const (
+	// MethodNone is used when authentication is disabled.
+	MethodNone Method = "none"
+	// MethodAPIKey is used for callers presenting an API key.
+	MethodAPIKey Method = "apikey"
+)
+
+var (
+	// ErrUnauthenticated is returned when no valid credentials are presented.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrUnknownScope is returned when parsing an unknown scope.
+	ErrUnknownScope = errors.New("unknown scope")
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// ID identifies the caller, e.g. the API key id
+	ID string
+	// Method is how the caller was authenticated
+	Method Method
+	// Scopes are the permissions of the caller
+	Scopes []Scope
+}
+
+// Anonymous is the principal of every request when authentication is disabled.
+func Anonymous() *Principal {
+	return &Principal{
+		ID:     "anonymous",
+		Method: MethodNone,
+		Scopes: AllScopes(),
+	}
+}
+
+// HasScope tells if the principal was granted a scope.
+func (p *Principal) HasScope(scope Scope) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// ClientKey identifies the client of a request, e.g. for quotas and fair
+// scheduling: by principal when authenticated, namespaced by method as ids
+// of different methods may clash, by IP address otherwise.
+func ClientKey(r *http.Request) string {
+	if p, ok := FromContext(r.Context()); ok && p.Method != MethodNone {
+		return string(p.Method) + ":" + p.ID
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
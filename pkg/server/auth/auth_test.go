@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		expected  string
+	}{
+		{"anonymous", Anonymous(), "ip:192.0.2.1"},
+		{"api key", &Principal{ID: "uploader", Method: MethodAPIKey}, "apikey:uploader"},
+		{"jwt", &Principal{ID: "uploader", Method: MethodJWT}, "jwt:uploader"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// prepare
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r = r.WithContext(NewContext(r.Context(), tt.principal))
+
+			// execute
+			key := ClientKey(r)
+
+			// assert
+			assert.Equal(t, tt.expected, key)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	bearerPrefix        = "Bearer "
+)
+
+// Authenticator authenticates requests with an API key or, if enabled,
+// with a bearer JWT in the Authorization header.
+type Authenticator struct {
+	apiKeyHeader string
+	keys         *KeyStore
+	jwt          *JWTValidator
+}
+
+// NewAuthenticator creates an authenticator from the configuration.
+func NewAuthenticator(conf config.AuthConfig) (*Authenticator, error) {
+	keys, err := NewKeyStore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authenticator{
+		apiKeyHeader: conf.APIKeyHeader,
+		keys:         keys,
+	}
+	if a.apiKeyHeader == "" {
+		a.apiKeyHeader = defaultAPIKeyHeader
+	}
+
+	if conf.JWT.Enabled {
+		if a.jwt, err = NewJWTValidator(conf.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Keys returns the API key store.
+func (a *Authenticator) Keys() *KeyStore {
+	return a.keys
+}
+
+// AuthenticateRequest returns the principal making the request.
+func (a *Authenticator) AuthenticateRequest(r *http.Request) (*Principal, error) {
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		if a.jwt == nil {
+			return nil, fmt.Errorf("%w: bearer tokens are not enabled", ErrUnauthenticated)
+		}
+		if !strings.HasPrefix(authz, bearerPrefix) {
+			return nil, fmt.Errorf("%w: unsupported authorization scheme", ErrUnauthenticated)
+		}
+		return a.jwt.Authenticate(r.Context(), strings.TrimPrefix(authz, bearerPrefix))
+	}
+
+	return a.keys.Authenticate(r.Header.Get(a.apiKeyHeader))
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ClientCertIdentity describes the client certificate of a TLS connection,
+// or returns an empty string if the client did not present one.
+func ClientCertIdentity(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.String()
+}
+
+// CertificateSANs returns all the subject alternative names of a
+// certificate: DNS names, email addresses, IP addresses and URIs.
+func CertificateSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultJWKSCacheTTL = 10 * time.Minute
+	// minJWKSRefreshInterval limits refreshes, e.g. triggered by unknown
+	// key ids or while the IdP is down
+	minJWKSRefreshInterval = 30 * time.Second
+	// maxJWKSStaleness is how long past the TTL keys are used when they
+	// cannot be refreshed
+	maxJWKSStaleness = time.Hour
+	jwksFetchTimeout = 10 * time.Second
+	maxJWKSSize      = 1 << 20
+)
+
+var (
+	// ErrJWKS is returned when the JWKS cannot be loaded or parsed.
+	ErrJWKS = errors.New("invalid JWKS")
+	// ErrUnknownKey is returned when a token is signed by a key not in the JWKS.
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// jwk is a JSON Web Key as in RFC 7517, only with the fields needed for
+// signature verification with RSA and EC keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwtKey is a verification key, bound to the algorithm of its JWK if any.
+type jwtKey struct {
+	public crypto.PublicKey
+	alg    string
+}
+
+// jwksCache loads the JWKS from a local file or from a URL and keeps it
+// for a TTL.  A token with an unknown key id triggers a refresh, to pick
+// up rotated keys as soon as they are published.  Concurrent requests
+// share a single refresh, done at most every minJWKSRefreshInterval, and
+// keys that cannot be refreshed are still used up to maxJWKSStaleness
+// past the TTL, so that the IdP being slow or down is not felt at once.
+type jwksCache struct {
+	file   string
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]jwtKey
+	// fetched is when keys were loaded
+	fetched time.Time
+	// attempted is when the last refresh started, failed or not
+	attempted time.Time
+	// refreshErr is the error of the last refresh, nil if it succeeded
+	refreshErr error
+	// refreshing is closed when the refresh in progress is over, nil if
+	// none is
+	refreshing chan struct{}
+}
+
+func newJWKSCache(file string, url string, ttl time.Duration) *jwksCache {
+	if ttl == 0 {
+		ttl = defaultJWKSCacheTTL
+	}
+	return &jwksCache{
+		file:   file,
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// key returns the key with the given key id.
+func (c *jwksCache) key(ctx context.Context, kid string) (jwtKey, error) {
+	if c.expired(0) {
+		err := c.refresh(ctx)
+		if err != nil && c.expired(maxJWKSStaleness) {
+			return jwtKey{}, err
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("unable to refresh JWKS, using the expired keys")
+		}
+	}
+
+	if k, ok := c.lookup(kid); ok {
+		return k, nil
+	}
+
+	// maybe keys were rotated
+	if err := c.refresh(ctx); err != nil {
+		return jwtKey{}, err
+	}
+	if k, ok := c.lookup(kid); ok {
+		return k, nil
+	}
+
+	return jwtKey{}, fmt.Errorf("%w: kid %q", ErrUnknownKey, kid)
+}
+
+// expired tells if there are no keys, or they were loaded longer than
+// the TTL and the grace period ago.
+func (c *jwksCache) expired(grace time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.keys == nil || time.Since(c.fetched) > c.ttl+grace
+}
+
+func (c *jwksCache) lookup(kid string) (jwtKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k, ok := c.keys[kid]
+	return k, ok
+}
+
+// refresh loads the keys again, unless already done in the last
+// minJWKSRefreshInterval, returning the error of the last refresh.  If a
+// refresh is in progress, it waits for it instead.
+func (c *jwksCache) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	if done := c.refreshing; done != nil {
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.refreshErr
+	}
+	if !c.attempted.IsZero() && time.Since(c.attempted) < minJWKSRefreshInterval {
+		defer c.mu.Unlock()
+		return c.refreshErr
+	}
+	done := make(chan struct{})
+	c.refreshing = done
+	c.attempted = time.Now()
+	c.mu.Unlock()
+
+	// shared by the requests waiting, it must not fail if this one is
+	// cancelled
+	keys, err := c.fetch(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.keys = keys
+		c.fetched = time.Now()
+	}
+	c.refreshErr = err
+	c.refreshing = nil
+	close(done)
+	return err
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]jwtKey, error) {
+	content, err := c.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load JWKS: %w", err)
+	}
+
+	return parseJWKS(content)
+}
+
+func (c *jwksCache) load(ctx context.Context) ([]byte, error) {
+	if c.file != "" {
+		return os.ReadFile(c.file)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status %d fetching %s", ErrJWKS, resp.StatusCode, c.url)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+func parseJWKS(content []byte) (map[string]jwtKey, error) {
+	var set jwkSet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrJWKS, err)
+	}
+
+	keys := make(map[string]jwtKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if k.Alg != "" {
+			alg, ok := jwtAlgorithms[k.Alg]
+			if !ok {
+				return nil, fmt.Errorf("key %q: %w: unsupported algorithm %q", k.Kid, ErrJWKS, k.Alg)
+			}
+			if !alg.matches(pub) {
+				return nil, fmt.Errorf("key %q: %w: algorithm %s does not match the key", k.Kid, ErrJWKS, k.Alg)
+			}
+		}
+		keys[k.Kid] = jwtKey{public: pub, alg: k.Alg}
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("%w: RSA exponent too large", ErrJWKS)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		return k.ecPublicKey()
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %q", ErrJWKS, k.Kty)
+	}
+}
+
+func (k *jwk) ecPublicKey() (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+	switch k.Crv {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("%w: unsupported curve %q", ErrJWKS, k.Crv)
+	}
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate the point by parsing its uncompressed form
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x.Bytes()) > size || len(y.Bytes()) > size {
+		return nil, fmt.Errorf("%w: EC coordinates too large", ErrJWKS)
+	}
+	point := make([]byte, 1+2*size)
+	point[0] = 4
+	x.FillBytes(point[1 : 1+size])
+	y.FillBytes(point[1+size:])
+	if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("%w: invalid EC point: %w", ErrJWKS, err)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrJWKS, err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
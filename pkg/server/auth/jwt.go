@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+const defaultScopeClaim = "scope"
+
+// MethodJWT is used for callers presenting a bearer JWT.
+const MethodJWT Method = "jwt"
+
+var (
+	// ErrInvalidToken is returned when a token is malformed, badly signed
+	// or its claims are not acceptable.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrJWTConfig is returned when the JWT configuration is invalid.
+	ErrJWTConfig = errors.New("invalid JWT configuration")
+)
+
+// jwtAlgorithm describes how to verify a JWS signature algorithm, and the
+// keys it can be verified with.
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	pss  bool
+	// curve is the curve of the EC keys, empty for RSA keys
+	curve string
+}
+
+//nolint:gochecknoglobals
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256, curve: "P-256"},
+	"ES384": {hash: crypto.SHA384, curve: "P-384"},
+	"ES512": {hash: crypto.SHA512, curve: "P-521"},
+}
+
+// CheckJWTAlgorithm returns an error if tokens cannot be signed with the
+// named algorithm.
+func CheckJWTAlgorithm(name string) error {
+	if _, ok := jwtAlgorithms[name]; !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrJWTConfig, name)
+	}
+	return nil
+}
+
+// matches tells if the key is of the type, and of the curve, of the
+// algorithm.
+func (a jwtAlgorithm) matches(key crypto.PublicKey) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return a.curve == ""
+	case *ecdsa.PublicKey:
+		return a.curve == k.Curve.Params().Name
+	default:
+		return false
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// JWTValidator authenticates callers with bearer JWTs, signed with one of
+// the configured algorithms and verified against a JWKS and the configured
+// issuer and audiences.
+type JWTValidator struct {
+	algorithms    []string
+	issuer        string
+	audiences     []string
+	leeway        time.Duration
+	scopeClaim    string
+	scopeMappings map[string][]Scope
+	jwks          *jwksCache
+	now           func() time.Time
+}
+
+// NewJWTValidator creates a validator from the configuration.
+func NewJWTValidator(conf config.JWTConfig) (*JWTValidator, error) {
+	if (conf.JWKSFile == "") == (conf.JWKSURL == "") {
+		return nil, fmt.Errorf("%w: exactly one of jwksFile and jwksUrl is required", ErrJWTConfig)
+	}
+	if conf.Issuer == "" || len(conf.Audiences) == 0 {
+		return nil, fmt.Errorf("%w: issuer and audiences are required", ErrJWTConfig)
+	}
+	if len(conf.Algorithms) == 0 {
+		return nil, fmt.Errorf("%w: no algorithm allowed", ErrJWTConfig)
+	}
+	for _, alg := range conf.Algorithms {
+		if err := CheckJWTAlgorithm(alg); err != nil {
+			return nil, err
+		}
+	}
+
+	mappings := make(map[string][]Scope, len(conf.ScopeMappings))
+	for _, m := range conf.ScopeMappings {
+		for _, s := range m.Scopes {
+			scope, err := ParseScope(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: mapping of %q: %w", ErrJWTConfig, m.Value, err)
+			}
+			mappings[m.Value] = append(mappings[m.Value], scope)
+		}
+	}
+
+	scopeClaim := conf.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = defaultScopeClaim
+	}
+
+	return &JWTValidator{
+		algorithms:    conf.Algorithms,
+		issuer:        conf.Issuer,
+		audiences:     conf.Audiences,
+		leeway:        conf.Leeway,
+		scopeClaim:    scopeClaim,
+		scopeMappings: mappings,
+		jwks:          newJWKSCache(conf.JWKSFile, conf.JWKSURL, conf.JWKSCacheTTL),
+		now:           time.Now,
+	}, nil
+}
+
+// Authenticate verifies a compact serialized JWT and returns the principal
+// it represents.
+func (v *JWTValidator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	claims, err := v.verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	return &Principal{
+		ID:     sub,
+		Method: MethodJWT,
+		Scopes: v.scopes(claims),
+	}, nil
+}
+
+// verify checks the token signature and returns its claims.
+func (v *JWTValidator) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", ErrInvalidToken)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok || !slices.Contains(v.algorithms, header.Alg) {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed", ErrInvalidToken, header.Alg)
+	}
+
+	key, err := v.jwks.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	// the key decides the algorithm, not the token
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: algorithm %s does not match key algorithm %s", ErrInvalidToken, header.Alg, key.alg)
+	}
+	if !alg.matches(key.public) {
+		return nil, fmt.Errorf("%w: algorithm %s does not match key %q", ErrInvalidToken, header.Alg, header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %w", ErrInvalidToken, err)
+	}
+
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(alg, key.public, h.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verifySignature verifies the signature with a key matching the algorithm.
+func verifySignature(alg jwtAlgorithm, key crypto.PublicKey, digest []byte, signature []byte) error {
+	var valid bool
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg.pss {
+			valid = rsa.VerifyPSS(k, alg.hash, digest, signature, nil) == nil
+		} else {
+			valid = rsa.VerifyPKCS1v15(k, alg.hash, digest, signature) == nil
+		}
+	case *ecdsa.PublicKey:
+		// JWS encodes EC signatures as r || s
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("%w: malformed EC signature", ErrInvalidToken)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		valid = ecdsa.Verify(k, digest, r, s)
+	default:
+		return fmt.Errorf("%w: unsupported key", ErrInvalidToken)
+	}
+
+	if !valid {
+		return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+	return nil
+}
+
+func (v *JWTValidator) validateClaims(claims map[string]any) error {
+	now := v.now()
+
+	exp, ok := numericDate(claims, "exp")
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrInvalidToken)
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := numericDate(claims, "nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+
+	accepted := slices.ContainsFunc(stringOrList(claims["aud"]), func(aud string) bool {
+		return slices.Contains(v.audiences, aud)
+	})
+	if !accepted {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	// the subject identifies the caller, e.g. for quotas and job ownership
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// scopes maps the scope claim values to scopes.  Without mappings, claim
+// values are taken as scope names.
+func (v *JWTValidator) scopes(claims map[string]any) []Scope {
+	values := stringOrList(claims[v.scopeClaim])
+	if len(values) == 1 {
+		// OAuth2 scope claim is a space separated string
+		values = strings.Fields(values[0])
+	}
+
+	scopes := make([]Scope, 0, len(values))
+	for _, value := range values {
+		var mapped []Scope
+		if len(v.scopeMappings) > 0 {
+			mapped = v.scopeMappings[value]
+		} else if scope, err := ParseScope(value); err == nil {
+			mapped = []Scope{scope}
+		}
+
+		for _, scope := range mapped {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment: %w", ErrInvalidToken, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: malformed segment: %w", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+func numericDate(claims map[string]any, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// stringOrList reads a claim that can be a string or a list of strings.
+func stringOrList(claim any) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,432 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+func TestJWTValidatorRSA(t *testing.T) {
+	// prepare
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	v := newTestValidator(t, writeJWKS(t, rsaJWK("rsa-1", &key.PublicKey)), config.JWTConfig{
+		Issuer:    "https://idp.example.com",
+		Audiences: []string{"restclam"},
+	})
+
+	token := signRS256(t, key, "rsa-1", map[string]any{
+		"sub":   "svc-uploader",
+		"iss":   "https://idp.example.com",
+		"aud":   []string{"other", "restclam"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "scan read-stats",
+	})
+
+	// execute
+	p, err := v.Authenticate(context.Background(), token)
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, "svc-uploader", p.ID)
+	assert.Equal(t, MethodJWT, p.Method)
+	assert.Equal(t, []Scope{ScopeScan, ScopeReadStats}, p.Scopes)
+}
+
+func TestJWTValidatorEC(t *testing.T) {
+	// prepare
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	v := newTestValidator(t, writeJWKS(t, ecJWK("ec-1", &key.PublicKey)), config.JWTConfig{
+		Issuer:     "https://idp.example.com",
+		Audiences:  []string{"restclam"},
+		ScopeClaim: "roles",
+		ScopeMappings: []config.JWTScopeMappingConfig{
+			{Value: "restclam-operator", Scopes: []string{"admin", "read-stats"}},
+		},
+	})
+
+	token := signES256(t, key, "ec-1", map[string]any{
+		"sub":   "alice",
+		"iss":   "https://idp.example.com",
+		"aud":   "restclam",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"restclam-operator", "unrelated"},
+	})
+
+	// execute
+	p, err := v.Authenticate(context.Background(), token)
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, "alice", p.ID)
+	assert.Equal(t, []Scope{ScopeAdmin, ScopeReadStats}, p.Scopes)
+}
+
+func TestJWTValidatorRejects(t *testing.T) {
+	// prepare
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks := writeJWKS(t,
+		rsaJWK("rsa-1", &key.PublicKey),
+		withAlg(rsaJWK("rsa-ps", &key.PublicKey), "PS256"),
+		ecJWK("ec-1", &ecKey.PublicKey))
+	v := newTestValidator(t, jwks, config.JWTConfig{
+		Algorithms: []string{"RS256", "PS256", "ES256", "ES384"},
+		Issuer:     "https://idp.example.com",
+		Audiences:  []string{"restclam"},
+	})
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub": "svc-uploader",
+			"iss": "https://idp.example.com",
+			"aud": "restclam",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value any) map[string]any {
+		claims := valid()
+		claims[key] = value
+		return claims
+	}
+	without := func(key string) map[string]any {
+		claims := valid()
+		delete(claims, key)
+		return claims
+	}
+
+	tests := map[string]string{
+		"expired":      signRS256(t, key, "rsa-1", with("exp", time.Now().Add(-time.Hour).Unix())),
+		"no exp":       signRS256(t, key, "rsa-1", without("exp")),
+		"not yet":      signRS256(t, key, "rsa-1", with("nbf", time.Now().Add(time.Hour).Unix())),
+		"bad issuer":   signRS256(t, key, "rsa-1", with("iss", "https://evil.example.com")),
+		"no issuer":    signRS256(t, key, "rsa-1", without("iss")),
+		"bad audience": signRS256(t, key, "rsa-1", with("aud", "other")),
+		"no audience":  signRS256(t, key, "rsa-1", without("aud")),
+		"no subject":   signRS256(t, key, "rsa-1", without("sub")),
+		"empty sub":    signRS256(t, key, "rsa-1", with("sub", "")),
+		"bad key":      signRS256(t, otherKey, "rsa-1", valid()),
+		"unknown kid":  signRS256(t, key, "rsa-2", valid()),
+		"alg none":     encodeSegment(t, map[string]any{"alg": "none"}) + "." + encodeSegment(t, valid()) + ".",
+		"not allowed":  signRSA(t, "RS512", crypto.SHA512, key, "rsa-1", valid()),
+		"not key alg":  signRS256(t, key, "rsa-ps", valid()),
+		"not key type": signRS256(t, key, "ec-1", valid()),
+		"not curve":    signEC(t, "ES384", crypto.SHA384, ecKey, "ec-1", valid()),
+		"garbage":      "not-a-token",
+	}
+
+	for name, token := range tests {
+		// execute
+		_, err := v.Authenticate(context.Background(), token)
+
+		// assert
+		require.ErrorIs(t, err, ErrUnauthenticated, name)
+	}
+}
+
+func TestJWKSFromURLIsCached(t *testing.T) {
+	// prepare
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := jwkSet{Keys: []jwk{rsaJWK("rsa-1", &key.PublicKey)}}
+
+	var fetches atomic.Int32
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer idp.Close()
+
+	v, err := NewJWTValidator(config.JWTConfig{
+		JWKSURL:      idp.URL,
+		JWKSCacheTTL: time.Hour,
+		Algorithms:   []string{"RS256"},
+		Issuer:       "https://idp.example.com",
+		Audiences:    []string{"restclam"},
+	})
+	require.NoError(t, err)
+
+	token := signRS256(t, key, "rsa-1", map[string]any{
+		"sub": "svc-uploader",
+		"iss": "https://idp.example.com",
+		"aud": "restclam",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// execute
+	for range 3 {
+		_, err := v.Authenticate(context.Background(), token)
+		require.NoError(t, err)
+	}
+
+	// assert
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestJWKSRefreshFailureKeepsKeys(t *testing.T) {
+	// prepare
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := jwkSet{Keys: []jwk{rsaJWK("rsa-1", &key.PublicKey)}}
+
+	var fetches atomic.Int32
+	var down atomic.Bool
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer idp.Close()
+
+	c := newJWKSCache("", idp.URL, time.Minute)
+	_, err = c.key(context.Background(), "rsa-1")
+	require.NoError(t, err)
+	down.Store(true)
+
+	// execute
+	// expired, not refreshed too recently
+	c.fetched = time.Now().Add(-2 * time.Minute)
+	c.attempted = c.fetched
+	_, staleErr := c.key(context.Background(), "rsa-1")
+	_, unknownErr := c.key(context.Background(), "rsa-2")
+	// expired past the staleness bound
+	c.fetched = time.Now().Add(-maxJWKSStaleness - 2*time.Minute)
+	_, expiredErr := c.key(context.Background(), "rsa-1")
+
+	// assert
+	require.NoError(t, staleErr)
+	require.ErrorIs(t, unknownErr, ErrJWKS)
+	require.ErrorIs(t, expiredErr, ErrJWKS)
+	assert.Equal(t, int32(2), fetches.Load(), "failed refreshes are rate limited too")
+}
+
+func TestJWKSSingleRefresh(t *testing.T) {
+	// prepare
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := jwkSet{Keys: []jwk{rsaJWK("rsa-1", &key.PublicKey)}}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer idp.Close()
+
+	c := newJWKSCache("", idp.URL, time.Hour)
+	_, err = c.key(context.Background(), "rsa-1")
+	require.NoError(t, err)
+	c.attempted = time.Time{}
+
+	// execute
+	// unknown keys wait for a single slow refresh
+	errs := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := c.key(context.Background(), "rsa-2")
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return fetches.Load() == 2 }, time.Second, 5*time.Millisecond)
+	start := time.Now()
+	_, knownErr := c.key(context.Background(), "rsa-1")
+	elapsed := time.Since(start)
+	close(release)
+
+	// assert
+	require.NoError(t, knownErr)
+	assert.Less(t, elapsed, 100*time.Millisecond, "known keys do not wait for the refresh")
+	for range 5 {
+		require.ErrorIs(t, <-errs, ErrUnknownKey)
+	}
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestNewJWTValidatorInvalidConfig(t *testing.T) {
+	valid := func() config.JWTConfig {
+		return config.JWTConfig{
+			JWKSFile:   "jwks.json",
+			Algorithms: []string{"RS256"},
+			Issuer:     "https://idp.example.com",
+			Audiences:  []string{"restclam"},
+		}
+	}
+	noSource := valid()
+	noSource.JWKSFile = ""
+	noIssuer := valid()
+	noIssuer.Issuer = ""
+	noAudience := valid()
+	noAudience.Audiences = nil
+	noAlgorithm := valid()
+	noAlgorithm.Algorithms = nil
+	badAlgorithm := valid()
+	badAlgorithm.Algorithms = []string{"HS256"}
+	badScope := valid()
+	badScope.ScopeMappings = []config.JWTScopeMappingConfig{{Value: "x", Scopes: []string{"root"}}}
+
+	for name, conf := range map[string]config.JWTConfig{
+		"no source":     noSource,
+		"no issuer":     noIssuer,
+		"no audience":   noAudience,
+		"no algorithm":  noAlgorithm,
+		"bad algorithm": badAlgorithm,
+	} {
+		_, err := NewJWTValidator(conf)
+		require.ErrorIs(t, err, ErrJWTConfig, name)
+	}
+	_, err := NewJWTValidator(badScope)
+	require.ErrorIs(t, err, ErrUnknownScope)
+}
+
+func TestParseJWKSKeyAlgorithm(t *testing.T) {
+	// prepare
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := map[string]jwk{
+		"RSA key ES256":   withAlg(rsaJWK("k", &rsaKey.PublicKey), "ES256"),
+		"P-256 key ES384": withAlg(ecJWK("k", &ecKey.PublicKey), "ES384"),
+		"P-256 key RS256": withAlg(ecJWK("k", &ecKey.PublicKey), "RS256"),
+		"unsupported":     withAlg(rsaJWK("k", &rsaKey.PublicKey), "HS256"),
+	}
+	for name, k := range tests {
+		// execute
+		content, err := json.Marshal(jwkSet{Keys: []jwk{k}})
+		require.NoError(t, err)
+		_, err = parseJWKS(content)
+
+		// assert
+		require.ErrorIs(t, err, ErrJWKS, name)
+	}
+}
+
+// helpers
+
+func newTestValidator(t *testing.T, jwksFile string, conf config.JWTConfig) *JWTValidator {
+	t.Helper()
+
+	conf.JWKSFile = jwksFile
+	if len(conf.Algorithms) == 0 {
+		conf.Algorithms = []string{"RS256", "ES256"}
+	}
+	v, err := NewJWTValidator(conf)
+	require.NoError(t, err)
+	return v
+}
+
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+
+	content, err := json.Marshal(jwkSet{Keys: keys})
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(file, content, 0o600))
+	return file
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	return signRSA(t, "RS256", crypto.SHA256, key, kid, claims)
+}
+
+func signRSA(t *testing.T, alg string, hash crypto.Hash, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	signingInput := encodeSegment(t, map[string]any{"alg": alg, "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := hash.New()
+	digest.Write([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil))
+	require.NoError(t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	return signEC(t, "ES256", crypto.SHA256, key, kid, claims)
+}
+
+func signEC(t *testing.T, alg string, hash crypto.Hash, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+
+	signingInput := encodeSegment(t, map[string]any{"alg": alg, "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := hash.New()
+	digest.Write([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+	require.NoError(t, err)
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func withAlg(k jwk, alg string) jwk {
+	k.Alg = alg
+	return k
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
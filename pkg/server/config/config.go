@@ -5,6 +5,8 @@ import (
 	"bytes"
 	_ "embed"
 	"errors"
+	"fmt"
+	"reflect"
 	"strings"
 	"time"
 
@@ -15,6 +17,13 @@ import (
 //go:embed defaults.yaml
 var configDefaults []byte
 
+// envPrefix prefixes the env variables setting properties.
+const envPrefix = "RESTCLAM"
+
+// ErrInvalidOverride is returned for a command line override not formatted
+// as key=value.
+var ErrInvalidOverride = errors.New("invalid override")
+
 // ServerConfig is the configuration of the server.
 type ServerConfig struct {
 	Host            string        `mapstructure:"host"`
@@ -23,12 +32,27 @@ type ServerConfig struct {
 	ReadTimeout     time.Duration `mapstructure:"readTimeout"`
 	IdleTimeout     time.Duration `mapstructure:"idleTimeout"`
 	ShutdownTimeout time.Duration `mapstructure:"shutdownTimeout"`
+	DrainDelay      time.Duration `mapstructure:"drainDelay"`
+	TLS             TLSConfig     `mapstructure:"tls"`
+}
+
+// TLSConfig is the configuration of TLS termination, optionally with
+// client certificate authentication (mTLS).
+type TLSConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	CertFile        string        `mapstructure:"certFile"`
+	KeyFile         string        `mapstructure:"keyFile"`
+	ClientCAFile    string        `mapstructure:"clientCaFile"`
+	ClientAuth      string        `mapstructure:"clientAuth"`
+	AllowedSubjects []string      `mapstructure:"allowedSubjects"`
+	AllowedSANs     []string      `mapstructure:"allowedSans"`
+	ReloadInterval  time.Duration `mapstructure:"reloadInterval"`
 }
 
 // LogConfig is the configuration of logging.
 type LogConfig struct {
 	Level       string `mapstructure:"level"`
-	JSON        bool   `mapstructure:"jSON"`
+	JSON        bool   `mapstructure:"json"`
 	Concise     bool   `mapstructure:"concise"`
 	LogRequests bool   `mapstructure:"logRequests"`
 }
@@ -44,19 +68,143 @@ type CORSConfig struct {
 	MaxAge           int      `mapstructure:"maxAge"`
 }
 
+// AuthConfig is the configuration of API authentication.
+type AuthConfig struct {
+	Enabled              bool           `mapstructure:"enabled"`
+	APIKeyHeader         string         `mapstructure:"apiKeyHeader"`
+	APIKeys              []APIKeyConfig `mapstructure:"apiKeys"`
+	KeyFile              string         `mapstructure:"keyFile"`
+	KeyFileCheckInterval time.Duration  `mapstructure:"keyFileCheckInterval"`
+	JWT                  JWTConfig      `mapstructure:"jwt"`
+}
+
+// JWTConfig is the configuration of bearer JWT authentication.
+type JWTConfig struct {
+	Enabled       bool                    `mapstructure:"enabled"`
+	JWKSFile      string                  `mapstructure:"jwksFile"`
+	JWKSURL       string                  `mapstructure:"jwksUrl" secret:"true"`
+	JWKSCacheTTL  time.Duration           `mapstructure:"jwksCacheTtl"`
+	Algorithms    []string                `mapstructure:"algorithms"`
+	Issuer        string                  `mapstructure:"issuer"`
+	Audiences     []string                `mapstructure:"audiences"`
+	Leeway        time.Duration           `mapstructure:"leeway"`
+	ScopeClaim    string                  `mapstructure:"scopeClaim"`
+	ScopeMappings []JWTScopeMappingConfig `mapstructure:"scopeMappings"`
+}
+
+// JWTScopeMappingConfig maps a value of the scope claim to scopes.
+type JWTScopeMappingConfig struct {
+	Value  string   `mapstructure:"value"`
+	Scopes []string `mapstructure:"scopes"`
+}
+
+// APIKeyConfig is an API key, stored as hash, with its granted scopes.
+type APIKeyConfig struct {
+	ID     string   `mapstructure:"id"     yaml:"id"`
+	Hash   string   `mapstructure:"hash"   yaml:"hash"   secret:"true"`
+	Scopes []string `mapstructure:"scopes" yaml:"scopes"`
+}
+
+// RateLimitConfig is the configuration of per-client rate limits and
+// quotas.  Clients are identified by authenticated principal, or by IP
+// address when not authenticated.
+type RateLimitConfig struct {
+	Enabled            bool    `mapstructure:"enabled"`
+	RequestsPerSecond  float64 `mapstructure:"requestsPerSecond"`
+	Burst              int     `mapstructure:"burst"`
+	MaxConcurrentScans int     `mapstructure:"maxConcurrentScans"`
+	BytesPerMinute     int64   `mapstructure:"bytesPerMinute"`
+	Store              string  `mapstructure:"store"`
+}
+
 // ClamConfig is the configuration of ClamAV.
 type ClamConfig struct {
-	Network              string        `mapstructure:"network"`
-	Address              string        `mapstructure:"address"`
-	MinWorkers           int           `mapstructure:"minWorkers"`
-	MaxWorkers           int           `mapstructure:"maxWorkers"`
-	ConnectMaxRetries    int           `mapstructure:"connectMaxRetries"`
+	Network           string              `mapstructure:"network"`
+	Address           string              `mapstructure:"address"`
+	TLS               ClamTLSConfig       `mapstructure:"tls"`
+	Backends          []ClamBackendConfig `mapstructure:"backends"`
+	MinWorkers        int                 `mapstructure:"minWorkers"`
+	MaxWorkers        int                 `mapstructure:"maxWorkers"`
+	ConnectMaxRetries int                 `mapstructure:"connectMaxRetries"`
+	ConnectBackoff    BackoffConfig       `mapstructure:"connectBackoff"`
+	ConnectTimeout    time.Duration       `mapstructure:"connectTimeout"`
+	ReadTimeout       time.Duration       `mapstructure:"readTimeout"`
+	WriteTimeout      time.Duration       `mapstructure:"writeTimeout"`
+	StreamChunkSize   int                 `mapstructure:"streamChunkSize"`
+	HeartbeatInterval time.Duration       `mapstructure:"heartbeatInterval"`
+	JobTimeout        time.Duration       `mapstructure:"jobTimeout"`
+	MaxJobTimeout     time.Duration       `mapstructure:"maxJobTimeout"`
+	Scheduling        SchedulingConfig    `mapstructure:"scheduling"`
+	Retries           RetriesConfig       `mapstructure:"retries"`
+	CircuitBreaker    BreakerConfig       `mapstructure:"circuitBreaker"`
+
+	// Deprecated: ConnectRetryInterval is the initial delay of a linear,
+	// uncapped, ConnectBackoff, replacing it when set.
 	ConnectRetryInterval time.Duration `mapstructure:"connectRetryInterval"`
-	ConnectTimeout       time.Duration `mapstructure:"connectTimeout"`
-	ReadTimeout          time.Duration `mapstructure:"readTimeout"`
-	WriteTimeout         time.Duration `mapstructure:"writeTimeout"`
-	StreamChunkSize      int           `mapstructure:"streamChunkSize"`
-	HeartbeatInterval    time.Duration `mapstructure:"heartbeatInterval"`
+}
+
+// SchedulingConfig is the configuration of the scan job queue.
+type SchedulingConfig struct {
+	InteractiveWeight int           `mapstructure:"interactiveWeight"`
+	BulkWeight        int           `mapstructure:"bulkWeight"`
+	MaxQueueWait      time.Duration `mapstructure:"maxQueueWait"`
+	MaxQueueLength    int           `mapstructure:"maxQueueLength"`
+	MaxAdmissionWait  time.Duration `mapstructure:"maxAdmissionWait"`
+}
+
+// RetriesConfig is the configuration of jobs retried after transport errors
+// and of slow scans hedged on another backend.
+type RetriesConfig struct {
+	MaxRetries       int           `mapstructure:"maxRetries"`
+	Backoff          BackoffConfig `mapstructure:"backoff"`
+	HedgePercentile  float64       `mapstructure:"hedgePercentile"`
+	SpoolMemoryLimit int64         `mapstructure:"spoolMemoryLimit"`
+	SpoolMaxSize     int64         `mapstructure:"spoolMaxSize"`
+	SpoolDir         string        `mapstructure:"spoolDir"`
+}
+
+// BreakerConfig is the configuration of the circuit breaker of each clamd
+// backend.
+type BreakerConfig struct {
+	ConsecutiveFailures int           `mapstructure:"consecutiveFailures"`
+	ErrorRate           float64       `mapstructure:"errorRate"`
+	Window              int           `mapstructure:"window"`
+	Backoff             BackoffConfig `mapstructure:"backoff"`
+	HalfOpenProbes      int           `mapstructure:"halfOpenProbes"`
+}
+
+// BackoffConfig is the configuration of the delays between retries.
+type BackoffConfig struct {
+	Strategy   string        `mapstructure:"strategy"`
+	Initial    time.Duration `mapstructure:"initial"`
+	Max        time.Duration `mapstructure:"max"`
+	Multiplier float64       `mapstructure:"multiplier"`
+}
+
+// ClamBackendConfig is the configuration of one of many clamd backends.
+type ClamBackendConfig struct {
+	Network string        `mapstructure:"network"`
+	Address string        `mapstructure:"address"`
+	TLS     ClamTLSConfig `mapstructure:"tls"`
+}
+
+// ClamTLSConfig is the configuration of TLS towards a clamd backend.
+type ClamTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"caFile"`
+	CertFile           string `mapstructure:"certFile"`
+	KeyFile            string `mapstructure:"keyFile"`
+	ServerName         string `mapstructure:"serverName"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+// BackendList returns the configured clamd backends: the backends list if
+// not empty, otherwise the single backend of network and address.
+func (c ClamConfig) BackendList() []ClamBackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	return []ClamBackendConfig{{Network: c.Network, Address: c.Address, TLS: c.TLS}}
 }
 
 // FeatureFlags control switchin on/off experimental features
@@ -67,14 +215,23 @@ type FeatureFlags struct {
 	ApiV1 bool `mapstructure:"apiV1"`
 }
 
-// AppConfig is the global application configuration.
+// AppConfig is the global application configuration.  Any string value
+// can reference a file, as file:/run/secrets/x, or an env variable, as
+// env:NAME, resolved every time the configuration is loaded.  Fields tagged
+// secret:"true", like URLs that may embed credentials, and values resolved
+// from references are redacted when the configuration is logged or printed.
 type AppConfig struct {
-	Environment  string       `mapstructure:"environment"`
-	Server       ServerConfig `mapstructure:"server"`
-	Log          LogConfig    `mapstructure:"log"`
-	Cors         CORSConfig   `mapstructure:"cors"`
-	Clam         ClamConfig   `mapstructure:"clam"`
-	FeatureFlags FeatureFlags `mapstructure:"featureFlags"`
+	Environment  string          `mapstructure:"environment"`
+	Server       ServerConfig    `mapstructure:"server"`
+	Log          LogConfig       `mapstructure:"log"`
+	Cors         CORSConfig      `mapstructure:"cors"`
+	Auth         AuthConfig      `mapstructure:"auth"`
+	RateLimit    RateLimitConfig `mapstructure:"rateLimit"`
+	Clam         ClamConfig      `mapstructure:"clam"`
+	FeatureFlags FeatureFlags    `mapstructure:"featureFlags"`
+
+	// refs are the properties resolved from references, nil if none
+	refs map[string]bool
 }
 
 type configReader func(v *viper.Viper) error
@@ -85,6 +242,15 @@ func readDefaults(v *viper.Viper) error {
 	return v.ReadConfig(bytes.NewReader(configDefaults))
 }
 
+// readFile reads an explicitly given config file, that must exist.
+func readFile(file string) configReader {
+	return func(v *viper.Viper) error {
+		v.SetConfigType("yaml")
+		v.SetConfigFile(file)
+		return v.MergeInConfig()
+	}
+}
+
 func readFromFile(v *viper.Viper) error {
 	// set file properties
 	v.SetConfigType("yaml")
@@ -108,31 +274,108 @@ func readFromFile(v *viper.Viper) error {
 }
 
 func loadConfig(defaultsReader configReader, configReader configReader) (AppConfig, error) {
+	l, err := load(defaultsReader, configReader, nil)
+	return l.Config, err
+}
+
+// load reads the defaults, the config file, the env and the overrides, each
+// taking precedence over the previous ones.
+func load(defaultsReader configReader, configReader configReader, overrides []string) (Loaded, error) {
 	v := viper.NewWithOptions(viper.ExperimentalBindStruct())
 
 	// load defaults
 	if err := defaultsReader(v); err != nil {
-		return AppConfig{}, err
+		return Loaded{}, err
 	}
 
-	// load file config overrides
-	if err := configReader(v); err != nil {
-		return AppConfig{}, err
+	// load file config overrides, read apart to know which properties the
+	// file sets
+	fv := viper.New()
+	if err := configReader(fv); err != nil {
+		return Loaded{}, err
+	}
+	if err := v.MergeConfigMap(fv.AllSettings()); err != nil {
+		return Loaded{}, err
 	}
 
 	// load environment variables overrides
-	v.SetEnvPrefix("RESTCLAM")
+	v.SetEnvPrefix(envPrefix)
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
-	// unmarshal config into config struct
+	// load command line overrides
+	set := make(map[string]bool, len(overrides))
+	for _, o := range overrides {
+		key, value, ok := strings.Cut(o, "=")
+		if !ok || key == "" {
+			return Loaded{}, fmt.Errorf("%w: %q, expected key=value", ErrInvalidOverride, o)
+		}
+		v.Set(key, value)
+		set[strings.ToLower(key)] = true
+	}
+
+	// unmarshal config into config struct, rejecting unknown properties
+	// that are likely typos
 	var c AppConfig
-	if err := v.Unmarshal(&c); err != nil {
-		return AppConfig{}, err
+	if err := v.UnmarshalExact(&c); err != nil {
+		return Loaded{}, err
+	}
+
+	// replace references to files and env variables, e.g. of secrets
+	refs := map[string]bool{}
+	if err := resolveRefs(reflect.ValueOf(&c).Elem(), "", refs); err != nil {
+		return Loaded{}, err
+	}
+	if len(refs) > 0 {
+		c.refs = refs
 	}
 
-	// TODO validate config! fail fast
-	return c, nil
+	deprecations := c.applyDeprecated()
+
+	fileKeys := make(map[string]bool)
+	for _, k := range fv.AllKeys() {
+		fileKeys[k] = true
+	}
+	return Loaded{
+		Config:       c,
+		File:         fv.ConfigFileUsed(),
+		fileKeys:     fileKeys,
+		setKeys:      set,
+		Deprecations: deprecations,
+	}, nil
+}
+
+// applyDeprecated maps the deprecated properties set to the ones replacing
+// them, returning a warning for each.
+func (c *AppConfig) applyDeprecated() []string {
+	var warnings []string
+	if c.Clam.ConnectRetryInterval > 0 {
+		c.Clam.ConnectBackoff = BackoffConfig{Strategy: "linear", Initial: c.Clam.ConnectRetryInterval}
+		warnings = append(warnings, "clam.connectRetryInterval is deprecated, replacing clam.connectBackoff "+
+			"with a linear backoff: use clam.connectBackoff instead")
+	}
+	return warnings
+}
+
+// Options tell where to load the configuration from.
+type Options struct {
+	// File is the config file to read, instead of searching config.yaml
+	File string
+	// Overrides are properties as key=value, e.g. clam.minWorkers=4,
+	// taking precedence over the config file and the env
+	Overrides []string
+}
+
+// Loaded is a loaded configuration, knowing where each property comes from.
+type Loaded struct {
+	Config AppConfig
+	// File is the config file read, empty if none was found
+	File string
+	// Deprecations warn about the deprecated properties set
+	Deprecations []string
+
+	fileKeys map[string]bool
+	setKeys  map[string]bool
 }
 
 // LoadConfig loads the application configuration.
@@ -151,3 +394,13 @@ func loadConfig(defaultsReader configReader, configReader configReader) (AppConf
 func LoadConfig() (AppConfig, error) {
 	return loadConfig(readDefaults, readFromFile)
 }
+
+// Load is like LoadConfig, reading the config file and the overrides of the
+// options.
+func Load(opts Options) (Loaded, error) {
+	configReader := readFromFile
+	if opts.File != "" {
+		configReader = readFile(opts.File)
+	}
+	return load(readDefaults, configReader, opts.Overrides)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadConfigEnv(t *testing.T) {
@@ -114,3 +115,109 @@ func readFromFileMock(mockFile string, v *viper.Viper) error {
 	v.SetConfigType("yaml")
 	return v.ReadConfig(bytes.NewBuffer([]byte(mockFile)))
 }
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	// prepare
+	readFunc := func(v *viper.Viper) error {
+		return readFromFileMock(`
+clam:
+  minWorker: 3
+`, v)
+	}
+
+	// execute
+	_, err := loadConfig(readDefaults, readFunc)
+
+	// assert
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "minworker")
+}
+
+func TestLoadConfigDeprecatedKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+	}{
+		{"file", "clam:\n  connectRetryInterval: 3s\n", ""},
+		{"env", "", "3s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// prepare
+			if tt.env != "" {
+				t.Setenv("RESTCLAM_CLAM_CONNECTRETRYINTERVAL", tt.env)
+			}
+			readFunc := func(v *viper.Viper) error {
+				return readFromFileMock(tt.file, v)
+			}
+
+			// execute
+			loaded, err := load(readDefaults, readFunc, nil)
+
+			// assert
+			require.NoError(t, err)
+			assert.Equal(t, BackoffConfig{Strategy: "linear", Initial: 3 * time.Second}, loaded.Config.Clam.ConnectBackoff)
+			require.Len(t, loaded.Deprecations, 1)
+			assert.Contains(t, loaded.Deprecations[0], "clam.connectRetryInterval")
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	// prepare
+	config, err := loadConfig(readDefaults, readNop)
+	require.NoError(t, err)
+
+	// execute
+	err = config.Validate()
+
+	// assert
+	require.NoError(t, err)
+	assert.False(t, config.Log.LogRequests, "log requests from default")
+}
+
+func TestValidate(t *testing.T) {
+	// prepare
+	config, err := loadConfig(readDefaults, readNop)
+	require.NoError(t, err)
+	config.Server.Port = 70000
+	config.Log.Level = "loud"
+	config.Clam.MinWorkers = 5
+	config.Clam.MaxWorkers = 2
+	config.Clam.HeartbeatInterval = 0
+	config.Clam.Backends = []ClamBackendConfig{
+		{Network: "tcp", Address: "clamd:3310"},
+		{Network: "udp", Address: "clamd:3310"},
+	}
+	config.Clam.Retries.Backoff.Strategy = "random"
+	config.Auth.JWT.Enabled = true
+	config.Auth.JWT.JWKSFile = "jwks.json"
+
+	// execute
+	err = config.Validate(func(_ AppConfig, v *Validator) {
+		v.Check(false, "auth.apiKeys[0].scopes", "unknown scope")
+	})
+
+	// assert
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	paths := make([]string, 0, len(validationErr.Fields))
+	for _, f := range validationErr.Fields {
+		paths = append(paths, f.Path)
+	}
+	assert.Equal(t, []string{
+		"server.port",
+		"log.level",
+		"auth.jwt.issuer",
+		"auth.jwt.audiences",
+		"clam.backends[1].network",
+		"clam.backends[1].address",
+		"clam.maxWorkers",
+		"clam.heartbeatInterval",
+		"clam.retries.backoff",
+		"auth.apiKeys[0].scopes",
+	}, paths)
+	assert.Contains(t, err.Error(), "server.port: must be between 1 and 65535, got 70000")
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a configuration property changed between two configurations.
+type Change struct {
+	// Path is the property, like in the YAML file with dots between
+	// levels, e.g. clam.minWorkers or clam.backends[0].address
+	Path string
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Diff returns the properties changed from old to new, in declaration
+// order.  Values of secrets are redacted.
+func Diff(old AppConfig, new AppConfig) []Change {
+	oldProps := properties(old)
+	newProps := properties(new)
+
+	newValues := make(map[string]property, len(newProps))
+	for _, p := range newProps {
+		newValues[p.path] = p
+	}
+
+	var changes []Change
+	seen := make(map[string]bool, len(oldProps))
+	for _, p := range oldProps {
+		seen[p.path] = true
+		n, ok := newValues[p.path]
+		if !ok {
+			changes = append(changes, Change{Path: p.path, Old: p.redacted(), New: "<none>"})
+		} else if n.value != p.value {
+			changes = append(changes, Change{Path: p.path, Old: p.redacted(), New: n.redacted()})
+		}
+	}
+	for _, p := range newProps {
+		if !seen[p.path] {
+			changes = append(changes, Change{Path: p.path, Old: "<none>", New: p.redacted()})
+		}
+	}
+	return changes
+}
+
+// Changed tells if any change is of one of the properties, or nested into
+// them.
+func Changed(changes []Change, paths ...string) bool {
+	for _, c := range changes {
+		for _, p := range paths {
+			if c.Path == p || strings.HasPrefix(c.Path, p+".") || strings.HasPrefix(c.Path, p+"[") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type property struct {
+	path   string
+	value  string
+	secret bool
+}
+
+// redacted returns the value, unless secret.
+func (p property) redacted() string {
+	if p.secret && p.value != "" {
+		return redacted
+	}
+	return p.value
+}
+
+// properties lists the leaf properties of the configuration, marking as
+// secret the ones resolved from references too.
+func properties(c AppConfig) []property {
+	props := flatten(reflect.ValueOf(c), "", nil)
+	for i := range props {
+		if c.refs[props[i].path] {
+			props[i].secret = true
+		}
+	}
+	return props
+}
+
+// flatten lists the leaf properties of v, named by their mapstructure tags.
+// Lists of objects are flattened by index, other lists are leaves.  Fields
+// tagged secret:"true" are marked as secret.
+func flatten(v reflect.Value, prefix string, props []property) []property {
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			n := len(props)
+			props = flatten(v.Field(i), join(prefix, name), props)
+			if field.Tag.Get("secret") == "true" {
+				for j := n; j < len(props); j++ {
+					props[j].secret = true
+				}
+			}
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		for i := range v.Len() {
+			props = flatten(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i), props)
+		}
+	default:
+		props = append(props, property{path: prefix, value: fmt.Sprintf("%v", v.Interface())})
+	}
+	return props
+}
+
+func join(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadDebounce groups the burst of events of a single file save.
+const reloadDebounce = 200 * time.Millisecond
+
+// ErrReloadRejected is returned when a new configuration cannot be loaded
+// or applied, the current one is kept.
+var ErrReloadRejected = errors.New("configuration reload rejected")
+
+// ReloadFunc checks a new configuration and returns how to apply it.
+// Changes are applied only after all the reload functions accepted them,
+// so that a rejected configuration is not applied partially.  Applying may
+// still fail, then the reload is reported as failed.
+type ReloadFunc func(old AppConfig, new AppConfig) (apply func() error, err error)
+
+type reloadHook struct {
+	name   string
+	paths  []string
+	reload ReloadFunc
+}
+
+// Reloader loads the configuration again when the config file changes and
+// on SIGHUP, applying live the changes of the properties registered with
+// OnReload.  Changes of other properties need a restart.
+type Reloader struct {
+	file     string
+	load     func() (AppConfig, error)
+	validate func(AppConfig) error
+	debounce time.Duration
+
+	mu      sync.Mutex
+	current AppConfig
+	hooks   []reloadHook
+}
+
+// NewReloader returns a reloader of the loaded configuration, loading it
+// again with the same options and checking it with validate.  The config
+// file read, if any, is watched for changes.
+func NewReloader(current Loaded, opts Options, validate func(AppConfig) error) *Reloader {
+	load := func() (AppConfig, error) {
+		l, err := Load(opts)
+		for _, d := range l.Deprecations {
+			log.Warn().Msg(d)
+		}
+		return l.Config, err
+	}
+	r := newReloader(current.Config, current.File, load)
+	r.validate = validate
+	return r
+}
+
+func newReloader(current AppConfig, file string, load func() (AppConfig, error)) *Reloader {
+	return &Reloader{
+		file:     file,
+		load:     load,
+		validate: func(AppConfig) error { return nil },
+		debounce: reloadDebounce,
+		current:  current,
+	}
+}
+
+// OnReload registers a component applying live the changes of the given
+// properties, or nested into them.  It is called only when some of them
+// changed.
+func (r *Reloader) OnReload(name string, paths []string, reload ReloadFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hooks = append(r.hooks, reloadHook{name, paths, reload})
+}
+
+// Current returns the configuration last applied.
+func (r *Reloader) Current() AppConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.current
+}
+
+// Reload loads the configuration and applies it if all the components
+// accept it.  Otherwise the current configuration is kept and the error
+// is logged with the rejected changes.  If a component fails to apply its
+// changes, the following ones are not applied and the current
+// configuration is kept, to be applied again by the next reload.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		log.Error().Err(err).Msg("Configuration reload rejected, keeping the current one")
+		return fmt.Errorf("%w: %w", ErrReloadRejected, err)
+	}
+
+	changes := Diff(r.current, next)
+	if len(changes) == 0 {
+		log.Info().Msg("Configuration reloaded, nothing changed")
+		return nil
+	}
+
+	type pendingApply struct {
+		name  string
+		apply func() error
+	}
+	var applies []pendingApply
+	var errs []error
+	if err := r.validate(next); err != nil {
+		errs = append(errs, err)
+	}
+	for _, h := range r.hooks {
+		if !Changed(changes, h.paths...) {
+			continue
+		}
+		apply, err := h.reload(r.current, next)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		applies = append(applies, pendingApply{h.name, apply})
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.Error().
+			Err(err).
+			Strs("diff", changeStrings(changes)).
+			Msg("Configuration reload rejected, keeping the current one")
+		return fmt.Errorf("%w: %w", ErrReloadRejected, err)
+	}
+
+	applied := make([]string, 0, len(applies))
+	for _, a := range applies {
+		if err := a.apply(); err != nil {
+			log.Error().
+				Err(err).
+				Str("component", a.name).
+				Strs("applied", applied).
+				Strs("diff", changeStrings(changes)).
+				Msg("Configuration reload failed, keeping the current one")
+			return fmt.Errorf("%w: %s: %w", ErrReloadRejected, a.name, err)
+		}
+		applied = append(applied, a.name)
+	}
+
+	var live, restart []Change
+	for _, c := range changes {
+		if r.live(c) {
+			live = append(live, c)
+		} else {
+			restart = append(restart, c)
+		}
+	}
+	if len(live) > 0 {
+		log.Info().Strs("diff", changeStrings(live)).Msg("Configuration reloaded")
+	}
+	if len(restart) > 0 {
+		log.Warn().Strs("diff", changeStrings(restart)).Msg("Configuration changes not applied, they need a restart")
+	}
+
+	r.current = next
+	return nil
+}
+
+// live tells if a change is applied by some registered component.
+func (r *Reloader) live(c Change) bool {
+	for _, h := range r.hooks {
+		if Changed([]Change{c}, h.paths...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the configuration on changes of the config file, if any,
+// and on SIGHUP, until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if r.file != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("unable to watch config file: %w", err)
+		}
+		defer watcher.Close()
+
+		// watch the directory, as editors and Kubernetes config maps
+		// replace the file rather than writing it
+		if err := watcher.Add(filepath.Dir(r.file)); err != nil {
+			return fmt.Errorf("unable to watch config file: %w", err)
+		}
+		events, watchErrors = watcher.Events, watcher.Errors
+		log.Info().Str("file", r.file).Msg("Watching config file for changes")
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			log.Info().Msg("Received SIGHUP, reloading configuration")
+			_ = r.Reload()
+		case event := <-events:
+			if r.affects(event) {
+				settled = time.After(r.debounce)
+			}
+		case err := <-watchErrors:
+			log.Warn().Err(err).Str("file", r.file).Msg("Error watching config file")
+		case <-settled:
+			settled = nil
+			log.Info().Str("file", r.file).Msg("Config file changed, reloading configuration")
+			_ = r.Reload()
+		}
+	}
+}
+
+// affects tells if a file event may have changed the config file.
+func (r *Reloader) affects(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	// Kubernetes swaps the ..data symlink of config map volumes
+	return name == filepath.Clean(r.file) || filepath.Base(name) == "..data"
+}
+
+func changeStrings(changes []Change) []string {
+	s := make([]string, 0, len(changes))
+	for _, c := range changes {
+		s = append(s, c.String())
+	}
+	return s
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTestRejected = errors.New("rejected")
+
+func TestDiff(t *testing.T) {
+	// prepare
+	old := AppConfig{}
+	old.Log.Level = "info"
+	old.Clam.Backends = []ClamBackendConfig{{Network: "tcp", Address: "clamd-1:3310"}}
+	old.Cors.AllowedOrigins = []string{"https://a"}
+
+	new := old
+	new.Log.Level = "debug"
+	new.Clam.Backends = []ClamBackendConfig{
+		{Network: "tcp", Address: "clamd-1:3310"},
+		{Network: "tcp", Address: "clamd-2:3310"},
+	}
+	new.Cors.AllowedOrigins = []string{"https://a", "https://b"}
+
+	// execute
+	changes := Diff(old, new)
+
+	// assert
+	assert.Equal(t, []Change{
+		{Path: "log.level", Old: "info", New: "debug"},
+		{Path: "cors.allowedOrigins", Old: "[https://a]", New: "[https://a https://b]"},
+		{Path: "clam.backends[1].network", Old: "<none>", New: "tcp"},
+		{Path: "clam.backends[1].address", Old: "<none>", New: "clamd-2:3310"},
+		{Path: "clam.backends[1].tls.enabled", Old: "<none>", New: "false"},
+		{Path: "clam.backends[1].tls.caFile", Old: "<none>", New: ""},
+		{Path: "clam.backends[1].tls.certFile", Old: "<none>", New: ""},
+		{Path: "clam.backends[1].tls.keyFile", Old: "<none>", New: ""},
+		{Path: "clam.backends[1].tls.serverName", Old: "<none>", New: ""},
+		{Path: "clam.backends[1].tls.insecureSkipVerify", Old: "<none>", New: "false"},
+	}, changes)
+	assert.True(t, Changed(changes, "clam.backends"))
+	assert.True(t, Changed(changes, "cors"))
+	assert.False(t, Changed(changes, "clam.minWorkers", "log.json"))
+}
+
+func TestReload(t *testing.T) {
+	// prepare
+	current := AppConfig{}
+	current.Log.Level = "info"
+	current.Server.Port = 8080
+
+	next := current
+	next.Log.Level = "debug"
+	next.Server.Port = 9090
+
+	r := newReloader(current, "", func() (AppConfig, error) { return next, nil })
+	var applied string
+	r.OnReload("log", []string{"log"}, func(_, c AppConfig) (func() error, error) {
+		return func() error {
+			applied = c.Log.Level
+			return nil
+		}, nil
+	})
+	r.OnReload("clam", []string{"clam"}, func(_, _ AppConfig) (func() error, error) {
+		t.Error("unexpected reload of unchanged properties")
+		return func() error { return nil }, nil
+	})
+
+	// execute
+	err := r.Reload()
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, "debug", applied)
+	assert.Equal(t, next, r.Current())
+}
+
+func TestReloadRejected(t *testing.T) {
+	// prepare
+	current := AppConfig{}
+	current.Log.Level = "info"
+	current.Clam.MinWorkers = 1
+
+	next := current
+	next.Log.Level = "debug"
+	next.Clam.MinWorkers = 100
+
+	r := newReloader(current, "", func() (AppConfig, error) { return next, nil })
+	applied := false
+	r.OnReload("log", []string{"log.level"}, func(_, _ AppConfig) (func() error, error) {
+		return func() error {
+			applied = true
+			return nil
+		}, nil
+	})
+	r.OnReload("workers", []string{"clam.minWorkers"}, func(_, _ AppConfig) (func() error, error) {
+		return nil, errTestRejected
+	})
+
+	// execute
+	err := r.Reload()
+
+	// assert
+	require.ErrorIs(t, err, ErrReloadRejected)
+	require.ErrorIs(t, err, errTestRejected)
+	assert.False(t, applied, "rejected configuration must not be applied partially")
+	assert.Equal(t, current, r.Current())
+}
+
+func TestReloadApplyFailed(t *testing.T) {
+	// prepare
+	current := AppConfig{}
+	current.Log.Level = "info"
+	current.Clam.MinWorkers = 1
+
+	next := current
+	next.Log.Level = "debug"
+	next.Clam.MinWorkers = 2
+
+	r := newReloader(current, "", func() (AppConfig, error) { return next, nil })
+	r.OnReload("workers", []string{"clam.minWorkers"}, func(_, _ AppConfig) (func() error, error) {
+		return func() error { return errTestRejected }, nil
+	})
+	r.OnReload("log", []string{"log.level"}, func(_, _ AppConfig) (func() error, error) {
+		return func() error {
+			t.Error("unexpected apply after a failed one")
+			return nil
+		}, nil
+	})
+
+	// execute
+	err := r.Reload()
+
+	// assert
+	require.ErrorIs(t, err, ErrReloadRejected)
+	require.ErrorIs(t, err, errTestRejected)
+	assert.Equal(t, current, r.Current())
+}
+
+func TestReloadInvalid(t *testing.T) {
+	// prepare
+	current := AppConfig{}
+	current.Clam.MinWorkers = 1
+	current.Clam.MaxWorkers = 1
+
+	next := current
+	next.Clam.MinWorkers = 2
+
+	r := newReloader(current, "", func() (AppConfig, error) { return next, nil })
+	r.validate = func(c AppConfig) error {
+		v := &Validator{}
+		v.Check(c.Clam.MaxWorkers >= c.Clam.MinWorkers, "clam.maxWorkers", "must not be less than minWorkers")
+		return v.Err()
+	}
+
+	// execute
+	err := r.Reload()
+
+	// assert
+	require.ErrorIs(t, err, ErrReloadRejected)
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	assert.Equal(t, current, r.Current())
+}
+
+func TestReloadLoadError(t *testing.T) {
+	// prepare
+	current := AppConfig{Environment: "test"}
+	r := newReloader(current, "", func() (AppConfig, error) { return AppConfig{}, errTestRejected })
+
+	// execute
+	err := r.Reload()
+
+	// assert
+	require.ErrorIs(t, err, ErrReloadRejected)
+	assert.Equal(t, current, r.Current())
+}
+
+func TestWatchFile(t *testing.T) {
+	// prepare
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("log:\n  level: info\n"), 0o600))
+
+	load := func() (AppConfig, error) {
+		return loadConfig(readNop, func(v *viper.Viper) error {
+			v.SetConfigType("yaml")
+			v.SetConfigFile(file)
+			return v.MergeInConfig()
+		})
+	}
+	current, err := load()
+	require.NoError(t, err)
+
+	r := newReloader(current, file, load)
+	r.debounce = 10 * time.Millisecond
+	var level atomic.Value
+	r.OnReload("log", []string{"log.level"}, func(_, c AppConfig) (func() error, error) {
+		return func() error {
+			level.Store(c.Log.Level)
+			return nil
+		}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = r.Watch(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// execute
+	require.NoError(t, os.WriteFile(file, []byte("log:\n  level: warn\n"), 0o600))
+
+	// assert
+	assert.Eventually(t, func() bool { return level.Load() == "warn" }, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// durationPattern matches the durations accepted by time.ParseDuration.
+const durationPattern = `^(0|[-+]?([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+// Schema returns the JSON Schema of AppConfig with the embedded defaults,
+// for editors to check and complete config.yaml.
+func Schema() ([]byte, error) {
+	v := viper.New()
+	if err := readDefaults(v); err != nil {
+		return nil, err
+	}
+	var defaults AppConfig
+	if err := v.Unmarshal(&defaults); err != nil {
+		return nil, err
+	}
+
+	schema := schemaOf(reflect.TypeOf(defaults), reflect.ValueOf(defaults))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "restclam configuration"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaOf returns the schema of t, properties named by their mapstructure
+// tags, with def as default unless invalid.
+func schemaOf(t reflect.Type, def reflect.Value) map[string]any {
+	var schema map[string]any
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		schema = map[string]any{"type": "string", "pattern": durationPattern}
+		if def.IsValid() {
+			schema["default"] = time.Duration(def.Int()).String()
+		}
+		return schema
+	case t.Kind() == reflect.Struct:
+		props := map[string]any{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			var fieldDef reflect.Value
+			if def.IsValid() {
+				fieldDef = def.Field(i)
+			}
+			props[name] = schemaOf(field.Type, fieldDef)
+		}
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	case t.Kind() == reflect.Slice:
+		schema = map[string]any{"type": "array", "items": schemaOf(t.Elem(), reflect.Value{})}
+		if def.IsValid() && def.Len() > 0 && t.Elem().Kind() != reflect.Struct {
+			schema["default"] = def.Interface()
+		}
+		return schema
+	case t.Kind() == reflect.Bool:
+		schema = map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema = map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = map[string]any{"type": "number"}
+	default:
+		schema = map[string]any{"type": "string"}
+	}
+	if def.IsValid() {
+		schema["default"] = def.Interface()
+	}
+	return schema
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	// execute
+	raw, err := Schema()
+
+	// assert
+	require.NoError(t, err)
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal(raw, &schema))
+
+	props := schema["properties"].(map[string]any)
+	server := props["server"].(map[string]any)
+	assert.Equal(t, false, server["additionalProperties"])
+	serverProps := server["properties"].(map[string]any)
+	assert.Equal(t, map[string]any{"type": "integer", "default": 8080.0}, serverProps["port"])
+	assert.Equal(t, map[string]any{"type": "string", "pattern": durationPattern, "default": "1m0s"}, serverProps["idleTimeout"])
+
+	clam := props["clam"].(map[string]any)["properties"].(map[string]any)
+	backends := clam["backends"].(map[string]any)
+	assert.Equal(t, "array", backends["type"])
+	assert.Equal(t, "object", backends["items"].(map[string]any)["type"])
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Prefixes of the values referencing where the actual value is, to keep
+// secrets out of config.yaml and the env.
+const (
+	fileRefPrefix = "file:"
+	envRefPrefix  = "env:"
+)
+
+// ErrUnresolvedRef is returned when a referenced file or env variable
+// cannot be read.
+var ErrUnresolvedRef = errors.New("unresolved reference")
+
+// resolveRefs replaces the string values that are references with the
+// referenced values:
+//   - file:/run/secrets/x is the content of the file, without the trailing
+//     newline
+//   - env:NAME is the value of the env variable NAME
+//
+// The properties resolved are added to refs, named like by flatten.
+func resolveRefs(v reflect.Value, path string, refs map[string]bool) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		var errs []error
+		for i := range v.NumField() {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("mapstructure"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			errs = append(errs, resolveRefs(v.Field(i), join(path, name), refs))
+		}
+		return errors.Join(errs...)
+	case reflect.Slice:
+		var errs []error
+		for i := range v.Len() {
+			errs = append(errs, resolveRefs(v.Index(i), fmt.Sprintf("%s[%d]", path, i), refs))
+		}
+		return errors.Join(errs...)
+	case reflect.String:
+		resolved, err := resolveRef(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if resolved != v.String() {
+			refs[leafPath(path)] = true
+		}
+		v.SetString(resolved)
+	}
+	return nil
+}
+
+// leafPath returns the property of a path: lists of values are single
+// properties, unlike lists of objects.
+func leafPath(path string) string {
+	if i := strings.LastIndex(path, "["); i >= 0 && strings.HasSuffix(path, "]") {
+		return path[:i]
+	}
+	return path
+}
+
+func resolveRef(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, fileRefPrefix):
+		file := strings.TrimPrefix(value, fileRefPrefix)
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%w %s: %w", ErrUnresolvedRef, value, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case strings.HasPrefix(value, envRefPrefix):
+		name := strings.TrimPrefix(value, envRefPrefix)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%w %s: env variable not set", ErrUnresolvedRef, value)
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
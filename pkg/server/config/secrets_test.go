@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSecretRefs(t *testing.T) {
+	// prepare
+	secret := filepath.Join(t.TempDir(), "hash")
+	require.NoError(t, os.WriteFile(secret, []byte("sha256:0123\n"), 0o600))
+	t.Setenv("TEST_JWKS_URL", "https://idp/jwks")
+	readFunc := func(v *viper.Viper) error {
+		return readFromFileMock(`
+auth:
+  apiKeys:
+    - id: ci
+      hash: file:`+secret+`
+  jwt:
+    jwksUrl: env:TEST_JWKS_URL
+`, v)
+	}
+
+	// execute
+	loaded, err := load(readNop, readFunc, nil)
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:0123", loaded.Config.Auth.APIKeys[0].Hash)
+	assert.Equal(t, "https://idp/jwks", loaded.Config.Auth.JWT.JWKSURL)
+}
+
+func TestLoadSecretRefsUnresolved(t *testing.T) {
+	// prepare
+	readFunc := func(v *viper.Viper) error {
+		return readFromFileMock(`
+auth:
+  apiKeys:
+    - id: ci
+      hash: file:/nonexistent/hash
+  jwt:
+    jwksUrl: env:TEST_UNSET_VARIABLE
+`, v)
+	}
+
+	// execute
+	_, err := load(readNop, readFunc, nil)
+
+	// assert
+	require.ErrorIs(t, err, ErrUnresolvedRef)
+	assert.Contains(t, err.Error(), "auth.apiKeys[0].hash: unresolved reference file:/nonexistent/hash")
+	assert.Contains(t, err.Error(), "auth.jwt.jwksUrl: unresolved reference env:TEST_UNSET_VARIABLE")
+}
+
+func TestDiffRedactsSecrets(t *testing.T) {
+	// prepare
+	old := AppConfig{}
+	old.Auth.APIKeys = []APIKeyConfig{{ID: "ci", Hash: "sha256:0123"}}
+	new := AppConfig{}
+	new.Auth.APIKeys = []APIKeyConfig{{ID: "ci", Hash: "sha256:4567"}}
+
+	// execute
+	changes := Diff(old, new)
+
+	// assert
+	assert.Equal(t, []Change{{Path: "auth.apiKeys[0].hash", Old: "<redacted>", New: "<redacted>"}}, changes)
+}
+
+func TestDiffRedactsRefs(t *testing.T) {
+	// prepare
+	t.Setenv("TEST_CLAMD_ADDRESS", "clamd:3310")
+	old, err := load(readNop, func(v *viper.Viper) error {
+		return readFromFileMock(`
+clam:
+  address: env:TEST_CLAMD_ADDRESS
+auth:
+  jwt:
+    audiences: [restclam, env:TEST_CLAMD_ADDRESS]
+`, v)
+	}, nil)
+	require.NoError(t, err)
+	new, err := load(readNop, func(v *viper.Viper) error {
+		return readFromFileMock(`
+clam:
+  address: clamd:3311
+auth:
+  jwt:
+    audiences: [restclam]
+`, v)
+	}, nil)
+	require.NoError(t, err)
+
+	// execute
+	changes := Diff(old.Config, new.Config)
+
+	// assert
+	assert.Equal(t, []Change{
+		{Path: "auth.jwt.audiences", Old: "<redacted>", New: "[restclam]"},
+		{Path: "clam.address", Old: "<redacted>", New: "clamd:3311"},
+	}, changes)
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// redacted replaces the value of secret properties.
+const redacted = "<redacted>"
+
+// Source is where the value of a property comes from.
+type Source string
+
+// Sources of property values, from the lowest precedence.
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Property is a leaf property of the effective configuration.
+type Property struct {
+	// Path is the property, like in Change
+	Path   string
+	Value  string
+	Source Source
+	Secret bool
+}
+
+// Properties lists the properties of the configuration in declaration
+// order, with the values of secrets redacted.
+func (l Loaded) Properties() []Property {
+	flat := properties(l.Config)
+	props := make([]Property, 0, len(flat))
+	for _, p := range flat {
+		props = append(props, Property{
+			Path:   p.path,
+			Value:  p.redacted(),
+			Source: l.Source(p.path),
+			Secret: p.secret,
+		})
+	}
+	return props
+}
+
+// Source returns where the value of the property comes from.  Items of
+// lists come from where the whole list does.
+func (l Loaded) Source(path string) Source {
+	key, _, _ := strings.Cut(strings.ToLower(path), "[")
+	_, env := os.LookupEnv(envName(key))
+	switch {
+	case l.setKeys[key]:
+		return SourceFlag
+	case env:
+		return SourceEnv
+	case l.fileKeys[key]:
+		return SourceFile
+	default:
+		return SourceDefault
+	}
+}
+
+// envName returns the env variable setting the property key.
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
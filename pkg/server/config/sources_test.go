@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSources(t *testing.T) {
+	// prepare
+	t.Setenv("RESTCLAM_SERVER_PORT", "9090")
+	t.Setenv("RESTCLAM_CLAM_MINWORKERS", "2")
+	readFunc := func(v *viper.Viper) error {
+		return readFromFileMock(`
+log:
+  level: error
+auth:
+  apiKeys:
+    - id: ci
+      hash: sha256:0123
+      scopes: [scan]
+`, v)
+	}
+
+	// execute
+	loaded, err := load(readDefaults, readFunc, []string{"clam.minWorkers=4", "log.json=true"})
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, 4, loaded.Config.Clam.MinWorkers, "overrides win over env")
+	assert.True(t, loaded.Config.Log.JSON)
+	assert.Equal(t, 9090, loaded.Config.Server.Port)
+
+	props := map[string]Property{}
+	for _, p := range loaded.Properties() {
+		props[p.Path] = p
+	}
+	assert.Equal(t, SourceDefault, props["server.host"].Source)
+	assert.Equal(t, SourceEnv, props["server.port"].Source)
+	assert.Equal(t, SourceFile, props["log.level"].Source)
+	assert.Equal(t, SourceFlag, props["clam.minWorkers"].Source)
+	assert.Equal(t, SourceFlag, props["log.json"].Source)
+	assert.Equal(t, SourceFile, props["auth.apiKeys[0].id"].Source)
+	assert.Equal(t, Property{Path: "auth.apiKeys[0].hash", Value: "<redacted>", Source: SourceFile, Secret: true},
+		props["auth.apiKeys[0].hash"])
+}
+
+func TestLoadInvalidOverride(t *testing.T) {
+	// execute
+	_, errFormat := load(readDefaults, readNop, []string{"clam.minWorkers"})
+	_, errUnknown := load(readDefaults, readNop, []string{"clam.minWorker=4"})
+
+	// assert
+	require.ErrorIs(t, errFormat, ErrInvalidOverride)
+	require.Error(t, errUnknown)
+	assert.Contains(t, errUnknown.Error(), "minworker")
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomrss/restclam/pkg/backoff"
+)
+
+// ErrInvalidConfig is wrapped by ValidationError.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// FieldError is an invalid configuration property.
+type FieldError struct {
+	// Path is the property, like in Change
+	Path   string
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Reason
+}
+
+// ValidationError lists all the invalid properties of a configuration.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString(ErrInvalidConfig.Error() + ":")
+	for _, f := range e.Fields {
+		b.WriteString("\n  - ")
+		b.WriteString(f.Error())
+	}
+	return b.String()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// Validator collects the invalid properties of a configuration.
+type Validator struct {
+	fields []FieldError
+}
+
+// Check records the property as invalid, for the formatted reason, unless
+// ok.
+func (v *Validator) Check(ok bool, path string, reason string, args ...any) {
+	if !ok {
+		v.fields = append(v.fields, FieldError{Path: path, Reason: fmt.Sprintf(reason, args...)})
+	}
+}
+
+// CheckErr records the property as invalid, for err, unless nil.
+func (v *Validator) CheckErr(err error, path string) {
+	if err != nil {
+		v.fields = append(v.fields, FieldError{Path: path, Reason: err.Error()})
+	}
+}
+
+// Err returns a *ValidationError with the invalid properties, if any.
+func (v *Validator) Err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+// Check validates what the configuration package cannot know, like scope
+// names.
+type Check func(c AppConfig, v *Validator)
+
+// Validate checks every property of the configuration, and the extra
+// checks, returning a *ValidationError listing all the invalid ones.
+func (c AppConfig) Validate(checks ...Check) error {
+	v := &Validator{}
+
+	c.Server.validate(v, "server")
+	c.Log.validate(v, "log")
+	c.Cors.validate(v, "cors")
+	c.Auth.validate(v, "auth")
+	c.RateLimit.validate(v, "rateLimit")
+	c.Clam.validate(v, "clam")
+	v.Check(c.FeatureFlags.ApiV0 || c.FeatureFlags.ApiV1, "featureFlags", "at least one of apiV0 and apiV1 must be enabled")
+
+	for _, check := range checks {
+		check(c, v)
+	}
+
+	return v.Err()
+}
+
+func (c ServerConfig) validate(v *Validator, path string) {
+	v.Check(c.Port > 0 && c.Port <= 65535, path+".port", "must be between 1 and 65535, got %d", c.Port)
+	nonNegative(v, path+".writeTimeout", c.WriteTimeout)
+	nonNegative(v, path+".readTimeout", c.ReadTimeout)
+	nonNegative(v, path+".idleTimeout", c.IdleTimeout)
+	positive(v, path+".shutdownTimeout", c.ShutdownTimeout)
+	nonNegative(v, path+".drainDelay", c.DrainDelay)
+	v.Check(c.DrainDelay < c.ShutdownTimeout || c.ShutdownTimeout <= 0, path+".drainDelay",
+		"must be less than shutdownTimeout %s, got %s", c.ShutdownTimeout, c.DrainDelay)
+	c.TLS.validate(v, path+".tls")
+}
+
+func (c TLSConfig) validate(v *Validator, path string) {
+	nonNegative(v, path+".reloadInterval", c.ReloadInterval)
+	if !c.Enabled {
+		return
+	}
+
+	v.Check(c.CertFile != "", path+".certFile", "required when TLS is enabled")
+	v.Check(c.KeyFile != "", path+".keyFile", "required when TLS is enabled")
+	oneOf(v, path+".clientAuth", c.ClientAuth, "", "none", "request", "require")
+	v.Check(c.ClientAuth == "" || c.ClientAuth == "none" || c.ClientCAFile != "", path+".clientCaFile",
+		"required for client authentication %q", c.ClientAuth)
+}
+
+func (c LogConfig) validate(v *Validator, path string) {
+	_, err := zerolog.ParseLevel(strings.ToLower(c.Level))
+	v.Check(err == nil, path+".level", "must be one of trace, debug, info, warn, error, fatal, panic, disabled, got %q", c.Level)
+}
+
+func (c CORSConfig) validate(v *Validator, path string) {
+	v.Check(c.MaxAge >= 0, path+".maxAge", "must not be negative, got %d", c.MaxAge)
+	v.Check(!c.Enabled || len(c.AllowedOrigins) > 0, path+".allowedOrigins", "required when CORS is enabled")
+}
+
+func (c AuthConfig) validate(v *Validator, path string) {
+	v.Check(!c.Enabled || c.APIKeyHeader != "", path+".apiKeyHeader", "required when authentication is enabled")
+	nonNegative(v, path+".keyFileCheckInterval", c.KeyFileCheckInterval)
+
+	ids := map[string]bool{}
+	for i, k := range c.APIKeys {
+		keyPath := fmt.Sprintf("%s.apiKeys[%d]", path, i)
+		v.Check(k.ID != "", keyPath+".id", "required")
+		v.Check(!ids[k.ID], keyPath+".id", "duplicate key id %q", k.ID)
+		ids[k.ID] = true
+	}
+
+	c.JWT.validate(v, path+".jwt")
+}
+
+func (c JWTConfig) validate(v *Validator, path string) {
+	nonNegative(v, path+".jwksCacheTtl", c.JWKSCacheTTL)
+	nonNegative(v, path+".leeway", c.Leeway)
+	if !c.Enabled {
+		return
+	}
+
+	v.Check((c.JWKSFile == "") != (c.JWKSURL == ""), path+".jwksFile", "exactly one of jwksFile and jwksUrl is required")
+	v.Check(len(c.Algorithms) > 0, path+".algorithms", "required")
+	v.Check(c.Issuer != "", path+".issuer", "required")
+	v.Check(len(c.Audiences) > 0, path+".audiences", "required")
+}
+
+func (c RateLimitConfig) validate(v *Validator, path string) {
+	v.Check(c.RequestsPerSecond >= 0, path+".requestsPerSecond", "must not be negative, got %g", c.RequestsPerSecond)
+	v.Check(c.Burst >= 0, path+".burst", "must not be negative, got %d", c.Burst)
+	v.Check(c.MaxConcurrentScans >= 0, path+".maxConcurrentScans", "must not be negative, got %d", c.MaxConcurrentScans)
+	v.Check(c.BytesPerMinute >= 0, path+".bytesPerMinute", "must not be negative, got %d", c.BytesPerMinute)
+}
+
+func (c ClamConfig) validate(v *Validator, path string) {
+	if len(c.Backends) == 0 {
+		validateBackend(v, path, c.Network, c.Address, c.TLS)
+	}
+	addresses := map[string]bool{}
+	for i, b := range c.Backends {
+		backendPath := fmt.Sprintf("%s.backends[%d]", path, i)
+		validateBackend(v, backendPath, b.Network, b.Address, b.TLS)
+		v.Check(!addresses[b.Address], backendPath+".address", "duplicate backend %q", b.Address)
+		addresses[b.Address] = true
+	}
+
+	v.Check(c.MinWorkers > 0, path+".minWorkers", "must be positive, got %d", c.MinWorkers)
+	v.Check(c.MaxWorkers >= c.MinWorkers, path+".maxWorkers", "must not be less than minWorkers %d, got %d", c.MinWorkers, c.MaxWorkers)
+	v.Check(c.ConnectMaxRetries >= 0, path+".connectMaxRetries", "must not be negative, got %d", c.ConnectMaxRetries)
+	validateBackoff(v, path+".connectBackoff", c.ConnectBackoff)
+	nonNegative(v, path+".connectRetryInterval", c.ConnectRetryInterval)
+	nonNegative(v, path+".connectTimeout", c.ConnectTimeout)
+	nonNegative(v, path+".readTimeout", c.ReadTimeout)
+	nonNegative(v, path+".writeTimeout", c.WriteTimeout)
+	v.Check(c.StreamChunkSize > 0, path+".streamChunkSize", "must be positive, got %d", c.StreamChunkSize)
+	positive(v, path+".heartbeatInterval", c.HeartbeatInterval)
+	nonNegative(v, path+".jobTimeout", c.JobTimeout)
+	nonNegative(v, path+".maxJobTimeout", c.MaxJobTimeout)
+	v.Check(c.MaxJobTimeout <= 0 || c.JobTimeout <= c.MaxJobTimeout, path+".jobTimeout",
+		"must not exceed maxJobTimeout %s, got %s", c.MaxJobTimeout, c.JobTimeout)
+
+	c.Scheduling.validate(v, path+".scheduling")
+	c.Retries.validate(v, path+".retries")
+	c.CircuitBreaker.validate(v, path+".circuitBreaker")
+}
+
+func validateBackend(v *Validator, path string, network string, address string, tls ClamTLSConfig) {
+	oneOf(v, path+".network", network, "unix", "tcp", "tcp4", "tcp6")
+	v.Check(address != "", path+".address", "required")
+	v.Check(!tls.Enabled || network != "unix", path+".tls.enabled", "TLS needs a tcp network")
+	v.Check((tls.CertFile == "") == (tls.KeyFile == ""), path+".tls.certFile", "certFile and keyFile must be set together")
+}
+
+func (c SchedulingConfig) validate(v *Validator, path string) {
+	v.Check(c.InteractiveWeight >= 0, path+".interactiveWeight", "must not be negative, got %d", c.InteractiveWeight)
+	v.Check(c.BulkWeight >= 0, path+".bulkWeight", "must not be negative, got %d", c.BulkWeight)
+	nonNegative(v, path+".maxQueueWait", c.MaxQueueWait)
+	v.Check(c.MaxQueueLength >= 0, path+".maxQueueLength", "must not be negative, got %d", c.MaxQueueLength)
+	nonNegative(v, path+".maxAdmissionWait", c.MaxAdmissionWait)
+}
+
+func (c RetriesConfig) validate(v *Validator, path string) {
+	v.Check(c.MaxRetries >= 0, path+".maxRetries", "must not be negative, got %d", c.MaxRetries)
+	validateBackoff(v, path+".backoff", c.Backoff)
+	v.Check(c.HedgePercentile >= 0 && c.HedgePercentile < 1, path+".hedgePercentile",
+		"must be between 0 and 1, e.g. 0.95, got %g", c.HedgePercentile)
+	v.Check(c.SpoolMemoryLimit >= 0, path+".spoolMemoryLimit", "must not be negative, got %d", c.SpoolMemoryLimit)
+	v.Check(c.SpoolMaxSize >= 0, path+".spoolMaxSize", "must not be negative, got %d", c.SpoolMaxSize)
+}
+
+func (c BreakerConfig) validate(v *Validator, path string) {
+	v.Check(c.ConsecutiveFailures >= 0, path+".consecutiveFailures", "must not be negative, got %d", c.ConsecutiveFailures)
+	v.Check(c.ErrorRate >= 0 && c.ErrorRate <= 1, path+".errorRate", "must be between 0 and 1, got %g", c.ErrorRate)
+	v.Check(c.Window >= 0, path+".window", "must not be negative, got %d", c.Window)
+	validateBackoff(v, path+".backoff", c.Backoff)
+	v.Check(c.HalfOpenProbes >= 0, path+".halfOpenProbes", "must not be negative, got %d", c.HalfOpenProbes)
+}
+
+func validateBackoff(v *Validator, path string, c BackoffConfig) {
+	_, err := backoff.New(backoff.Config{
+		Strategy:   backoff.Strategy(c.Strategy),
+		Initial:    c.Initial,
+		Max:        c.Max,
+		Multiplier: c.Multiplier,
+	})
+	v.CheckErr(err, path)
+}
+
+func positive(v *Validator, path string, d time.Duration) {
+	v.Check(d > 0, path, "must be positive, got %s", d)
+}
+
+func nonNegative(v *Validator, path string, d time.Duration) {
+	v.Check(d >= 0, path, "must not be negative, got %s", d)
+}
+
+func oneOf(v *Validator, path string, value string, allowed ...string) {
+	v.Check(slices.Contains(allowed, value), path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
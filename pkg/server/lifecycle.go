@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/server/api/render"
+)
+
+// ErrNotReady is returned by Lifecycle.Ready before the server starts, while
+// draining and when a readiness check fails.
+var ErrNotReady = errors.New("not ready")
+
+// Shutdowner is the part of http.Server stopped by Lifecycle.Shutdown.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Lifecycle tracks the readiness of the server and stops it in order:
+// readiness turns false, then after the drain delay the HTTP server stops
+// accepting requests and waits for the in-flight ones, last the components
+// registered with OnShutdown are drained in registration order.
+type Lifecycle struct {
+	drainDelay time.Duration
+	ready      atomic.Bool
+
+	mu     sync.Mutex
+	checks []namedCheck
+	hooks  []namedHook
+}
+
+type namedCheck struct {
+	name  string
+	check func() error
+}
+
+type namedHook struct {
+	name string
+	hook func(ctx context.Context) error
+}
+
+// NewLifecycle returns a lifecycle not ready yet.  The drain delay is how
+// long to keep serving after readiness turns false, to let load balancers
+// notice.
+func NewLifecycle(drainDelay time.Duration) *Lifecycle {
+	return &Lifecycle{drainDelay: drainDelay}
+}
+
+// AddCheck adds a readiness check, e.g. of a backend.
+func (l *Lifecycle) AddCheck(name string, check func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.checks = append(l.checks, namedCheck{name, check})
+}
+
+// OnShutdown registers a component to drain after the HTTP server stopped.
+func (l *Lifecycle) OnShutdown(name string, hook func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, namedHook{name, hook})
+}
+
+// Ready returns nil if the server is started, not draining and all the
+// readiness checks pass.
+func (l *Lifecycle) Ready() error {
+	if !l.ready.Load() {
+		return fmt.Errorf("%w: not started or draining", ErrNotReady)
+	}
+
+	l.mu.Lock()
+	checks := l.checks
+	l.mu.Unlock()
+
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrNotReady, c.name, err)
+		}
+	}
+	return nil
+}
+
+// Shutdown turns readiness false, waits the drain delay, then stops srv and
+// drains the registered components, all within ctx.
+func (l *Lifecycle) Shutdown(ctx context.Context, srv Shutdowner) error {
+	l.ready.Store(false)
+	log.Info().Str("drainDelay", l.drainDelay.String()).Msg("Draining, readiness turned false")
+
+	if l.drainDelay > 0 {
+		select {
+		case <-time.After(l.drainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+	}
+	log.Info().Msg("Server stopped accepting requests")
+
+	l.mu.Lock()
+	hooks := l.hooks
+	l.mu.Unlock()
+
+	for _, h := range hooks {
+		if err := h.hook(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		log.Info().Str("component", h.name).Msg("Component drained")
+	}
+
+	return errors.Join(errs...)
+}
+
+// LivenessHandler replies 200 as long as the process serves requests.
+func (l *Lifecycle) LivenessHandler(w http.ResponseWriter, _ *http.Request) {
+	render.JSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+// ReadinessHandler replies 200 when Ready, 503 otherwise.
+func (l *Lifecycle) ReadinessHandler(w http.ResponseWriter, _ *http.Request) {
+	if err := l.Ready(); err != nil {
+		render.Error(w, http.StatusServiceUnavailable, render.CodeUnavailable, err.Error())
+		return
+	}
+	render.JSON(w, http.StatusOK, statusResponse{Status: "ready"})
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleShutdownOrder(t *testing.T) {
+	// prepare
+	lc := NewLifecycle(0)
+	lc.ready.Store(true)
+
+	var order []string
+	var readyDuringShutdown error
+	srv := shutdownFunc(func(context.Context) error {
+		readyDuringShutdown = lc.Ready()
+		order = append(order, "http")
+		return nil
+	})
+	lc.OnShutdown("first", func(context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	lc.OnShutdown("second", func(context.Context) error {
+		order = append(order, "second")
+		return nil
+	})
+
+	// execute
+	err := lc.Shutdown(context.Background(), srv)
+
+	// assert
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http", "first", "second"}, order)
+	assert.ErrorIs(t, readyDuringShutdown, ErrNotReady)
+}
+
+func TestLifecycleShutdownDrainDelay(t *testing.T) {
+	// prepare
+	lc := NewLifecycle(100 * time.Millisecond)
+	lc.ready.Store(true)
+
+	var stopped time.Time
+	srv := shutdownFunc(func(context.Context) error {
+		stopped = time.Now()
+		return nil
+	})
+
+	// execute
+	start := time.Now()
+	err := lc.Shutdown(context.Background(), srv)
+
+	// assert
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stopped.Sub(start), 100*time.Millisecond)
+}
+
+func TestLifecycleShutdownWaitsInFlightRequests(t *testing.T) {
+	// prepare
+	lc := NewLifecycle(0)
+	lc.ready.Store(true)
+
+	started := make(chan struct{})
+	var mu sync.Mutex
+	completed := false
+	srv, addr := serveHTTP(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		completed = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var completedBeforeDrain bool
+	lc.OnShutdown("scans", func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		completedBeforeDrain = completed
+		return nil
+	})
+
+	resp := make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + addr)
+		if err == nil {
+			_ = r.Body.Close()
+		}
+		resp <- err
+	}()
+	<-started
+
+	// execute
+	err := lc.Shutdown(context.Background(), srv)
+
+	// assert
+	require.NoError(t, err)
+	require.NoError(t, <-resp)
+	assert.True(t, completedBeforeDrain)
+}
+
+func TestLifecycleShutdownErrors(t *testing.T) {
+	// prepare
+	lc := NewLifecycle(0)
+	errDrain := errors.New("stuck")
+
+	drained := false
+	srv := shutdownFunc(func(context.Context) error { return context.DeadlineExceeded })
+	lc.OnShutdown("stuck", func(context.Context) error { return errDrain })
+	lc.OnShutdown("other", func(context.Context) error {
+		drained = true
+		return nil
+	})
+
+	// execute
+	err := lc.Shutdown(context.Background(), srv)
+
+	// assert
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, errDrain)
+	assert.True(t, drained, "a failing component must not stop the others")
+}
+
+func TestLifecycleReadiness(t *testing.T) {
+	// prepare
+	lc := NewLifecycle(0)
+	var backendErr error
+	lc.AddCheck("backend", func() error { return backendErr })
+
+	// execute
+	notStarted := probe(lc.ReadinessHandler)
+	lc.ready.Store(true)
+	ready := probe(lc.ReadinessHandler)
+	backendErr = errors.New("down")
+	backendDown := probe(lc.ReadinessHandler)
+	alive := probe(lc.LivenessHandler)
+
+	// assert
+	assert.Equal(t, http.StatusServiceUnavailable, notStarted.Code)
+	assert.Equal(t, http.StatusOK, ready.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, backendDown.Code)
+	assert.Contains(t, backendDown.Body.String(), "backend: down")
+	assert.Equal(t, http.StatusOK, alive.Code)
+}
+
+func TestLifecycleReadyOnceListening(t *testing.T) {
+	// prepare
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	lc := NewLifecycle(0)
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(lc.ReadinessHandler), ReadHeaderTimeout: time.Second}
+	defer srv.Close()
+	failed := NewLifecycle(0)
+	conflicting := &http.Server{Addr: busy.Addr().String(), ReadHeaderTimeout: time.Second}
+
+	// execute
+	addr, err := start(srv, false, lc)
+	_, errBusy := start(conflicting, false, failed)
+
+	// assert
+	require.NoError(t, err)
+	require.NoError(t, lc.Ready())
+	resp, err := http.Get("http://" + addr.String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Error(t, errBusy)
+	assert.ErrorIs(t, failed.Ready(), ErrNotReady)
+}
+
+// helpers
+
+type shutdownFunc func(ctx context.Context) error
+
+func (f shutdownFunc) Shutdown(ctx context.Context) error {
+	return f(ctx)
+}
+
+func serveHTTP(t *testing.T, h http.Handler) (*http.Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return srv, l.Addr().String()
+}
+
+func probe(h http.HandlerFunc) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
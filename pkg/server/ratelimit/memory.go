@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are dropped from memory.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	rate    float64
+	burst   float64
+	updated time.Time
+}
+
+// refill adds the tokens accumulated since last update.
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	b.updated = now
+}
+
+// MemoryStore is a Store keeping the state in process memory.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	slots     map[string]int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   map[string]*bucket{},
+		slots:     map[string]int{},
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(key string, cost float64, rate float64, burst float64) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.bucket(key, rate, burst)
+
+	// costs bigger than the whole bucket need a full bucket
+	needed := math.Min(cost, b.burst)
+	if b.tokens < needed {
+		return false, time.Duration((needed - b.tokens) / b.rate * float64(time.Second))
+	}
+
+	b.tokens -= cost
+	return true, 0
+}
+
+// Charge implements Store.
+func (s *MemoryStore) Charge(key string, cost float64, rate float64, burst float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bucket(key, rate, burst).tokens -= cost
+}
+
+// Acquire implements Store.
+func (s *MemoryStore) Acquire(key string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.slots[key] >= max {
+		return false
+	}
+	s.slots[key]++
+	return true
+}
+
+// Release implements Store.
+func (s *MemoryStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.slots[key]--
+	if s.slots[key] <= 0 {
+		delete(s.slots, key)
+	}
+}
+
+// bucket returns the refilled bucket of key, creating it full if missing.
+// It must be called holding the lock.
+func (s *MemoryStore) bucket(key string, rate float64, burst float64) *bucket {
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+
+	// limits may have changed since last time
+	b.rate = rate
+	b.burst = burst
+	b.refill(now)
+
+	return b
+}
+
+// sweep drops the buckets that are full again, as they are equivalent to
+// missing ones.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(s.buckets, key)
+		}
+	}
+}
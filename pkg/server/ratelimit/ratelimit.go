@@ -0,0 +1,169 @@
+// Package ratelimit enforces per-client request rates, concurrency limits
+// and byte quotas.
+//
+// State is kept in a Store.  MemoryStore keeps it in process; deployments
+// with multiple replicas can plug a shared implementation of Store.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+// ErrUnknownStore is returned when the configured store is not available.
+var ErrUnknownStore = errors.New("unknown rate limit store")
+
+// Limits are the limits enforced for every client.  Zero values disable
+// the corresponding limit.
+type Limits struct {
+	// RequestsPerSecond is the sustained request rate
+	RequestsPerSecond float64
+	// Burst is the number of requests allowed above the sustained rate
+	Burst int
+	// MaxConcurrentScans is the number of scans a client can run at once
+	MaxConcurrentScans int
+	// BytesPerMinute is the scanned bytes quota
+	BytesPerMinute int64
+}
+
+// LimitsFromConfig returns the limits set in the configuration.
+func LimitsFromConfig(c config.RateLimitConfig) Limits {
+	return Limits{
+		RequestsPerSecond:  c.RequestsPerSecond,
+		Burst:              c.Burst,
+		MaxConcurrentScans: c.MaxConcurrentScans,
+		BytesPerMinute:     c.BytesPerMinute,
+	}
+}
+
+// Store keeps the state of the limits of every client.
+type Store interface {
+	// Take takes cost tokens from the bucket of key, refilled at rate tokens
+	// per second up to burst.  It is allowed if the bucket has cost tokens,
+	// or is full for costs bigger than burst: then the balance goes negative
+	// and the debt is paid by next calls.  When not allowed, it returns how
+	// long to wait before retrying.
+	Take(key string, cost float64, rate float64, burst float64) (bool, time.Duration)
+	// Charge takes cost tokens from the bucket of key regardless of its
+	// balance.
+	Charge(key string, cost float64, rate float64, burst float64)
+	// Acquire takes one of max slots of key, if any is free.
+	Acquire(key string, max int) bool
+	// Release frees a slot of key taken with Acquire.
+	Release(key string)
+}
+
+// NewStore creates the store with the given name.
+func NewStore(name string) (Store, error) {
+	switch name {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStore, name)
+	}
+}
+
+// Limiter checks clients against the limits.
+type Limiter struct {
+	limits atomic.Pointer[Limits]
+	store  Store
+}
+
+// NewLimiter creates a limiter enforcing limits with state in store.
+func NewLimiter(limits Limits, store Store) *Limiter {
+	l := &Limiter{store: store}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits replaces the enforced limits.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.limits.Store(&limits)
+}
+
+// AllowRequest checks the request rate of a client.
+func (l *Limiter) AllowRequest(client string) (bool, time.Duration) {
+	limits := l.limits.Load()
+	if limits.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+
+	burst := math.Max(float64(limits.Burst), 1)
+	return l.store.Take("req:"+client, 1, limits.RequestsPerSecond, burst)
+}
+
+// AllowBytes checks the bytes quota of a client, charging size bytes.
+func (l *Limiter) AllowBytes(client string, size int64) (bool, time.Duration) {
+	limits := l.limits.Load()
+	if limits.BytesPerMinute <= 0 {
+		return true, 0
+	}
+
+	perSecond := float64(limits.BytesPerMinute) / 60
+	return l.store.Take("bytes:"+client, float64(size), perSecond, float64(limits.BytesPerMinute))
+}
+
+// ChargeBytes charges size bytes to the quota of a client, regardless of
+// the remaining quota.  It is used when the size is known only after the
+// scan: the next requests pay the debt.
+func (l *Limiter) ChargeBytes(client string, size int64) {
+	limits := l.limits.Load()
+	if limits.BytesPerMinute <= 0 {
+		return
+	}
+
+	perSecond := float64(limits.BytesPerMinute) / 60
+	l.store.Charge("bytes:"+client, float64(size), perSecond, float64(limits.BytesPerMinute))
+}
+
+// AcquireScan takes a concurrent scan slot of a client.  If it succeeds,
+// the returned function must be called to release the slot.
+func (l *Limiter) AcquireScan(client string) (func(), bool) {
+	limits := l.limits.Load()
+	if limits.MaxConcurrentScans <= 0 {
+		return func() {}, true
+	}
+
+	key := "scans:" + client
+	if !l.store.Acquire(key, limits.MaxConcurrentScans) {
+		return nil, false
+	}
+	return func() { l.store.Release(key) }, true
+}
+
+// scanSlot is a concurrent scan slot taken for a request.
+type scanSlot struct {
+	release func()
+	kept    atomic.Bool
+}
+
+type scanSlotKey struct{}
+
+// WithScanSlot returns a context carrying the scan slot taken for a
+// request, and the function to call when the request is over: it releases
+// the slot, unless kept with KeepScanSlot.
+func WithScanSlot(ctx context.Context, release func()) (context.Context, func()) {
+	slot := &scanSlot{release: release}
+	return context.WithValue(ctx, scanSlotKey{}, slot), func() {
+		if !slot.kept.Load() {
+			release()
+		}
+	}
+}
+
+// KeepScanSlot keeps the scan slot of a request beyond the request, for
+// scans going on in background.  The returned function must be called to
+// release it once the scan is over.
+func KeepScanSlot(ctx context.Context) func() {
+	slot, ok := ctx.Value(scanSlotKey{}).(*scanSlot)
+	if !ok || !slot.kept.CompareAndSwap(false, true) {
+		return func() {}
+	}
+	return slot.release
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterRequestRate(t *testing.T) {
+	// prepare
+	store, clock := newTestStore()
+	l := NewLimiter(Limits{RequestsPerSecond: 2, Burst: 3}, store)
+
+	// execute
+	var allowed int
+	for range 5 {
+		if ok, _ := l.AllowRequest("alice"); ok {
+			allowed++
+		}
+	}
+	okDenied, retryAfter := l.AllowRequest("alice")
+	okOther, _ := l.AllowRequest("bob")
+	clock.Advance(time.Second)
+	okRefilled, _ := l.AllowRequest("alice")
+
+	// assert
+	assert.Equal(t, 3, allowed)
+	assert.False(t, okDenied)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	assert.True(t, okOther)
+	assert.True(t, okRefilled)
+}
+
+func TestLimiterBytesQuota(t *testing.T) {
+	// prepare
+	store, clock := newTestStore()
+	l := NewLimiter(Limits{BytesPerMinute: 600}, store)
+
+	// execute
+	okFirst, _ := l.AllowBytes("alice", 400)
+	okSecond, retryAfter := l.AllowBytes("alice", 400)
+	clock.Advance(20 * time.Second)
+	okAfterWait, _ := l.AllowBytes("alice", 400)
+
+	// assert
+	assert.True(t, okFirst)
+	assert.False(t, okSecond)
+	assert.Equal(t, 20*time.Second, retryAfter)
+	assert.True(t, okAfterWait)
+}
+
+func TestLimiterBytesBiggerThanQuota(t *testing.T) {
+	// prepare
+	store, clock := newTestStore()
+	l := NewLimiter(Limits{BytesPerMinute: 600}, store)
+
+	// execute
+	okFull, _ := l.AllowBytes("alice", 1200)
+	okDebt, retryAfter := l.AllowBytes("alice", 1)
+
+	// assert
+	assert.True(t, okFull, "a full quota allows a single bigger scan")
+	assert.False(t, okDebt)
+	assert.InDelta(t, 60.1, retryAfter.Seconds(), 0.01)
+
+	clock.Advance(61 * time.Second)
+	okPaid, _ := l.AllowBytes("alice", 1)
+	assert.True(t, okPaid)
+}
+
+func TestLimiterChargeBytes(t *testing.T) {
+	// prepare
+	store, _ := newTestStore()
+	l := NewLimiter(Limits{BytesPerMinute: 600}, store)
+
+	// execute
+	l.ChargeBytes("alice", 1000)
+	ok, _ := l.AllowBytes("alice", 1)
+
+	// assert
+	assert.False(t, ok)
+}
+
+func TestLimiterConcurrentScans(t *testing.T) {
+	// prepare
+	store, _ := newTestStore()
+	l := NewLimiter(Limits{MaxConcurrentScans: 2}, store)
+
+	// execute
+	release1, ok1 := l.AcquireScan("alice")
+	_, ok2 := l.AcquireScan("alice")
+	_, ok3 := l.AcquireScan("alice")
+	release1()
+	_, ok4 := l.AcquireScan("alice")
+
+	// assert
+	assert.True(t, ok1)
+	assert.True(t, ok2)
+	assert.False(t, ok3)
+	assert.True(t, ok4)
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	// prepare
+	store, _ := newTestStore()
+	l := NewLimiter(Limits{}, store)
+
+	// execute and assert
+	for range 100 {
+		ok, _ := l.AllowRequest("alice")
+		require.True(t, ok)
+		ok, _ = l.AllowBytes("alice", 1<<30)
+		require.True(t, ok)
+		_, ok = l.AcquireScan("alice")
+		require.True(t, ok)
+	}
+}
+
+func TestLimiterSetLimits(t *testing.T) {
+	// prepare
+	store, _ := newTestStore()
+	l := NewLimiter(Limits{RequestsPerSecond: 1, Burst: 1}, store)
+	okFirst, _ := l.AllowRequest("alice")
+	okLimited, _ := l.AllowRequest("alice")
+
+	// execute
+	l.SetLimits(Limits{})
+	okUnlimited, _ := l.AllowRequest("alice")
+
+	// assert
+	assert.True(t, okFirst)
+	assert.False(t, okLimited)
+	assert.True(t, okUnlimited)
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	// prepare
+	store, clock := newTestStore()
+	store.Take("idle", 1, 1, 1)
+	store.Take("busy", 100, 1, 100)
+
+	// execute
+	clock.Advance(sweepInterval)
+	store.Take("other", 1, 1, 1)
+
+	// assert
+	assert.NotContains(t, store.buckets, "idle")
+	assert.Contains(t, store.buckets, "busy")
+}
+
+func TestNewStore(t *testing.T) {
+	memory, errMemory := NewStore("memory")
+	_, errUnknown := NewStore("redis")
+
+	require.NoError(t, errMemory)
+	assert.IsType(t, &MemoryStore{}, memory)
+	require.ErrorIs(t, errUnknown, ErrUnknownStore)
+}
+
+// helpers
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestStore() (*MemoryStore, *testClock) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	store := NewMemoryStore()
+	store.now = clock.Now
+	store.lastSweep = clock.now
+	return store, clock
+}
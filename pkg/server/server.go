@@ -15,8 +15,9 @@ import (
 	"github.com/tomrss/restclam/pkg/server/config"
 )
 
-// HTTPListenAndServe starts an HTTP server in a goroutine with a given router.
-func HTTPListenAndServe(router *chi.Mux, cfg config.ServerConfig) {
+// HTTPListenAndServe starts an HTTP server in a goroutine with a given
+// router, then on interruption shuts it down with the lifecycle.
+func HTTPListenAndServe(router *chi.Mux, cfg config.ServerConfig, lc *Lifecycle) {
 	// setup server
 	addr := net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port))
 	server := &http.Server{
@@ -27,18 +28,24 @@ func HTTPListenAndServe(router *chi.Mux, cfg config.ServerConfig) {
 		Handler:      router,
 	}
 
-	// start server async
-	go func() {
-		if err := server.ListenAndServe(); errors.Is(err, http.ErrServerClosed) {
-			log.Info().Msg("Server closed")
-		} else if err != nil {
+	if cfg.TLS.Enabled {
+		reloader, err := newTLSReloader(cfg.TLS)
+		if err != nil {
 			log.Fatal().
 				Err(err).
-				Msg("Error starting server")
+				Msg("Error configuring TLS")
 		}
-	}()
+		server.TLSConfig = reloader.serverConfig()
+	}
 
-	log.Info().Str("address", addr).Msg("Server started")
+	// start server async, ready once listening
+	listener, err := start(server, cfg.TLS.Enabled, lc)
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("Error starting server")
+	}
+	log.Info().Str("address", listener.String()).Bool("tls", cfg.TLS.Enabled).Msg("Server started")
 
 	// handle interruption signals
 	done := make(chan os.Signal, 1)
@@ -53,9 +60,39 @@ func HTTPListenAndServe(router *chi.Mux, cfg config.ServerConfig) {
 		cancel()
 	}()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal().
+	if err := lc.Shutdown(ctx, server); err != nil {
+		log.Error().
 			Err(err).
 			Msg("Server shutdown failed")
 	}
 }
+
+// start binds the address of the server, then serves in a goroutine and
+// turns the lifecycle ready.  It returns the address bound.
+func start(server *http.Server, withTLS bool, lc *Lifecycle) (net.Addr, error) {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := serve(server, listener, withTLS); errors.Is(err, http.ErrServerClosed) {
+			log.Info().Msg("Server closed")
+		} else if err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Error serving")
+		}
+	}()
+
+	lc.ready.Store(true)
+	return listener.Addr(), nil
+}
+
+func serve(server *http.Server, listener net.Listener, withTLS bool) error {
+	if withTLS {
+		// certificates are provided by the TLS config
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tomrss/restclam/pkg/server/audit"
+	"github.com/tomrss/restclam/pkg/server/auth"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+var (
+	// ErrTLSConfig is returned when the TLS configuration is invalid.
+	ErrTLSConfig = errors.New("invalid TLS configuration")
+	// ErrClientNotAllowed is returned when a client certificate is valid but
+	// not among the allowed ones.
+	ErrClientNotAllowed = errors.New("client certificate not allowed")
+)
+
+// tlsReloader serves the TLS configuration of the server, reloading
+// certificate, key and client CA when their files change.
+type tlsReloader struct {
+	conf     config.TLSConfig
+	interval time.Duration
+
+	mu        sync.Mutex
+	current   *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func newTLSReloader(conf config.TLSConfig) (*tlsReloader, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, fmt.Errorf("%w: certFile and keyFile are required", ErrTLSConfig)
+	}
+	if _, err := clientAuthType(conf.ClientAuth); err != nil {
+		return nil, err
+	}
+	if conf.ClientAuth != "" && conf.ClientAuth != "none" && conf.ClientCAFile == "" {
+		return nil, fmt.Errorf("%w: clientCaFile is required for client authentication", ErrTLSConfig)
+	}
+
+	r := &tlsReloader{conf: conf, interval: conf.ReloadInterval}
+	if r.interval == 0 {
+		r.interval = defaultTLSReloadInterval
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+
+	return r, nil
+}
+
+// serverConfig returns the TLS config to give to http.Server.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config(), nil
+		},
+	}
+}
+
+// config returns the current TLS config, reloading it if files changed.
+// Reload errors are logged and the previous config is kept.
+func (r *tlsReloader) config() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= r.interval {
+		r.lastCheck = time.Now()
+		if err := r.reloadLocked(); err != nil {
+			log.Error().Err(err).Msg("unable to reload TLS certificates, keeping previous ones")
+		}
+	}
+
+	return r.current
+}
+
+func (r *tlsReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reloadLocked()
+}
+
+func (r *tlsReloader) reloadLocked() error {
+	files := []string{r.conf.CertFile, r.conf.KeyFile}
+	if r.conf.ClientCAFile != "" {
+		files = append(files, r.conf.ClientCAFile)
+	}
+
+	modTimes := make([]time.Time, 0, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrTLSConfig, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	if r.current != nil && slices.Equal(modTimes, r.modTimes) {
+		return nil
+	}
+
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	if r.current != nil {
+		log.Info().Str("certFile", r.conf.CertFile).Msg("TLS certificates reloaded")
+	}
+	r.current = cfg
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTLSConfig, err)
+	}
+
+	clientAuth, err := clientAuthType(r.conf.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+	}
+
+	if r.conf.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrTLSConfig, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in %s", ErrTLSConfig, r.conf.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	if len(r.conf.AllowedSubjects) > 0 || len(r.conf.AllowedSANs) > 0 {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyClientAllowed(cs, r.conf.AllowedSubjects, r.conf.AllowedSANs)
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyClientAllowed accepts a client certificate if its subject or one
+// of its SANs is allowed.  Connections without client certificate are left
+// to the client auth policy.
+func verifyClientAllowed(cs tls.ConnectionState, subjects []string, sans []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := cs.PeerCertificates[0]
+	if slices.Contains(subjects, cert.Subject.CommonName) || slices.Contains(subjects, cert.Subject.String()) {
+		return nil
+	}
+	for _, san := range auth.CertificateSANs(cert) {
+		if slices.Contains(sans, san) {
+			return nil
+		}
+	}
+
+	audit.DeniedConnection(log.Logger, &cs).Msg("client certificate not allowed")
+	return fmt.Errorf("%w: %s", ErrClientNotAllowed, cert.Subject.String())
+}
+
+func clientAuthType(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("%w: unknown clientAuth %q", ErrTLSConfig, clientAuth)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomrss/restclam/pkg/server/config"
+)
+
+func TestTLSMutualAuthAllowedSubjects(t *testing.T) {
+	// prepare
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	ca.issue(t, "localhost", dir, "server", time.Now())
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+
+	addr := serveTLS(t, config.TLSConfig{
+		CertFile:        filepath.Join(dir, "server.pem"),
+		KeyFile:         filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:    filepath.Join(dir, "ca.pem"),
+		ClientAuth:      "require",
+		AllowedSubjects: []string{"uploader"},
+	})
+
+	allowed := ca.issue(t, "uploader", dir, "allowed", time.Now())
+	denied := ca.issue(t, "intruder", dir, "denied", time.Now())
+
+	// execute
+	errAllowed := handshake(addr, ca, &allowed)
+	errDenied := handshake(addr, ca, &denied)
+	errNoCert := handshake(addr, ca, nil)
+
+	// assert
+	require.NoError(t, errAllowed)
+	require.Error(t, errDenied)
+	require.Error(t, errNoCert)
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	// prepare
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	first := ca.issue(t, "localhost", dir, "server", time.Now().Add(-time.Minute))
+
+	r, err := newTLSReloader(config.TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server-key.pem"),
+		ReloadInterval: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	served := r.config().Certificates[0].Leaf
+
+	// execute
+	second := ca.issue(t, "localhost", dir, "server", time.Now())
+	reloaded := r.config().Certificates[0].Leaf
+
+	// assert
+	assert.Equal(t, first.Leaf.SerialNumber, served.SerialNumber)
+	assert.Equal(t, second.Leaf.SerialNumber, reloaded.SerialNumber)
+}
+
+func TestTLSInvalidConfig(t *testing.T) {
+	_, errNoCert := newTLSReloader(config.TLSConfig{})
+	_, errNoCA := newTLSReloader(config.TLSConfig{CertFile: "c", KeyFile: "k", ClientAuth: "require"})
+	_, errClientAuth := newTLSReloader(config.TLSConfig{CertFile: "c", KeyFile: "k", ClientAuth: "maybe"})
+
+	require.ErrorIs(t, errNoCert, ErrTLSConfig)
+	require.ErrorIs(t, errNoCA, ErrTLSConfig)
+	require.ErrorIs(t, errClientAuth, ErrTLSConfig)
+}
+
+// helpers
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue creates a certificate for cn, writes it to dir as <name>.pem and
+// <name>-key.pem with the given modification time.
+func (ca *testCA) issue(t *testing.T, cn string, dir string, name string, modTime time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return cert
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	t.Helper()
+
+	content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(file, content, 0o600))
+}
+
+func serveTLS(t *testing.T, conf config.TLSConfig) string {
+	t.Helper()
+
+	r, err := newTLSReloader(conf)
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", r.serverConfig())
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}),
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return l.Addr().String()
+}
+
+func handshake(addr string, ca *testCA, clientCert *tls.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    roots,
+		ServerName: "localhost",
+	}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// with TLS 1.3 client certificate errors surface on first read
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
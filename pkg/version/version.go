@@ -0,0 +1,68 @@
+// Package version reports how the running binary was built.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is the release version, set when building with
+// -ldflags "-X github.com/tomrss/restclam/pkg/version.Version=v1.2.3".
+// When empty, the module version is reported.
+var Version = ""
+
+// Info is the build information of the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, s := range build.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+func (i Info) String() string {
+	version := i.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	s := version
+	if i.Revision != "" {
+		s += ", revision " + i.Revision
+		if i.Modified {
+			s += " (modified)"
+		}
+	}
+	if i.Time != "" {
+		s += ", built " + i.Time
+	}
+	return fmt.Sprintf("%s, %s %s", s, i.GoVersion, i.Platform)
+}